@@ -9,7 +9,11 @@
 #include <string.h>
 #include <float.h>
 #include <pthread.h>
+#ifdef _WIN32
+#include <windows.h>
+#else
 #include <unistd.h>
+#endif
 
 // ═══════════════════════════════════════════════════════════════════════════════
 // BLAS BACKEND
@@ -3600,7 +3604,13 @@ int nt_qmatvec(float *out, const uint8_t *Wq, int dtype,
     nt_qrows_fn fn = nt_qrows_for(dtype, k);
     if (!fn) return -1;
 
+#ifdef _WIN32
+    SYSTEM_INFO si;
+    GetSystemInfo(&si);
+    int nt = (int)si.dwNumberOfProcessors;
+#else
     int nt = (int)sysconf(_SC_NPROCESSORS_ONLN);
+#endif
     if (nt < 1) nt = 1;
     if (nt > NT_QMV_MAX_THREADS) nt = NT_QMV_MAX_THREADS;
     if (nt > m) nt = m;
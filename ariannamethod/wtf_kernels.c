@@ -1,6 +1,7 @@
 // wtf_kernels.c — thin shim over notorch + gguf for WTForacle inference.
 //
-// Public surface: wtf_dequant_to_f32 + wtf_sgemv (declared in wtf_kernels.h).
+// Public surface: wtf_dequant_to_f32, wtf_sgemv, wtf_qmatvec and the int8
+// pair wtf_quantize_i8 / wtf_i8matvec (declared in wtf_kernels.h).
 //
 // Dequant kernels (Q4_0 / Q5_0 / Q8_0 / Q4_K / Q6_K / F16) are implemented
 // here directly to keep vendored notorch source untouched — gguf.c keeps
@@ -9,11 +10,20 @@
 //
 // SGEMV is delegated to nt_blas_matvec (notorch.c), which routes to
 // cblas_sgemv via Apple Accelerate / OpenBLAS when USE_BLAS is defined.
+//
+// wtf_qmatvec and wtf_i8matvec pick a SIMD variant once per process (see
+// wtf_kernels_x86.c, wtf_kernels_arm.c); wtf_set_kernel_isa overrides it.
 
 #include "wtf_kernels.h"
 #include "notorch.h"
 #include <stdio.h>
 #include <string.h>
+#include <pthread.h>
+#ifdef _WIN32
+#include <windows.h>
+#else
+#include <unistd.h>
+#endif
 
 // ── F16 → F32 ───────────────────────────────────────────────────────────────
 static float wtf_f16_to_f32(uint16_t h) {
@@ -36,6 +46,58 @@ static float wtf_f16_to_f32(uint16_t h) {
     return f;
 }
 
+// ── SIMD variants ───────────────────────────────────────────────────────────
+
+typedef void (*wtf_rows_fn)(float*, const uint8_t*, const float*, int, int, int);
+
+_Static_assert(WTF_I8_BLOCK == 32, "the int8 kernels load one 32-byte block at a time");
+
+// Row fan-out with nt_qmatvec's policy: one thread per core up to 16, and
+// only for matrices big enough to amortize the spawns.
+#define WTF_ROWS_MAX_THREADS 16
+
+typedef struct {
+    wtf_rows_fn fn; float* out; const uint8_t* W; const float* x;
+    int r0, r1, k;
+} wtf_rows_job;
+
+static void* wtf_rows_worker(void* p) {
+    wtf_rows_job* j = (wtf_rows_job*)p;
+    j->fn(j->out, j->W, j->x, j->r0, j->r1, j->k);
+    return NULL;
+}
+
+static void wtf_rows_run(wtf_rows_fn fn, float* out, const uint8_t* W, const float* x, int m, int k) {
+#ifdef _WIN32
+    SYSTEM_INFO si;
+    GetSystemInfo(&si);
+    int nt = (int)si.dwNumberOfProcessors;
+#else
+    int nt = (int)sysconf(_SC_NPROCESSORS_ONLN);
+#endif
+    if (nt > WTF_ROWS_MAX_THREADS) nt = WTF_ROWS_MAX_THREADS;
+    if (nt > m) nt = m;
+    if (nt <= 1 || (long)m * k < (4L << 20)) { fn(out, W, x, 0, m, k); return; }
+
+    pthread_t th[WTF_ROWS_MAX_THREADS];
+    wtf_rows_job jobs[WTF_ROWS_MAX_THREADS];
+    int per = (m + nt - 1) / nt, launched = 0;
+    for (int t = 0; t < nt; t++) {
+        int r0 = t * per, r1 = (r0 + per > m) ? m : r0 + per;
+        if (r0 >= m) break;
+        jobs[t] = (wtf_rows_job){ fn, out, W, x, r0, r1, k };
+        if (pthread_create(&th[t], NULL, wtf_rows_worker, &jobs[t]) != 0) {
+            fn(out, W, x, r0, m, k);
+            break;
+        }
+        launched++;
+    }
+    for (int t = 0; t < launched; t++) pthread_join(th[t], NULL);
+}
+
+#include "wtf_kernels_x86.c"
+#include "wtf_kernels_arm.c"
+
 // ── Dequant kernels — match notorch/gguf.c byte-for-byte ────────────────────
 
 static void deq_q4_0(const uint8_t* src, float* dst, uint64_t n) {
@@ -162,11 +224,117 @@ void wtf_sgemv(float* out, const float* W, const float* x, int m, int n) {
     nt_blas_matvec(out, W, x, m, n);
 }
 
+// ── Kernel variant ──────────────────────────────────────────────────────────
+
+static int wtf_isa = -1; // -1 = not probed yet
+
+static int wtf_best_isa(void) {
+#ifdef WTF_HAVE_X86
+    if (wtf_x86_avx512()) return WTF_ISA_AVX512;
+#endif
+#ifdef WTF_HAVE_NEON
+    if (wtf_arm_dotprod()) return WTF_ISA_NEON;
+#endif
+    return WTF_ISA_GENERIC;
+}
+
+int wtf_kernel_isa(void) {
+    if (wtf_isa < 0) wtf_isa = wtf_best_isa();
+    return wtf_isa;
+}
+
+int wtf_set_kernel_isa(int isa) {
+    int best = wtf_best_isa();
+    wtf_isa = (isa == WTF_ISA_GENERIC) ? isa : best;
+    return wtf_isa;
+}
+
+// wtf_rows_simd returns the current variant's row kernel for dtype, or NULL
+// to leave the matrix to nt_qmatvec.
+static wtf_rows_fn wtf_rows_simd(int dtype, int k) {
+    switch (wtf_kernel_isa()) {
+#ifdef WTF_HAVE_X86
+    case WTF_ISA_AVX512: return wtf_rows_avx512(dtype, k);
+#endif
+#ifdef WTF_HAVE_NEON
+    case WTF_ISA_NEON:   return wtf_rows_neon(dtype, k);
+#endif
+    default:             return NULL;
+    }
+}
+
 int wtf_qmatvec(float* out, const uint8_t* Wq, int dtype,
                 const float* x, int m, int k) {
+    wtf_rows_fn fn = wtf_rows_simd(dtype, k);
+    if (fn) { wtf_rows_run(fn, out, Wq, x, m, k); return 0; }
     return nt_qmatvec(out, Wq, dtype, x, m, k);
 }
 
+// ── int8, quantized at load ─────────────────────────────────────────────────
+//
+// Symmetric per-row weights, per-block activations (llama.cpp's Q8_0 split of
+// the work): the inner loop is a plain int8×int8→int32 dot over one block,
+// which compilers vectorize — with VNNI / dotprod instructions when the build
+// targets them (e.g. CGO_CFLAGS=-march=native).
+
+#include <math.h>
+
+void wtf_quantize_i8(const float* W, int m, int k, int8_t* q, float* scales) {
+    for (int i = 0; i < m; i++) {
+        const float* row = W + (uint64_t)i * k;
+        float amax = 0;
+        for (int j = 0; j < k; j++) {
+            float a = fabsf(row[j]);
+            if (a > amax) amax = a;
+        }
+        float s = amax / 127.0f;
+        float inv = s > 0 ? 1.0f / s : 0;
+        int8_t* qr = q + (uint64_t)i * k;
+        for (int j = 0; j < k; j++) qr[j] = (int8_t)lrintf(row[j] * inv);
+        scales[i] = s;
+    }
+}
+
+void wtf_i8matvec(float* out, const int8_t* Wq, const float* scales,
+                  const float* x, int m, int k) {
+    int nb = k / WTF_I8_BLOCK;
+    int8_t xq[k];
+    float xs[nb];
+    for (int b = 0; b < nb; b++) {
+        const float* xb = x + b * WTF_I8_BLOCK;
+        float amax = 0;
+        for (int j = 0; j < WTF_I8_BLOCK; j++) {
+            float a = fabsf(xb[j]);
+            if (a > amax) amax = a;
+        }
+        float s = amax / 127.0f;
+        float inv = s > 0 ? 1.0f / s : 0;
+        for (int j = 0; j < WTF_I8_BLOCK; j++) xq[b * WTF_I8_BLOCK + j] = (int8_t)lrintf(xb[j] * inv);
+        xs[b] = s;
+    }
+    switch (wtf_kernel_isa()) {
+#ifdef WTF_HAVE_X86
+    case WTF_ISA_AVX512: wtf_i8_rows_avx512(out, Wq, scales, xq, xs, m, k); return;
+#endif
+#ifdef WTF_HAVE_NEON
+    case WTF_ISA_NEON:   wtf_i8_rows_neon(out, Wq, scales, xq, xs, m, k); return;
+#endif
+    default:             break;
+    }
+    for (int i = 0; i < m; i++) {
+        const int8_t* wr = Wq + (uint64_t)i * k;
+        float acc = 0;
+        for (int b = 0; b < nb; b++) {
+            const int8_t* wb = wr + b * WTF_I8_BLOCK;
+            const int8_t* qb = xq + b * WTF_I8_BLOCK;
+            int32_t dot = 0;
+            for (int j = 0; j < WTF_I8_BLOCK; j++) dot += (int32_t)wb[j] * (int32_t)qb[j];
+            acc += xs[b] * (float)dot;
+        }
+        out[i] = acc * scales[i];
+    }
+}
+
 #ifdef USE_BLAS
   #ifdef ACCELERATE
     #include <Accelerate/Accelerate.h>
@@ -1,8 +1,10 @@
 // wtf_kernels.h — thin shim over notorch + gguf for WTForacle inference.
 //
-// Two primitives only:
+// Primitives:
 //   - wtf_dequant_to_f32: GGML quant blob → contiguous float32 row-major
 //   - wtf_sgemv         : out[m] = W[m,n] @ x[n]  via Accelerate / OpenBLAS
+//   - wtf_qmatvec       : the same on packed GGUF weights
+//   - wtf_i8matvec      : the same on weights quantized to int8 at load
 //
 // The full notorch.c / gguf.c are vendored alongside as source-of-truth;
 // this header exposes only what the Go side calls through cgo.
@@ -48,6 +50,26 @@ void wtf_sgemv_strided(float* out, const float* W, int lda,
 int wtf_qmatvec(float* out, const uint8_t* Wq, int dtype,
                 const float* x, int m, int k);
 
+// SIMD variant wtf_qmatvec / wtf_i8matvec run. The best the CPU supports is
+// picked on first use; wtf_set_kernel_isa forces generic (0) or back to the
+// best (anything else) and returns the variant in effect.
+#define WTF_ISA_GENERIC 0
+#define WTF_ISA_AVX512  1 // x86-64: AVX-512 F/BW/VL + VNNI
+#define WTF_ISA_NEON    2 // AArch64: NEON + dotprod
+int wtf_kernel_isa(void);
+int wtf_set_kernel_isa(int isa);
+
+// Load-time int8: each row of W[m,k] becomes int8 with one f32 scale
+// (absmax / 127). k must be a multiple of WTF_I8_BLOCK.
+#define WTF_I8_BLOCK 32
+void wtf_quantize_i8(const float* W, int m, int k, int8_t* q, float* scales);
+
+// out[m] = Wq[m,k] @ x[k] for wtf_quantize_i8 weights. x is quantized to
+// int8 per WTF_I8_BLOCK elements on the C stack, dot products accumulate
+// in int32.
+void wtf_i8matvec(float* out, const int8_t* Wq, const float* scales,
+                  const float* x, int m, int k);
+
 #ifdef __cplusplus
 }
 #endif
@@ -0,0 +1,144 @@
+// wtf_kernels_arm.c — NEON variants of the matvec kernels for AArch64
+// (Graviton 2/3/4, Ampere, Apple Silicon), picked at run time. Included by
+// wtf_kernels.c; the x86 counterparts are in wtf_kernels_x86.c.
+//
+// The variant needs the dotprod extension (ARMv8.2, every Graviton and
+// Apple M-series chip), probed from the OS: getauxval on Linux, sysctl on
+// macOS. Covered: the packed Q4_0 / Q8_0 / F16 rows nt_qmatvec would run,
+// and the load-time int8 dot (sdot). f32 matrices go to the BLAS.
+//
+// No SVE variant yet: Graviton 4's SVE2 units are 128 bits wide, the same
+// as NEON, and only Graviton 3 (256-bit SVE) would gain from one.
+
+#if defined(__aarch64__) && (defined(__GNUC__) || defined(__clang__))
+#define WTF_HAVE_NEON 1
+
+#include <arm_neon.h>
+#if defined(__APPLE__)
+#include <sys/sysctl.h>
+#elif defined(__linux__)
+#include <sys/auxv.h>
+#ifndef HWCAP_ASIMDDP
+#define HWCAP_ASIMDDP (1 << 20)
+#endif
+#elif defined(_WIN32) && !defined(PF_ARM_V82_DP_INSTRUCTIONS_AVAILABLE)
+#define PF_ARM_V82_DP_INSTRUCTIONS_AVAILABLE 43
+#endif
+
+#if defined(__ARM_FEATURE_DOTPROD)
+#define WTF_NEON
+#elif defined(__clang__)
+#define WTF_NEON __attribute__((target("dotprod")))
+#else
+#define WTF_NEON __attribute__((target("+dotprod")))
+#endif
+
+static int wtf_arm_dotprod(void) {
+#if defined(__ARM_FEATURE_DOTPROD)
+    return 1;
+#elif defined(__APPLE__)
+    int v = 0;
+    size_t n = sizeof v;
+    return sysctlbyname("hw.optional.arm.FEAT_DotProd", &v, &n, NULL, 0) == 0 && v;
+#elif defined(__linux__)
+    return (getauxval(AT_HWCAP) & HWCAP_ASIMDDP) != 0;
+#elif defined(_WIN32)
+    return IsProcessorFeaturePresent(PF_ARM_V82_DP_INSTRUCTIONS_AVAILABLE) != 0;
+#else
+    return 0;
+#endif
+}
+
+// t += q[0:16] · x[0:16], q widened from int8 to f32.
+static WTF_NEON float32x4_t wtf_fma_s8x16(float32x4_t t, int8x16_t q, const float* x) {
+    int16x8_t a = vmovl_s8(vget_low_s8(q)), b = vmovl_high_s8(q);
+    t = vfmaq_f32(t, vcvtq_f32_s32(vmovl_s16(vget_low_s16(a))), vld1q_f32(x));
+    t = vfmaq_f32(t, vcvtq_f32_s32(vmovl_high_s16(a)), vld1q_f32(x + 4));
+    t = vfmaq_f32(t, vcvtq_f32_s32(vmovl_s16(vget_low_s16(b))), vld1q_f32(x + 8));
+    t = vfmaq_f32(t, vcvtq_f32_s32(vmovl_high_s16(b)), vld1q_f32(x + 12));
+    return t;
+}
+
+static WTF_NEON void wtf_q4_0_rows_neon(float* out, const uint8_t* W, const float* x,
+                                        int r0, int r1, int k) {
+    int nb = k / 32;
+    const uint8x16_t low = vdupq_n_u8(0x0F);
+    const int8x16_t eight = vdupq_n_s8(8);
+    for (int row = r0; row < r1; row++) {
+        const uint8_t* rb = W + (uint64_t)row * nb * 18;
+        float32x4_t acc = vdupq_n_f32(0);
+        for (int b = 0; b < nb; b++) {
+            const uint8_t* blk = rb + (uint64_t)b * 18;
+            uint16_t h; memcpy(&h, blk, 2);
+            uint8x16_t qs = vld1q_u8(blk + 2);
+            int8x16_t lo = vsubq_s8(vreinterpretq_s8_u8(vandq_u8(qs, low)), eight);
+            int8x16_t hi = vsubq_s8(vreinterpretq_s8_u8(vshrq_n_u8(qs, 4)), eight);
+            const float* xb = x + (uint64_t)b * 32;
+            float32x4_t t = wtf_fma_s8x16(vdupq_n_f32(0), lo, xb);
+            t = wtf_fma_s8x16(t, hi, xb + 16);
+            acc = vfmaq_n_f32(acc, t, wtf_f16_to_f32(h));
+        }
+        out[row] = vaddvq_f32(acc);
+    }
+}
+
+static WTF_NEON void wtf_q8_0_rows_neon(float* out, const uint8_t* W, const float* x,
+                                        int r0, int r1, int k) {
+    int nb = k / 32;
+    for (int row = r0; row < r1; row++) {
+        const uint8_t* rb = W + (uint64_t)row * nb * 34;
+        float32x4_t acc = vdupq_n_f32(0);
+        for (int b = 0; b < nb; b++) {
+            const uint8_t* blk = rb + (uint64_t)b * 34;
+            uint16_t h; memcpy(&h, blk, 2);
+            const float* xb = x + (uint64_t)b * 32;
+            float32x4_t t = wtf_fma_s8x16(vdupq_n_f32(0), vld1q_s8((const int8_t*)(blk + 2)), xb);
+            t = wtf_fma_s8x16(t, vld1q_s8((const int8_t*)(blk + 18)), xb + 16);
+            acc = vfmaq_n_f32(acc, t, wtf_f16_to_f32(h));
+        }
+        out[row] = vaddvq_f32(acc);
+    }
+}
+
+static WTF_NEON void wtf_f16_rows_neon(float* out, const uint8_t* W, const float* x,
+                                       int r0, int r1, int k) {
+    const uint16_t* Wh = (const uint16_t*)W;
+    for (int row = r0; row < r1; row++) {
+        const uint16_t* r = Wh + (uint64_t)row * k;
+        float32x4_t acc = vdupq_n_f32(0);
+        int j = 0;
+        for (; j + 4 <= k; j += 4)
+            acc = vfmaq_f32(acc, vcvt_f32_f16(vreinterpret_f16_u16(vld1_u16(r + j))), vld1q_f32(x + j));
+        float tail = 0;
+        for (; j < k; j++) tail += wtf_f16_to_f32(r[j]) * x[j];
+        out[row] = vaddvq_f32(acc) + tail;
+    }
+}
+
+static wtf_rows_fn wtf_rows_neon(int dtype, int k) {
+    switch (dtype) {
+    case WTF_DTYPE_Q4_0: return (k % 32) ? NULL : wtf_q4_0_rows_neon;
+    case WTF_DTYPE_Q8_0: return (k % 32) ? NULL : wtf_q8_0_rows_neon;
+    case WTF_DTYPE_F16:  return wtf_f16_rows_neon;
+    default:             return NULL;
+    }
+}
+
+static WTF_NEON void wtf_i8_rows_neon(float* out, const int8_t* Wq, const float* scales,
+                                      const int8_t* xq, const float* xs, int m, int k) {
+    int nb = k / WTF_I8_BLOCK;
+    for (int i = 0; i < m; i++) {
+        const int8_t* wr = Wq + (uint64_t)i * k;
+        float32x4_t acc = vdupq_n_f32(0);
+        for (int b = 0; b < nb; b++) {
+            const int8_t* wb = wr + b * WTF_I8_BLOCK;
+            const int8_t* qb = xq + b * WTF_I8_BLOCK;
+            int32x4_t dot = vdotq_s32(vdupq_n_s32(0), vld1q_s8(wb), vld1q_s8(qb));
+            dot = vdotq_s32(dot, vld1q_s8(wb + 16), vld1q_s8(qb + 16));
+            acc = vfmaq_n_f32(acc, vcvtq_f32_s32(dot), xs[b]);
+        }
+        out[i] = vaddvq_f32(acc) * scales[i];
+    }
+}
+
+#endif
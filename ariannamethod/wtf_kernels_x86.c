@@ -0,0 +1,115 @@
+// wtf_kernels_x86.c — AVX-512 variants of the matvec kernels, picked at run
+// time. Included by wtf_kernels.c (the ARM ones are in wtf_kernels_arm.c);
+// compiled on every x86-64 build (each function carries its own target
+// attribute, so no -mavx512 flag is needed and the binary still runs on
+// CPUs without it).
+//
+// The variant needs AVX-512 F/BW/VL + VNNI (Ice Lake, Cascade Lake, Zen 4,
+// Sapphire Rapids and later); Skylake-X and older keep the generic kernels.
+// Covered: the packed Q4_0 / Q8_0 / F16 rows nt_qmatvec would run, and the
+// load-time int8 dot (vpdpwssd). f32 matrices go to the BLAS, which does its
+// own dispatch.
+//
+// AMX is reported (amx-int8 in the version's cpu_features) but has no
+// kernel: its tiles multiply a 16-row block of activations at a time, and
+// every pass here is a single token's matvec, one activation row. Batched
+// prefill would be its use.
+
+#if defined(__x86_64__) && (defined(__GNUC__) || defined(__clang__))
+#define WTF_HAVE_X86 1
+
+#include <immintrin.h>
+
+#define WTF_AVX512 __attribute__((target("avx512f,avx512bw,avx512vl,avx512vnni,f16c,fma")))
+
+static int wtf_x86_avx512(void) {
+    __builtin_cpu_init();
+    return __builtin_cpu_supports("avx512f") && __builtin_cpu_supports("avx512bw") &&
+           __builtin_cpu_supports("avx512vl") && __builtin_cpu_supports("avx512vnni");
+}
+
+static WTF_AVX512 void wtf_q4_0_rows_avx512(float* out, const uint8_t* W, const float* x,
+                                            int r0, int r1, int k) {
+    int nb = k / 32;
+    const __m128i low = _mm_set1_epi8(0x0F);
+    const __m512 eight = _mm512_set1_ps(8.0f);
+    for (int row = r0; row < r1; row++) {
+        const uint8_t* rb = W + (uint64_t)row * nb * 18;
+        __m512 acc = _mm512_setzero_ps();
+        for (int b = 0; b < nb; b++) {
+            const uint8_t* blk = rb + (uint64_t)b * 18;
+            uint16_t h; memcpy(&h, blk, 2);
+            __m128i qs = _mm_loadu_si128((const __m128i*)(blk + 2));
+            __m512 lo = _mm512_cvtepi32_ps(_mm512_cvtepu8_epi32(_mm_and_si128(qs, low)));
+            __m512 hi = _mm512_cvtepi32_ps(_mm512_cvtepu8_epi32(_mm_and_si128(_mm_srli_epi16(qs, 4), low)));
+            const float* xb = x + (uint64_t)b * 32;
+            __m512 t = _mm512_mul_ps(_mm512_sub_ps(lo, eight), _mm512_loadu_ps(xb));
+            t = _mm512_fmadd_ps(_mm512_sub_ps(hi, eight), _mm512_loadu_ps(xb + 16), t);
+            acc = _mm512_fmadd_ps(_mm512_set1_ps(_cvtsh_ss(h)), t, acc);
+        }
+        out[row] = _mm512_reduce_add_ps(acc);
+    }
+}
+
+static WTF_AVX512 void wtf_q8_0_rows_avx512(float* out, const uint8_t* W, const float* x,
+                                            int r0, int r1, int k) {
+    int nb = k / 32;
+    for (int row = r0; row < r1; row++) {
+        const uint8_t* rb = W + (uint64_t)row * nb * 34;
+        __m512 acc = _mm512_setzero_ps();
+        for (int b = 0; b < nb; b++) {
+            const uint8_t* blk = rb + (uint64_t)b * 34;
+            uint16_t h; memcpy(&h, blk, 2);
+            __m512 q0 = _mm512_cvtepi32_ps(_mm512_cvtepi8_epi32(_mm_loadu_si128((const __m128i*)(blk + 2))));
+            __m512 q1 = _mm512_cvtepi32_ps(_mm512_cvtepi8_epi32(_mm_loadu_si128((const __m128i*)(blk + 18))));
+            const float* xb = x + (uint64_t)b * 32;
+            __m512 t = _mm512_mul_ps(q0, _mm512_loadu_ps(xb));
+            t = _mm512_fmadd_ps(q1, _mm512_loadu_ps(xb + 16), t);
+            acc = _mm512_fmadd_ps(_mm512_set1_ps(_cvtsh_ss(h)), t, acc);
+        }
+        out[row] = _mm512_reduce_add_ps(acc);
+    }
+}
+
+static WTF_AVX512 void wtf_f16_rows_avx512(float* out, const uint8_t* W, const float* x,
+                                           int r0, int r1, int k) {
+    const uint16_t* Wh = (const uint16_t*)W;
+    for (int row = r0; row < r1; row++) {
+        const uint16_t* r = Wh + (uint64_t)row * k;
+        __m512 acc = _mm512_setzero_ps();
+        int j = 0;
+        for (; j + 16 <= k; j += 16)
+            acc = _mm512_fmadd_ps(_mm512_cvtph_ps(_mm256_loadu_si256((const __m256i*)(r + j))),
+                                  _mm512_loadu_ps(x + j), acc);
+        float tail = 0;
+        for (; j < k; j++) tail += _cvtsh_ss(r[j]) * x[j];
+        out[row] = _mm512_reduce_add_ps(acc) + tail;
+    }
+}
+
+static wtf_rows_fn wtf_rows_avx512(int dtype, int k) {
+    switch (dtype) {
+    case WTF_DTYPE_Q4_0: return (k % 32) ? NULL : wtf_q4_0_rows_avx512;
+    case WTF_DTYPE_Q8_0: return (k % 32) ? NULL : wtf_q8_0_rows_avx512;
+    case WTF_DTYPE_F16:  return wtf_f16_rows_avx512;
+    default:             return NULL;
+    }
+}
+
+static WTF_AVX512 void wtf_i8_rows_avx512(float* out, const int8_t* Wq, const float* scales,
+                                          const int8_t* xq, const float* xs, int m, int k) {
+    int nb = k / WTF_I8_BLOCK;
+    for (int i = 0; i < m; i++) {
+        const int8_t* wr = Wq + (uint64_t)i * k;
+        __m512 acc = _mm512_setzero_ps();
+        for (int b = 0; b < nb; b++) {
+            __m512i w = _mm512_cvtepi8_epi16(_mm256_loadu_si256((const __m256i*)(wr + b * WTF_I8_BLOCK)));
+            __m512i q = _mm512_cvtepi8_epi16(_mm256_loadu_si256((const __m256i*)(xq + b * WTF_I8_BLOCK)));
+            __m512i dot = _mm512_dpwssd_epi32(_mm512_setzero_si512(), w, q);
+            acc = _mm512_fmadd_ps(_mm512_set1_ps(xs[b]), _mm512_cvtepi32_ps(dot), acc);
+        }
+        out[i] = _mm512_reduce_add_ps(acc) * scales[i];
+    }
+}
+
+#endif
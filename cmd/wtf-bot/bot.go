@@ -0,0 +1,358 @@
+package main
+
+// bot.go — the transport-independent half of the bot: one Session per chat,
+// a per-chat rate limit, and the /persona, /reset and /help commands.
+// Transports turn their service's updates into Incoming messages and give
+// back a Replier that can edit the reply in place while it streams.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"wtforacle/wtf"
+)
+
+// Incoming is one chat message addressed to the bot.
+type Incoming struct {
+	Chat string // transport-qualified chat id, e.g. "tg:1234"
+	User string
+	Text string
+}
+
+// Replier delivers the reply to one Incoming. Update may be called several
+// times with a growing text while the reply streams; the last call has
+// final set.
+type Replier interface {
+	Update(text string, final bool) error
+}
+
+// Handler answers one message. Transports call it on their own goroutine
+// per message; a chat's messages are answered one at a time, but not
+// necessarily in the order they arrived.
+type Handler func(ctx context.Context, in Incoming, out Replier)
+
+// Transport connects the bot to one chat service.
+type Transport interface {
+	Name() string
+	Run(ctx context.Context, h Handler) error // until ctx is done or a fatal error
+}
+
+// editEvery spaces the in-place edits of a streaming reply; chat APIs rate
+// limit edits well below token speed.
+const editEvery = 1500 * time.Millisecond
+
+const helpText = "ask me anything, i'll tell you what reddit thinks.\n" +
+	"/persona — list personas, /persona <name> — switch (starts over)\n" +
+	"/remember <fact>, /forget <fact> — what i should keep in mind here\n" +
+	"/reset — forget this chat\n" +
+	"/help — this"
+
+// Bot answers chats on an Engine.
+type Bot struct {
+	Engine  *wtf.Engine
+	Opts    wtf.GenOptions
+	Persona string // for new chats
+
+	// Summarize is set on every chat's session (see wtf/summary.go).
+	Summarize wtf.SummaryPolicy
+
+	RatePerMinute float64 // replies per chat; 0 = unlimited
+	Burst         int     // bucket size (0 = 1)
+	Idle          time.Duration
+
+	// DB, if set, keeps every chat's conversation across restarts and
+	// idle sweeps.
+	DB *wtf.SessionDB
+
+	mu    sync.Mutex
+	chats map[string]*chat
+}
+
+type chat struct {
+	mu      sync.Mutex // held while answering, so a chat's messages wait their turn
+	id      string
+	persona string
+	s       *wtf.Session
+
+	bucket float64 // under Bot.mu
+	last   time.Time
+}
+
+// chat returns the state of id, creating it on first contact, and takes one
+// reply from its bucket. ok is false when the chat is over its rate.
+func (b *Bot) chat(id string, now time.Time) (c *chat, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.chats == nil {
+		b.chats = make(map[string]*chat)
+	}
+	burst := float64(max(b.Burst, 1))
+	c, found := b.chats[id]
+	if !found {
+		c = &chat{id: id, persona: b.Persona, bucket: burst, last: now}
+		b.chats[id] = c
+	}
+	if b.RatePerMinute <= 0 {
+		c.last = now
+		return c, true
+	}
+	c.bucket = min(c.bucket+now.Sub(c.last).Minutes()*b.RatePerMinute, burst)
+	c.last = now
+	if c.bucket < 1 {
+		return c, false
+	}
+	c.bucket--
+	return c, true
+}
+
+// Sweep forgets chats idle longer than b.Idle, releasing their sessions.
+func (b *Bot) Sweep(now time.Time) {
+	if b.Idle <= 0 {
+		return
+	}
+	b.mu.Lock()
+	var stale []*chat
+	for id, c := range b.chats {
+		if now.Sub(c.last) > b.Idle {
+			stale = append(stale, c)
+			delete(b.chats, id)
+		}
+	}
+	b.mu.Unlock()
+	for _, c := range stale {
+		c.mu.Lock()
+		c.reset()
+		c.mu.Unlock()
+	}
+}
+
+// Handle is the Handler the transports are run with.
+func (b *Bot) Handle(ctx context.Context, in Incoming, out Replier) {
+	// The engine recovers its own panics (wtf.ErrPanic); this catches the
+	// bot's, so one message cannot take the other chats down with it.
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "[wtf-bot] %s: panic: %v\n%s", in.Chat, r, debug.Stack())
+		}
+	}()
+	text := strings.TrimSpace(in.Text)
+	if text == "" || ctx.Err() != nil {
+		return
+	}
+	cmd, arg, isCmd := command(text)
+	c, ok := b.chat(in.Chat, time.Now())
+	if !ok && !isCmd {
+		b.send(in, out, "slow down. even the oracle has a rate limit.")
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if isCmd {
+		b.send(in, out, b.command(c, cmd, arg))
+		return
+	}
+	reply, err := b.ask(c, text, out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[wtf-bot] %s: %v\n", in.Chat, err)
+		switch {
+		case errors.Is(err, wtf.ErrPromptInjection):
+			reply = "nice try."
+		case errors.Is(err, wtf.ErrPromptTooLong):
+			reply = "not reading all that. shorter."
+		default:
+			reply = "the oracle choked on that one. try again or /reset."
+		}
+	}
+	b.send(in, out, reply)
+}
+
+func (b *Bot) send(in Incoming, out Replier, text string) {
+	if err := out.Update(text, true); err != nil {
+		fmt.Fprintf(os.Stderr, "[wtf-bot] %s: reply: %v\n", in.Chat, err)
+	}
+}
+
+// command splits "/persona@wtfbot troll" into ("persona", "troll").
+func command(text string) (cmd, arg string, ok bool) {
+	if !strings.HasPrefix(text, "/") {
+		return "", "", false
+	}
+	cmd, arg, _ = strings.Cut(text[1:], " ")
+	cmd, _, _ = strings.Cut(cmd, "@")
+	return strings.ToLower(cmd), strings.TrimSpace(arg), true
+}
+
+func (b *Bot) command(c *chat, cmd, arg string) string {
+	switch cmd {
+	case "start", "help":
+		return helpText
+	case "reset":
+		c.reset()
+		c.persona = b.Persona
+		if b.DB != nil {
+			if err := b.DB.Delete(c.id); err != nil {
+				fmt.Fprintf(os.Stderr, "[wtf-bot] %s: %v\n", c.id, err)
+			}
+		}
+		return "forgotten. who are you again?"
+	case "persona":
+		names := b.Engine.Personas()
+		slices.Sort(names)
+		if arg == "" {
+			for i, n := range names {
+				if n == c.persona {
+					names[i] = n + " (current)"
+				}
+			}
+			return "personas: " + strings.Join(names, ", ")
+		}
+		if !slices.Contains(names, arg) {
+			return fmt.Sprintf("no persona %q. try /persona", arg)
+		}
+		c.reset()
+		c.persona = arg
+		if b.DB != nil {
+			// The stored history is under the old anchor.
+			if err := b.DB.Delete(c.id); err != nil {
+				fmt.Fprintf(os.Stderr, "[wtf-bot] %s: %v\n", c.id, err)
+			}
+		}
+		return "now speaking as " + arg + "."
+	case "remember", "forget":
+		if arg == "" {
+			return "/" + cmd + " what?"
+		}
+		if c.s == nil {
+			c.s = b.open(c)
+		}
+		reply := "noted. kept until /reset."
+		if cmd == "forget" {
+			if !c.s.Forget(arg) {
+				return "never knew that."
+			}
+			reply = "gone."
+		} else if err := c.s.Remember(arg); err != nil {
+			return "not remembering that."
+		}
+		if b.DB != nil {
+			// Facts outlive a restart or an idle sweep before the next turn.
+			if err := b.DB.Save(c.id, c.s); err != nil {
+				fmt.Fprintf(os.Stderr, "[wtf-bot] %s: %v\n", c.id, err)
+			}
+		}
+		return reply
+	}
+	return "unknown command. /help"
+}
+
+// reset drops the conversation; the next message starts a new session.
+func (c *chat) reset() {
+	if c.s != nil {
+		c.s.Close()
+		c.s = nil
+	}
+}
+
+// open resumes c's stored conversation, or starts one under c.persona.
+// A resumed session gets today's options for the persona whose anchor it
+// was started with.
+func (b *Bot) open(c *chat) *wtf.Session {
+	var s *wtf.Session
+	if b.DB != nil {
+		var err error
+		s, err = b.DB.Resume(b.Engine, c.id)
+		if err != nil && !errors.Is(err, wtf.ErrNoSession) {
+			fmt.Fprintf(os.Stderr, "[wtf-bot] %s: %v\n", c.id, err)
+		}
+	}
+	if s != nil && len(s.Messages) > 0 && s.Messages[0].Role == wtf.RoleSystem {
+		for _, name := range b.Engine.Personas() {
+			if p, ok := b.Engine.Persona(name); ok && p.Anchor == s.Messages[0].Content {
+				c.persona = name
+				s.Opts, s.Summarize = p.Options(b.Opts), b.Summarize
+				return s
+			}
+		}
+	}
+	if s != nil {
+		s.Close() // persona gone or raw: start over
+	}
+	system, opts := "", b.Opts
+	if p, ok := b.Engine.Persona(c.persona); ok {
+		system, opts = p.Anchor, p.Options(opts)
+	}
+	s = b.Engine.NewSession(system, wtf.ChatQA, opts)
+	s.Summarize = b.Summarize
+	return s
+}
+
+// ask sends text to c's session, relaying the reply to out as it decodes.
+func (b *Bot) ask(c *chat, text string, out Replier) (string, error) {
+	if c.s == nil {
+		c.s = b.open(c)
+	}
+	// Old turns go first when the history no longer fits the context.
+	if err := c.s.Fit(text, wtf.TruncDropOldest); err != nil {
+		return "", err
+	}
+
+	// Pieces land in a buffer; a goroutine ships snapshots, so a slow chat
+	// API never holds up the decoder (and the engine lock with it).
+	var (
+		mu    sync.Mutex
+		buf   strings.Builder
+		dirty bool
+		wg    sync.WaitGroup
+	)
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(editEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				mu.Lock()
+				snap, send := buf.String(), dirty && strings.TrimSpace(buf.String()) != ""
+				dirty = false
+				mu.Unlock()
+				if send {
+					out.Update(snap+" …", false)
+				}
+			}
+		}
+	}()
+	opts := c.s.Opts
+	c.s.Opts.OnToken = func(piece string) {
+		mu.Lock()
+		buf.WriteString(piece)
+		dirty = true
+		mu.Unlock()
+	}
+	res, err := c.s.Send(text)
+	c.s.Opts = opts
+	close(done)
+	wg.Wait()
+	if err != nil {
+		return "", err
+	}
+	if b.DB != nil {
+		if err := b.DB.SaveTurn(c.id, c.s, res); err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf-bot] %s: %v\n", c.id, err)
+		}
+	}
+	if strings.TrimSpace(res.Text) == "" {
+		return "...", nil
+	}
+	return res.Text, nil
+}
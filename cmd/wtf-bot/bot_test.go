@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"wtforacle/wtf"
+)
+
+// newTestEngine builds a 2-layer model with random f32 weights, through an
+// in-memory GGUF, and a byte-level BPE tokenizer with the chat specials.
+func newTestEngine(t *testing.T) *wtf.Engine {
+	vocab := []string{"<|endoftext|>", "<|im_start|>", "<|im_end|>"}
+	types := []int32{3, 3, 3}
+	for b := 33; b <= 126; b++ {
+		vocab, types = append(vocab, string(rune(b))), append(types, 1)
+	}
+	vocab, types = append(vocab, "Ġ", "Ċ"), append(types, 1, 1)
+	g := &wtf.GGUFFile{
+		Meta: wtf.GGUFMetadata{
+			NumLayers: 2, EmbedDim: 32, NumHeads: 4, NumKVHeads: 2, HeadDim: 8,
+			VocabSize: len(vocab), SeqLen: 128, IntermSize: 64,
+			RMSNormEps: 1e-5, RopeTheta: 10000,
+			TokenList: vocab, TokenTypes: types, TokenModel: "gpt2",
+			KV: map[string]any{"general.architecture": "wtftest"},
+		},
+		Tensors: make(map[string]*wtf.GGUFTensorInfo),
+	}
+	rng := rand.New(rand.NewSource(7))
+	add := func(name string, norm bool, dims ...uint64) {
+		info := &wtf.GGUFTensorInfo{Name: name, NDims: uint32(len(dims)), Offset: uint64(len(g.TensorData))}
+		n := uint64(1)
+		for i, d := range dims {
+			info.Dims[i], n = d, n*d
+		}
+		for range n {
+			v := float32(1)
+			if !norm {
+				v = rng.Float32()*0.6 - 0.3
+			}
+			g.TensorData = binary.LittleEndian.AppendUint32(g.TensorData, math.Float32bits(v))
+		}
+		g.Tensors[name] = info
+	}
+	const dim, kvDim, ff = 32, 16, 64
+	add("token_embd.weight", false, dim, uint64(len(vocab)))
+	add("output_norm.weight", true, dim)
+	for i := range 2 {
+		p := fmt.Sprintf("blk.%d.", i)
+		add(p+"attn_norm.weight", true, dim)
+		add(p+"ffn_norm.weight", true, dim)
+		add(p+"attn_q.weight", false, dim, dim)
+		add(p+"attn_k.weight", false, dim, kvDim)
+		add(p+"attn_v.weight", false, dim, kvDim)
+		add(p+"attn_output.weight", false, dim, dim)
+		add(p+"ffn_gate.weight", false, dim, ff)
+		add(p+"ffn_up.weight", false, dim, ff)
+		add(p+"ffn_down.weight", false, ff, dim)
+	}
+	model, err := wtf.LoadLlamaModel(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := wtf.NewEngine(model, wtf.NewTokenizer(&g.Meta))
+	if err := e.RegisterPersona("oracle", "be rude.", wtf.SamplerOverrides{}); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// discard is a Replier that drops the edits.
+type discard struct{}
+
+func (discard) Update(string, bool) error { return nil }
+
+func TestCommand(t *testing.T) {
+	for _, tc := range []struct {
+		text, cmd, arg string
+		ok             bool
+	}{
+		{"/help", "help", "", true},
+		{"/persona@wtfbot troll", "persona", "troll", true},
+		{"/Persona  troll ", "persona", "troll", true},
+		{"/remember i use arch btw", "remember", "i use arch btw", true},
+		{"what is rust", "", "", false},
+		{"why /reset", "", "", false},
+	} {
+		cmd, arg, ok := command(tc.text)
+		if cmd != tc.cmd || arg != tc.arg || ok != tc.ok {
+			t.Errorf("command(%q) = %q, %q, %v; want %q, %q, %v", tc.text, cmd, arg, ok, tc.cmd, tc.arg, tc.ok)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	b := &Bot{RatePerMinute: 6, Burst: 2, Persona: "oracle"}
+	now := time.Unix(1000, 0)
+	for i, want := range []bool{true, true, false} {
+		if _, ok := b.chat("tg:1", now); ok != want {
+			t.Fatalf("reply %d: ok = %v, want %v", i, ok, want)
+		}
+	}
+	if _, ok := b.chat("tg:2", now); !ok {
+		t.Fatal("another chat's bucket was drained")
+	}
+	// 6 per minute refills one reply every 10s.
+	if _, ok := b.chat("tg:1", now.Add(5*time.Second)); ok {
+		t.Fatal("refilled after 5s")
+	}
+	if _, ok := b.chat("tg:1", now.Add(15*time.Second)); !ok {
+		t.Fatal("not refilled after 15s")
+	}
+	// The bucket never holds more than Burst.
+	later := now.Add(time.Hour)
+	for i, want := range []bool{true, true, false} {
+		if _, ok := b.chat("tg:1", later); ok != want {
+			t.Fatalf("after an hour, reply %d: ok = %v, want %v", i, ok, want)
+		}
+	}
+	c, _ := b.chat("tg:3", now)
+	if c.persona != "oracle" || c.id != "tg:3" {
+		t.Errorf("new chat = %q as %q", c.id, c.persona)
+	}
+}
+
+func TestRateUnlimited(t *testing.T) {
+	b := &Bot{}
+	now := time.Unix(1000, 0)
+	for i := range 100 {
+		if _, ok := b.chat("tg:1", now); !ok {
+			t.Fatalf("reply %d limited with RatePerMinute 0", i)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	b := &Bot{Idle: time.Minute}
+	now := time.Unix(1000, 0)
+	b.chat("tg:1", now)
+	b.chat("tg:2", now.Add(50*time.Second))
+	b.Sweep(now.Add(90 * time.Second))
+	if _, ok := b.chats["tg:1"]; ok {
+		t.Error("idle chat kept")
+	}
+	if _, ok := b.chats["tg:2"]; !ok {
+		t.Error("active chat swept")
+	}
+}
+
+func TestAskFitsFacts(t *testing.T) {
+	e := newTestEngine(t)
+	opts := wtf.DefaultGenOptions()
+	opts.MaxTokens, opts.Temp, opts.Grace.Limit = 4, 0, 0
+	b := &Bot{Engine: e, Opts: opts, Persona: "oracle"}
+	c, _ := b.chat("tg:1", time.Unix(1000, 0))
+	for i := range 2 {
+		if reply := b.command(c, "remember", fmt.Sprintf("fact number %d is here", i)); reply != "noted. kept until /reset." {
+			t.Fatalf("remember: %q", reply)
+		}
+	}
+	// History right up to SeqLen less the reply; the facts go over.
+	msgs := c.s.Messages
+	for i := 0; ; i++ {
+		turn := append(slices.Clip(msgs), wtf.Message{Role: wtf.RoleUser, Content: fmt.Sprintf("q%d?", i)},
+			wtf.Message{Role: wtf.RoleAssistant, Content: "no."})
+		ids, _ := e.Tok.BuildChat(append(turn, wtf.Message{Role: wtf.RoleUser, Content: "last?"}), wtf.ChatQA)
+		if len(ids) > e.Model.Config.SeqLen-1-opts.MaxTokens {
+			break
+		}
+		msgs = turn
+	}
+	c.s.Messages = msgs
+	if _, err := b.ask(c, "last?", discard{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.s.Messages) >= len(msgs)+2 {
+		t.Fatalf("no turns dropped: %d messages after %d", len(c.s.Messages), len(msgs))
+	}
+}
+
+func TestRememberKept(t *testing.T) {
+	db, err := wtf.OpenSessionDB(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	b := &Bot{Engine: newTestEngine(t), Opts: wtf.DefaultGenOptions(), Persona: "oracle", Idle: time.Minute, DB: db}
+	now := time.Unix(1000, 0)
+	c, _ := b.chat("tg:1", now)
+	b.command(c, "remember", "uses vim")
+	b.command(c, "remember", "uses emacs")
+	if reply := b.command(c, "forget", "uses emacs"); reply != "gone." {
+		t.Fatalf("forget: %q", reply)
+	}
+	b.Sweep(now.Add(time.Hour))
+
+	c, _ = b.chat("tg:1", now.Add(time.Hour))
+	if s := b.open(c); !slices.Equal(s.Facts, []string{"uses vim"}) {
+		t.Fatalf("resumed with facts %q", s.Facts)
+	}
+}
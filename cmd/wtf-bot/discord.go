@@ -0,0 +1,203 @@
+package main
+
+// discord.go — Discord transport as an Interactions endpoint: Discord POSTs
+// slash commands to an HTTPS URL set in the developer portal, the bot
+// acknowledges within the 3s window with a deferred response, then fills in
+// (and keeps editing) the original response through the interaction webhook.
+// This needs no gateway websocket, only a public URL in front of -discord-addr.
+//
+// Commands: /ask question:<text>, /persona [name:<text>], /reset, /help.
+// With -discord-bot-token they are registered at startup.
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const discordMax = 2000
+
+// Discord interaction and response types.
+const (
+	dcPing            = 1
+	dcCommand         = 2
+	dcPong            = 1
+	dcDeferredMessage = 5
+)
+
+// Discord serves the interactions endpoint of one application.
+type Discord struct {
+	AppID     string
+	PublicKey ed25519.PublicKey // from the developer portal, verifies every request
+	BotToken  string            // optional: register the slash commands on Run
+	Addr      string            // listen address, e.g. ":8080"
+	API       string            // default https://discord.com/api/v10
+	Client    *http.Client
+}
+
+func (d *Discord) Name() string { return "discord" }
+
+var discordCommands = json.RawMessage(`[
+	{"name":"ask","description":"ask the oracle","options":[{"type":3,"name":"question","description":"your question","required":true}]},
+	{"name":"persona","description":"list or switch personas","options":[{"type":3,"name":"name","description":"persona to switch to"}]},
+	{"name":"reset","description":"make the oracle forget this channel"},
+	{"name":"help","description":"what the oracle does"}
+]`)
+
+type dcInteraction struct {
+	Type      int    `json:"type"`
+	Token     string `json:"token"`
+	ChannelID string `json:"channel_id"`
+	Data      struct {
+		Name    string `json:"name"`
+		Options []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"options"`
+	} `json:"data"`
+	Member *struct {
+		User dcUser `json:"user"`
+	} `json:"member"`
+	User *dcUser `json:"user"` // set instead of member in DMs
+}
+
+type dcUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+// Run serves the endpoint until ctx is done.
+func (d *Discord) Run(ctx context.Context, h Handler) error {
+	if d.BotToken != "" {
+		if err := d.do(ctx, http.MethodPut, "/applications/"+d.AppID+"/commands", discordCommands, "Bot "+d.BotToken); err != nil {
+			return fmt.Errorf("registering commands: %w", err)
+		}
+	}
+	srv := &http.Server{
+		Addr:              d.Addr,
+		Handler:           d.endpoint(ctx, h),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	fmt.Fprintf(os.Stderr, "[wtf-bot] discord interactions on %s\n", d.Addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return ctx.Err()
+}
+
+func (d *Discord) endpoint(ctx context.Context, h Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Discord probes the endpoint with bad signatures and expects 401.
+		sig, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+		ts := r.Header.Get("X-Signature-Timestamp")
+		if err != nil || !ed25519.Verify(d.PublicKey, append([]byte(ts), body...), sig) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		var it dcInteraction
+		if err := json.Unmarshal(body, &it); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch it.Type {
+		case dcPing:
+			fmt.Fprintf(w, `{"type":%d}`, dcPong)
+		case dcCommand:
+			fmt.Fprintf(w, `{"type":%d}`, dcDeferredMessage)
+			in := Incoming{Chat: "dc:" + it.ChannelID, Text: it.text()}
+			if it.Member != nil {
+				in.User = it.Member.User.Username
+			} else if it.User != nil {
+				in.User = it.User.Username
+			}
+			go h(ctx, in, &dcReply{d: d, token: it.Token})
+		default:
+			http.Error(w, "unsupported interaction", http.StatusBadRequest)
+		}
+	})
+}
+
+// text maps a slash command onto the message the bot core understands.
+func (it *dcInteraction) text() string {
+	arg := ""
+	if len(it.Data.Options) > 0 {
+		arg = it.Data.Options[0].Value
+	}
+	if it.Data.Name == "ask" {
+		return arg
+	}
+	return "/" + it.Data.Name + " " + arg
+}
+
+// dcReply edits the deferred response in place.
+type dcReply struct {
+	d     *Discord
+	token string
+	text  string
+}
+
+func (r *dcReply) Update(text string, final bool) error {
+	text = clip(text, discordMax)
+	if text == r.text {
+		return nil
+	}
+	r.text = text
+	blob, err := json.Marshal(map[string]string{"content": text})
+	if err != nil {
+		return err
+	}
+	return r.d.do(context.Background(), http.MethodPatch, "/webhooks/"+r.d.AppID+"/"+r.token+"/messages/@original", blob, "")
+}
+
+// do sends one REST request; auth is the Authorization header, if any.
+func (d *Discord) do(ctx context.Context, method, path string, body []byte, auth string) error {
+	api := d.API
+	if api == "" {
+		api = "https://discord.com/api/v10"
+	}
+	client := d.Client
+	if client == nil {
+		client = &http.Client{Timeout: 15 * time.Second}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, api+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err // webhook URLs carry the interaction token
+		}
+		return fmt.Errorf("discord %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("discord %s: %s: %s", method, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
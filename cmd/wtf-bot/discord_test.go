@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiscordSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan Incoming, 1)
+	d := &Discord{PublicKey: pub}
+	h := d.endpoint(context.Background(), func(_ context.Context, in Incoming, _ Replier) {
+		got <- in
+	})
+	post := func(body, ts string, sig []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set("X-Signature-Timestamp", ts)
+		if sig != nil {
+			r.Header.Set("X-Signature-Ed25519", hex.EncodeToString(sig))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	sign := func(ts, body string) []byte { return ed25519.Sign(priv, []byte(ts+body)) }
+
+	ping := `{"type":1}`
+	if w := post(ping, "1700000000", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned: %d, want 401", w.Code)
+	}
+	if w := post(ping, "1700000001", sign("1700000000", ping)); w.Code != http.StatusUnauthorized {
+		t.Errorf("other timestamp: %d, want 401", w.Code)
+	}
+	if w := post(`{"type":2}`, "1700000000", sign("1700000000", ping)); w.Code != http.StatusUnauthorized {
+		t.Errorf("other body: %d, want 401", w.Code)
+	}
+	_, other, _ := ed25519.GenerateKey(nil)
+	if w := post(ping, "1700000000", ed25519.Sign(other, []byte("1700000000"+ping))); w.Code != http.StatusUnauthorized {
+		t.Errorf("other key: %d, want 401", w.Code)
+	}
+	if w := post(ping, "1700000000", sign("1700000000", ping)); w.Code != http.StatusOK || w.Body.String() != `{"type":1}` {
+		t.Errorf("ping: %d %s", w.Code, w.Body)
+	}
+
+	cmd := `{"type":2,"token":"tok","channel_id":"42","data":{"name":"persona","options":[{"name":"name","value":"troll"}]},"member":{"user":{"id":"7","username":"kim"}}}`
+	w := post(cmd, "1700000000", sign("1700000000", cmd))
+	if w.Code != http.StatusOK || w.Body.String() != `{"type":5}` {
+		t.Fatalf("command: %d %s", w.Code, w.Body)
+	}
+	select {
+	case in := <-got:
+		if want := (Incoming{Chat: "dc:42", User: "kim", Text: "/persona troll"}); in != want {
+			t.Errorf("handler got %+v, want %+v", in, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called")
+	}
+	select {
+	case in := <-got:
+		t.Errorf("handler called for a rejected request: %+v", in)
+	default:
+	}
+}
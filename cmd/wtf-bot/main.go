@@ -0,0 +1,197 @@
+package main
+
+// wtf-bot — the oracle in group chats. One process, one resident model, any
+// number of transports (see bot.go for the interface): each chat gets its
+// own conversation, its own persona and its own rate limit.
+//
+//	TELEGRAM_BOT_TOKEN=123:abc wtf-bot
+//	DISCORD_PUBLIC_KEY=... wtf-bot -discord-app-id 1234 -discord-addr :8080
+//
+// Tokens are read from the environment so they stay out of ps output.
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"wtforacle/wtf"
+)
+
+func main() {
+	weightsFlag := flag.String("weights", "", "path to GGUF weights (default: ./wtfweights/wtf360_v2_q4_0.gguf)")
+	configPath := flag.String("config", "", "JSON config with engine defaults (see wtf/config.go); WTF_* variables override it")
+	persona := flag.String("persona", wtf.OraclePersona, "persona new chats start with (\"\" = raw)")
+	rate := flag.Float64("rate", 6, "replies per minute per chat (0 = unlimited)")
+	burst := flag.Int("burst", 3, "replies a chat may send back to back before -rate applies")
+	idle := flag.Duration("idle", time.Hour, "forget chats idle this long (0 = never)")
+	cache := flag.Int("cache", 0, "answer repeated first messages from a cache of this many replies (0 = config / WTF_CACHE_*)")
+	cacheTTL := flag.Duration("cache-ttl", 10*time.Minute, "how long a -cache reply is reused")
+	dbPath := flag.String("db", "", "SQLite file keeping every chat's conversation and transcript across restarts")
+	discordApp := flag.String("discord-app-id", "", "Discord application id; enables the Discord transport (needs DISCORD_PUBLIC_KEY)")
+	discordAddr := flag.String("discord-addr", ":8080", "listen address of the Discord interactions endpoint")
+	flag.Parse()
+
+	var transports []Transport
+	if tok := os.Getenv("TELEGRAM_BOT_TOKEN"); tok != "" {
+		transports = append(transports, &Telegram{Token: tok})
+	}
+	if *discordApp != "" {
+		key, err := hex.DecodeString(os.Getenv("DISCORD_PUBLIC_KEY"))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			fmt.Fprintf(os.Stderr, "[wtf-bot] DISCORD_PUBLIC_KEY: want the application's hex public key\n")
+			os.Exit(1)
+		}
+		transports = append(transports, &Discord{
+			AppID:     *discordApp,
+			PublicKey: key,
+			BotToken:  os.Getenv("DISCORD_BOT_TOKEN"), // optional, registers the commands
+			Addr:      *discordAddr,
+		})
+	}
+	if len(transports) == 0 {
+		fmt.Fprintf(os.Stderr, "[wtf-bot] no transport: set TELEGRAM_BOT_TOKEN and/or -discord-app-id\n")
+		os.Exit(2)
+	}
+
+	cfg := wtf.NewConfig()
+	if *configPath != "" {
+		if err := cfg.Load(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf-bot] -config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := cfg.LoadEnv(os.Environ()); err != nil {
+		fmt.Fprintf(os.Stderr, "[wtf-bot] %v\n", err)
+		os.Exit(1)
+	}
+
+	weights := *weightsFlag
+	if weights == "" {
+		exe, _ := os.Executable()
+		weights = filepath.Join(filepath.Dir(exe), "wtfweights", "wtf360_v2_q4_0.gguf")
+		if _, err := os.Stat(weights); err != nil {
+			weights = "wtfweights/wtf360_v2_q4_0.gguf"
+		}
+	}
+	gguf, model, err := loadModel(weights, cfg.Model)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[wtf-bot] %v\n", err)
+		os.Exit(1)
+	}
+	if *cache > 0 {
+		// Chats run with random seeds; a repeat getting the first reply
+		// again is the point.
+		cfg.Cache.Size, cfg.Cache.TTL, cfg.Cache.Policy = *cache, *cacheTTL, wtf.CacheAll
+	}
+	e := wtf.NewEngine(model, wtf.NewTokenizer(&gguf.Meta))
+	if cfg.IdleUnload > 0 {
+		e.Idle = wtf.IdlePolicy{After: cfg.IdleUnload, Load: func() (*wtf.LlamaModel, error) {
+			_, m, err := loadModel(weights, cfg.Model)
+			return m, err
+		}}
+	}
+	if err := e.RegisterOracle(); err == nil {
+		err = cfg.Apply(e)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[wtf-bot] %v\n", err)
+		os.Exit(1)
+	}
+
+	opts := cfg.Options()
+	// Strangers type into these chats: chat markers in their messages are
+	// stripped at the least, whatever the config says.
+	opts.Injection = max(opts.Injection, wtf.InjectionStrip)
+	if cfg.Warmup > 0 {
+		rep, err := e.Warmup(opts, cfg.Warmup)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf-bot] warmup: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "[wtf-bot] warmup: %d passes, %d personas in %s\n", rep.Passes, rep.Personas, rep.Took.Round(time.Millisecond))
+	}
+	b := &Bot{Engine: e, Opts: opts, Persona: *persona, Summarize: cfg.Summarize, RatePerMinute: *rate, Burst: *burst, Idle: *idle}
+	if *dbPath != "" {
+		db, err := wtf.OpenSessionDB(*dbPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf-bot] -db: %v\n", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		b.DB = db
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		t := time.NewTicker(time.Minute)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				b.Sweep(now)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	for _, t := range transports {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fmt.Fprintf(os.Stderr, "[wtf-bot] %s up\n", t.Name())
+			if err := t.Run(ctx, b.Handle); err != nil && !errors.Is(err, context.Canceled) {
+				fmt.Fprintf(os.Stderr, "[wtf-bot] %s: %v\n", t.Name(), err)
+				failed.Store(true)
+				stop()
+			}
+		}()
+	}
+	wg.Wait()
+	if failed.Load() {
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "[wtf-bot] shutting down\n")
+}
+
+// loadModel reads the weights and builds the model the way mc says. It
+// runs at startup and again whenever the idle policy reloads.
+func loadModel(weights string, mc wtf.ModelConfig) (*wtf.GGUFFile, *wtf.LlamaModel, error) {
+	load := wtf.LoadGGUF
+	if mc.Stream {
+		load = wtf.MapGGUF
+	}
+	gguf, err := load(weights)
+	if err == nil {
+		err = gguf.Provenance.Verify(mc.Allow)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading %s: %w", weights, err)
+	}
+	fmt.Fprintf(os.Stderr, "[wtf-bot] weights %s\n", gguf.Provenance)
+	model, err := wtf.LoadLlamaModel(gguf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading model: %w", err)
+	}
+	if mc.Int8 {
+		st, err := model.QuantizeInt8()
+		if err != nil {
+			return nil, nil, fmt.Errorf("int8: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "[wtf-bot] int8: %s\n", st)
+	}
+	return gguf, model, nil
+}
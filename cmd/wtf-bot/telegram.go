@@ -0,0 +1,181 @@
+package main
+
+// telegram.go — Telegram Bot API transport: long-polls getUpdates, answers
+// text messages with sendMessage and streams by editing that message.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// telegramMax is Telegram's message length limit, in UTF-16 units; runes
+// are a close enough stand-in for the oracle's output.
+const telegramMax = 4096
+
+// Telegram talks to the Bot API with a bot token from @BotFather.
+type Telegram struct {
+	Token  string
+	API    string // default https://api.telegram.org
+	Client *http.Client
+}
+
+func (t *Telegram) Name() string { return "telegram" }
+
+type tgUpdate struct {
+	UpdateID int        `json:"update_id"`
+	Message  *tgMessage `json:"message"`
+}
+
+type tgMessage struct {
+	MessageID int    `json:"message_id"`
+	Text      string `json:"text"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	From struct {
+		ID       int64  `json:"id"`
+		Username string `json:"username"`
+	} `json:"from"`
+}
+
+// Run polls for messages until ctx is done. Network errors are logged and
+// retried; a rejected token is fatal.
+func (t *Telegram) Run(ctx context.Context, h Handler) error {
+	offset := 0
+	for {
+		var ups []tgUpdate
+		err := t.call(ctx, "getUpdates", map[string]any{
+			"offset": offset, "timeout": 30, "allowed_updates": []string{"message"},
+		}, &ups)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var api *tgError
+		if errors.As(err, &api) && api.Code == http.StatusUnauthorized {
+			return err
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf-bot] %v\n", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		for _, u := range ups {
+			offset = u.UpdateID + 1
+			m := u.Message
+			if m == nil || m.Text == "" {
+				continue
+			}
+			in := Incoming{
+				Chat: "tg:" + strconv.FormatInt(m.Chat.ID, 10),
+				User: m.From.Username,
+				Text: m.Text,
+			}
+			go h(ctx, in, &tgReply{t: t, chat: m.Chat.ID, replyTo: m.MessageID})
+		}
+	}
+}
+
+// tgReply sends the first Update as a reply and edits it with the rest.
+type tgReply struct {
+	t       *Telegram
+	chat    int64
+	replyTo int
+	sent    int // message id, 0 until the first Update
+	text    string
+}
+
+func (r *tgReply) Update(text string, final bool) error {
+	text = clip(text, telegramMax)
+	if text == r.text {
+		return nil // Telegram rejects edits that change nothing
+	}
+	r.text = text
+	if r.sent == 0 {
+		var m tgMessage
+		err := r.t.call(context.Background(), "sendMessage", map[string]any{
+			"chat_id": r.chat, "text": text, "reply_to_message_id": r.replyTo,
+		}, &m)
+		r.sent = m.MessageID
+		return err
+	}
+	return r.t.call(context.Background(), "editMessageText", map[string]any{
+		"chat_id": r.chat, "message_id": r.sent, "text": text,
+	}, nil)
+}
+
+type tgError struct {
+	Method      string
+	Code        int
+	Description string
+}
+
+func (e *tgError) Error() string {
+	return fmt.Sprintf("telegram %s: %d %s", e.Method, e.Code, e.Description)
+}
+
+// call invokes one Bot API method and decodes its result into out.
+func (t *Telegram) call(ctx context.Context, method string, params any, out any) error {
+	api := t.API
+	if api == "" {
+		api = "https://api.telegram.org"
+	}
+	client := t.Client
+	if client == nil {
+		client = &http.Client{Timeout: 45 * time.Second} // past the 30s long poll
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api+"/bot"+t.Token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err // the URL carries the token; keep it out of logs
+		}
+		return fmt.Errorf("telegram %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	var env struct {
+		OK          bool            `json:"ok"`
+		Result      json.RawMessage `json:"result"`
+		ErrorCode   int             `json:"error_code"`
+		Description string          `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		return fmt.Errorf("telegram %s: %s: %w", method, resp.Status, err)
+	}
+	if !env.OK {
+		return &tgError{method, env.ErrorCode, env.Description}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(env.Result, out)
+}
+
+// clip cuts text to at most n runes.
+func clip(text string, n int) string {
+	r := []rune(text)
+	if len(r) <= n {
+		return text
+	}
+	return string(r[:n-1]) + "…"
+}
@@ -11,15 +11,20 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
-	"unicode"
+	"time"
 
 	"wtforacle/wtf"
 )
@@ -31,15 +36,6 @@ const banner = "" +
 	"  WTForacle v3 (SmolLM2 360M, Q4_0 → notorch sgemv)\n" +
 	"============================================================\n"
 
-const systemPrompt = "" +
-	"you are wtforacle, a cynical reddit commenter. " +
-	"you love to argue for fun, and when you argue you write more. " +
-	"if you say something helpful, always end with sarcasm. " +
-	"a weird answer is always better than a boring one. " +
-	"talk like reddit: bro, tbh, ngl, imo. " +
-	"if you apologize, do it with sarcasm. " +
-	"if someone asks for code, give the code but call them lazy."
-
 func main() {
 	weightsFlag := flag.String("weights", "", "path to GGUF weights (default: ./wtfweights/wtf360_v2_q4_0.gguf)")
 	prompt := flag.String("prompt", "", "one-shot prompt (omit to enter REPL)")
@@ -48,7 +44,134 @@ func main() {
 	topP := flag.Float64("top-p", 0.9, "top-p (nucleus) threshold")
 	rawFlag := flag.Bool("raw", false, "skip system prompt (raw mode)")
 	trollFlag := flag.Bool("troll", false, "trolling mode (3 candidates, spiciest wins)")
+	grace := flag.Int("grace", 32, "extra tokens allowed past -max to finish a sentence (0 = hard stop)")
+	fuzzyLoops := flag.Bool("fuzzy-loops", false, "also stop on near-repeated text (rolling-hash loop detector)")
+	timeout := flag.Duration("timeout", 0, "wall-clock limit per generation, e.g. 5s (0 = none)")
+	heal := flag.Bool("heal", false, "token healing: let the reply re-pick the prompt's last token boundary")
+	forcePrefix := flag.String("force-prefix", "", "text every reply must start with (teacher-forced)")
+	sinks := flag.Int("sinks", 0, "attention sinks: keep N first tokens and slide the rest so replies can outrun the context (0 = off)")
+	suffix := flag.String("suffix", "", "fill-in-the-middle: -prompt is the text before, -suffix the text after")
+	eosBias := flag.Float64("eos-bias", 0, "added to the EOS logit each step (+ shorter replies, - fewer early endings)")
+	target := flag.Int("target", 0, "soft reply length in tokens: bias EOS down before it and up after (0 = off)")
+	repPenalty := flag.Float64("rep-penalty", 1.15, "multiplicative repetition penalty (1 = off)")
+	repWindow := flag.Int("rep-window", 64, "how many recent tokens the penalties look at")
+	presence := flag.Float64("presence", 0, "presence penalty: subtracted once from tokens already in the window")
+	frequency := flag.Float64("frequency", 0, "frequency penalty: subtracted per occurrence in the window")
+	minP := flag.Float64("min-p", 0, "min-p: drop tokens below this fraction of the top token's probability (0 = off)")
+	nonFinite := flag.String("nonfinite", "", "when a forward pass yields NaN/Inf logits: abort (default) or retry (recompute the KV cache once)")
+	watchdog := flag.Int("watchdog", 0, "regenerate looping or blank replies up to N times, tightening min-p each time")
+	style := flag.Int("style", -1, "score each reply against the oracle's house style (report on stderr) and resample failing ones up to N times (-1 = off, 0 = score only)")
+	normalize := flag.Bool("normalize", false, "NFKC + smart-quote/space folding on input before tokenizing")
+	scrub := flag.Bool("scrub-pii", false, "replace emails, phone numbers and card numbers in input with placeholders before tokenizing")
+	injection := flag.String("injection", "", "user text containing special tokens or chat markers: strip | reject (default: honour them)")
+	lang := flag.String("lang", "", "keep replies in this language's script by biasing against others: auto (the question's language) or a code like en, ru, ja (report on stderr with -telemetry)")
+	multilingual := flag.Bool("multilingual", false, "multilingual mode for multilingual model variants: no -lang bias, CJK/Hindi/Arabic sentence ends, per-script sampler tuning")
+	strip := flag.String("strip", "", "keep emoji and/or markdown out of replies by masking them while sampling: emoji, markup, all, none")
+	telemetry := flag.Bool("telemetry", false, "print prompt size, time to first token and mean entropy / surprise of each reply to stderr")
+	tracePath := flag.String("trace", "", "append a JSON line per generated token (top-5, penalties, sampler, timing) to this file")
+	attnOut := flag.String("attn-map", "", "write one layer's attention weights at one step to this file (.bin = raw float32, else JSON)")
+	attnLayer := flag.Int("attn-layer", 0, "layer recorded by -attn-map")
+	attnStep := flag.Int("attn-step", 0, "reply token recorded by -attn-map (0 = the pass over the prompt's last token)")
+	safety := flag.String("safety", "", "screen replies against this lexicon file (mask = resample, redact = replace; see wtf/safety.go)")
+	safetyOff := flag.String("safety-off", "", "comma-separated lexicon categories to disable")
+	recordOut := flag.String("record", "", "write a recording of each reply (model hash, tokens, seed, sampler, RNG draws) to this JSON file")
+	selftest := flag.Bool("selftest", false, "check the model after loading (NaN/Inf weights, tokenizer round trip, a greedy reply against its stored hash), print the report and exit non-zero on failure")
+	selftestHashes := flag.String("selftest-hashes", "", "JSON file of known-good -selftest reply hashes by model fingerprint; a model not in it is added (default: the weights file with .selftest.json)")
+	replayIn := flag.String("replay", "", "replay a -record file, print the reply and exit non-zero unless it matches bit for bit")
+	saliency := flag.Bool("saliency", false, "with -prompt: after the reply, show on stderr which words of the question it came from (one extra pass per word)")
+	choose := flag.String("choose", "", "classify instead of generating: score these |-separated answers to -prompt and print the likeliest")
+	jsonMode := flag.Bool("json", false, "JSON mode: print the reply's first JSON value, repaired (closed brackets/quotes, prose stripped)")
+	runAhead := flag.Bool("run-ahead", false, "speculatively run the likeliest next token's forward pass while sampling")
+	mix := flag.String("mix", "", "ensemble: run this second GGUF (same vocabulary, e.g. the base model) on the same context and mix its logits in before sampling")
+	mixWeight := flag.Float64("mix-weight", 0.2, "share of the -mix model in the mix, 0..1")
+	mixMode := flag.String("mix-mode", "product", "how -mix combines the models: product (weighted log-probabilities) or sum (weighted probabilities)")
+	nice := flag.Duration("nice", 0, "background mode: pause this long after each token and drop to the lowest thread priority, e.g. 2ms (0 = off)")
+	threads := flag.Int("threads", 0, "max threads running Go code at once (0 = all cores)")
+	gcPercent := flag.Int("gc-percent", 0, "GOGC for the process: higher = fewer collections, more memory (0 = leave as started, -1 = off, needs -mem-limit)")
+	memLimit := flag.String("mem-limit", "", "GOMEMLIMIT for the process, e.g. 1536MiB: collect harder near it instead of growing past it")
+	stream := flag.Bool("stream", false, "map the weights file and keep only ~2 layers resident, paging the rest from disk (low-RAM boards; slower)")
+	quantInt8 := flag.Bool("int8", false, "requantize F16/F32 layer weights to int8 after load: half the memory, faster matmuls, slightly different replies")
+	pprofAddr := flag.String("pprof", "", "serve net/http/pprof (and runtime/trace) on this address, e.g. 127.0.0.1:6060")
+	kernels := flag.String("kernels", "", "matvec kernel variant: auto (default: the best the CPU has), generic, avx512 or neon")
+	cpus := flag.String("cpus", "", "pin the process to these CPUs, e.g. 0-3,6 (Linux)")
+	version := flag.Bool("version", false, "print version and build info as JSON and exit")
+	configPath := flag.String("config", "", "JSON config with engine defaults (sampler, filters, personas, threads); WTF_* variables override it, flags override both")
+	rpc := flag.Bool("rpc", false, "JSON-RPC 2.0 on stdin/stdout, one message per line (methods: generate, encode, embed); logs go to stderr")
+	mcp := flag.Bool("mcp", false, "serve the oracle as an MCP tool (consult_wtforacle) on stdin/stdout; logs go to stderr")
+	dumpVocab := flag.String("dump-vocab", "", "write the vocabulary (id, piece, score, type) as JSON to this path and exit")
+	batchIn := flag.String("batch", "", "batch mode: answer every JSONL line of this file (- = stdin), write JSONL results and exit (see wtf/batch.go)")
+	batchOut := flag.String("batch-out", "", "where -batch writes its results (default stdout)")
+	concurrency := flag.Int("concurrency", 1, "parallel generations in -batch mode (each adds a KV cache; weights are shared)")
+	evalPath := flag.String("eval", "", "perplexity of a corpus (.jsonl with {\"id\",\"text\"} per line, else one document): JSON line per document, then the total")
+	evalWindow := flag.Int("eval-window", 0, "tokens per -eval window (0 = the model's context)")
+	evalStride := flag.Int("eval-stride", 0, "tokens the -eval window advances (0 = half the window)")
+	experimentPath := flag.String("experiment", "", "A/B test sampler settings: route each reply to an arm of this JSON experiment (see wtf/experiment.go); /rate N and /ab in the REPL")
+	experimentLog := flag.String("experiment-log", "", "where -experiment appends its JSONL outcomes (default: the experiment file with .log.jsonl)")
+	experimentReport := flag.String("experiment-report", "", "summarise an -experiment log per arm and exit")
 	flag.Parse()
+	if *version {
+		fmt.Println(wtf.VersionJSON())
+		return
+	}
+	if *experimentReport != "" {
+		os.Exit(reportExperiment(*experimentReport))
+	}
+	rpcOut := os.Stdout
+	if *rpc || *mcp || *evalPath != "" || (*batchIn != "" && *batchOut == "") {
+		os.Stdout = os.Stderr // the loaders log with Printf; keep stdout for the protocol
+	}
+
+	// Settings layer up: the CLI's defaults, then -config, then WTF_*
+	// variables, then flags given on the command line.
+	cfg := wtf.NewConfig()
+	cfg.Gen.Watchdog.MinTokens = 16
+	if *configPath != "" {
+		if err := cfg.Load(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] -config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := cfg.LoadEnv(os.Environ()); err != nil {
+		fmt.Fprintf(os.Stderr, "[wtf] %v\n", err)
+		os.Exit(1)
+	}
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if !set["threads"] {
+		*threads = cfg.Threads
+	}
+	if !set["cpus"] {
+		*cpus = cfg.CPUs
+	}
+	if set["kernels"] {
+		cfg.Kernels = *kernels
+	}
+	if set["pprof"] {
+		cfg.PProf = *pprofAddr
+	}
+	if set["gc-percent"] {
+		cfg.GC.Percent = *gcPercent
+	}
+	if set["mem-limit"] {
+		cfg.GC.MemoryLimit = *memLimit
+	}
+	if _, err := wtf.SetGC(cfg.GC); err != nil {
+		fmt.Fprintf(os.Stderr, "[wtf] gc: %v\n", err)
+		os.Exit(1)
+	}
+	cfg.Threads, cfg.CPUs, cfg.GC = 0, "", wtf.GCConfig{} // applied here, before the model loads
+	wtf.SetThreads(*threads)
+	if *cpus != "" {
+		list, err := wtf.ParseCPUList(*cpus)
+		if err == nil {
+			err = wtf.SetThreadAffinity(list)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] -cpus: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	weights := *weightsFlag
 	if weights == "" {
@@ -59,160 +182,530 @@ func main() {
 		}
 	}
 
-	model, tokenizer := loadModel(weights)
+	if set["int8"] {
+		cfg.Model.Int8 = *quantInt8
+	}
+	if set["stream"] {
+		cfg.Model.Stream = *stream
+	}
+	model, tokenizer := loadModel(weights, cfg.Model)
+	if *dumpVocab != "" {
+		writeVocab(tokenizer, *dumpVocab)
+		return
+	}
+	engine := newEngine(model, tokenizer)
+	if err := cfg.Apply(engine); err != nil {
+		fmt.Fprintf(os.Stderr, "[wtf] -config: %v\n", err)
+		os.Exit(1)
+	}
+	if *replayIn != "" {
+		replay(engine, *replayIn)
+		return
+	}
+	if *selftest {
+		path := *selftestHashes
+		if path == "" {
+			path = strings.TrimSuffix(weights, filepath.Ext(weights)) + ".selftest.json"
+		}
+		os.Exit(selfTest(engine, path))
+	}
+
+	opts := cfg.Options()
+	if set["max"] {
+		opts.MaxTokens = *maxTokens
+	}
+	if set["temp"] {
+		opts.Temp = float32(*temp)
+	}
+	if set["top-p"] {
+		opts.TopP = float32(*topP)
+	}
+	if set["grace"] {
+		opts.Grace.Limit = *grace
+	}
+	if set["fuzzy-loops"] {
+		opts.Cycle.Fuzzy = *fuzzyLoops
+	}
+	if set["timeout"] {
+		opts.MaxTime = *timeout
+	}
+	if set["heal"] {
+		opts.TokenHealing = *heal
+	}
+	if set["force-prefix"] {
+		opts.ForcePrefix = *forcePrefix
+	}
+	if set["sinks"] {
+		opts.Sinks = *sinks
+	}
+	if set["telemetry"] {
+		opts.Telemetry = *telemetry
+	}
+	if set["normalize"] {
+		opts.Normalize = 0
+		if *normalize {
+			opts.Normalize = wtf.NormNFKC | wtf.NormFold
+		}
+	}
+	if set["scrub-pii"] {
+		opts.ScrubPII = 0
+		if *scrub {
+			opts.ScrubPII = wtf.PIIAll
+		}
+	}
+	if set["injection"] {
+		p, err := wtf.ParseInjectionPolicy(*injection)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] -injection: %v\n", err)
+			os.Exit(1)
+		}
+		opts.Injection = p
+	}
+	if set["lang"] {
+		lt, err := wtf.ParseLanguageTarget(*lang)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] -lang: %v\n", err)
+			os.Exit(1)
+		}
+		opts.Language = lt
+	}
+	if set["multilingual"] {
+		opts.Multilingual = nil
+		if *multilingual {
+			opts.Multilingual = &wtf.MultilingualMode{}
+		}
+	}
+	if set["strip"] {
+		k, err := wtf.ParseStripKind(*strip)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] -strip: %v\n", err)
+			os.Exit(1)
+		}
+		opts.Strip = k
+	}
+	if set["nonfinite"] {
+		p, err := wtf.ParseNonFinitePolicy(*nonFinite)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] -nonfinite: %v\n", err)
+			os.Exit(1)
+		}
+		opts.NonFinite = p
+	}
+	if set["min-p"] {
+		opts.MinP = float32(*minP)
+	}
+	if set["rep-penalty"] {
+		opts.RepPenalty = float32(*repPenalty)
+	}
+	if set["rep-window"] {
+		opts.RepWindow = *repWindow
+	}
+	if set["presence"] {
+		opts.PresencePenalty = float32(*presence)
+	}
+	if set["frequency"] {
+		opts.FrequencyPenalty = float32(*frequency)
+	}
+	if set["target"] {
+		opts.Length.Tokens = *target
+	}
+	if set["eos-bias"] {
+		opts.EOSBias = float32(*eosBias)
+	}
+	if set["watchdog"] {
+		opts.Watchdog.Retries = *watchdog
+	}
+	if *style >= 0 {
+		opts.Style = &wtf.StyleGate{Retries: *style}
+	}
+	if set["nice"] {
+		opts.Nice = *nice
+	}
+	if set["run-ahead"] {
+		opts.RunAhead = *runAhead
+	}
+	if set["json"] {
+		opts.JSON = *jsonMode
+	}
+	if *tracePath != "" {
+		f, err := os.OpenFile(*tracePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] -trace: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		opts.Trace = wtf.TraceJSON(f)
+	}
+	var out outputs
+	if *attnOut != "" {
+		opts.AttentionMap = &wtf.AttentionProbe{Layer: *attnLayer, Step: *attnStep}
+		out.attnMap = *attnOut
+	}
+	if *safety != "" {
+		sf, err := wtf.LoadSafetyLexicon(*safety)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] -safety: %v\n", err)
+			os.Exit(1)
+		}
+		opts.Safety = sf
+	}
+	if *safetyOff != "" && opts.Safety != nil {
+		opts.Safety = opts.Safety.Disable(strings.Split(*safetyOff, ",")...)
+	}
+	if *recordOut != "" {
+		opts.Record = true
+		out.recording = *recordOut
+	}
+	if *mix != "" {
+		mode, err := wtf.ParseEnsembleMode(*mixMode)
+		if err == nil {
+			second, secondTok := loadModel(*mix, cfg.Model)
+			opts.Ensemble, err = wtf.NewEnsemble(engine, second, secondTok, float32(*mixWeight), mode)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] -mix: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *rpc || *mcp {
+		srv := &wtf.Server{Engine: engine, Defaults: opts}
+		var wh *wtf.Webhook
+		if len(cfg.Webhook.URLs) > 0 {
+			wh = wtf.NewWebhook(cfg.Webhook)
+			srv.OnResult = wh.OnResult
+		}
+		serve := srv.ServeJSONRPC
+		if *mcp {
+			serve = srv.ServeMCP
+		}
+		err := serve(os.Stdin, rpcOut)
+		if wh != nil {
+			wh.Close() // deliver what is queued before exiting
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *evalPath != "" {
+		docs, err := wtf.ReadCorpus(*evalPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] -eval: %v\n", err)
+			os.Exit(1)
+		}
+		enc := json.NewEncoder(rpcOut)
+		total, err := engine.EvalCorpus(docs, wtf.PerplexityOptions{Window: *evalWindow, Stride: *evalStride},
+			func(d wtf.DocPerplexity) { enc.Encode(d) })
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] -eval: %v\n", err)
+			os.Exit(1)
+		}
+		total.ID = "total"
+		enc.Encode(total)
+		return
+	}
+	if *batchIn != "" {
+		os.Exit(runBatch(engine, *batchIn, *batchOut, rpcOut, wtf.BatchConfig{
+			Defaults: opts, Persona: personaFor(!*rawFlag), Concurrency: *concurrency,
+		}, cfg.Webhook))
+	}
+
+	if *experimentPath != "" {
+		f, err := openExperiment(*experimentPath, *experimentLog)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] -experiment: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+	}
 
 	// One-shot mode: explicit -prompt only. Stdin is REPL by default so that
 	// piped multi-line scripts like `printf '/stats\n/quit\n' | wtforacle`
 	// behave the same as typing into a TTY.
+	if *prompt != "" && *suffix != "" {
+		res, err := engine.Infill(*prompt, *suffix, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "infill: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(res.Text)
+		return
+	}
+	if *prompt != "" && *choose != "" {
+		options := strings.Split(*choose, "|")
+		for i, o := range options {
+			options[i] = " " + strings.TrimSpace(o)
+		}
+		c, err := engine.Choose(personaFor(!*rawFlag), wtf.QuestionPrompt(*prompt), options)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "choose: %v\n", err)
+			os.Exit(1)
+		}
+		for i, o := range options {
+			fmt.Fprintf(os.Stderr, "[wtf] %-20q %.3f\n", strings.TrimSpace(o), c.Probs[i])
+		}
+		fmt.Println(strings.TrimSpace(c.Option))
+		return
+	}
 	if *prompt != "" {
-		out := generateOnce(model, tokenizer, *prompt, *maxTokens, float32(*temp), float32(*topP),
-			!*rawFlag, *trollFlag)
-		fmt.Println(out)
+		reply := generateOnce(engine, *prompt, opts, out, !*rawFlag, *trollFlag)
+		fmt.Println(reply)
+		if *saliency {
+			explain(engine, *prompt, reply, opts, !*rawFlag)
+		}
 		return
 	}
 
-	repl(model, tokenizer, *maxTokens, *temp, *topP)
+	repl(engine, opts, out)
+}
+
+// explain prints -saliency: each word of the question with a bar for its
+// share of the reply.
+func explain(e *wtf.Engine, question, reply string, opts wtf.GenOptions, useSystem bool) {
+	question = wtf.ScrubPII(wtf.Normalize(question, opts.Normalize), opts.ScrubPII)
+	sal, err := e.Saliency(personaFor(useSystem), question, reply, wtf.SaliencyOptions{Wrap: wtf.QuestionPrompt})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[wtf] saliency: %v\n", err)
+		return
+	}
+	for _, sp := range sal.Spans {
+		fmt.Fprintf(os.Stderr, "[wtf] %-20q %5.1f%% %s\n", sp.Text, 100*sp.Weight, strings.Repeat("█", int(sp.Weight*40+0.5)))
+	}
 }
 
-func loadModel(path string) (*wtf.LlamaModel, *wtf.Tokenizer) {
+func loadModel(path string, mc wtf.ModelConfig) (*wtf.LlamaModel, *wtf.Tokenizer) {
 	fmt.Fprintf(os.Stderr, "[wtf] loading %s\n", path)
-	gguf, err := wtf.LoadGGUF(path)
+	load := wtf.LoadGGUF
+	if mc.Stream {
+		load = wtf.MapGGUF
+	}
+	gguf, err := load(path)
+	if err == nil {
+		err = gguf.Provenance.Verify(mc.Allow)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error loading GGUF: %v\n", err)
 		os.Exit(1)
 	}
+	fmt.Fprintf(os.Stderr, "[wtf] weights %s\n", gguf.Provenance)
 	model, err := wtf.LoadLlamaModel(gguf)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error loading model: %v\n", err)
 		os.Exit(1)
 	}
+	if mc.Int8 {
+		st, err := model.QuantizeInt8()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error quantizing to int8: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "[wtf] int8: %s\n", st)
+	}
 	tok := wtf.NewTokenizer(&gguf.Meta)
 	fmt.Fprintf(os.Stderr, "[wtf] ready: %d layers, %d dim, %d vocab\n",
 		model.Config.NumLayers, model.Config.EmbedDim, model.Config.VocabSize)
 	return model, tok
 }
 
-// ─────────────────────────────────────────────────────────────────────────────
-// Generation — single call
-
-func buildPrompt(text string, useSystem bool) string {
-	if useSystem {
-		return systemPrompt + "\n### Question: " + text + "\n### Answer:"
+// writeVocab dumps the vocabulary JSON to path. Not stdout: the loader
+// already logs there.
+func writeVocab(tok *wtf.Tokenizer, path string) {
+	f, err := os.Create(path)
+	if err == nil {
+		err = tok.WriteVocabJSON(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dump-vocab: %v\n", err)
+		os.Exit(1)
 	}
-	return "### Question: " + text + "\n### Answer:"
 }
 
-func generateOnce(model *wtf.LlamaModel, tok *wtf.Tokenizer, userPrompt string,
-	maxTokens int, temp, topP float32, useSystem, troll bool) string {
-
-	if troll {
-		text, _, _ := generateTroll(model, tok, userPrompt, maxTokens, useSystem)
-		return text
+func writeAttention(a *wtf.AttentionMap, path string) {
+	f, err := os.Create(path)
+	if err == nil {
+		if strings.HasSuffix(path, ".bin") {
+			err = a.WriteBinary(f)
+		} else {
+			err = json.NewEncoder(f).Encode(a)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
 	}
-	full := buildPrompt(userPrompt, useSystem)
-	return generate(model, tok, full, maxTokens, temp, topP)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "attn-map: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[wtf] attention of layer %d at step %d -> %s\n", a.Layer, a.Step, path)
 }
 
-// generate runs one decode pass starting from `prompt`, returning the
-// generated text. Reuses sampling buffers across tokens.
-func generate(model *wtf.LlamaModel, tok *wtf.Tokenizer, prompt string,
-	maxTokens int, temp, topP float32) string {
-
-	model.Reset()
-	repPenalty := float32(1.15)
-	repWindow := 64
+func writeRecording(rec *wtf.Recording, path string) {
+	blob, err := json.Marshal(rec)
+	if err == nil {
+		err = os.WriteFile(path, blob, 0o644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "record: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[wtf] recording (seed %d, %d draws) -> %s\n", rec.Opts.Seed, len(rec.Draws), path)
+}
 
-	var allTokens []int
-	if tok.BosID >= 0 && tok.BosID != tok.EosID {
-		allTokens = append(allTokens, tok.BosID)
+func replay(e *wtf.Engine, path string) {
+	blob, err := os.ReadFile(path)
+	var rec wtf.Recording
+	if err == nil {
+		err = json.Unmarshal(blob, &rec)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		os.Exit(1)
+	}
+	res, err := e.Replay(&rec)
+	fmt.Println(res.Text)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		os.Exit(1)
 	}
-	allTokens = append(allTokens, tok.Encode(prompt, false)...)
+	fmt.Fprintf(os.Stderr, "[wtf] replay matches: %d tokens\n", len(res.Tokens))
+}
 
-	pos := 0
-	for _, t := range allTokens {
-		model.Forward(t, pos)
-		pos++
-		if pos >= model.Config.SeqLen-1 {
-			break
+// selfTest runs the engine's self-test against the reply hash stored for
+// the model in path, records the hash of a passing model that has none, and
+// returns the exit code.
+func selfTest(e *wtf.Engine, path string) int {
+	hashes := map[string]string{}
+	blob, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(blob, &hashes)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "selftest: %v\n", err)
+		return 1
+	}
+	fp := e.Model.Fingerprint()
+	r := e.SelfTest(wtf.SelfTestOptions{Golden: hashes[fp]})
+	for _, c := range r.Checks {
+		mark := "ok  "
+		if !c.OK {
+			mark = "FAIL"
 		}
+		fmt.Fprintf(os.Stderr, "[wtf] selftest %s %-10s %s\n", mark, c.Name, c.Detail)
 	}
+	if !r.OK {
+		fmt.Fprintf(os.Stderr, "[wtf] selftest failed: model %s is corrupt or not the one it was recorded as — re-download the weights\n", fp[:12])
+		return 1
+	}
+	if hashes[fp] == "" {
+		hashes[fp] = r.ReplyHash
+		blob, _ := json.MarshalIndent(hashes, "", "  ")
+		if err := os.WriteFile(path, append(blob, '\n'), 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "selftest: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "[wtf] selftest: recorded reply hash for model %s in %s\n", fp[:12], path)
+	}
+	fmt.Fprintf(os.Stderr, "[wtf] selftest passed: model %s\n", fp[:12])
+	return 0
+}
 
-	sb := wtf.NewSampleBuffers(model.Config.VocabSize)
-	vocab := model.Config.VocabSize
+// ─────────────────────────────────────────────────────────────────────────────
+// Generation — single call
 
-	var out []byte
-	graceLimit := 32
-	inGrace := false
-	recent := make([]int, 0, repWindow)
-	counts := make(map[int]int, 64)
+// outputs says where generate writes what a reply recorded; "" skips it.
+type outputs struct {
+	attnMap   string // -attn-map: the recorded attention weights
+	recording string // -record: each reply's Recording
+}
 
-	for i := 0; i < maxTokens+graceLimit; i++ {
-		if i >= maxTokens && !inGrace {
-			inGrace = true
-		}
-		if inGrace && len(out) > 0 {
-			last := out[len(out)-1]
-			if last == '.' || last == '!' || last == '?' || last == '\n' {
-				break
-			}
-		}
+// experiment, when -experiment is set, picks the sampler arm of each reply;
+// lastOutcome is the reply /rate scores.
+var (
+	experiment  *wtf.Experiment
+	lastOutcome *wtf.Outcome
+)
 
-		// Repetition penalty (presence-based, sliding window)
-		for _, t := range recent {
-			lg := model.State.Logits[t]
-			if lg > 0 {
-				model.State.Logits[t] = lg / repPenalty
-			} else {
-				model.State.Logits[t] = lg * repPenalty
-			}
-		}
+func newEngine(model *wtf.LlamaModel, tok *wtf.Tokenizer) *wtf.Engine {
+	e := wtf.NewEngine(model, tok)
+	if err := e.RegisterOracle(); err != nil {
+		fmt.Fprintf(os.Stderr, "error registering persona: %v\n", err)
+		os.Exit(1)
+	}
+	return e
+}
 
-		var next int
-		if topP < 1.0 {
-			next = wtf.SampleTopP(model.State.Logits, vocab, temp, topP, sb)
-		} else {
-			next = wtf.SampleTopK(model.State.Logits, vocab, temp, 50, sb)
-		}
+// personaFor maps the /raw toggle onto a persona name ("" = no anchor).
+func personaFor(useSystem bool) string {
+	if useSystem {
+		return wtf.OraclePersona
+	}
+	return ""
+}
 
-		counts[next]++
-		recent = append(recent, next)
-		if len(recent) > repWindow {
-			leaving := recent[0]
-			counts[leaving]--
-			if counts[leaving] <= 0 {
-				delete(counts, leaving)
-			}
-			recent = recent[1:]
-		}
+func generateOnce(e *wtf.Engine, userPrompt string, opts wtf.GenOptions, out outputs, useSystem, troll bool) string {
+	if troll {
+		text, _, _ := generateTroll(e, userPrompt, opts, out, useSystem)
+		return text
+	}
+	return generate(e, userPrompt, opts, out, useSystem)
+}
 
-		if next == tok.EosID {
-			break
+// generate runs one decode pass for `userPrompt` under the anchor (or raw).
+func generate(e *wtf.Engine, userPrompt string, opts wtf.GenOptions, out outputs, useSystem bool) string {
+	var (
+		res wtf.Result
+		err error
+	)
+	if opts.RoleHeaders == nil {
+		opts.RoleHeaders = wtf.ChatHeaders(wtf.ChatQA) // the prompt is a QuestionPrompt turn
+	}
+	if experiment != nil {
+		var outcome wtf.Outcome
+		res, outcome, err = experiment.Generate(e, personaFor(useSystem), wtf.QuestionPrompt(userPrompt), opts, "")
+		lastOutcome = &outcome
+	} else {
+		res, err = e.Generate(personaFor(useSystem), wtf.QuestionPrompt(userPrompt), opts)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "generate: %v\n", err)
+	}
+	if res.Finish == wtf.FinishTimeout {
+		fmt.Fprintf(os.Stderr, "[wtf] timed out after %v, reply is partial\n", opts.MaxTime)
+	}
+	if opts.Telemetry {
+		fmt.Fprintf(os.Stderr, "[wtf] prompt %d tokens, ttft %v, %d tokens, entropy %.2f nats, surprise %.2f nats\n",
+			res.PromptTokens, res.TTFT.Round(time.Millisecond), len(res.Tokens), res.MeanEntropy(), res.MeanSurprise())
+		if res.Language != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] reply language %q (%s, %.0f%%)\n", res.Language.Code, res.Language.Script, 100*res.Language.Confidence)
 		}
-
-		// Cycle detection: last 8 tokens match the 8 before that
-		if len(recent) >= 16 {
-			n := len(recent)
-			cycle := true
-			for k := 0; k < 8; k++ {
-				if recent[n-1-k] != recent[n-9-k] {
-					cycle = false
-					break
-				}
-			}
-			if cycle {
-				break
-			}
+	}
+	if res.Style != nil {
+		verdict := "pass"
+		if !res.Style.Pass {
+			verdict = "FAIL: " + strings.Join(res.Style.Failures, "; ")
 		}
-
-		out = append(out, tok.DecodeToken(next)...)
-		model.Forward(next, pos)
-		pos++
-		if pos >= model.Config.SeqLen {
-			break
+		fmt.Fprintf(os.Stderr, "[wtf] style %s (snark %.1f, %d sentences, mean %.1f words, %d retries)\n",
+			verdict, res.Style.Snark, res.Style.Sentences, res.Style.MeanSentence, res.Retries)
+	}
+	if res.Attention != nil && out.attnMap != "" {
+		writeAttention(res.Attention, out.attnMap)
+	}
+	if res.Recording != nil && out.recording != "" {
+		writeRecording(res.Recording, out.recording)
+	}
+	if res.JSON != nil {
+		if !res.JSON.Valid {
+			fmt.Fprintf(os.Stderr, "[wtf] reply is not valid JSON even after repair\n")
 		}
+		return res.JSON.Text
 	}
-
-	return string(out)
+	return res.Text
 }
 
 // ─────────────────────────────────────────────────────────────────────────────
@@ -220,10 +713,9 @@ func generate(model *wtf.LlamaModel, tok *wtf.Tokenizer, prompt string,
 
 // generateTroll runs three decodes at temps 0.9 / 1.0 / 1.1 and returns the
 // spiciest one. Decodes serialize because the model has shared state.
-func generateTroll(model *wtf.LlamaModel, tok *wtf.Tokenizer,
-	userPrompt string, maxTokens int, useSystem bool) (string, float32, string) {
+func generateTroll(e *wtf.Engine,
+	userPrompt string, opts wtf.GenOptions, out outputs, useSystem bool) (string, float32, string) {
 
-	full := buildPrompt(userPrompt, useSystem)
 	temps := []float32{0.9, 1.0, 1.1}
 	type cand struct {
 		text  string
@@ -232,8 +724,9 @@ func generateTroll(model *wtf.LlamaModel, tok *wtf.Tokenizer,
 	}
 	cands := make([]cand, 0, len(temps))
 	for _, t := range temps {
-		text := generate(model, tok, full, maxTokens, t, 1.0)
-		cands = append(cands, cand{text: text, temp: t, score: scoreTroll(text)})
+		opts.Temp, opts.TopP = t, 1.0
+		text := generate(e, userPrompt, opts, out, useSystem)
+		cands = append(cands, cand{text: text, temp: t, score: wtf.SnarkScore(text)})
 	}
 	sort.Slice(cands, func(i, j int) bool { return cands[i].score > cands[j].score })
 
@@ -250,56 +743,11 @@ func generateTroll(model *wtf.LlamaModel, tok *wtf.Tokenizer,
 	return cands[0].text, cands[0].temp, report
 }
 
-// scoreTroll mirrors wtforacle.py:_score_response — same constants so saved
-// /troll choices stay comparable across versions.
-func scoreTroll(text string) float64 {
-	if len(strings.TrimSpace(text)) < 5 {
-		return -100
-	}
-	score := 0.0
-	words := strings.Fields(text)
-	if w := len(words); w < 80 {
-		score += float64(w) * 0.5
-	} else {
-		score += 80 * 0.5
-	}
-	lower := strings.ToLower(text)
-	for _, s := range []string{"bro", "tbh", "ngl", "imo", "lmao", "lol", "bruh",
-		"nah", "fr", "literally", "actually", "honestly",
-		"ok so", "look", "the thing is", "imagine"} {
-		score += float64(strings.Count(lower, s)) * 3
-	}
-	score += float64(strings.Count(text, "?")) * 2
-	score += float64(strings.Count(text, "!")) * 1.5
-	score += float64(strings.Count(text, "...")) * 2
-
-	alpha := 0
-	lowerAlpha := 0
-	for _, r := range text {
-		if unicode.IsLetter(r) {
-			alpha++
-			if unicode.IsLower(r) {
-				lowerAlpha++
-			}
-		}
-	}
-	if alpha > 0 && float64(lowerAlpha)/float64(alpha) > 0.9 {
-		score += 5
-	}
-	for _, b := range []string{"as an ai", "i cannot", "i apologize",
-		"how can i help", "i'd be happy to", "great question"} {
-		if strings.Contains(lower, b) {
-			score -= 20
-		}
-	}
-	return score
-}
-
 // ─────────────────────────────────────────────────────────────────────────────
 // Interactive REPL
 
-func repl(model *wtf.LlamaModel, tok *wtf.Tokenizer, defaultMax int, defaultTemp, defaultTopP float64) {
-	fmt.Println(banner)
+func repl(e *wtf.Engine, opts wtf.GenOptions, out outputs) {
+	fmt.Print(banner + "\n")
 
 	mem, err := wtf.OpenLimpha()
 	if err != nil {
@@ -314,11 +762,11 @@ func repl(model *wtf.LlamaModel, tok *wtf.Tokenizer, defaultMax int, defaultTemp
 	if mem != nil {
 		fmt.Println("Memory:   /recall QUERY, /recent, /stats")
 	}
+	if experiment != nil {
+		fmt.Printf("A/B:      /rate N (score the last reply), /ab  [experiment %q]\n", experiment.Name)
+	}
 	fmt.Println()
 
-	maxTokens := defaultMax
-	temp := float32(defaultTemp)
-	topP := float32(defaultTopP)
 	useSystem := true
 	troll := false
 
@@ -351,8 +799,8 @@ func repl(model *wtf.LlamaModel, tok *wtf.Tokenizer, defaultMax int, defaultTemp
 
 		case strings.HasPrefix(lower, "/tokens "):
 			if n, err := strconv.Atoi(strings.TrimSpace(input[8:])); err == nil {
-				maxTokens = n
-				fmt.Printf("Max tokens set to %d\n", maxTokens)
+				opts.MaxTokens = n
+				fmt.Printf("Max tokens set to %d\n", opts.MaxTokens)
 			} else {
 				fmt.Println("Usage: /tokens N")
 			}
@@ -360,8 +808,8 @@ func repl(model *wtf.LlamaModel, tok *wtf.Tokenizer, defaultMax int, defaultTemp
 
 		case strings.HasPrefix(lower, "/temp "):
 			if t, err := strconv.ParseFloat(strings.TrimSpace(input[6:]), 32); err == nil {
-				temp = float32(t)
-				fmt.Printf("Temperature set to %.2f\n", temp)
+				opts.Temp = float32(t)
+				fmt.Printf("Temperature set to %.2f\n", opts.Temp)
 			} else {
 				fmt.Println("Usage: /temp T")
 			}
@@ -414,6 +862,20 @@ func repl(model *wtf.LlamaModel, tok *wtf.Tokenizer, defaultMax int, defaultTemp
 			}
 			continue
 
+		case strings.HasPrefix(lower, "/rate ") && experiment != nil:
+			score, err := strconv.ParseFloat(strings.TrimSpace(input[6:]), 64)
+			if err != nil || lastOutcome == nil {
+				fmt.Println("Usage: /rate N, after a reply")
+				continue
+			}
+			experiment.Rate(*lastOutcome, score)
+			fmt.Printf("rated %g (arm %s)\n", score, lastOutcome.Arm)
+			continue
+
+		case lower == "/ab" && experiment != nil:
+			printArmStats(os.Stdout, experiment.Report())
+			continue
+
 		case lower == "/stats" && mem != nil:
 			s, err := mem.Stats()
 			if err != nil {
@@ -432,19 +894,18 @@ func repl(model *wtf.LlamaModel, tok *wtf.Tokenizer, defaultMax int, defaultTemp
 		fmt.Print("\nWTForacle: ")
 		var response string
 		if troll {
-			text, _, report := generateTroll(model, tok, input, maxTokens, useSystem)
+			text, _, report := generateTroll(e, input, opts, out, useSystem)
 			response = text
 			fmt.Println(strings.TrimSpace(text))
 			fmt.Printf("  [%s]\n", report)
 		} else {
-			full := buildPrompt(input, useSystem)
-			response = generate(model, tok, full, maxTokens, temp, topP)
+			response = generate(e, input, opts, out, useSystem)
 			fmt.Println(strings.TrimSpace(response))
 		}
 		fmt.Println()
 
 		if mem != nil && strings.TrimSpace(response) != "" {
-			_, _ = mem.Store(input, response, float64(temp))
+			_, _ = mem.Store(input, response, float64(opts.Temp))
 		}
 	}
 }
@@ -455,3 +916,101 @@ func trunc(s string, n int) string {
 	}
 	return s[:n]
 }
+
+// runBatch runs -batch and returns the exit status: 1 when the batch could
+// not run to the end, 2 when it did but some lines failed.
+func runBatch(e *wtf.Engine, in, out string, stdout *os.File, cfg wtf.BatchConfig, hook wtf.WebhookConfig) int {
+	r := os.Stdin
+	if in != "-" {
+		f, err := os.Open(in)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] -batch: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	w := stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] -batch-out: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if len(hook.URLs) > 0 {
+		wh := wtf.NewWebhook(hook)
+		defer wh.Close()
+		cfg.OnResult = wh.OnResult
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	bw := bufio.NewWriter(w)
+	st, err := e.RunBatch(ctx, r, bw, cfg)
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	fmt.Fprintf(os.Stderr, "[wtf] batch: %d lines, %d failed, %d tokens in %v\n",
+		st.Lines, st.Failed, st.Tokens, st.Elapsed.Round(time.Millisecond))
+	switch {
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "[wtf] batch: %v\n", err)
+		return 1
+	case st.Failed > 0:
+		return 2
+	}
+	return 0
+}
+
+// openExperiment loads -experiment into the experiment global and opens its
+// log for appending; the caller closes the log.
+func openExperiment(path, logPath string) (*os.File, error) {
+	x, err := wtf.LoadExperiment(path)
+	if err != nil {
+		return nil, err
+	}
+	if logPath == "" {
+		logPath = strings.TrimSuffix(path, filepath.Ext(path)) + ".log.jsonl"
+	}
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	x.LogTo(f)
+	experiment = x
+	fmt.Fprintf(os.Stderr, "[wtf] experiment %q: %d arms, logging to %s\n", x.Name, len(x.Arms), logPath)
+	return f, nil
+}
+
+// reportExperiment runs -experiment-report and returns the exit status.
+func reportExperiment(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[wtf] -experiment-report: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	stats, err := wtf.ReadExperimentLog(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[wtf] -experiment-report: %v\n", err)
+		return 1
+	}
+	printArmStats(os.Stdout, stats)
+	return 0
+}
+
+func printArmStats(w io.Writer, stats []wtf.ArmStats) {
+	fmt.Fprintf(w, "  %-16s %6s %6s %8s %8s %8s %6s %7s  %s\n",
+		"arm", "n", "errors", "tokens", "ttft", "time", "rated", "score", "finish")
+	for _, s := range stats {
+		reasons := make([]string, 0, len(s.Finish))
+		for r, n := range s.Finish {
+			reasons = append(reasons, fmt.Sprintf("%s=%d", r, n))
+		}
+		sort.Strings(reasons)
+		fmt.Fprintf(w, "  %-16s %6d %6d %8.1f %8v %8v %6d %7.2f  %s\n",
+			s.Arm, s.N, s.Errors, s.MeanTokens, s.MeanTTFT, s.MeanTime, s.Rated, s.MeanScore, strings.Join(reasons, " "))
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+// wtfd — keeps the model resident and answers over a Unix socket, so
+// short-lived scripts (cron jobs, shell one-liners) skip the model load.
+// Protocol: length-prefixed JSON frames, see wtf/serve.go.
+//
+//	wtfd -socket /tmp/wtfd.sock &
+//	wtfd -socket /tmp/wtfd.sock -ask "is rust worth it"
+//	wtfd -socket /tmp/wtfd.sock -health 127.0.0.1:8081   # /healthz, /readyz
+//	wtfd -http :8080 -keys keys.json                      # POST /call with an API key
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"wtforacle/wtf"
+)
+
+func main() {
+	weightsFlag := flag.String("weights", "", "path to GGUF weights (default: ./wtfweights/wtf360_v2_q4_0.gguf)")
+	socket := flag.String("socket", filepath.Join(os.TempDir(), "wtfd.sock"), "Unix socket to listen on (or, with -ask, to call)")
+	configPath := flag.String("config", "", "JSON config with engine defaults (see wtf/config.go); WTF_* variables override it")
+	ask := flag.String("ask", "", "client mode: ask the running daemon this question, print the streamed reply and exit")
+	persona := flag.String("persona", wtf.OraclePersona, "persona for -ask (\"\" = raw)")
+	webhook := flag.String("webhook", "", "comma-separated URLs to POST each finished generation to (secret: WTF_WEBHOOK_SECRET)")
+	healthAddr := flag.String("health", "", "serve /healthz and /readyz over HTTP on this address, e.g. 127.0.0.1:8081 (up before the model loads)")
+	httpAddr := flag.String("http", "", "also serve calls over HTTP (POST /call) on this address; needs -keys")
+	keysPath := flag.String("keys", "", "API key file with per-key rate limits and daily token quotas for -http (reloaded when it changes)")
+	flag.Parse()
+
+	if *ask != "" {
+		os.Exit(client(*socket, *persona, *ask))
+	}
+
+	cfg := wtf.NewConfig()
+	if *configPath != "" {
+		if err := cfg.Load(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "[wtfd] -config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := cfg.LoadEnv(os.Environ()); err != nil {
+		fmt.Fprintf(os.Stderr, "[wtfd] %v\n", err)
+		os.Exit(1)
+	}
+
+	health := wtf.NewHealth()
+	if *healthAddr != "" {
+		cfg.Health = *healthAddr
+	}
+	if cfg.Health != "" {
+		addr, err := serveHealth(cfg.Health, health)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtfd] -health: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "[wtfd] health on http://%s/healthz and /readyz\n", addr)
+	}
+
+	weights := *weightsFlag
+	if weights == "" {
+		exe, _ := os.Executable()
+		weights = filepath.Join(filepath.Dir(exe), "wtfweights", "wtf360_v2_q4_0.gguf")
+		if _, err := os.Stat(weights); err != nil {
+			weights = "wtfweights/wtf360_v2_q4_0.gguf"
+		}
+	}
+	health.Loading("loading " + weights)
+	gguf, model, err := loadModel(weights, cfg.Model)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[wtfd] %v\n", err)
+		os.Exit(1)
+	}
+	e := wtf.NewEngine(model, wtf.NewTokenizer(&gguf.Meta))
+	e.Idle = wtf.IdlePolicy{After: cfg.IdleUnload, Load: reloader(weights, cfg.Model)}
+	if err := e.RegisterOracle(); err == nil {
+		err = cfg.Apply(e)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[wtfd] %v\n", err)
+		os.Exit(1)
+	}
+	var router *wtf.Router
+	if len(cfg.Router.Models) > 0 {
+		health.Loading("loading the routed models")
+		if router, err = newRouter(cfg, e); err != nil {
+			fmt.Fprintf(os.Stderr, "[wtfd] router: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "[wtfd] router: %s\n", strings.Join(router.Models(), ", "))
+	}
+
+	if cfg.Warmup > 0 {
+		health.Loading("warming up")
+		rep, err := e.Warmup(cfg.Options(), cfg.Warmup)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtfd] warmup: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "[wtfd] warmup: %d passes, %d personas in %s\n", rep.Passes, rep.Personas, rep.Took.Round(time.Millisecond))
+	}
+
+	ln, err := listen(*socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[wtfd] %v\n", err)
+		os.Exit(1)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		ln.Close() // also removes the socket file
+	}()
+
+	if *webhook != "" {
+		cfg.Webhook.URLs = strings.Split(*webhook, ",")
+	}
+	srv := &wtf.Server{Engine: e, Defaults: cfg.Options(), Health: health, Router: router}
+	if len(cfg.Webhook.URLs) > 0 {
+		wh := wtf.NewWebhook(cfg.Webhook)
+		defer wh.Close() // deliver what is queued before exiting
+		srv.OnResult = wh.OnResult
+	}
+	if *httpAddr != "" {
+		cfg.HTTP = *httpAddr
+	}
+	if *keysPath != "" {
+		cfg.Keys = *keysPath
+	}
+	if cfg.HTTP != "" {
+		addr, err := serveHTTP(cfg.HTTP, cfg.Keys, srv)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[wtfd] -http: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "[wtfd] calls on http://%s/call\n", addr)
+	}
+	health.Ready(e)
+	fmt.Fprintf(os.Stderr, "[wtfd] listening on %s\n", *socket)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				fmt.Fprintf(os.Stderr, "[wtfd] shutting down\n")
+				return
+			}
+			fmt.Fprintf(os.Stderr, "[wtfd] accept: %v\n", err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			if err := srv.ServeConn(conn); err != nil {
+				fmt.Fprintf(os.Stderr, "[wtfd] connection: %v\n", err)
+			}
+		}()
+	}
+}
+
+// serveHealth serves h's endpoints on a TCP addr for the life of the
+// process and returns the address bound.
+func serveHealth(addr string, h *wtf.Health) (net.Addr, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: wtf.HealthHandler(h), ReadHeaderTimeout: 10 * time.Second}
+	go srv.Serve(ln)
+	return ln.Addr(), nil
+}
+
+// serveHTTP serves srv's calls on a TCP addr for the life of the process,
+// behind the API keys in keys, and returns the address bound. Unlike the
+// socket the port may be reachable by anyone, so there is no keyless mode.
+func serveHTTP(addr, keys string, srv *wtf.Server) (net.Addr, error) {
+	if keys == "" {
+		return nil, errors.New("an API key file (-keys) is required")
+	}
+	q, err := wtf.LoadQuotas(keys)
+	if err != nil {
+		return nil, err
+	}
+	go q.Watch(context.Background(), 10*time.Second)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	hs := &http.Server{Handler: srv.HTTPHandler(q), ReadHeaderTimeout: 10 * time.Second}
+	go hs.Serve(ln)
+	return ln.Addr(), nil
+}
+
+// listen binds the socket, replacing a stale socket file left by a daemon
+// that died, but not one a live daemon still answers on.
+func listen(path string) (net.Listener, error) {
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, fmt.Errorf("%s: another wtfd is already listening", path)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(path, 0o600) // same-user clients only
+	return ln, nil
+}
+
+// client asks the daemon one question and returns the exit status.
+func client(socket, persona, question string) int {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[wtfd] %v (is the daemon running?)\n", err)
+		return 1
+	}
+	defer conn.Close()
+	if err := wtf.WriteFrame(conn, wtf.Call{Op: "generate", Persona: persona, Question: question, Stream: true}); err != nil {
+		fmt.Fprintf(os.Stderr, "[wtfd] %v\n", err)
+		return 1
+	}
+	for {
+		var r wtf.Reply
+		if err := wtf.ReadFrame(conn, &r); err != nil {
+			fmt.Fprintf(os.Stderr, "[wtfd] %v\n", err)
+			return 1
+		}
+		if !r.Done {
+			fmt.Print(r.Piece)
+			continue
+		}
+		fmt.Println()
+		if r.Error != "" {
+			fmt.Fprintf(os.Stderr, "[wtfd] %s\n", r.Error)
+			return 1
+		}
+		return 0
+	}
+}
+
+// newRouter puts main (the -weights model) and the config's router models
+// behind one Router. The routed models share main's response cache.
+func newRouter(cfg *wtf.Config, main *wtf.Engine) (*wtf.Router, error) {
+	rc := cfg.Router
+	r := &wtf.Router{Routes: rc.Routes, Default: rc.Default, Budget: int64(rc.BudgetMB) << 20}
+	if r.Default == "" {
+		r.Default = "main"
+	}
+	if err := r.Add("main", main); err != nil {
+		return nil, err
+	}
+	for _, name := range slices.Sorted(maps.Keys(rc.Models)) {
+		path := rc.Models[name]
+		gguf, model, err := loadModel(path, cfg.Model)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		e := wtf.NewEngine(model, wtf.NewTokenizer(&gguf.Meta))
+		e.Idle = wtf.IdlePolicy{After: cfg.IdleUnload, Load: reloader(path, cfg.Model)}
+		e.Cache = main.Cache
+		if err = e.RegisterOracle(); err == nil {
+			err = cfg.Apply(e)
+		}
+		if err == nil {
+			err = r.Add(name, e)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return r, nil
+}
+
+// reloader is an IdlePolicy.Load for the weights at path.
+func reloader(weights string, mc wtf.ModelConfig) func() (*wtf.LlamaModel, error) {
+	return func() (*wtf.LlamaModel, error) {
+		_, m, err := loadModel(weights, mc)
+		return m, err
+	}
+}
+
+// loadModel reads the weights and builds the model the way mc says. It
+// runs at startup and again whenever the idle policy reloads.
+func loadModel(weights string, mc wtf.ModelConfig) (*wtf.GGUFFile, *wtf.LlamaModel, error) {
+	load := wtf.LoadGGUF
+	if mc.Stream {
+		load = wtf.MapGGUF
+	}
+	gguf, err := load(weights)
+	if err == nil {
+		err = gguf.Provenance.Verify(mc.Allow)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading %s: %w", weights, err)
+	}
+	fmt.Fprintf(os.Stderr, "[wtfd] weights %s\n", gguf.Provenance)
+	model, err := wtf.LoadLlamaModel(gguf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading model: %w", err)
+	}
+	if mc.Int8 {
+		st, err := model.QuantizeInt8()
+		if err != nil {
+			return nil, nil, fmt.Errorf("int8: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "[wtfd] int8: %s\n", st)
+	}
+	return gguf, model, nil
+}
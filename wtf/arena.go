@@ -0,0 +1,52 @@
+package wtf
+
+// arena.go — one allocation for everything a forward pass scribbles on.
+// The residual stream, the attention and FFN intermediates, the Q/K
+// unpermute row and the logits are carved out of a single slab sized from
+// the config when the state is built, and the sampler's buffers live with
+// the model, so decoding a token allocates nothing and the GC has nothing
+// to pause for. Each carved buffer is capped at its own length: an append
+// reallocates instead of running into its neighbour.
+
+import "time"
+
+// arena hands out consecutive, non-overlapping slices of one []float32.
+type arena struct {
+	buf []float32
+	off int
+}
+
+func newArena(n int) *arena {
+	return &arena{buf: make([]float32, n)}
+}
+
+// take returns the next n floats. It panics when the arena is exhausted:
+// scratchFloats and allocScratch disagree, which is a bug, not a runtime
+// condition.
+func (a *arena) take(n int) []float32 {
+	s := a.buf[a.off : a.off+n : a.off+n]
+	a.off += n
+	return s
+}
+
+// scratchFloats is the arena size allocScratch carves up.
+func scratchFloats(cfg *LlamaConfig) int {
+	kvDim := cfg.NumKVHeads * cfg.HeadDim
+	return 3*cfg.EmbedDim + 2*cfg.IntermSize + cfg.NumHeads*cfg.HeadDim + 2*kvDim +
+		cfg.HeadDim + cfg.NumHeads*cfg.SeqLen + cfg.VocabSize
+}
+
+// sampler returns the model's sampling buffers, built on first use, with
+// the RNG seeded for one decode pass (seed 0 = the clock).
+func (m *LlamaModel) sampler(seed int64) *SampleBuffers {
+	if m.sb == nil {
+		m.sb = NewSampleBuffers(m.Config.VocabSize)
+		m.rng = m.sb.RNG
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	m.rng.Seed(seed)
+	m.sb.RNG = m.rng
+	return m.sb
+}
@@ -0,0 +1,39 @@
+package wtf
+
+import "testing"
+
+func TestForwardAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("-race allocates")
+	}
+	e := newTestEngine()
+	m := e.Model
+	m.Config.QKPermuted = true // the unpermute row comes from the arena too
+	if n := testing.AllocsPerRun(20, func() { m.Forward(5, 3) }); n != 0 {
+		t.Fatalf("Forward allocates %v times", n)
+	}
+
+	// Sampling reuses the model's buffers: a longer reply costs only the
+	// growth of its own token and text slices.
+	opts := greedyOpts(4)
+	opts.Temp, opts.Seed, opts.Grace.Limit, opts.Cycle = 0.9, 1, 0, CyclePolicy{}
+	short := testing.AllocsPerRun(5, func() { Generate(m, e.Tok, "what is the sky?", opts) })
+	opts.MaxTokens = 40
+	long := testing.AllocsPerRun(5, func() { Generate(m, e.Tok, "what is the sky?", opts) })
+	if long-short > 20 {
+		t.Fatalf("36 more tokens cost %v more allocations", long-short)
+	}
+}
+
+func TestArenaCapped(t *testing.T) {
+	cfg := newTestModel(8).Config
+	s := allocScratch(&cfg)
+	if len(s.X) != cfg.EmbedDim || len(s.Logits) != cfg.VocabSize || len(s.Row) != cfg.HeadDim {
+		t.Fatalf("buffer sizes: X %d, Logits %d, Row %d", len(s.X), len(s.Logits), len(s.Row))
+	}
+	s.XB[0] = 1
+	_ = append(s.X, 2) // must not run into XB
+	if s.XB[0] != 1 {
+		t.Fatal("append to X overwrote XB")
+	}
+}
@@ -0,0 +1,128 @@
+package wtf
+
+// async.go — non-blocking generation. Submit enqueues a request and returns a
+// Future at once; a single worker goroutine drains the queue (the model has
+// one KV cache, so there is nothing to gain from more). The queue is bounded:
+// when it is full Submit fails fast with ErrQueueFull instead of blocking the
+// caller — event-driven hosts can shed load or retry later.
+
+import (
+	"errors"
+	"sync"
+)
+
+// DefaultQueueDepth is the pending-request limit when Engine.QueueDepth is 0.
+const DefaultQueueDepth = 16
+
+var (
+	// ErrQueueFull means Submit was rejected because QueueDepth requests are
+	// already waiting.
+	ErrQueueFull = errors.New("generation queue full")
+	// ErrEngineClosed means Submit was called after Close.
+	ErrEngineClosed = errors.New("engine closed")
+)
+
+// Request is one generation for the async API.
+type Request struct {
+	Persona string // "" = raw mode
+	Prompt  string
+	Opts    GenOptions
+}
+
+// Future is the handle for a submitted Request.
+type Future struct {
+	done chan struct{}
+	res  Result
+	err  error
+}
+
+// Done is closed when the result is ready.
+func (f *Future) Done() <-chan struct{} { return f.done }
+
+// Poll returns the result if it is ready; ok is false while still pending.
+func (f *Future) Poll() (res Result, err error, ok bool) {
+	select {
+	case <-f.done:
+		return f.res, f.err, true
+	default:
+		return Result{}, nil, false
+	}
+}
+
+// Wait blocks until the result is ready.
+func (f *Future) Wait() (Result, error) {
+	<-f.done
+	return f.res, f.err
+}
+
+type job struct {
+	req Request
+	fut *Future
+}
+
+// asyncQueue is the Engine's lazily started worker and its inbox.
+type asyncQueue struct {
+	mu     sync.Mutex
+	jobs   chan job
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Submit queues req and returns immediately. The worker starts on first use
+// with a queue of QueueDepth (DefaultQueueDepth if unset).
+func (e *Engine) Submit(req Request) (*Future, error) {
+	q := &e.async
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, ErrEngineClosed
+	}
+	if q.jobs == nil {
+		depth := e.QueueDepth
+		if depth <= 0 {
+			depth = DefaultQueueDepth
+		}
+		q.jobs = make(chan job, depth)
+		q.wg.Add(1)
+		go e.worker(q.jobs)
+	}
+	fut := &Future{done: make(chan struct{})}
+	select {
+	case q.jobs <- job{req: req, fut: fut}:
+		return fut, nil
+	default:
+		return nil, ErrQueueFull
+	}
+}
+
+// Pending is the number of submitted requests not yet picked up.
+func (e *Engine) Pending() int {
+	e.async.mu.Lock()
+	defer e.async.mu.Unlock()
+	return len(e.async.jobs)
+}
+
+// Close stops accepting async requests and waits for queued ones to finish.
+// Synchronous Generate keeps working.
+func (e *Engine) Close() {
+	q := &e.async
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	if q.jobs != nil {
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+func (e *Engine) worker(jobs <-chan job) {
+	defer e.async.wg.Done()
+	for j := range jobs {
+		j.fut.res, j.fut.err = e.Generate(j.req.Persona, j.req.Prompt, j.req.Opts)
+		close(j.fut.done)
+	}
+}
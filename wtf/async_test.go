@@ -0,0 +1,62 @@
+package wtf
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSubmitMatchesGenerate(t *testing.T) {
+	e := newTestEngine()
+	defer e.Close()
+	opts := greedyOpts(16)
+	want, _ := e.Generate("", "is this wtf?", opts)
+
+	fut, err := e.Submit(Request{Prompt: "is this wtf?", Opts: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := fut.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Text != want.Text {
+		t.Fatalf("async %q != sync %q", got.Text, want.Text)
+	}
+	if _, _, ok := fut.Poll(); !ok {
+		t.Fatal("Poll not ready after Wait")
+	}
+}
+
+func TestSubmitBackpressure(t *testing.T) {
+	e := newTestEngine()
+	e.QueueDepth = 1
+	// Hold the model so the worker blocks on its first job.
+	e.mu.Lock()
+	opts := greedyOpts(4)
+	var futs []*Future
+	var full bool
+	for i := 0; i < 4; i++ {
+		f, err := e.Submit(Request{Prompt: "x", Opts: opts})
+		if errors.Is(err, ErrQueueFull) {
+			full = true
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		futs = append(futs, f)
+	}
+	e.mu.Unlock()
+	if !full {
+		t.Fatal("queue never reported full")
+	}
+	for _, f := range futs {
+		if _, err := f.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Close()
+	if _, err := e.Submit(Request{Prompt: "x", Opts: opts}); !errors.Is(err, ErrEngineClosed) {
+		t.Fatalf("Submit after Close: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package wtf
+
+// attention.go — fused single-pass attention for one query row. Scores,
+// softmax and the weighted sum of V happen in one sweep over the cache with
+// an online softmax (running max + running sum, flash-attention style), so no
+// [seq_len] score row is ever materialized: scratch is one fixed tile on the
+// stack, whatever the context length.
+//
+// Pure Go. The inner loops are unrolled by four, which the compiler keeps in
+// registers; a SIMD version belongs next to the other kernels in notorch.
+
+import "math"
+
+// attnTile is how many cache rows are scored before the accumulator is
+// rescaled. Bigger tiles rescale less often; 64 scores fit in one cache page.
+const attnTile = 64
+
+// attendFused writes softmax(q·Kᵀ·scale)·V into out for one head. keys and
+// values start at the head's first row; consecutive rows are stride apart.
+// n is the number of rows (pos+1), len(q) == len(out) == head dim.
+func attendFused(out, q, keys, values []float32, stride, n int, scale float32) {
+	hd := len(q)
+	clear(out)
+	var scores [attnTile]float32
+	runMax := float32(math.Inf(-1))
+	var runSum float32
+	for t0 := 0; t0 < n; t0 += attnTile {
+		rows := min(attnTile, n-t0)
+		tileMax := runMax
+		for i := 0; i < rows; i++ {
+			off := (t0 + i) * stride
+			s := dot(q, keys[off:off+hd]) * scale
+			scores[i] = s
+			if s > tileMax {
+				tileMax = s
+			}
+		}
+		// Rescale what was accumulated under the old max.
+		if tileMax > runMax {
+			c := float32(math.Exp(float64(runMax - tileMax)))
+			runSum *= c
+			scaleInPlace(out, c)
+			runMax = tileMax
+		}
+		for i := 0; i < rows; i++ {
+			p := float32(math.Exp(float64(scores[i] - runMax)))
+			runSum += p
+			off := (t0 + i) * stride
+			axpy(out, values[off:off+hd], p)
+		}
+	}
+	scaleInPlace(out, 1/runSum)
+}
+
+func dot(a, b []float32) float32 {
+	b = b[:len(a)]
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		s0 += a[i] * b[i]
+		s1 += a[i+1] * b[i+1]
+		s2 += a[i+2] * b[i+2]
+		s3 += a[i+3] * b[i+3]
+	}
+	for ; i < len(a); i++ {
+		s0 += a[i] * b[i]
+	}
+	return (s0 + s1) + (s2 + s3)
+}
+
+// axpy: y += a·x.
+func axpy(y, x []float32, a float32) {
+	x = x[:len(y)]
+	i := 0
+	for ; i+4 <= len(y); i += 4 {
+		y[i] += a * x[i]
+		y[i+1] += a * x[i+1]
+		y[i+2] += a * x[i+2]
+		y[i+3] += a * x[i+3]
+	}
+	for ; i < len(y); i++ {
+		y[i] += a * x[i]
+	}
+}
+
+func scaleInPlace(x []float32, a float32) {
+	for i := range x {
+		x[i] *= a
+	}
+}
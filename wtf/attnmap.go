@@ -0,0 +1,78 @@
+package wtf
+
+// attnmap.go — attention weights for one layer at one decode step, for
+// seeing what the model looked at when it picked a token (did it stop
+// attending to the anchor?). The fused kernel never materializes the
+// weights, so the probed pass recomputes them into LlamaState.Att with a
+// plain softmax on the side; every other pass runs as usual.
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"slices"
+)
+
+// AttentionProbe selects what GenOptions.AttentionMap records.
+type AttentionProbe struct {
+	Layer int
+	// Step is the reply token whose choice is recorded: step 0 is the pass
+	// over the last prompt token (its logits pick reply token 0), step i the
+	// pass over reply token i-1.
+	Step int
+}
+
+// AttentionMap holds the recorded weights: Weights[h][t] is how much head h
+// attended to cache row t. Tokens[t] is the token in row t when known.
+type AttentionMap struct {
+	Layer   int         `json:"layer"`
+	Step    int         `json:"step"`
+	Pos     int         `json:"pos"`
+	Tokens  []int       `json:"tokens,omitempty"`
+	Weights [][]float32 `json:"weights"`
+}
+
+// WriteBinary writes the map as little-endian int32 layer, step, pos,
+// heads, rows, then heads×rows float32 — for numpy.fromfile and friends.
+func (a *AttentionMap) WriteBinary(w io.Writer) error {
+	rows := 0
+	if len(a.Weights) > 0 {
+		rows = len(a.Weights[0])
+	}
+	buf := make([]byte, 0, 20+4*len(a.Weights)*rows)
+	for _, v := range []int{a.Layer, a.Step, a.Pos, len(a.Weights), rows} {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(v))
+	}
+	for _, h := range a.Weights {
+		for _, x := range h {
+			buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(x))
+		}
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// recordAttention fills m.probe's map from layer's queries at pos. Called
+// from the forward pass after the layer's K/V row is stored.
+func (m *LlamaModel) recordAttention(s *LlamaState, layer, pos int, scale float32) {
+	cfg := &m.Config
+	hd, kvDim := cfg.HeadDim, cfg.NumKVHeads*cfg.HeadDim
+	layerBase := layer * cfg.SeqLen * kvDim
+	a := m.probe
+	a.Pos = pos
+	a.Weights = make([][]float32, cfg.NumHeads)
+	for h := range a.Weights {
+		w := s.Att[h*cfg.SeqLen : h*cfg.SeqLen+pos+1]
+		base := layerBase + (h/(cfg.NumHeads/cfg.NumKVHeads))*hd
+		q := s.Q[h*hd : (h+1)*hd]
+		for t := range w {
+			off := base + t*kvDim
+			w[t] = dot(q, s.KeyCache[off:off+hd]) * scale
+		}
+		Softmax(w, len(w))
+		a.Weights[h] = slices.Clone(w)
+	}
+	if len(s.Tokens) > pos {
+		a.Tokens = append([]int(nil), s.Tokens[:pos+1]...)
+	}
+}
@@ -0,0 +1,190 @@
+package wtf
+
+// batch.go — run a file of prompts through the oracle, for daily digests
+// and other jobs a cron entry kicks off. Input is JSONL, one Call per line
+// (op is implied; "persona" may be left out for the batch default):
+//
+//	{"id": "monday", "question": "is monday a scam"}
+//	{"id": "rust", "question": "rewrite it in rust?", "opts": {"Seed": 7}}
+//
+// Output is JSONL in input order, one BatchResult per line, with the reply,
+// token counts, timings and finish reason. A bad line gets a result with
+// Error set; the rest of the batch still runs.
+//
+// Concurrency N runs N generations at once on Engine forks (shared weights,
+// one KV cache each). Each forward pass is itself multithreaded, so past
+// the core count more workers only add contention.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// BatchConfig configures RunBatch.
+type BatchConfig struct {
+	Defaults    GenOptions
+	Persona     string // for lines without a "persona" field
+	Concurrency int    // parallel generations (0 = 1)
+
+	// OnResult, when set, sees every finished generation (see webhook.go).
+	OnResult func(Call, Result)
+}
+
+// BatchResult is one output line.
+type BatchResult struct {
+	Line         int          `json:"line"` // 1-based input line
+	ID           string       `json:"id,omitempty"`
+	Text         string       `json:"text"`
+	Tokens       int          `json:"tokens"`
+	PromptTokens int          `json:"prompt_tokens"`
+	Finish       FinishReason `json:"finish,omitempty"`
+	TTFTMillis   int64        `json:"ttft_ms"`
+	TotalMillis  int64        `json:"total_ms"`
+	Cached       bool         `json:"cached,omitempty"`
+	Error        string       `json:"error,omitempty"`
+}
+
+// BatchStats summarises a run.
+type BatchStats struct {
+	Lines   int
+	Failed  int
+	Tokens  int
+	Elapsed time.Duration
+}
+
+type batchItem struct {
+	seq  int // position among the non-blank lines
+	line int
+	call Call
+	err  error // the line did not parse
+}
+
+type batchDone struct {
+	seq int
+	res BatchResult
+}
+
+// RunBatch generates a reply for every line of r and writes the results to
+// w. It stops early, with ctx's error, when ctx is cancelled; results
+// already written stay valid. Other errors are reading r or writing w.
+func (e *Engine) RunBatch(ctx context.Context, r io.Reader, w io.Writer, cfg BatchConfig) (BatchStats, error) {
+	began := time.Now()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	items := make(chan batchItem)
+	done := make(chan batchDone)
+
+	var wg sync.WaitGroup
+	for i := range max(cfg.Concurrency, 1) {
+		eng := e
+		if i > 0 {
+			eng = e.Fork()
+		}
+		srv := &Server{Engine: eng, Defaults: cfg.Defaults}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range items {
+				done <- batchDone{it.seq, srv.batchOne(it, cfg.OnResult)}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(items)
+		sc := bufio.NewScanner(r)
+		sc.Buffer(make([]byte, 64<<10), MaxFrame)
+		seq := 0
+		for line := 1; sc.Scan(); line++ {
+			if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+				continue
+			}
+			it := batchItem{seq: seq, line: line}
+			seq++
+			var in struct {
+				Call
+				Persona *string `json:"persona"`
+			}
+			if it.err = json.Unmarshal(sc.Bytes(), &in); it.err == nil {
+				it.call = in.Call
+				it.call.Op, it.call.Persona = "generate", cfg.Persona
+				if in.Persona != nil {
+					it.call.Persona = *in.Persona
+				}
+			}
+			select {
+			case items <- it:
+			case <-ctx.Done():
+				readErr <- ctx.Err()
+				return
+			}
+		}
+		readErr <- sc.Err()
+	}()
+
+	// Results arrive in completion order; each waits for the ones before it.
+	var (
+		st      BatchStats
+		werr    error
+		pending = make(map[int]BatchResult)
+		next    int
+	)
+	enc := json.NewEncoder(w)
+	for d := range done {
+		pending[d.seq] = d.res
+		for res, ok := pending[next]; ok; res, ok = pending[next] {
+			delete(pending, next)
+			next++
+			st.Lines++
+			st.Tokens += res.Tokens
+			if res.Error != "" {
+				st.Failed++
+			}
+			if werr == nil {
+				if werr = enc.Encode(res); werr != nil {
+					cancel() // no point generating what cannot be written
+				}
+			}
+		}
+	}
+	st.Elapsed = time.Since(began)
+	if werr != nil {
+		return st, werr
+	}
+	return st, <-readErr
+}
+
+// batchOne runs one item.
+func (s *Server) batchOne(it batchItem, onResult func(Call, Result)) BatchResult {
+	out := BatchResult{Line: it.line, ID: it.call.ID}
+	if it.err != nil {
+		out.Error = fmt.Sprintf("line %d: %v", it.line, it.err)
+		return out
+	}
+	began := time.Now()
+	s.OnResult = func(c Call, res Result) {
+		out.PromptTokens, out.TTFTMillis, out.Cached = res.PromptTokens, res.TTFT.Milliseconds(), res.Cached
+		if onResult != nil {
+			onResult(c, res)
+		}
+	}
+	reply, err := s.handle(it.call, nil)
+	out.TotalMillis = time.Since(began).Milliseconds()
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	out.Text, out.Tokens, out.Finish = reply.Text, len(reply.Tokens), reply.Finish
+	return out
+}
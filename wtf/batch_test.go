@@ -0,0 +1,62 @@
+package wtf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRunBatch(t *testing.T) {
+	e := newTestEngine()
+	prompts := []string{"the sky", "a cat", "why is", "hello there"}
+	var in strings.Builder
+	for i, p := range prompts {
+		blob, _ := json.Marshal(map[string]string{"id": string(rune('a' + i)), "prompt": p})
+		in.Write(blob)
+		in.WriteString("\n")
+		if i == 1 {
+			in.WriteString("\n{not json\n")
+		}
+	}
+
+	var out bytes.Buffer
+	st, err := e.RunBatch(context.Background(), strings.NewReader(in.String()), &out,
+		BatchConfig{Defaults: greedyOpts(5), Concurrency: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Lines != 5 || st.Failed != 1 {
+		t.Fatalf("stats %+v, want 5 lines, 1 failed", st)
+	}
+
+	var got []BatchResult
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var r BatchResult
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r)
+	}
+	wantLines := []int{1, 2, 4, 5, 6}
+	for i, r := range got {
+		if r.Line != wantLines[i] {
+			t.Fatalf("result %d is line %d, want %d: output not in input order", i, r.Line, wantLines[i])
+		}
+	}
+	if got[2].Error == "" {
+		t.Fatalf("bad line gave %+v, want an error", got[2])
+	}
+	// Forks decode exactly like the engine they came from.
+	for i, r := range append(got[:2:2], got[3:]...) {
+		want, err := e.Generate("", prompts[i], greedyOpts(5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Error != "" || r.Text != want.Text || r.Tokens != len(want.Tokens) || r.Finish != want.Finish {
+			t.Fatalf("line %d: %+v, want %q (%s)", r.Line, r, want.Text, want.Finish)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package wtf
+
+// cache.go — reuse replies to prompts the engine has already answered. When
+// a thread goes viral the same "is this WTF?" arrives hundreds of times, and
+// recomputing identical snark is pure CPU burn.
+//
+// The key is a hash of the model fingerprint, the exact token sequence that
+// would be decoded (persona anchor or chat history included) and every
+// sampler setting that can change the output. Whether calls with a random
+// seed are cached is the CachePolicy: under CacheSeeded only reproducible
+// calls are, under CacheAll a repeat simply gets the first reply again.
+//
+// Entries live in an in-memory LRU; with a Path they are also written
+// through to SQLite, so the cache survives restarts and can be shared by
+// processes on one host.
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// CachePolicy says which generations may be served from the cache.
+type CachePolicy string
+
+const (
+	CacheSeeded CachePolicy = "seeded" // only reproducible calls: Seed set, or Temp 0; the default
+	CacheAll    CachePolicy = "all"    // random-seed calls too
+)
+
+func (p CachePolicy) valid() error {
+	switch p {
+	case "", CacheSeeded, CacheAll:
+		return nil
+	}
+	return fmt.Errorf("cache policy %q: want seeded or all", string(p))
+}
+
+// DefaultCacheSize is the in-memory entry count when CacheConfig.Size is 0.
+const DefaultCacheSize = 1024
+
+// CacheConfig configures a ResponseCache.
+type CacheConfig struct {
+	Size   int           `json:"size"`   // entries kept in memory (0 = DefaultCacheSize)
+	TTL    time.Duration `json:"ttl"`    // entry lifetime, "10m" in JSON; 0 = until evicted
+	Path   string        `json:"path"`   // SQLite file to persist to; "" = memory only
+	Policy CachePolicy   `json:"policy"` // "seeded" (or "") or "all"
+}
+
+// UnmarshalJSON reads TTL as a duration string and checks Policy.
+func (c *CacheConfig) UnmarshalJSON(b []byte) error {
+	type plain CacheConfig
+	v := struct {
+		*plain
+		TTL jsonDuration `json:"ttl"`
+	}{(*plain)(c), jsonDuration(c.TTL)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	c.TTL = time.Duration(v.TTL)
+	return c.Policy.valid()
+}
+
+const cacheSchema = `
+CREATE TABLE IF NOT EXISTS response_cache (
+    key TEXT PRIMARY KEY,
+    created REAL NOT NULL,
+    text TEXT NOT NULL,
+    tokens TEXT NOT NULL,
+    finish TEXT NOT NULL,
+    redacted INTEGER DEFAULT 0
+);
+`
+
+// ResponseCache maps generation keys to finished replies. Safe for
+// concurrent use. Set it as Engine.Cache.
+type ResponseCache struct {
+	cfg CacheConfig
+	db  *sql.DB
+	now func() time.Time
+
+	mu     sync.Mutex
+	lru    *list.List // of *cacheEntry, most recent first
+	items  map[string]*list.Element
+	hits   int
+	misses int
+}
+
+type cacheEntry struct {
+	key      string
+	created  time.Time
+	text     string
+	tokens   []int
+	finish   FinishReason
+	redacted int
+}
+
+// OpenCache creates a cache, opening (and pruning) its SQLite file when
+// cfg.Path is set.
+func OpenCache(cfg CacheConfig) (*ResponseCache, error) {
+	if err := cfg.Policy.valid(); err != nil {
+		return nil, fmt.Errorf("cache: %w", err)
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = DefaultCacheSize
+	}
+	c := &ResponseCache{cfg: cfg, now: time.Now, lru: list.New(), items: make(map[string]*list.Element)}
+	if cfg.Path == "" {
+		return c, nil
+	}
+	db, err := sql.Open("sqlite", cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("cache: open sqlite: %w", err)
+	}
+	for _, q := range []string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000", cacheSchema} {
+		if _, err := db.Exec(q); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("cache %s: %w", cfg.Path, err)
+		}
+	}
+	if cfg.TTL > 0 {
+		cutoff := c.now().Add(-cfg.TTL)
+		if _, err := db.Exec("DELETE FROM response_cache WHERE created < ?", unixSeconds(cutoff)); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("cache %s: %w", cfg.Path, err)
+		}
+	}
+	c.db = db
+	return c, nil
+}
+
+// Close releases the database handle, if any.
+func (c *ResponseCache) Close() error {
+	if c.db == nil {
+		return nil
+	}
+	return c.db.Close()
+}
+
+// Stats returns the hit and miss counts since the cache was opened.
+func (c *ResponseCache) Stats() (hits, misses int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+func (c *ResponseCache) expired(created time.Time) bool {
+	return c.cfg.TTL > 0 && c.now().Sub(created) > c.cfg.TTL
+}
+
+func (c *ResponseCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		ent := el.Value.(*cacheEntry)
+		if !c.expired(ent.created) {
+			c.lru.MoveToFront(el)
+			c.hits++
+			return ent, true
+		}
+		c.lru.Remove(el)
+		delete(c.items, key)
+	}
+	if ent := c.load(key); ent != nil && !c.expired(ent.created) {
+		c.addLocked(ent)
+		c.hits++
+		return ent, true
+	}
+	c.misses++
+	return nil, false
+}
+
+func (c *ResponseCache) put(ent *cacheEntry) {
+	c.mu.Lock()
+	if el, ok := c.items[ent.key]; ok {
+		c.lru.Remove(el)
+	}
+	c.addLocked(ent)
+	c.mu.Unlock()
+	if c.db == nil {
+		return
+	}
+	tokens, _ := json.Marshal(ent.tokens)
+	// A failed write only costs a future miss.
+	c.db.Exec(`INSERT OR REPLACE INTO response_cache (key, created, text, tokens, finish, redacted)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		ent.key, unixSeconds(ent.created), ent.text, string(tokens), string(ent.finish), ent.redacted)
+}
+
+func (c *ResponseCache) addLocked(ent *cacheEntry) {
+	c.items[ent.key] = c.lru.PushFront(ent)
+	for c.lru.Len() > c.cfg.Size {
+		old := c.lru.Back()
+		c.lru.Remove(old)
+		delete(c.items, old.Value.(*cacheEntry).key)
+	}
+}
+
+// load reads key from the database; nil when absent or unreadable.
+func (c *ResponseCache) load(key string) *cacheEntry {
+	if c.db == nil {
+		return nil
+	}
+	var (
+		created float64
+		tokens  string
+		ent     = &cacheEntry{key: key}
+	)
+	err := c.db.QueryRow("SELECT created, text, tokens, finish, redacted FROM response_cache WHERE key = ?", key).
+		Scan(&created, &ent.text, &tokens, &ent.finish, &ent.redacted)
+	if err != nil || json.Unmarshal([]byte(tokens), &ent.tokens) != nil {
+		return nil
+	}
+	ent.created = time.Unix(0, int64(created*1e9))
+	return ent
+}
+
+func unixSeconds(t time.Time) float64 { return float64(t.UnixNano()) / 1e9 }
+
+// cacheKey returns the key of decoding tokens under opts, or "" when the
+// call must not be cached: no cache, a random seed under CacheSeeded, or
+// options whose Result carries more than the reply (recordings, telemetry,
+// attention maps) or that run caller code per step (Trace, Veto).
+func (e *Engine) cacheKey(tokens []int, opts GenOptions) string {
+	c := e.Cache
+	if c == nil || opts.Record || opts.tape != nil || opts.Telemetry ||
+		opts.AttentionMap != nil || opts.Trace != nil || opts.Veto != nil || opts.ToolCalls {
+		return ""
+	}
+	if c.cfg.Policy != CacheAll && opts.Seed == 0 && opts.Temp > 0 {
+		return ""
+	}
+	// Knobs that change how fast the reply comes, not what it is.
+	opts.MaxTime, opts.Nice, opts.RunAhead = 0, 0, false
+	blob, err := json.Marshal(opts)
+	if err != nil {
+		return ""
+	}
+	h := sha256.New()
+	h.Write([]byte(e.Model.Fingerprint()))
+	var b [8]byte
+	for _, t := range tokens {
+		binary.LittleEndian.PutUint64(b[:], uint64(t))
+		h.Write(b[:])
+	}
+	h.Write(blob)
+	if f := opts.Safety; f != nil {
+		for _, cat := range f.Categories {
+			if cat.Enabled {
+				fmt.Fprintf(h, "\x00%s:%v", cat.Name, cat.Action)
+				for _, r := range cat.rules {
+					fmt.Fprintf(h, "\x00%s", r)
+				}
+			}
+		}
+	}
+	if ens := opts.Ensemble; ens != nil && ens.Weight > 0 {
+		fmt.Fprintf(h, "\x00ensemble:%s:%g:%d", ens.m.Fingerprint(), ens.Weight, ens.Mode)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cached returns the cached reply for key, or runs decode and caches what
+// it returns if the reply ran to a natural end. An empty key just runs.
+// Caller holds mu.
+func (e *Engine) cached(key string, opts GenOptions, decode func() Result) Result {
+	if key == "" {
+		return decode()
+	}
+	if ent, ok := e.Cache.get(key); ok {
+		res := Result{Text: ent.text, Tokens: slices.Clone(ent.tokens), Finish: ent.finish,
+			Redacted: ent.redacted, Injected: opts.injected, Cached: true}
+		if opts.JSON {
+			res.JSON = jsonOutput(res.Text)
+		}
+		if opts.OnToken != nil {
+			opts.OnToken(res.Text)
+		}
+		return res
+	}
+	res := decode()
+	if res.Finish == FinishStop || res.Finish == FinishLength {
+		e.Cache.put(&cacheEntry{key: key, created: e.Cache.now(), text: res.Text,
+			tokens: slices.Clone(res.Tokens), finish: res.Finish, redacted: res.Redacted})
+	}
+	return res
+}
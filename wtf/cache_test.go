@@ -0,0 +1,76 @@
+package wtf
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	e := newTestEngine()
+	path := filepath.Join(t.TempDir(), "cache.db")
+	rc, err := OpenCache(CacheConfig{Size: 4, TTL: time.Minute, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Cache = rc
+
+	opts := greedyOpts(6)
+	opts.Temp, opts.Seed = 0.9, 42
+	first, err := e.Generate("", "the sky", opts)
+	if err != nil || first.Cached {
+		t.Fatalf("first call: cached=%v err=%v", first.Cached, err)
+	}
+	var streamed string
+	opts.OnToken = func(p string) { streamed += p }
+	again, err := e.Generate("", "the sky", opts)
+	if err != nil || !again.Cached || again.Text != first.Text || !slices.Equal(again.Tokens, first.Tokens) {
+		t.Fatalf("repeat: cached=%v %q, want %q from the cache (err %v)", again.Cached, again.Text, first.Text, err)
+	}
+	if streamed != first.Text {
+		t.Fatalf("streamed %q from the cache, want %q", streamed, first.Text)
+	}
+	opts.OnToken = nil
+
+	// A different sampler setting is a different key.
+	other := opts
+	other.RepPenalty = 1.5
+	if res, _ := e.Generate("", "the sky", other); res.Cached {
+		t.Fatal("different RepPenalty served from the cache")
+	}
+	// Random seeds are not cached under CacheSeeded ...
+	random := opts
+	random.Seed = 0
+	e.Generate("", "the sky", random)
+	if res, _ := e.Generate("", "the sky", random); res.Cached {
+		t.Fatal("random-seed call cached under CacheSeeded")
+	}
+	// ... but are under CacheAll.
+	rc.cfg.Policy = CacheAll
+	e.Generate("", "the sky", random)
+	if res, _ := e.Generate("", "the sky", random); !res.Cached {
+		t.Fatal("random-seed call not cached under CacheAll")
+	}
+
+	// Entries expire after TTL.
+	rc.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if res, _ := e.Generate("", "the sky", opts); res.Cached {
+		t.Fatal("expired entry served")
+	}
+	rc.Close()
+
+	// The SQLite file outlives the process; the entry rewritten above is fresh.
+	rc, err = OpenCache(CacheConfig{Size: 4, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	e.Cache = rc
+	if res, _ := e.Generate("", "the sky", opts); !res.Cached || res.Text != first.Text {
+		t.Fatalf("reopened cache: cached=%v %q, want %q", res.Cached, res.Text, first.Text)
+	}
+	if hits, misses := rc.Stats(); hits != 1 || misses != 0 {
+		t.Fatalf("stats %d hits %d misses, want 1 / 0", hits, misses)
+	}
+}
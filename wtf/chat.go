@@ -0,0 +1,157 @@
+package wtf
+
+// chat.go — role-aware prompt construction. Callers hand over structured
+// messages; the tokenizer emits the token sequence for the chosen format with
+// BOS and special-token rules handled here instead of in every host.
+//
+// Two formats:
+//   ChatML — SmolLM2-Instruct: <|im_start|>role\ncontent<|im_end|>\n ...
+//            <|im_start|>assistant\n   (role markers are real special ids)
+//   ChatQA — the WTForacle fine-tune: system text, then
+//            ### Question: q\n### Answer: a\n ... ### Question: q\n### Answer:
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Role is who said a message.
+type Role string
+
+const (
+	RoleSystem    Role = "system"
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+)
+
+// Message is one turn of a conversation.
+type Message struct {
+	Role    Role   `json:"role"`
+	Content string `json:"content"`
+}
+
+// ChatFormat selects the prompt template.
+type ChatFormat int
+
+const (
+	ChatQA ChatFormat = iota // ### Question / ### Answer (the fine-tune's format)
+	ChatML                   // <|im_start|> / <|im_end|>
+)
+
+// ErrNoChatTokens means the vocab lacks the special tokens ChatML needs.
+var ErrNoChatTokens = errors.New("vocab has no <|im_start|>/<|im_end|> tokens")
+
+// BuildChat encodes msgs in format f, ending with the cue for the assistant's
+// reply. A system message may only come first, and the last message must be
+// the user's — that is the turn being answered.
+func (t *Tokenizer) BuildChat(msgs []Message, f ChatFormat) ([]int, error) {
+	if err := validateChat(msgs); err != nil {
+		return nil, err
+	}
+	tokens := t.bosPrefix()
+	switch f {
+	case ChatML:
+		start, end := t.FindSpecialToken("im_start"), t.FindSpecialToken("im_end")
+		if start < 0 || end < 0 {
+			return nil, ErrNoChatTokens
+		}
+		for _, m := range msgs {
+			tokens = append(tokens, start)
+			tokens = append(tokens, t.Encode(string(m.Role)+"\n"+m.Content, false)...)
+			tokens = append(tokens, end)
+			tokens = append(tokens, t.Encode("\n", false)...)
+		}
+		tokens = append(tokens, start)
+		tokens = append(tokens, t.Encode(string(RoleAssistant)+"\n", false)...)
+	case ChatQA:
+		for _, m := range msgs {
+			var seg string
+			switch m.Role {
+			case RoleSystem:
+				seg = m.Content + "\n"
+			case RoleUser:
+				seg = "### Question: " + m.Content + "\n### Answer:"
+			case RoleAssistant:
+				seg = " " + m.Content + "\n"
+			}
+			tokens = append(tokens, t.Encode(seg, false)...)
+		}
+	default:
+		return nil, fmt.Errorf("unknown chat format %d", f)
+	}
+	return tokens, nil
+}
+
+func validateChat(msgs []Message) error {
+	if len(msgs) == 0 {
+		return errors.New("chat: no messages")
+	}
+	for i, m := range msgs {
+		switch m.Role {
+		case RoleSystem:
+			if i != 0 {
+				return fmt.Errorf("chat: system message at index %d (only first allowed)", i)
+			}
+		case RoleUser, RoleAssistant:
+		default:
+			return fmt.Errorf("chat: unknown role %q at index %d", m.Role, i)
+		}
+	}
+	if msgs[len(msgs)-1].Role != RoleUser {
+		return errors.New("chat: last message must be from the user")
+	}
+	return nil
+}
+
+// GenerateChat builds the prompt from msgs and decodes the assistant reply.
+// No persona prefix is involved — the system message, if any, is the anchor.
+func (e *Engine) GenerateChat(msgs []Message, f ChatFormat, opts GenOptions) (_ Result, err error) {
+	defer e.contain(&err, CrashRequest{Op: "chat", PromptBytes: chatBytes(msgs), MaxTokens: opts.MaxTokens})
+	msgs, err = e.prepareChat(msgs, &opts)
+	if err != nil {
+		return Result{}, err
+	}
+	tokens, err := e.Tok.BuildChat(msgs, f)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := e.lock(); err != nil {
+		return Result{}, err
+	}
+	defer e.unlock()
+	e.claim(nil)
+	e.armTools(&opts)
+	e.Tok.chatStops(f, &opts)
+	e.Model.Reset()
+	return finishErr(decode(e.Model, e.Tok, tokens, 0, opts), e.Model, len(tokens))
+}
+
+// prepareChat returns a copy of msgs length-checked, normalized, scrubbed
+// and guarded per opts, with retrieved context filled in for the last
+// message's question and the system message's template variables resolved.
+func (e *Engine) prepareChat(msgs []Message, opts *GenOptions) ([]Message, error) {
+	msgs = append([]Message(nil), msgs...)
+	texts := make([]*string, len(msgs))
+	for i := range msgs {
+		if err := e.checkLen(msgs[i].Content); err != nil {
+			return nil, err
+		}
+		msgs[i].Content = opts.input(msgs[i].Content)
+		texts[i] = &msgs[i].Content
+		if msgs[i].Role == RoleSystem {
+			msgs[i].Content = e.expand(msgs[i].Content, opts.Vars)
+			continue
+		}
+		var err error
+		if msgs[i].Content, err = e.guard(msgs[i].Content, opts); err != nil {
+			return nil, err
+		}
+		if msgs[i].Role == RoleUser {
+			opts.Language.resolve(msgs[i].Content)
+		}
+	}
+	if len(msgs) == 0 {
+		return msgs, nil
+	}
+	return msgs, e.fillContext(msgs[len(msgs)-1].Content, texts, opts)
+}
@@ -0,0 +1,258 @@
+package wtf
+
+// config.go — engine defaults from a file, so deployments that differ only
+// in knobs differ only in a diffable config:
+//
+//	{
+//	  "threads": 4,
+//	  "cpus": "0-3",
+//	  "gen": {"MaxTokens": 120, "Temp": 0.8, "RepPenalty": 1.2},
+//	  "filters": {"safety": "lexicon.txt", "safety_off": ["mild"], "scrub_pii": true, "injection": "strip"},
+//	  "personas": [{"name": "oracle", "anchor": "you are a cynical oracle.", "overrides": {"Temp": 1.1}}],
+//	  "webhook": {"urls": ["https://mod.example/hook"], "secret": "s3cret", "retries": 5, "timeout": "10s"},
+//	  "cache": {"size": 4096, "ttl": "10m", "path": "cache.db", "policy": "all"}
+//	}
+//
+// "gen" is GenOptions as JSON and is laid over DefaultGenOptions, so it only
+// needs the fields that differ. JSON because everything else the engine
+// reads and writes (sessions, recordings, quotas) is JSON.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Config is a parsed engine config file.
+type Config struct {
+	Threads        int             `json:"threads"` // SetThreads; 0 leaves it alone
+	CPUs           string          `json:"cpus"`    // SetThreadAffinity, e.g. "0-3,6"
+	GC             GCConfig        `json:"gc"`      // SetGC; zero leaves the runtime's settings alone
+	Kernels        string          `json:"kernels"` // SetKernels; "" leaves the CPU's best
+	PProf          string          `json:"pprof"`   // EnableProfiling on this address; "" = off
+	Health         string          `json:"health"`  // address wtfd serves /healthz and /readyz on; "" = off
+	Gen            GenOptions      `json:"gen"`
+	Filters        FilterConfig    `json:"filters"`
+	Personas       []PersonaConfig `json:"personas"`
+	Webhook        WebhookConfig   `json:"webhook"`          // used by the servers; see webhook.go
+	Cache          CacheConfig     `json:"cache"`            // opened by Apply when size or path is set
+	Model          ModelConfig     `json:"model"`            // checked by the commands on load; see provenance.go
+	MaxPromptBytes int             `json:"max_prompt_bytes"` // Engine.MaxPromptBytes; 0 keeps the default
+	CrashDir       string          `json:"crash_dir"`        // Engine.CrashDir, relative to the config file
+	Warmup         int             `json:"warmup"`           // Engine.Warmup passes the servers run after Apply; 0 = none
+	IdleUnload     time.Duration   `json:"idle_unload"`      // Engine.Idle.After in the servers, "15m" in JSON; 0 keeps the weights loaded
+	Router         RouterConfig    `json:"router"`           // more models for wtfd and the routes between them; see router.go
+
+	// Vars are template variables for anchors and system messages, set
+	// with Engine.SetVar by Apply, e.g. {"cutoff": "2024"} (see template.go).
+	Vars map[string]string `json:"vars"`
+
+	// Tools are registered with Engine.RegisterTool by Apply (see tools.go).
+	Tools []Tool `json:"tools"`
+
+	// Summarize is the session compression policy wtf-bot gives its chats
+	// (see summary.go).
+	Summarize SummaryPolicy `json:"summarize"`
+
+	// HTTP is the address wtfd serves the call API on (see httpapi.go);
+	// "" = off. It needs Keys, the API key file (see quota.go), relative
+	// to the config file.
+	HTTP string `json:"http"`
+	Keys string `json:"keys"`
+}
+
+// UnmarshalJSON reads IdleUnload as a duration string.
+func (c *Config) UnmarshalJSON(b []byte) error {
+	type plain Config
+	v := struct {
+		*plain
+		IdleUnload jsonDuration `json:"idle_unload"`
+	}{(*plain)(c), jsonDuration(c.IdleUnload)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	c.IdleUnload = time.Duration(v.IdleUnload)
+	return nil
+}
+
+// FilterConfig selects the input and output filters.
+type FilterConfig struct {
+	Safety    string   `json:"safety"` // lexicon path, relative to the config file
+	SafetyOff []string `json:"safety_off"`
+	ScrubPII  bool     `json:"scrub_pii"`
+	Injection string   `json:"injection"` // "", "strip" or "reject"
+	Strip     string   `json:"strip"`     // emoji, markup, all (see strip.go)
+
+	safety *SafetyFilter // all categories, as loaded
+	loaded string        // path safety was loaded from
+}
+
+// PersonaConfig is one persona to register.
+type PersonaConfig struct {
+	Name      string           `json:"name"`
+	Anchor    string           `json:"anchor"`
+	Overrides SamplerOverrides `json:"overrides"`
+}
+
+// NewConfig returns a config holding the library defaults.
+func NewConfig() *Config {
+	return &Config{
+		Gen:     DefaultGenOptions(),
+		Webhook: WebhookConfig{Retries: 3, Timeout: 10 * time.Second},
+	}
+}
+
+// LoadConfig reads a config file over the library defaults.
+func LoadConfig(path string) (*Config, error) {
+	c := NewConfig()
+	if err := c.Load(path); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Load lays a config file over c: fields the file sets replace c's, the
+// rest stay. Relative paths in the file are resolved against its directory.
+func (c *Config) Load(path string) error {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	f := c.Filters
+	c.Filters.Safety = ""
+	if err := json.Unmarshal(blob, c); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	if lex := c.Filters.Safety; lex == "" {
+		c.Filters.Safety, c.Filters.safety = f.Safety, f.safety
+	} else if !filepath.IsAbs(lex) {
+		c.Filters.Safety = filepath.Join(filepath.Dir(path), lex)
+	}
+	if db := c.Cache.Path; db != "" && !filepath.IsAbs(db) {
+		c.Cache.Path = filepath.Join(filepath.Dir(path), db)
+	}
+	if dir := c.CrashDir; dir != "" && !filepath.IsAbs(dir) {
+		c.CrashDir = filepath.Join(filepath.Dir(path), dir)
+	}
+	if keys := c.Keys; keys != "" && !filepath.IsAbs(keys) {
+		c.Keys = filepath.Join(filepath.Dir(path), keys)
+	}
+	for name, gguf := range c.Router.Models {
+		if !filepath.IsAbs(gguf) {
+			c.Router.Models[name] = filepath.Join(filepath.Dir(path), gguf)
+		}
+	}
+	if err := c.resolve(); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	return nil
+}
+
+// resolve turns the filter settings into GenOptions fields and loads the
+// safety lexicon when its path changed.
+func (c *Config) resolve() error {
+	f := &c.Filters
+	if f.Injection != "" {
+		p, err := ParseInjectionPolicy(f.Injection)
+		if err != nil {
+			return err
+		}
+		c.Gen.Injection = p
+	}
+	if f.ScrubPII {
+		c.Gen.ScrubPII = PIIAll
+	}
+	if f.Strip != "" {
+		k, err := ParseStripKind(f.Strip)
+		if err != nil {
+			return err
+		}
+		c.Gen.Strip = k
+	}
+	if f.Safety == "" {
+		f.safety, f.loaded = nil, ""
+		return nil
+	}
+	if f.Safety != f.loaded {
+		sf, err := LoadSafetyLexicon(f.Safety)
+		if err != nil {
+			return err
+		}
+		f.safety, f.loaded = sf, f.Safety
+	}
+	return nil
+}
+
+// Options returns the configured GenOptions, filters included.
+func (c *Config) Options() GenOptions {
+	opts := c.Gen
+	if sf := c.Filters.safety; sf != nil {
+		opts.Safety = sf.Disable(c.Filters.SafetyOff...)
+	}
+	return opts
+}
+
+// Apply sets the thread limits, starts the pprof server, sets the prompt
+// limit and crash dir, registers the personas and opens the response cache
+// on e. A persona with a name e already has replaces it.
+func (c *Config) Apply(e *Engine) error {
+	if c.Threads > 0 {
+		SetThreads(c.Threads)
+	}
+	if c.CPUs != "" {
+		cpus, err := ParseCPUList(c.CPUs)
+		if err == nil {
+			err = SetThreadAffinity(cpus)
+		}
+		if err != nil {
+			return fmt.Errorf("config cpus: %w", err)
+		}
+	}
+	if _, err := SetGC(c.GC); err != nil {
+		return fmt.Errorf("config gc: %w", err)
+	}
+	if c.Kernels != "" {
+		if err := SetKernels(c.Kernels); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+	if c.PProf != "" {
+		addr, err := EnableProfiling(c.PProf)
+		if err != nil && !errors.Is(err, ErrProfilingActive) {
+			return fmt.Errorf("config: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "[wtf] pprof on http://%s/debug/pprof/\n", addr)
+	}
+	if c.MaxPromptBytes != 0 {
+		e.MaxPromptBytes = c.MaxPromptBytes
+	}
+	if c.CrashDir != "" {
+		e.CrashDir = c.CrashDir
+	}
+	for name, v := range c.Vars {
+		if err := e.SetVar(name, v); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+	for _, t := range c.Tools {
+		if err := e.RegisterTool(t); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+	for _, p := range c.Personas {
+		if err := e.RegisterPersona(p.Name, p.Anchor, p.Overrides); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+	if (c.Cache.Size > 0 || c.Cache.Path != "") && e.Cache == nil {
+		rc, err := OpenCache(c.Cache)
+		if err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+		e.Cache = rc
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package wtf
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "lex.txt"), []byte("[a] redact\nfoo\n[b] redact\nbar\n"), 0o644)
+	path := filepath.Join(dir, "wtf.json")
+	os.WriteFile(path, []byte(`{
+		"gen": {"MaxTokens": 12, "Temp": 0, "Grace": {"Limit": 0}},
+		"filters": {"safety": "lex.txt", "safety_off": ["b"], "scrub_pii": true, "injection": "reject"},
+		"personas": [{"name": "calm", "anchor": "be calm.", "overrides": {"MaxTokens": 4}}],
+		"webhook": {"urls": ["http://mod.example/hook"], "timeout": "2s"}
+	}`), 0o644)
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := c.Options()
+	def := DefaultGenOptions()
+	if opts.MaxTokens != 12 || opts.Temp != 0 || opts.TopP != def.TopP || len(opts.Grace.Terminators) == 0 {
+		t.Fatalf("gen not laid over defaults: %+v", opts)
+	}
+	if opts.ScrubPII != PIIAll || opts.Injection != InjectionReject {
+		t.Fatalf("filters: pii %d, injection %d", opts.ScrubPII, opts.Injection)
+	}
+	if got, _ := opts.Safety.Redact("foo bar"); got != Redaction+" bar" {
+		t.Fatalf("safety: %q", got)
+	}
+	if c.Webhook.Timeout != 2*time.Second || c.Webhook.Retries != 3 {
+		t.Fatalf("webhook: %+v", c.Webhook)
+	}
+
+	e := newTestEngine()
+	if err := c.Apply(e); err != nil {
+		t.Fatal(err)
+	}
+	res, err := e.Generate("calm", "hi", opts)
+	if err != nil || len(res.Tokens) > 4 {
+		t.Fatalf("persona from config: %v, %d tokens", err, len(res.Tokens))
+	}
+
+	os.WriteFile(path, []byte(`{"filters": {"injection": "maybe"}}`), 0o644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("bad injection policy accepted")
+	}
+	os.WriteFile(path, []byte(`{"webhook": {"timeout": "soon"}}`), 0o644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("bad webhook timeout accepted")
+	}
+
+	os.WriteFile(path, []byte(`{"cache": {"size": 8, "ttl": "10m", "policy": "all"}, "idle_unload": "15m"}`), 0o644)
+	if c, err = LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if c.Cache.TTL != 10*time.Minute || c.Cache.Policy != CacheAll || c.IdleUnload != 15*time.Minute {
+		t.Fatalf("cache %+v, idle_unload %s", c.Cache, c.IdleUnload)
+	}
+	os.WriteFile(path, []byte(`{"cache": {"size": 8, "policy": 1}}`), 0o644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("numeric cache policy accepted")
+	}
+	os.WriteFile(path, []byte(`{"cache": {"size": 8, "policy": "some"}}`), 0o644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("unknown cache policy accepted")
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wtf.json")
+	os.WriteFile(path, []byte(`{"threads": 2, "gen": {"Temp": 0.5, "MaxTokens": 50}}`), 0o644)
+	c := NewConfig()
+	if err := c.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	err := c.LoadEnv([]string{"HOME=/root", "WTF_TEMP=1.25", "WTF_THREADS=8", "WTF_MAX_TIME=3s", "WTF_SCRUB_PII=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := c.Options()
+	if opts.Temp != 1.25 || opts.MaxTokens != 50 || c.Threads != 8 || opts.MaxTime.Seconds() != 3 || opts.ScrubPII != PIIAll {
+		t.Fatalf("env over config: threads %d, %+v", c.Threads, opts)
+	}
+	if err := c.LoadEnv([]string{"WTF_TEMPP=1"}); err == nil {
+		t.Fatal("unknown variable accepted")
+	}
+	if err := c.LoadEnv([]string{"WTF_TOP_P=high"}); err == nil {
+		t.Fatal("bad value accepted")
+	}
+	if names := EnvNames(); !slices.IsSorted(names) || !slices.Contains(names, "WTF_CONTEXT_BUDGET") {
+		t.Fatalf("EnvNames: %v", names)
+	}
+}
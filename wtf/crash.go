@@ -0,0 +1,106 @@
+package wtf
+
+// crash.go — a panic stays inside the call that hit it. The Engine entry
+// points (Generate, GenerateChat, Infill, Session.Send, Embed, Eval,
+// Choose, Prob, Replay), the async worker and Server.Handle recover it and
+// return ErrPanic, so one bad request costs the host that request and not
+// its process: a bot keeps answering its other chats.
+//
+// The pass the panic cut short may have left the KV cache half written, so
+// the cache is marked empty and the next call prefills from scratch. With
+// Engine.CrashDir set, each recovered panic also leaves a JSON crash dump
+// there: the panic, its stack, the model file's hash and what was asked.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+// ErrPanic is returned by a call that panicked; the message carries the
+// panic value, the crash dump (if any) the stack.
+var ErrPanic = errors.New("internal error (recovered panic)")
+
+// CrashReport is the content of a crash dump.
+type CrashReport struct {
+	Time    time.Time    `json:"time"`
+	Panic   string       `json:"panic"`
+	Stack   string       `json:"stack"`
+	Model   string       `json:"model"`  // GGUF path
+	SHA256  string       `json:"sha256"` // of the GGUF file
+	Build   BuildInfo    `json:"build"`
+	Request CrashRequest `json:"request"`
+}
+
+// CrashRequest summarizes the call that panicked. It carries sizes, not
+// text: dumps are for the operator, prompts belong to the user.
+type CrashRequest struct {
+	Op          string `json:"op"`
+	Persona     string `json:"persona,omitempty"`
+	PromptBytes int    `json:"prompt_bytes"`
+	MaxTokens   int    `json:"max_tokens,omitempty"`
+}
+
+// contain is deferred by every entry point: it turns a panic into ErrPanic
+// on *err, resets the KV cache and writes the crash dump. It must be the
+// deferred function itself for recover to see the panic.
+func (e *Engine) contain(err *error, req CrashRequest) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	stack := debug.Stack()
+	e.panics.Add(1)
+	e.lastPanic.Store(time.Now().UnixNano())
+	// Every lock is released by a deferred unlock, which has run by now.
+	e.mu.Lock()
+	e.Model.State.Pos = 0
+	e.Model.State.Tokens = e.Model.State.Tokens[:0]
+	e.owner = nil
+	prov := e.Model.Provenance
+	e.mu.Unlock()
+	*err = fmt.Errorf("%w: %s: %v", ErrPanic, req.Op, r)
+	fmt.Fprintf(os.Stderr, "[wtf] recovered panic in %s: %v\n", req.Op, r)
+	if e.CrashDir == "" {
+		return
+	}
+	path, derr := e.writeCrash(CrashReport{
+		Time:    time.Now().UTC(),
+		Panic:   fmt.Sprint(r),
+		Stack:   string(stack),
+		Model:   prov.Path,
+		SHA256:  prov.SHA256,
+		Build:   Build(),
+		Request: req,
+	})
+	if derr != nil {
+		fmt.Fprintf(os.Stderr, "[wtf] crash dump: %v\n", derr)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[wtf] crash dump: %s\n", path)
+}
+
+// chatBytes is the total content length of msgs.
+func chatBytes(msgs []Message) int {
+	n := 0
+	for _, m := range msgs {
+		n += len(m.Content)
+	}
+	return n
+}
+
+func (e *Engine) writeCrash(rep CrashReport) (string, error) {
+	if err := os.MkdirAll(e.CrashDir, 0o755); err != nil {
+		return "", err
+	}
+	blob, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(e.CrashDir, "wtf-crash-"+rep.Time.Format("20060102T150405.000000000")+".json")
+	return path, os.WriteFile(path, blob, 0o600)
+}
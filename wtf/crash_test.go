@@ -0,0 +1,108 @@
+package wtf
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPanicContained(t *testing.T) {
+	e := newTestEngine()
+	e.CrashDir = t.TempDir()
+	want, err := e.Generate("", "the sky", greedyOpts(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := greedyOpts(8)
+	opts.OnToken = func(string) { panic("host callback blew up") }
+	if _, err := e.Generate("", "the sky", opts); !errors.Is(err, ErrPanic) {
+		t.Fatalf("err = %v, want ErrPanic", err)
+	}
+	dumps, _ := filepath.Glob(filepath.Join(e.CrashDir, "wtf-crash-*.json"))
+	if len(dumps) != 1 {
+		t.Fatalf("%d crash dumps, want 1", len(dumps))
+	}
+	blob, _ := os.ReadFile(dumps[0])
+	var rep CrashReport
+	if err := json.Unmarshal(blob, &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Panic != "host callback blew up" || rep.Stack == "" || rep.Request.Op != "generate" || rep.Request.PromptBytes != 7 {
+		t.Fatalf("dump: %+v", rep)
+	}
+
+	// The engine is still usable, and decodes as it did before.
+	got, err := e.Generate("", "the sky", greedyOpts(8))
+	if err != nil || got.Text != want.Text {
+		t.Fatalf("after the panic: %q, %v; want %q", got.Text, err, want.Text)
+	}
+
+	// Server.Handle reports it like any other error.
+	srv := &Server{Engine: e, Defaults: greedyOpts(4)}
+	r := srv.Handle(Call{Op: "generate", Prompt: "the sky", Stream: true}, func(Reply) { panic("socket gone") })
+	if r.Error == "" || !r.Done {
+		t.Fatalf("Handle: %+v", r)
+	}
+}
+
+func TestPanicRunAhead(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(8)
+	opts.RunAhead = true
+	bad := opts
+	bad.Veto = func(int, string) bool { panic("veto blew up") } // while a guess runs
+	if _, err := e.Generate("", "the sky", bad); !errors.Is(err, ErrPanic) {
+		t.Fatalf("err = %v, want ErrPanic", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := e.Generate("", "the sky", opts)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("run-ahead stuck after a recovered panic")
+	}
+}
+
+func TestPanicInSession(t *testing.T) {
+	e := newTestEngine()
+	s := e.NewSession("be brief.", ChatML, greedyOpts(8))
+	if _, err := s.Send("hi"); err != nil {
+		t.Fatal(err)
+	}
+	s.Opts.OnToken = func(string) { panic("host callback blew up") }
+	if _, err := s.Send("why is the sky"); !errors.Is(err, ErrPanic) {
+		t.Fatalf("err = %v, want ErrPanic", err)
+	}
+	if s.Turn != 1 || len(s.Messages) != 3 {
+		t.Fatalf("failed turn recorded: turn %d, %d messages", s.Turn, len(s.Messages))
+	}
+	s.Opts.OnToken = nil
+
+	// The engine lock was released: the session and other callers go on.
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Send("why is the sky")
+		if err == nil {
+			_, err = e.Generate("", "the sky", greedyOpts(4))
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("engine still locked after a panic in a session turn")
+	}
+}
@@ -0,0 +1,65 @@
+package wtf
+
+// embed.go — sentence embeddings from the loaded model: the final hidden
+// state (through the output norm) mean-pooled over the text's tokens and
+// scaled to unit length. Not a trained retrieval model, but close texts land
+// close, which is enough to rank few-shot examples or cached answers.
+
+import (
+	"fmt"
+	"math"
+)
+
+// Embed returns text's unit-length embedding (length EmbedDim). It uses the
+// KV cache, so it waits its turn like a generation.
+func (e *Engine) Embed(text string) (_ []float32, err error) {
+	defer e.contain(&err, CrashRequest{Op: "embed", PromptBytes: len(text)})
+	tokens := e.Tok.Encode(text, false)
+	if len(tokens) == 0 {
+		return nil, ErrEmptyPrompt
+	}
+	tokens = append(e.Tok.bosPrefix(), tokens...)
+	if len(tokens) > e.Model.Config.SeqLen {
+		return nil, fmt.Errorf("embed: %w: %d tokens, context is %d",
+			ErrContextOverflow, len(tokens), e.Model.Config.SeqLen)
+	}
+	if err := e.lock(); err != nil {
+		return nil, err
+	}
+	defer e.unlock()
+	e.claim(nil)
+	return e.embedLocked(tokens), nil
+}
+
+// embedLocked runs tokens from position 0 and pools the hidden states of all
+// but a leading BOS. Caller holds mu.
+func (e *Engine) embedLocked(tokens []int) []float32 {
+	m := e.Model
+	m.Reset()
+	dim := m.Config.EmbedDim
+	sum := make([]float32, dim)
+	h := make([]float32, dim)
+	skip := len(e.Tok.bosPrefix())
+	for pos, t := range tokens {
+		m.prefill(t, pos)
+		if pos < skip {
+			continue
+		}
+		RMSNormInto(h, m.State.X, m.Weights.OutputNorm, m.Config.RMSNormEps)
+		for i, x := range h {
+			sum[i] += x
+		}
+	}
+	m.State.Pos = len(tokens)
+	var ss float64
+	for _, x := range sum {
+		ss += float64(x) * float64(x)
+	}
+	if ss > 0 {
+		inv := float32(1 / math.Sqrt(ss))
+		for i := range sum {
+			sum[i] *= inv
+		}
+	}
+	return sum
+}
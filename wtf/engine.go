@@ -0,0 +1,163 @@
+package wtf
+
+// engine.go — Engine ties a loaded model + tokenizer to the things that
+// outlive a single generation: registered personas and their cached KV
+// prefixes. The model has one KV cache, so an Engine runs one generation at
+// a time; every entry point takes mu.
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Engine is a model, its tokenizer, and the persona registry.
+type Engine struct {
+	Model *LlamaModel
+	Tok   *Tokenizer
+
+	// QueueDepth bounds the async queue (see Submit). Set before first use.
+	QueueDepth int
+
+	// Store, if set, parks a session's KV rows when another caller takes
+	// the cache, so its next turn skips the re-prefill. Set before first use.
+	Store *KVStore
+
+	// Retrieve, if set, supplies the snippets that replace ContextMarker in
+	// Generate prompts and GenerateChat messages (see retrieve.go). Set
+	// before first use.
+	Retrieve RetrieveFunc
+
+	// Cache, if set, answers repeated Generate calls and session turns
+	// without decoding (see cache.go). Set before first use.
+	Cache *ResponseCache
+
+	// MaxPromptBytes bounds each piece of caller text (a prompt, a chat
+	// message, a FIM half); longer text fails with ErrPromptTooLong before
+	// it is encoded. 0 means DefaultMaxPromptBytes, negative no limit.
+	MaxPromptBytes int
+
+	// CrashDir, if set, receives a JSON crash dump for every panic an
+	// entry point recovers (see crash.go).
+	CrashDir string
+
+	// Idle, if set, releases the weights after a quiet spell and loads them
+	// back on the next call (see idle.go). Set before first use.
+	Idle IdlePolicy
+
+	mu       sync.Mutex
+	personas map[string]*Persona
+	shots    []shot // few-shot bank, see fewshot.go
+	async    asyncQueue
+	owner    *Session // session whose rows are in the live cache, if any
+	idle     idleState
+
+	varMu sync.Mutex        // guards vars and tools, both read by template expansion
+	vars  map[string]string // template variables, see template.go
+	tools []Tool            // see tools.go
+	now   func() time.Time  // clock for the date variables; nil = time.Now
+
+	panics    atomic.Int64 // recovered by contain, see health.go
+	lastPanic atomic.Int64 // unix nanoseconds
+
+	prov atomic.Pointer[Provenance] // last read under mu, for Health
+}
+
+// NewEngine wraps a loaded model and tokenizer.
+func NewEngine(m *LlamaModel, tok *Tokenizer) *Engine {
+	return &Engine{Model: m, Tok: tok, personas: make(map[string]*Persona)}
+}
+
+// Fork returns an Engine on e.Model.Fork() with the same tokenizer,
+// personas, few-shot bank, template variables, retriever and cache, for
+// running generations in parallel. Personas re-prefill their anchors on
+// the fork's first use; the KV store and the async queue are not shared.
+func (e *Engine) Fork() *Engine {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f := NewEngine(e.Model.Fork(), e.Tok)
+	f.QueueDepth, f.Retrieve, f.Cache = e.QueueDepth, e.Retrieve, e.Cache
+	f.MaxPromptBytes, f.CrashDir, f.Idle = e.MaxPromptBytes, e.CrashDir, e.Idle
+	f.idle.unloaded.Store(e.idle.unloaded.Load()) // loads its own copy on first use
+	f.shots = slices.Clone(e.shots)
+	f.vars, f.tools, f.now = e.Vars(), e.Tools(), e.now
+	for name, p := range e.personas {
+		f.personas[name] = &Persona{Name: p.Name, Anchor: p.Anchor, Overrides: p.Overrides, text: p.text, tokens: p.tokens}
+	}
+	return f
+}
+
+// Generate decodes `prompt` after the named persona's anchor. An empty
+// persona name means raw mode: BOS + prompt, no anchor. Persona overrides
+// are applied on top of opts.
+//
+// A whitespace-only prompt counts as empty. Under a persona the reply is
+// generated from the anchor alone; in raw mode it is generated from BOS, or
+// fails with ErrEmptyPrompt when the model has no distinct BOS.
+func (e *Engine) Generate(persona, prompt string, opts GenOptions) (_ Result, err error) {
+	defer e.contain(&err, CrashRequest{Op: "generate", Persona: persona, PromptBytes: len(prompt), MaxTokens: opts.MaxTokens})
+	prompt, err = e.admit(prompt, &opts)
+	if err != nil {
+		return Result{}, err
+	}
+	opts.Language.resolve(prompt)
+	if err := e.fillContext(prompt, []*string{&prompt}, &opts); err != nil {
+		return Result{}, err
+	}
+	if strings.TrimSpace(prompt) == "" {
+		prompt = ""
+	}
+	if err := e.lock(); err != nil {
+		return Result{}, err
+	}
+	defer e.unlock()
+	e.claim(nil)
+	e.armTools(&opts)
+	if persona == "" {
+		if prompt == "" && len(e.Tok.bosPrefix()) == 0 {
+			return Result{}, ErrEmptyPrompt
+		}
+		key := e.cacheKey(append(e.Tok.bosPrefix(), e.Tok.Encode(prompt, false)...), opts)
+		res := e.cached(key, opts, func() Result { return Generate(e.Model, e.Tok, prompt, opts) })
+		n := 0
+		if res.Finish == FinishOverflow {
+			n = len(e.Tok.bosPrefix()) + len(e.Tok.Encode(prompt, false))
+		}
+		return finishErr(res, e.Model, n)
+	}
+	p, ok := e.personas[persona]
+	if !ok {
+		return Result{}, fmt.Errorf("%w: %q", ErrUnknownPersona, persona)
+	}
+	opts = p.Overrides.apply(opts)
+	if err := e.resolve(p, opts.Vars); err != nil {
+		return Result{}, err
+	}
+
+	p.loadPrefix(e.Model)
+	tokens := append([]int(nil), p.tokens...)
+	tokens = append(tokens, e.Tok.Encode(prompt, false)...)
+	res := e.cached(e.cacheKey(tokens, opts), opts, func() Result {
+		return decode(e.Model, e.Tok, tokens, len(p.tokens), opts)
+	})
+	return finishErr(res, e.Model, len(tokens))
+}
+
+// claim hands the live KV cache to s (nil for one-off calls). The previous
+// owning session's rows are parked in Store first; if that fails it simply
+// re-prefills on its next turn. Caller holds mu.
+func (e *Engine) claim(s *Session) {
+	prev := e.owner
+	e.owner = s
+	if prev == nil || prev == s || e.Store == nil || len(prev.tokens) == 0 {
+		return
+	}
+	st := e.Model.State.Tokens
+	if len(st) < len(prev.tokens) || !slices.Equal(st[:len(prev.tokens)], prev.tokens) {
+		return
+	}
+	_ = e.Store.park(prev, e.Model.snapshotKV(len(prev.tokens)))
+}
@@ -0,0 +1,848 @@
+package wtf
+
+// engine_test.go — engine behaviour on a tiny random-weight model. The model
+// is nonsense, but greedy decoding is deterministic, which is all these tests
+// need: cached paths must agree with cold paths token for token.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTokenizer builds a GPT-2 style byte-level vocab: printable ASCII,
+// space (Ġ), newline (Ċ), a handful of merges and the SmolLM2 specials.
+func newTestTokenizer() *Tokenizer {
+	specials := []string{"<|endoftext|>", "<|im_start|>", "<|im_end|>",
+		"<fim_prefix>", "<fim_middle>", "<fim_suffix>"}
+	var vocab []string
+	var types []int32
+	for _, s := range specials {
+		vocab = append(vocab, s)
+		types = append(types, 3)
+	}
+	for b := 33; b <= 126; b++ {
+		vocab = append(vocab, string(rune(b)))
+		types = append(types, 1)
+	}
+	merges := []string{"Ġ t", "h e", "Ġt he", "o r", "a c"}
+	vocab = append(vocab, "Ġ", "Ċ", "Ġt", "he", "Ġthe", "or", "ac")
+	types = append(types, 1, 1, 1, 1, 1, 1, 1)
+	meta := &GGUFMetadata{
+		TokenList:   vocab,
+		TokenTypes:  types,
+		TokenMerges: merges,
+		TokenModel:  "gpt2",
+		VocabSize:   len(vocab),
+		BosID:       0,
+		EosID:       0,
+	}
+	return NewTokenizer(meta)
+}
+
+// newTestModel builds a 2-layer GQA model with random f32 weights.
+func newTestModel(vocab int) *LlamaModel {
+	rng := rand.New(rand.NewSource(7))
+	cfg := LlamaConfig{
+		NumLayers: 2, EmbedDim: 32, NumHeads: 4, NumKVHeads: 2, HeadDim: 8,
+		VocabSize: vocab, SeqLen: 128, IntermSize: 64,
+		RMSNormEps: 1e-5, RopeTheta: 10000,
+	}
+	randVec := func(n int) []float32 {
+		v := make([]float32, n)
+		for i := range v {
+			v[i] = rng.Float32()*0.6 - 0.3
+		}
+		return v
+	}
+	ones := func(n int) []float32 {
+		v := make([]float32, n)
+		for i := range v {
+			v[i] = 1
+		}
+		return v
+	}
+	qw := func(m, k int) QW { return QW{F32: randVec(m * k), Dtype: dtypeF32, M: m, K: k} }
+
+	dim, kvDim, qDim := cfg.EmbedDim, cfg.NumKVHeads*cfg.HeadDim, cfg.NumHeads*cfg.HeadDim
+	w := LlamaWeights{TokenEmbed: randVec(vocab * dim), OutputNorm: ones(dim)}
+	w.Output = w.TokenEmbed
+	for i := 0; i < cfg.NumLayers; i++ {
+		w.Layers = append(w.Layers, LlamaLayerWeights{
+			AttnNorm: ones(dim), FFNNorm: ones(dim),
+			WQ: qw(qDim, dim), WK: qw(kvDim, dim), WV: qw(kvDim, dim), WO: qw(dim, qDim),
+			WGate: qw(cfg.IntermSize, dim), WUp: qw(cfg.IntermSize, dim), WDown: qw(dim, cfg.IntermSize),
+		})
+	}
+	state := allocState(&cfg)
+	precomputeRoPE(&state, &cfg)
+	return &LlamaModel{Config: cfg, Weights: w, State: state}
+}
+
+func newTestEngine() *Engine {
+	tok := newTestTokenizer()
+	return NewEngine(newTestModel(tok.VocabSize), tok)
+}
+
+func greedyOpts(n int) GenOptions {
+	opts := DefaultGenOptions()
+	opts.MaxTokens = n
+	opts.Temp = 0
+	return opts
+}
+
+func TestPersonaPrefixCache(t *testing.T) {
+	e := newTestEngine()
+	if err := e.RegisterPersona("oracle", "be rude about it.", SamplerOverrides{}); err != nil {
+		t.Fatal(err)
+	}
+	opts := greedyOpts(24)
+
+	res, err := e.Generate("oracle", "what is the sky?", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cold := res.Text
+	if p, _ := e.Persona("oracle"); p.prefix == nil {
+		t.Fatal("prefix not cached after first generation")
+	}
+	if cold == "" {
+		t.Fatal("empty generation — test model hit EOS immediately")
+	}
+	warm, _ := e.Generate("oracle", "what is the sky?", opts)
+	if cold != warm.Text {
+		t.Fatalf("cached prefix changed output:\ncold %q\nwarm %q", cold, warm.Text)
+	}
+
+	// Same token stream without the persona machinery.
+	p, _ := e.Persona("oracle")
+	tokens := append(append([]int(nil), p.tokens...), e.Tok.Encode("what is the sky?", false)...)
+	e.Model.Reset()
+	if ref := decode(e.Model, e.Tok, tokens, 0, opts).Text; ref != cold {
+		t.Fatalf("prefix path diverges from full prefill:\nref  %q\ngot  %q", ref, cold)
+	}
+}
+
+func TestPersonaOverrides(t *testing.T) {
+	e := newTestEngine()
+	n := 3
+	if err := e.RegisterPersona("terse", "short.", SamplerOverrides{MaxTokens: &n}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Generate("nope", "hi", greedyOpts(4)); err == nil {
+		t.Fatal("expected error for unknown persona")
+	}
+	p, _ := e.Persona("terse")
+	if got := p.Overrides.apply(greedyOpts(50)).MaxTokens; got != 3 {
+		t.Fatalf("override MaxTokens = %d, want 3", got)
+	}
+}
+
+func TestGenerateTimeout(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(100)
+	opts.MaxTime = time.Nanosecond // expires before the first forward pass
+	res, err := e.Generate("", "tell me everything", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Finish != FinishTimeout || res.Text != "" {
+		t.Fatalf("got finish=%q text=%q, want an empty timeout", res.Finish, res.Text)
+	}
+}
+
+func TestTokenHealing(t *testing.T) {
+	e := newTestEngine()
+	a := e.Tok.Encode("a", false)[0]
+	ac := e.Tok.Encode("ac", false)[0]
+	for seed := 0; seed < 8; seed++ {
+		opts := DefaultGenOptions()
+		opts.MaxTokens = 4
+		opts.Temp = 2 // spread the distribution so the mask matters
+		opts.TokenHealing = true
+		res, err := e.Generate("", "pizza", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Tokens) == 0 {
+			continue
+		}
+		first := res.Tokens[0]
+		if first != a && first != ac {
+			t.Fatalf("first token %q does not extend the healed tail %q", e.Tok.Piece(first), "a")
+		}
+		rest := e.Tok.Piece(first)[1:]
+		if res.Text[:len(rest)] != rest {
+			t.Fatalf("healed text %q should start with %q (tail removed)", res.Text, rest)
+		}
+	}
+}
+
+func TestForcePrefix(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(8)
+	opts.Grace.Limit = 0
+	free, _ := e.Generate("", "is it bad?", opts)
+
+	opts.ForcePrefix = "Verdict:"
+	res, err := e.Generate("", "is it bad?", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Text) < len("Verdict:") || res.Text[:8] != "Verdict:" {
+		t.Fatalf("reply %q does not start with the forced prefix", res.Text)
+	}
+	if len(res.Tokens) > opts.MaxTokens {
+		t.Fatalf("forced tokens counted against MaxTokens: %d sampled", len(res.Tokens))
+	}
+
+	// Same as decoding a prompt that already contains the prefix.
+	tokens := append(e.Tok.Encode("is it bad?", false), e.Tok.Encode("Verdict:", false)...)
+	e.Model.Reset()
+	opts.ForcePrefix = ""
+	ref := decode(e.Model, e.Tok, tokens, 0, opts)
+	if res.Text != "Verdict:"+ref.Text {
+		t.Fatalf("forced %q != prefilled %q (free run was %q)", res.Text, "Verdict:"+ref.Text, free.Text)
+	}
+}
+
+func TestInfill(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(12)
+	res, err := e.Infill("def f(", "):", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pre, suf, mid, _ := e.Tok.fimTokens()
+	for _, id := range res.Tokens {
+		if id == pre || id == suf || id == mid {
+			t.Fatalf("FIM marker %d leaked into the middle", id)
+		}
+	}
+
+	e.Tok.specialTokens = map[string]int{}
+	e.Tok.tokenToID = map[string]int{}
+	if _, err := e.Infill("a", "b", opts); err != ErrNoFIM {
+		t.Fatalf("err = %v, want ErrNoFIM", err)
+	}
+}
+
+func TestContextOverflow(t *testing.T) {
+	e := newTestEngine()
+	long := strings.Repeat("x", e.Model.Config.SeqLen)
+	res, err := e.Generate("", long, greedyOpts(4))
+	if !errors.Is(err, ErrContextOverflow) || res.Finish != FinishOverflow || res.Text != "" {
+		t.Fatalf("got %+v, %v; want FinishOverflow + ErrContextOverflow", res, err)
+	}
+	// Right at the limit there is still room for one token.
+	fits := strings.Repeat("x", e.Model.Config.SeqLen-1)
+	if _, err := e.Generate("", fits, greedyOpts(4)); err != nil {
+		t.Fatalf("prompt of SeqLen-1 tokens: %v", err)
+	}
+}
+
+func TestAttentionSinks(t *testing.T) {
+	e := newTestEngine()
+	m := e.Model
+	seq := m.Config.SeqLen
+
+	// Layer-0 keys depend only on token and position, so after evicting
+	// rows [4, 4+n) the cache must match a cold prefill of the survivors.
+	toks := make([]int, seq)
+	for i := range toks {
+		toks[i] = 10 + i%50
+	}
+	const sinks, n = 4, 20
+	m.Reset()
+	for p, tk := range toks {
+		m.Forward(tk, p)
+	}
+	m.evictKV(sinks, n, seq)
+	kvDim := m.Config.NumKVHeads * m.Config.HeadDim
+	got := append([]float32(nil), m.State.KeyCache[:(seq-n)*kvDim]...)
+
+	m.Reset()
+	kept := append(append([]int(nil), toks[:sinks]...), toks[sinks+n:]...)
+	for p, tk := range kept {
+		m.Forward(tk, p)
+	}
+	for i, v := range m.State.KeyCache[:(seq-n)*kvDim] {
+		if d := v - got[i]; d > 1e-4 || d < -1e-4 {
+			t.Fatalf("key %d after eviction = %v, cold = %v", i, got[i], v)
+		}
+	}
+
+	opts := greedyOpts(3 * seq)
+	opts.Grace.Limit = 0
+	opts.Cycle = CyclePolicy{}
+	opts.Sinks = 4
+	res, err := e.Generate("", "hi", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Finish == FinishContext || len(res.Tokens) <= seq {
+		t.Fatalf("got %d tokens (%s), want a reply past the %d-token context", len(res.Tokens), res.Finish, seq)
+	}
+}
+
+func TestTelemetry(t *testing.T) {
+	uniform := make([]float32, 64)
+	s := tokenStat(uniform, 64, 0.7, 3)
+	if math.Abs(float64(s.Entropy)-math.Log(64)) > 1e-4 || math.Abs(float64(s.Prob)-1.0/64) > 1e-6 {
+		t.Fatalf("uniform stat = %+v, want entropy ln 64 and prob 1/64", s)
+	}
+
+	e := newTestEngine()
+	opts := greedyOpts(16)
+	opts.Telemetry = true
+	res, err := e.Generate("", "hi", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Stats) != len(res.Tokens) || len(res.Stats) == 0 {
+		t.Fatalf("%d stats for %d tokens", len(res.Stats), len(res.Tokens))
+	}
+	maxH := float32(math.Log(float64(e.Model.Config.VocabSize)))
+	for i, st := range res.Stats {
+		if st.ID != res.Tokens[i] || st.Prob <= 0 || st.Prob > 1 || st.Entropy < 0 || st.Entropy > maxH+1e-4 {
+			t.Fatalf("stat %d = %+v", i, st)
+		}
+	}
+	if res.MeanEntropy() <= 0 || res.MeanSurprise() < 0 {
+		t.Fatalf("mean entropy %v, surprise %v", res.MeanEntropy(), res.MeanSurprise())
+	}
+}
+
+func TestApplyMinP(t *testing.T) {
+	logits := []float32{2, 1, 0, -3}
+	// At T=1, p_i/p_max = e^(l_i-2): 1, 0.37, 0.14, 0.007.
+	ApplyMinP(logits, 4, 1, 0.1)
+	if logits[0] != 2 || logits[1] != 1 || logits[2] != 0 || logits[3] > -1e29 {
+		t.Fatalf("min-p 0.1 left %v", logits)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	e := newTestEngine()
+	e.Tok.EosID = -1
+	opts := DefaultGenOptions()
+	opts.MaxTokens = 64
+	// A 1-byte shingle repeats almost at once, so every attempt "loops";
+	// with no EOS no attempt can end cleanly first.
+	opts.Cycle = CyclePolicy{Repeats: 2, Fuzzy: true, FuzzyGram: 1, FuzzyWindow: 64}
+	opts.Watchdog = WatchdogPolicy{Retries: 3, MinTokens: 1000}
+	res, err := e.Generate("", "hi", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Retries != 3 || res.Finish != FinishCycle {
+		t.Fatalf("retries = %d finish = %s, want 3 retries ending in a cycle", res.Retries, res.Finish)
+	}
+
+	opts.Temp = 0
+	if res, _ := e.Generate("", "hi", opts); res.Retries != 0 {
+		t.Fatalf("greedy reply was retried %d times", res.Retries)
+	}
+}
+
+func TestPrefillSkipsLogitsOnly(t *testing.T) {
+	e := newTestEngine()
+	m := e.Model
+	toks := []int{10, 20, 30, 40}
+	m.Reset()
+	for p, tk := range toks {
+		m.Forward(tk, p)
+	}
+	want := append([]float32(nil), m.State.Logits...)
+	m.Reset()
+	for p, tk := range toks[:3] {
+		m.prefill(tk, p)
+	}
+	m.Forward(toks[3], 3)
+	for i, v := range m.State.Logits {
+		if v != want[i] {
+			t.Fatalf("logit %d = %v, want %v", i, v, want[i])
+		}
+	}
+}
+
+func TestStreamingAndTTFT(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(12)
+	opts.ForcePrefix = "Verdict:"
+	var streamed strings.Builder
+	opts.OnToken = func(piece string) { streamed.WriteString(piece) }
+	res, err := e.Generate("", "hi", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamed.String() != res.Text {
+		t.Fatalf("streamed %q, result %q", streamed.String(), res.Text)
+	}
+	if len(res.Tokens) > 0 && res.TTFT <= 0 {
+		t.Fatal("TTFT not recorded")
+	}
+	if want := len(e.Tok.Encode("hi", false)) + len(e.Tok.Encode("Verdict:", false)); res.PromptTokens != want {
+		t.Fatalf("PromptTokens = %d, want %d", res.PromptTokens, want)
+	}
+}
+
+func TestEmptyPrompt(t *testing.T) {
+	e := newTestEngine()
+	for _, p := range []string{"", "  \n\t"} {
+		if _, err := e.Generate("", p, greedyOpts(4)); !errors.Is(err, ErrEmptyPrompt) {
+			t.Fatalf("raw %q: err = %v, want ErrEmptyPrompt", p, err)
+		}
+	}
+
+	// Under a persona an empty prompt continues the anchor itself, which
+	// must match decoding the anchor without the prefix cache.
+	if err := e.RegisterPersona("oracle", "be rude about it.", SamplerOverrides{}); err != nil {
+		t.Fatal(err)
+	}
+	opts := greedyOpts(8)
+	first, err := e.Generate("oracle", " ", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, _ := e.Generate("oracle", "", opts)
+	ref, _ := e.Generate("", "be rude about it.\n", opts)
+	if first.Text != ref.Text || cached.Text != ref.Text {
+		t.Fatalf("anchor-only replies differ: first %q cached %q ref %q", first.Text, cached.Text, ref.Text)
+	}
+}
+
+func TestPenalties(t *testing.T) {
+	counts := map[int]int{1: 3, 2: 1}
+	logits := []float32{1, 2, -2, 5}
+	opts := GenOptions{RepPenalty: 2, PresencePenalty: 0.5, FrequencyPenalty: 0.25}
+	applyPenalties(logits, counts, &opts)
+	// 1: 2/2/2/2 - 0.5 - 0.75; 2: -2*2 - 0.5 - 0.25; untouched otherwise.
+	want := []float32{1, -1, -4.75, 5}
+	if !slices.Equal(logits, want) {
+		t.Fatalf("logits = %v, want %v", logits, want)
+	}
+}
+
+func TestPenaltiesSkipPrompt(t *testing.T) {
+	e := newTestEngine()
+	// Step 0 has an empty window, so even absurd penalties can't change the
+	// first token unless prompt or forced-prefix tokens leaked into it.
+	plain := greedyOpts(1)
+	plain.Grace.Limit = 0
+	harsh := plain
+	harsh.RepPenalty, harsh.PresencePenalty, harsh.FrequencyPenalty = 100, 1e4, 1e4
+	harsh.ForcePrefix = " the"
+	forced, _ := e.Generate("", "the the the", harsh)
+	plain.ForcePrefix = " the"
+	ref, _ := e.Generate("", "the the the", plain)
+	if !slices.Equal(forced.Tokens, ref.Tokens) {
+		t.Fatalf("first token moved under penalties: %v vs %v", forced.Tokens, ref.Tokens)
+	}
+}
+
+func TestNiceMode(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(8)
+	opts.Grace.Limit = 0
+	fast, err := e.Generate("", "hi there", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Nice = 2 * time.Millisecond
+	began := time.Now()
+	slow, err := e.Generate("", "hi there", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slow.Text != fast.Text {
+		t.Fatalf("nice mode changed the reply: %q vs %q", slow.Text, fast.Text)
+	}
+	passes := slow.PromptTokens + len(slow.Tokens)
+	if d := time.Since(began); d < time.Duration(passes)*opts.Nice {
+		t.Fatalf("%d forward passes took %v, want at least %v of pauses", passes, d, time.Duration(passes)*opts.Nice)
+	}
+}
+
+func TestRunAhead(t *testing.T) {
+	e := newTestEngine()
+	for _, opts := range []GenOptions{greedyOpts(16), DefaultGenOptions()} {
+		opts.Seed = 11
+		opts.MaxTokens = 16
+		want, err := e.Generate("", "why is the sky", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.RunAhead = true
+		got, err := e.Generate("", "why is the sky", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Text != want.Text || got.Finish != want.Finish {
+			t.Fatalf("temp %v: run-ahead %q (%s), plain %q (%s)", opts.Temp, got.Text, got.Finish, want.Text, want.Finish)
+		}
+		if opts.Temp == 0 && len(got.Tokens) > 1 && got.RunAheadHits == 0 {
+			t.Fatal("greedy decode never kept a run-ahead guess")
+		}
+	}
+}
+
+func TestRunAheadWorker(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(16)
+	opts.RunAhead = true
+	e.Generate("", "why is the sky", opts) // starts the worker
+	before := runtime.NumGoroutine()
+	for range 3 {
+		if _, err := e.Generate("", "why is the sky", opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("goroutines %d -> %d: run-ahead spawned per call", before, after)
+	}
+
+	// A dropped fork's worker exits with it.
+	f := e.Model.Fork()
+	Generate(f, e.Tok, "why is the sky", opts)
+	f = nil
+	for i := 0; i < 50 && runtime.NumGoroutine() > before; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("fork collected, goroutines still %d (want %d)", n, before)
+	}
+}
+
+func TestVeto(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(24)
+	opts.Veto = func(id int, piece string) bool { return strings.ContainsAny(piece, "eE") }
+	res, err := e.Generate("", "the sky", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ContainsAny(res.Text, "eE") || res.Finish == FinishVeto {
+		t.Fatalf("veto leaked: %q (%s)", res.Text, res.Finish)
+	}
+
+	calls := 0
+	opts.Veto = func(int, string) bool { calls++; return true }
+	res, _ = e.Generate("", "the sky", opts)
+	if res.Finish != FinishVeto || res.Text != "" || calls != MaxVetoes {
+		t.Fatalf("veto everything: %q (%s) after %d calls", res.Text, res.Finish, calls)
+	}
+}
+
+func TestChoose(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(1)
+	opts.Grace.Limit = 0
+	res, err := e.Generate("", "the sky is", opts)
+	if err != nil || len(res.Tokens) != 1 {
+		t.Fatalf("greedy first token: %v %v", res.Tokens, err)
+	}
+	top := e.Tok.DecodeToken(res.Tokens[0])
+	other := e.Tok.DecodeToken((res.Tokens[0] + 1) % e.Tok.VocabSize)
+	c, err := e.Choose("", "the sky is", []string{other, top, other + top})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Index != 1 || c.Option != top {
+		t.Fatalf("chose %d %q, greedy token is %q (probs %v)", c.Index, c.Option, top, c.Probs)
+	}
+	var sum float64
+	for _, p := range c.Probs {
+		sum += p
+	}
+	if math.Abs(sum-1) > 1e-9 || c.Probs[1] <= c.Probs[0] {
+		t.Fatalf("probs %v, logprobs %v", c.Probs, c.LogProbs)
+	}
+	if _, err := e.Choose("", "x", nil); err == nil {
+		t.Fatal("no options accepted")
+	}
+}
+
+func TestProb(t *testing.T) {
+	e := newTestEngine()
+	// Two tokens whose text encodes back to exactly themselves.
+	var ids []int
+	for id := 0; id < e.Tok.VocabSize && len(ids) < 2; id++ {
+		if enc := e.Tok.Encode(e.Tok.DecodeToken(id), false); len(enc) == 1 && enc[0] == id {
+			ids = append(ids, id)
+		}
+	}
+	a, b := ids[0], ids[1]
+	p, err := e.Prob("", "is it cringe?", a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, _ := e.Prob("", "is it cringe?", b, a)
+	if p <= 0 || p >= 1 || math.Abs(p+q-1) > 1e-9 {
+		t.Fatalf("P(a)=%v, P(b)=%v", p, q)
+	}
+	// Agrees with Choose over the same two single-token answers.
+	c, err := e.Choose("", "is it cringe?", []string{e.Tok.DecodeToken(a), e.Tok.DecodeToken(b)})
+	if err != nil || math.Abs(c.Probs[0]-p) > 1e-6 {
+		t.Fatalf("Prob %v, Choose %v (%v)", p, c.Probs, err)
+	}
+	if _, err := e.Prob("", "x", a, a); err == nil {
+		t.Fatal("identical answer tokens accepted")
+	}
+}
+
+func TestEvalLogits(t *testing.T) {
+	e := newTestEngine()
+	n, err := e.Eval("", "the sky is")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := len(e.Tok.bosPrefix()) + len(e.Tok.Encode("the sky is", false)); n != want {
+		t.Fatalf("Eval = %d tokens, want %d", n, want)
+	}
+	if _, err := newTestEngine().Logits(nil); !errors.Is(err, ErrNoLogits) {
+		t.Fatalf("logits before Eval: %v", err)
+	}
+	logits, err := e.Logits(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := greedyOpts(1)
+	opts.Grace.Limit = 0
+	res, _ := e.Generate("", "the sky is", opts)
+	if len(logits) != e.Tok.VocabSize || len(res.Tokens) != 1 || Argmax(logits, len(logits)) != res.Tokens[0] {
+		t.Fatalf("argmax of %d logits vs greedy token %v", len(logits), res.Tokens)
+	}
+
+	// Released weights take the logits with them.
+	e.Idle.Load = func() (*LlamaModel, error) { return newTestModel(e.Tok.VocabSize), nil }
+	e.Unload()
+	if _, err := e.Logits(logits); !errors.Is(err, ErrNoLogits) {
+		t.Fatalf("logits after an idle unload: %v", err)
+	}
+}
+
+func TestEvalTokenLoop(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(6)
+	opts.Grace.Limit = 0
+	opts.RepPenalty = 1
+	want, _ := e.Generate("", "the sky is", opts)
+
+	// The same greedy decode, driven from outside.
+	pos, err := e.Eval("", "the sky is")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	var logits []float32
+	for len(got) < 6 {
+		if logits, err = e.Logits(logits); err != nil {
+			t.Fatal(err)
+		}
+		next := Argmax(logits, len(logits))
+		if next == e.Tok.EosID {
+			break
+		}
+		got = append(got, next)
+		if err := e.EvalToken(next, pos); err != nil {
+			t.Fatal(err)
+		}
+		pos++
+	}
+	if !slices.Equal(got, want.Tokens) {
+		t.Fatalf("host loop %v, engine %v", got, want.Tokens)
+	}
+	if err := e.EvalToken(0, pos+1); err == nil {
+		t.Fatal("gap in positions accepted")
+	}
+
+	// After an idle unload the token runs on the reloaded weights.
+	e.Idle.Load = func() (*LlamaModel, error) { return newTestModel(e.Tok.VocabSize), nil }
+	e.Unload()
+	if err := e.EvalToken(want.Tokens[0], 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Logits(logits); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestActivationTap(t *testing.T) {
+	e := newTestEngine()
+	var seen []int
+	var last []float32
+	err := e.SetActivationTap([]int{1}, func(layer, pos int, h []float32) {
+		if layer != 1 || pos != len(seen) {
+			t.Errorf("tap got layer %d pos %d after %d calls", layer, pos, len(seen))
+		}
+		seen = append(seen, pos)
+		last = slices.Clone(h)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := e.Eval("", "the sky is")
+	if len(seen) != n || len(last) != e.Model.Config.EmbedDim {
+		t.Fatalf("tap fired %d times for %d tokens", len(seen), n)
+	}
+	// The last layer's tap is the residual stream the output norm reads.
+	RMSNorm(last, e.Model.Weights.OutputNorm, e.Model.Config.RMSNormEps)
+	if !slices.Equal(last, e.Model.State.X) {
+		t.Fatal("tapped hidden state differs from the model's")
+	}
+	e.SetActivationTap(nil, nil)
+	e.Eval("", "again")
+	if len(seen) != n {
+		t.Fatal("tap still fires after removal")
+	}
+	if err := e.SetActivationTap([]int{9}, func(int, int, []float32) {}); err == nil {
+		t.Fatal("out-of-range layer accepted")
+	}
+}
+
+func TestAttentionMap(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(6)
+	opts.Grace.Limit = 0
+	plain, _ := e.Generate("", "the sky is", opts)
+	opts.AttentionMap = &AttentionProbe{Layer: 1, Step: 2}
+	res, err := e.Generate("", "the sky is", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != plain.Text {
+		t.Fatalf("recording changed the reply: %q vs %q", res.Text, plain.Text)
+	}
+	a := res.Attention
+	if len(plain.Tokens) < 2 {
+		t.Skip("reply too short to reach step 2")
+	}
+	if a == nil || a.Pos != res.PromptTokens+1 || len(a.Weights) != e.Model.Config.NumHeads {
+		t.Fatalf("attention map %+v, prompt %d tokens", a, res.PromptTokens)
+	}
+	for h, w := range a.Weights {
+		var sum float32
+		for _, x := range w {
+			sum += x
+		}
+		if len(w) != a.Pos+1 || math.Abs(float64(sum-1)) > 1e-5 {
+			t.Fatalf("head %d: %d rows summing to %v", h, len(w), sum)
+		}
+	}
+	if a.Tokens[len(a.Tokens)-1] != res.Tokens[1] {
+		t.Fatalf("row %d holds %d, want reply token 1 (%d)", a.Pos, a.Tokens[len(a.Tokens)-1], res.Tokens[1])
+	}
+	var buf bytes.Buffer
+	if err := a.WriteBinary(&buf); err != nil || buf.Len() != 20+4*len(a.Weights)*(a.Pos+1) {
+		t.Fatalf("binary export: %d bytes, %v", buf.Len(), err)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(8)
+	opts.Grace.Limit = 0
+	opts.RepPenalty = 1.5
+	var buf bytes.Buffer
+	opts.Trace = TraceJSON(&buf)
+	res, err := e.Generate("", "the sky is", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []TraceEvent
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var ev TraceEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	steps := len(res.Tokens)
+	if res.Finish == FinishStop {
+		steps++ // the EOS step is traced too
+	}
+	if len(events) != steps {
+		t.Fatalf("%d events for %d steps", len(events), steps)
+	}
+	penalized := false
+	for i, ev := range events[:len(res.Tokens)] {
+		if ev.Step != i || ev.Chosen != res.Tokens[i] || ev.Top[0].ID != ev.Chosen || ev.Sampler != "greedy" || len(ev.Top) != traceTop {
+			t.Fatalf("event %d: %+v (token %d)", i, ev, res.Tokens[i])
+		}
+		penalized = penalized || len(ev.Penalties) > 0
+	}
+	if len(events) > 1 && !penalized {
+		t.Fatal("penalties never traced")
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	e := newTestEngine()
+	opts := DefaultGenOptions()
+	opts.MaxTokens = 12
+	opts.Record = true
+	res, err := e.Generate("", "the sky is", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := res.Recording
+	if rec == nil || rec.Opts.Seed == 0 || len(rec.Draws) == 0 || !slices.Equal(rec.Output, res.Tokens) {
+		t.Fatalf("recording %+v", rec)
+	}
+	blob, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back Recording
+	if err := json.Unmarshal(blob, &back); err != nil {
+		t.Fatal(err)
+	}
+	// Something else runs in between: replay must not depend on cache state.
+	if _, err := e.Generate("", "unrelated", greedyOpts(4)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := e.Replay(&back)
+	if err != nil || got.Text != res.Text {
+		t.Fatalf("replay: %q, %v; recorded %q", got.Text, err, res.Text)
+	}
+
+	// A Safety mask changes the reply; the recording carries the lexicon.
+	word := e.Tok.DecodeToken(res.Tokens[0])
+	opts.Safety, err = ParseSafetyLexicon(strings.NewReader("[x] mask\nre:" + regexp.QuoteMeta(word) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Seed = rec.Opts.Seed
+	masked, _ := e.Generate("", "the sky is", opts)
+	if masked.Text == res.Text {
+		t.Fatalf("mask on %q left the reply as it was", word)
+	}
+	blob, _ = json.Marshal(masked.Recording)
+	var safe Recording
+	if err := json.Unmarshal(blob, &safe); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := e.Replay(&safe); err != nil || got.Text != masked.Text {
+		t.Fatalf("replay under Safety: %q, %v; recorded %q", got.Text, err, masked.Text)
+	}
+
+	back.Output = append(slices.Clone(back.Output), 0)
+	if _, err := e.Replay(&back); !errors.Is(err, ErrReplayMismatch) {
+		t.Fatalf("tampered output: %v", err)
+	}
+	back.Model = "0"
+	if _, err := e.Replay(&back); !errors.Is(err, ErrReplayMismatch) {
+		t.Fatalf("other model: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package wtf
+
+// ensemble.go — two models, one reply. An Ensemble runs a second model over
+// the same context as the engine's and mixes its next-token distribution in
+// before sampling, so the snark fine-tune can be steadied by its base model
+// (or the other way round) at a chosen weight:
+//
+//	ens, err := wtf.NewEnsemble(e, base, baseTok, 0.2, wtf.EnsembleProduct)
+//	opts.Ensemble = ens
+//
+// The second model prefills every prompt and runs one forward pass per
+// reply token, so a reply costs about the sum of both models. Both must
+// share a vocabulary: the mix is token by token. Penalties, masks and the
+// sampler all apply to the mixed logits, which are log-probabilities: a
+// multiplicative RepPenalty bites harder on them than on raw logits.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+)
+
+// EnsembleMode says how an Ensemble combines the two distributions.
+type EnsembleMode int
+
+const (
+	// EnsembleProduct is a product of experts: the log-probabilities are
+	// summed at weights 1-Weight and Weight. A token either model finds
+	// unlikely stays unlikely.
+	EnsembleProduct EnsembleMode = iota
+	// EnsembleSum mixes the probabilities themselves; a token either model
+	// likes keeps some of its mass.
+	EnsembleSum
+)
+
+// ErrEnsembleVocab is returned when the two models of an Ensemble do not
+// share a vocabulary.
+var ErrEnsembleVocab = errors.New("ensemble models do not share a vocabulary")
+
+// Ensemble is a second model mixed into a generation through
+// GenOptions.Ensemble. It holds its own KV cache, so one Ensemble serves
+// one generation at a time: concurrent calls that share it wait for each
+// other.
+type Ensemble struct {
+	Weight float32 // share of the second model, 0..1; 0 leaves replies as they were
+	Mode   EnsembleMode
+
+	mu sync.Mutex
+	m  *LlamaModel
+}
+
+// NewEnsemble mixes m, whose tokenizer is tok, into e's generations at
+// weight. m becomes the Ensemble's: to mix in a model another engine is
+// serving, pass that model's Fork so the two keep separate caches.
+func NewEnsemble(e *Engine, m *LlamaModel, tok *Tokenizer, weight float32, mode EnsembleMode) (*Ensemble, error) {
+	if weight < 0 || weight > 1 || math.IsNaN(float64(weight)) {
+		return nil, fmt.Errorf("ensemble weight %g: want 0..1", weight)
+	}
+	if mode != EnsembleProduct && mode != EnsembleSum {
+		return nil, fmt.Errorf("ensemble mode %d: want product or sum", mode)
+	}
+	if m.Config.VocabSize != e.Model.Config.VocabSize || !slices.Equal(tok.Vocab, e.Tok.Vocab) {
+		return nil, fmt.Errorf("%w: %d tokens, engine has %d", ErrEnsembleVocab, m.Config.VocabSize, e.Model.Config.VocabSize)
+	}
+	if m.Config.SeqLen < e.Model.Config.SeqLen {
+		return nil, fmt.Errorf("ensemble context %d is shorter than the engine's %d", m.Config.SeqLen, e.Model.Config.SeqLen)
+	}
+	return &Ensemble{Weight: weight, Mode: mode, m: m}, nil
+}
+
+// ParseEnsembleMode maps "product" or "sum" (and "" = product) to a mode.
+func ParseEnsembleMode(s string) (EnsembleMode, error) {
+	switch s {
+	case "", "product":
+		return EnsembleProduct, nil
+	case "sum":
+		return EnsembleSum, nil
+	}
+	return 0, fmt.Errorf("ensemble mode %q: want product or sum", s)
+}
+
+// prefill brings the second model's cache up to tokens, reusing the rows it
+// already holds, and leaves the last token's logits in its state.
+func (ens *Ensemble) prefill(tokens []int) {
+	m := ens.m
+	k := 0
+	for k < len(m.State.Tokens) && k < len(tokens)-1 && m.State.Tokens[k] == tokens[k] {
+		k++
+	}
+	for pos := k; pos < len(tokens)-1; pos++ {
+		m.prefill(tokens[pos], pos)
+	}
+	m.Forward(tokens[len(tokens)-1], len(tokens)-1)
+}
+
+// mix combines the second model's logits into logits, in place.
+func (ens *Ensemble) mix(logits []float32, vocab int) {
+	a, b := logits[:vocab], ens.m.State.Logits[:vocab]
+	logSoftmax(a)
+	logSoftmax(b)
+	w := float64(ens.Weight)
+	for i := range a {
+		switch ens.Mode {
+		case EnsembleProduct:
+			a[i] = float32((1-w)*float64(a[i]) + w*float64(b[i]))
+		case EnsembleSum:
+			p := (1-w)*math.Exp(float64(a[i])) + w*math.Exp(float64(b[i]))
+			if p > 0 {
+				a[i] = float32(math.Log(p))
+			} else {
+				a[i] = -1e30
+			}
+		}
+	}
+}
+
+// logSoftmax turns logits into log-probabilities, in place.
+func logSoftmax(x []float32) {
+	top := x[0]
+	for _, v := range x[1:] {
+		top = max(top, v)
+	}
+	var sum float64
+	for _, v := range x {
+		sum += math.Exp(float64(v - top))
+	}
+	norm := top + float32(math.Log(sum))
+	for i := range x {
+		x[i] -= norm
+	}
+}
@@ -0,0 +1,65 @@
+package wtf
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEnsemble(t *testing.T) {
+	e := newTestEngine()
+	// The mixed logits are log-probabilities, which the multiplicative
+	// repetition penalty treats differently from raw logits; leave it out.
+	plain := greedyOpts(12)
+	plain.RepPenalty = 1
+	want, err := e.Generate("", "the sky", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Mixing a model with a copy of itself leaves every distribution as it
+	// was, in either mode and at any weight.
+	for _, mode := range []EnsembleMode{EnsembleProduct, EnsembleSum} {
+		for _, w := range []float32{0, 0.2, 1} {
+			ens, err := NewEnsemble(e, e.Model.Fork(), e.Tok, w, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := plain
+			opts.Ensemble = ens
+			for range 2 { // the second call reuses the ensemble's cached rows
+				got, err := e.Generate("", "the sky", opts)
+				if err != nil || got.Text != want.Text {
+					t.Fatalf("mode %d weight %g: %q, %v; want %q", mode, w, got.Text, err, want.Text)
+				}
+			}
+		}
+	}
+
+	// At weight 1 the reply is the second model's.
+	other := &Engine{Model: newTestModel(e.Tok.VocabSize), Tok: e.Tok}
+	down := other.Model.Weights.Layers[1].WDown.F32
+	for i := range down {
+		down[i] *= -3
+	}
+	alone, err := other.Generate("", "the sky", plain)
+	if err != nil || alone.Text == want.Text {
+		t.Fatalf("second model: %q, %v; want a reply of its own", alone.Text, err)
+	}
+	ens, err := NewEnsemble(e, other.Model.Fork(), e.Tok, 1, EnsembleProduct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := plain
+	opts.Ensemble = ens
+	if got, err := e.Generate("", "the sky", opts); err != nil || got.Text != alone.Text {
+		t.Fatalf("weight 1: %q, %v; want the second model's %q", got.Text, err, alone.Text)
+	}
+
+	small := newTestModel(e.Tok.VocabSize - 1)
+	if _, err := NewEnsemble(e, small, e.Tok, 0.2, EnsembleProduct); !errors.Is(err, ErrEnsembleVocab) {
+		t.Fatalf("mismatched vocab: %v", err)
+	}
+	if _, err := NewEnsemble(e, e.Model.Fork(), e.Tok, 1.5, EnsembleProduct); err == nil {
+		t.Fatal("weight 1.5 accepted")
+	}
+}
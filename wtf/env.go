@@ -0,0 +1,187 @@
+package wtf
+
+// env.go — WTF_* environment overrides, for containers that change knobs
+// without rebuilding or remounting a config. Precedence, lowest first:
+//
+//	DefaultGenOptions < config file (Load) < WTF_* variables (LoadEnv) < per-call options / CLI flags
+//
+// An unknown WTF_ variable is an error rather than silently ignored, so a
+// typo does not ship a deployment with the default it meant to change.
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix starts every variable LoadEnv reads.
+const EnvPrefix = "WTF_"
+
+type envVar struct {
+	name string // without EnvPrefix
+	set  func(c *Config, v string) error
+}
+
+func envInt(dst *int) func(*Config, string) error {
+	return func(_ *Config, v string) (err error) {
+		*dst, err = strconv.Atoi(v)
+		return err
+	}
+}
+
+func envFloat(dst *float32) func(*Config, string) error {
+	return func(_ *Config, v string) error {
+		f, err := strconv.ParseFloat(v, 32)
+		*dst = float32(f)
+		return err
+	}
+}
+
+func envBool(dst *bool) func(*Config, string) error {
+	return func(_ *Config, v string) (err error) {
+		*dst, err = strconv.ParseBool(v)
+		return err
+	}
+}
+
+func envDuration(dst *time.Duration) func(*Config, string) error {
+	return func(_ *Config, v string) (err error) {
+		*dst, err = time.ParseDuration(v)
+		return err
+	}
+}
+
+func (c *Config) envVars() []envVar {
+	g := &c.Gen
+	return []envVar{
+		{"THREADS", envInt(&c.Threads)},
+		{"CPUS", func(c *Config, v string) error { c.CPUs = v; return nil }},
+		{"KERNELS", func(c *Config, v string) error { c.Kernels = v; return nil }},
+		{"PPROF", func(c *Config, v string) error { c.PProf = v; return nil }},
+		{"HEALTH", func(c *Config, v string) error { c.Health = v; return nil }},
+		{"HTTP", func(c *Config, v string) error { c.HTTP = v; return nil }},
+		{"KEYS", func(c *Config, v string) error { c.Keys = v; return nil }},
+		{"MAX_PROMPT_BYTES", envInt(&c.MaxPromptBytes)},
+		{"CRASH_DIR", func(c *Config, v string) error { c.CrashDir = v; return nil }},
+		{"WARMUP", envInt(&c.Warmup)},
+		{"IDLE_UNLOAD", envDuration(&c.IdleUnload)},
+		{"ROUTER_BUDGET_MB", envInt(&c.Router.BudgetMB)},
+		{"SUMMARIZE_AT", func(c *Config, v string) (err error) {
+			c.Summarize.At, err = strconv.ParseFloat(v, 64)
+			return err
+		}},
+		{"GOGC", envInt(&c.GC.Percent)},
+		{"GOMEMLIMIT", func(c *Config, v string) error {
+			_, err := ParseMemoryLimit(v)
+			c.GC.MemoryLimit = v
+			return err
+		}},
+		{"MAX_TOKENS", envInt(&g.MaxTokens)},
+		{"TEMP", envFloat(&g.Temp)},
+		{"TOP_P", envFloat(&g.TopP)},
+		{"MIN_P", envFloat(&g.MinP)},
+		{"REP_PENALTY", envFloat(&g.RepPenalty)},
+		{"REP_WINDOW", envInt(&g.RepWindow)},
+		{"PRESENCE_PENALTY", envFloat(&g.PresencePenalty)},
+		{"FREQUENCY_PENALTY", envFloat(&g.FrequencyPenalty)},
+		{"EOS_BIAS", envFloat(&g.EOSBias)},
+		{"GRACE", envInt(&g.Grace.Limit)},
+		{"TARGET", envInt(&g.Length.Tokens)},
+		{"MAX_TIME", envDuration(&g.MaxTime)},
+		{"SINKS", envInt(&g.Sinks)},
+		{"WATCHDOG", envInt(&g.Watchdog.Retries)},
+		{"NICE", envDuration(&g.Nice)},
+		{"RUN_AHEAD", envBool(&g.RunAhead)},
+		{"CONTEXT_BUDGET", envInt(&g.ContextBudget)},
+		{"SEED", func(c *Config, v string) (err error) {
+			c.Gen.Seed, err = strconv.ParseInt(v, 10, 64)
+			return err
+		}},
+		{"SCRUB_PII", func(c *Config, v string) error {
+			on, err := strconv.ParseBool(v)
+			c.Filters.ScrubPII, c.Gen.ScrubPII = on, 0
+			return err
+		}},
+		{"INJECTION", func(c *Config, v string) error { c.Filters.Injection = v; return nil }},
+		{"MULTILINGUAL", func(c *Config, v string) error {
+			on, err := strconv.ParseBool(v)
+			c.Gen.Multilingual = nil
+			if on {
+				c.Gen.Multilingual = &MultilingualMode{}
+			}
+			return err
+		}},
+		{"NONFINITE", func(c *Config, v string) (err error) {
+			c.Gen.NonFinite, err = ParseNonFinitePolicy(v)
+			return err
+		}},
+		{"STRIP", func(c *Config, v string) error { c.Filters.Strip = v; return nil }},
+		{"LANG", func(c *Config, v string) (err error) {
+			c.Gen.Language, err = ParseLanguageTarget(v)
+			return err
+		}},
+		{"SAFETY", func(c *Config, v string) error { c.Filters.Safety = v; return nil }},
+		{"SAFETY_OFF", func(c *Config, v string) error {
+			c.Filters.SafetyOff = strings.Split(v, ",")
+			return nil
+		}},
+		{"WEBHOOK", func(c *Config, v string) error {
+			c.Webhook.URLs = strings.Split(v, ",")
+			return nil
+		}},
+		{"WEBHOOK_SECRET", func(c *Config, v string) error { c.Webhook.Secret = v; return nil }},
+		{"MODEL_ALLOW", func(c *Config, v string) error {
+			c.Model.Allow = strings.Split(v, ",")
+			return nil
+		}},
+		{"INT8", envBool(&c.Model.Int8)},
+		{"STREAM", envBool(&c.Model.Stream)},
+		{"CACHE_SIZE", envInt(&c.Cache.Size)},
+		{"CACHE_TTL", envDuration(&c.Cache.TTL)},
+		{"CACHE_PATH", func(c *Config, v string) error { c.Cache.Path = v; return nil }},
+		{"CACHE_ALL", func(c *Config, v string) error {
+			all, err := strconv.ParseBool(v)
+			c.Cache.Policy = CacheSeeded
+			if all {
+				c.Cache.Policy = CacheAll
+			}
+			return err
+		}},
+	}
+}
+
+// EnvNames lists the variables LoadEnv understands, sorted.
+func EnvNames() []string {
+	var names []string
+	for _, ev := range NewConfig().envVars() {
+		names = append(names, EnvPrefix+ev.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadEnv lays the WTF_* entries of environ (os.Environ() format) over c.
+func (c *Config) LoadEnv(environ []string) error {
+	vars := c.envVars()
+	for _, kv := range environ {
+		k, v, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutPrefix(k, EnvPrefix)
+		if !ok {
+			continue
+		}
+		i := slices.IndexFunc(vars, func(ev envVar) bool { return ev.name == name })
+		if i < 0 {
+			return fmt.Errorf("%s: unknown variable (see EnvNames)", k)
+		}
+		if err := vars[i].set(c, strings.TrimSpace(v)); err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+	}
+	if err := c.resolve(); err != nil {
+		return fmt.Errorf("environment: %w", err)
+	}
+	return nil
+}
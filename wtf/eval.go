@@ -0,0 +1,74 @@
+package wtf
+
+// eval.go — raw access for hosts that score or sample on their own: Eval
+// runs a prompt and leaves its next-token logits in place, Logits copies
+// them out, EvalToken feeds one more token. A host loop of EvalToken →
+// Logits → pick drives generation entirely from outside. The logits stay
+// valid until the next call that uses the engine.
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoLogits is returned by Logits when the cache holds no evaluated
+// tokens: nothing was run yet, or the weights were released and reloaded
+// since (see idle.go).
+var ErrNoLogits = errors.New("no logits: Eval first")
+
+// Eval puts prompt (after the named persona's anchor; "" = raw, BOS +
+// prompt) through the model and returns how many tokens the cache now holds
+// — the position the next token goes at.
+func (e *Engine) Eval(persona, prompt string) (_ int, err error) {
+	defer e.contain(&err, CrashRequest{Op: "eval", Persona: persona, PromptBytes: len(prompt)})
+	if err = e.lock(); err != nil {
+		return 0, err
+	}
+	defer e.unlock()
+	tokens, err := e.evalLocked(persona, prompt, 0)
+	return len(tokens), err
+}
+
+// Logits copies the current next-token logits into dst (grown to VocabSize
+// if short) and returns it, or ErrNoLogits when there are none to copy.
+func (e *Engine) Logits(dst []float32) ([]float32, error) {
+	if err := e.lock(); err != nil {
+		return dst, err
+	}
+	defer e.unlock()
+	if len(e.Model.State.Tokens) == 0 {
+		return dst, ErrNoLogits
+	}
+	n := e.Model.Config.VocabSize
+	if cap(dst) < n {
+		dst = make([]float32, n)
+	}
+	dst = dst[:n]
+	copy(dst, e.Model.State.Logits)
+	return dst, nil
+}
+
+// EvalToken runs token id at position pos and leaves the logits for pos+1.
+// pos may be at most the number of tokens the cache holds (Eval's result,
+// then +1 per EvalToken); a smaller pos rewinds and branches from there.
+func (e *Engine) EvalToken(id, pos int) (err error) {
+	defer e.contain(&err, CrashRequest{Op: "eval_token"})
+	if err = e.lock(); err != nil {
+		return err
+	}
+	defer e.unlock()
+	m := e.Model
+	if id < 0 || id >= m.Config.VocabSize {
+		return fmt.Errorf("eval: token %d out of vocab range", id)
+	}
+	if pos < 0 || pos > len(m.State.Tokens) {
+		return fmt.Errorf("eval: position %d, cache holds %d tokens", pos, len(m.State.Tokens))
+	}
+	if pos >= m.Config.SeqLen {
+		return fmt.Errorf("eval: %w: position %d, context is %d", ErrContextOverflow, pos, m.Config.SeqLen)
+	}
+	e.claim(nil)
+	m.Forward(id, pos)
+	m.State.Pos = pos + 1
+	return nil
+}
@@ -0,0 +1,282 @@
+package wtf
+
+// experiment.go — A/B tests over sampler settings. An experiment is a set of
+// arms, each a SamplerOverrides with a traffic weight; every generation is
+// routed to one arm, and what came out (length, finish reason, timings, and
+// any rating given afterwards) is logged as a JSON line tagged with the arm.
+// Report summarises the arms; ReadExperimentLog rebuilds the same summary
+// from a log, so the numbers survive restarts and can be compared offline.
+//
+//	{"name": "funny-but-coherent",
+//	 "arms": [
+//	   {"name": "control", "weight": 50},
+//	   {"name": "hot-minp", "weight": 25, "overrides": {"Temp": 1.1, "MinP": 0.05}},
+//	   {"name": "penalized", "weight": 25, "overrides": {"PresencePenalty": 0.4}}
+//	 ]}
+//
+// Arm overrides go over the caller's options; a persona's own overrides
+// still win for the fields it sets.
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ExperimentArm is one sampler configuration under test.
+type ExperimentArm struct {
+	Name      string           `json:"name"`
+	Weight    float64          `json:"weight"` // share of traffic, relative to the other arms
+	Overrides SamplerOverrides `json:"overrides"`
+}
+
+// Experiment routes generations across its arms. Safe for concurrent use.
+type Experiment struct {
+	Name string          `json:"name"`
+	Arms []ExperimentArm `json:"arms"`
+
+	mu    sync.Mutex
+	log   *json.Encoder // nil = no log
+	stats map[string]*ArmStats
+}
+
+// ExperimentEvent is one log line: a generation, or (Score set) a rating
+// of one.
+type ExperimentEvent struct {
+	Time       time.Time    `json:"time"`
+	Experiment string       `json:"experiment"`
+	ID         string       `json:"id"`
+	Arm        string       `json:"arm"`
+	Persona    string       `json:"persona,omitempty"`
+	Prompt     string       `json:"prompt,omitempty"`
+	Text       string       `json:"text,omitempty"`
+	Tokens     int          `json:"tokens,omitempty"`
+	Finish     FinishReason `json:"finish,omitempty"`
+	TTFTMillis int64        `json:"ttft_ms,omitempty"`
+	Millis     int64        `json:"ms,omitempty"`
+	Retries    int          `json:"retries,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	Score      *float64     `json:"score,omitempty"`
+}
+
+// ArmStats summarises one arm.
+type ArmStats struct {
+	Arm        string
+	N          int // generations
+	Errors     int
+	Finish     map[FinishReason]int
+	MeanTokens float64
+	MeanTTFT   time.Duration
+	MeanTime   time.Duration
+	Rated      int // generations with a score
+	MeanScore  float64
+
+	tokens, ttft, ms int64
+	score            float64
+}
+
+// Outcome identifies a routed generation, for rating it later.
+type Outcome struct {
+	ID  string
+	Arm string
+}
+
+// LoadExperiment reads an experiment definition.
+func LoadExperiment(path string) (*Experiment, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("experiment: %w", err)
+	}
+	x := &Experiment{}
+	if err := json.Unmarshal(blob, x); err != nil {
+		return nil, fmt.Errorf("experiment %s: %w", path, err)
+	}
+	if err := x.validate(); err != nil {
+		return nil, fmt.Errorf("experiment %s: %w", path, err)
+	}
+	return x, nil
+}
+
+func (x *Experiment) validate() error {
+	if len(x.Arms) == 0 {
+		return fmt.Errorf("no arms")
+	}
+	seen := map[string]bool{}
+	for _, a := range x.Arms {
+		if a.Name == "" || seen[a.Name] {
+			return fmt.Errorf("arm names must be set and distinct, got %q", a.Name)
+		}
+		if a.Weight < 0 {
+			return fmt.Errorf("arm %q: negative weight", a.Name)
+		}
+		seen[a.Name] = true
+	}
+	return nil
+}
+
+// LogTo appends an ExperimentEvent per generation and rating to w.
+func (x *Experiment) LogTo(w io.Writer) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.log = json.NewEncoder(w)
+}
+
+// Pick returns the arm for a generation. A non-empty key (a user or chat
+// id) always lands on the same arm, so one person sees one configuration;
+// an empty key picks at random by weight.
+func (x *Experiment) Pick(key string) ExperimentArm {
+	var total float64
+	for _, a := range x.Arms {
+		total += a.Weight
+	}
+	if total <= 0 {
+		return x.Arms[0]
+	}
+	if key == "" {
+		key = newEventID()
+	}
+	sum := sha256.Sum256([]byte(x.Name + "\x00" + key))
+	u := float64(binary.BigEndian.Uint64(sum[:])>>11) / (1 << 53) * total
+	for _, a := range x.Arms {
+		if u < a.Weight {
+			return a
+		}
+		u -= a.Weight
+	}
+	return x.Arms[len(x.Arms)-1]
+}
+
+// Generate runs Engine.Generate on the arm Pick(key) chooses and logs the
+// outcome.
+func (x *Experiment) Generate(e *Engine, persona, prompt string, opts GenOptions, key string) (Result, Outcome, error) {
+	arm := x.Pick(key)
+	began := time.Now()
+	res, err := e.Generate(persona, prompt, arm.Overrides.apply(opts))
+	out := Outcome{ID: newEventID(), Arm: arm.Name}
+	ev := ExperimentEvent{
+		Time: began.UTC(), Experiment: x.Name, ID: out.ID, Arm: arm.Name,
+		Persona: persona, Prompt: prompt, Text: res.Text, Tokens: len(res.Tokens),
+		Finish: res.Finish, TTFTMillis: res.TTFT.Milliseconds(),
+		Millis: time.Since(began).Milliseconds(), Retries: res.Retries,
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	x.record(ev)
+	return res, out, err
+}
+
+// Rate records a score (any scale, e.g. thumbs = ±1) for a generation.
+func (x *Experiment) Rate(o Outcome, score float64) {
+	x.record(ExperimentEvent{Time: time.Now().UTC(), Experiment: x.Name, ID: o.ID, Arm: o.Arm, Score: &score})
+}
+
+func (x *Experiment) record(ev ExperimentEvent) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.stats == nil {
+		x.stats = make(map[string]*ArmStats)
+	}
+	addEvent(x.stats, ev)
+	if x.log != nil {
+		if err := x.log.Encode(ev); err != nil {
+			fmt.Fprintf(os.Stderr, "[wtf] experiment log: %v\n", err)
+		}
+	}
+}
+
+// Report summarises the arms, in definition order.
+func (x *Experiment) Report() []ArmStats {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	out := make([]ArmStats, 0, len(x.Arms))
+	for _, a := range x.Arms {
+		st := ArmStats{Arm: a.Name}
+		if s := x.stats[a.Name]; s != nil {
+			st = s.summary()
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// ReadExperimentLog rebuilds the per-arm summary from a log LogTo wrote,
+// arms in order of first appearance.
+func ReadExperimentLog(r io.Reader) ([]ArmStats, error) {
+	stats := make(map[string]*ArmStats)
+	var order []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), MaxFrame)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var ev ExperimentEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("experiment log line %d: %w", line, err)
+		}
+		if stats[ev.Arm] == nil {
+			order = append(order, ev.Arm)
+		}
+		addEvent(stats, ev)
+	}
+	out := make([]ArmStats, len(order))
+	for i, name := range order {
+		out[i] = stats[name].summary()
+	}
+	return out, sc.Err()
+}
+
+func addEvent(stats map[string]*ArmStats, ev ExperimentEvent) {
+	s := stats[ev.Arm]
+	if s == nil {
+		s = &ArmStats{Arm: ev.Arm, Finish: make(map[FinishReason]int)}
+		stats[ev.Arm] = s
+	}
+	switch {
+	case ev.Score != nil:
+		s.Rated++
+		s.score += *ev.Score
+	case ev.Error != "":
+		s.N++
+		s.Errors++
+	default:
+		s.N++
+		s.Finish[ev.Finish]++
+		s.tokens += int64(ev.Tokens)
+		s.ttft += ev.TTFTMillis
+		s.ms += ev.Millis
+	}
+}
+
+// summary fills in the means.
+func (s *ArmStats) summary() ArmStats {
+	out := *s
+	out.Finish = make(map[FinishReason]int, len(s.Finish))
+	for k, v := range s.Finish {
+		out.Finish[k] = v
+	}
+	if ok := int64(s.N - s.Errors); ok > 0 {
+		out.MeanTokens = float64(s.tokens) / float64(ok)
+		out.MeanTTFT = time.Duration(s.ttft/ok) * time.Millisecond
+		out.MeanTime = time.Duration(s.ms/ok) * time.Millisecond
+	}
+	if s.Rated > 0 {
+		out.MeanScore = s.score / float64(s.Rated)
+	}
+	return out
+}
+
+func newEventID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,83 @@
+package wtf
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExperiment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exp.json")
+	os.WriteFile(path, []byte(`{"name": "t", "arms": [
+		{"name": "short", "weight": 75, "overrides": {"MaxTokens": 2}},
+		{"name": "long", "weight": 25}]}`), 0o644)
+	x, err := LoadExperiment(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys are sticky; traffic follows the weights.
+	counts := map[string]int{}
+	for i := range 4000 {
+		key := fmt.Sprint("user", i)
+		a := x.Pick(key)
+		if x.Pick(key).Name != a.Name {
+			t.Fatalf("key %q moved arms", key)
+		}
+		counts[a.Name]++
+	}
+	if share := float64(counts["short"]) / 4000; share < 0.7 || share > 0.8 {
+		t.Fatalf("short arm got %.2f of traffic, want ~0.75", share)
+	}
+
+	e := newTestEngine()
+	var log bytes.Buffer
+	x.LogTo(&log)
+	opts := greedyOpts(5)
+	opts.Grace.Limit = 0
+	var short, long Outcome
+	for i := 0; short.ID == "" || long.ID == ""; i++ {
+		res, out, err := x.Generate(e, "", "the sky", opts, fmt.Sprint("user", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Arm == "short" {
+			short = out
+			if len(res.Tokens) > 2 {
+				t.Fatalf("short arm generated %d tokens, override not applied", len(res.Tokens))
+			}
+		} else {
+			long = out
+		}
+	}
+	x.Rate(short, 1)
+	x.Rate(short, -1)
+	x.Rate(long, 1)
+
+	live := x.Report()
+	if live[0].Arm != "short" || live[0].N == 0 || live[0].Rated != 2 || live[0].MeanScore != 0 || live[1].MeanScore != 1 {
+		t.Fatalf("report %+v", live)
+	}
+	// The log rebuilds the same numbers.
+	offline, err := ReadExperimentLog(&log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byArm := map[string]ArmStats{}
+	for _, s := range offline {
+		byArm[s.Arm] = s
+	}
+	for _, s := range live {
+		o := byArm[s.Arm]
+		if o.N != s.N || o.Rated != s.Rated || o.MeanScore != s.MeanScore || o.MeanTokens != s.MeanTokens {
+			t.Fatalf("arm %s: log gives %+v, live %+v", s.Arm, o, s)
+		}
+	}
+
+	os.WriteFile(path, []byte(`{"name": "t", "arms": [{"name": "a"}, {"name": "a"}]}`), 0o644)
+	if _, err := LoadExperiment(path); err == nil {
+		t.Fatal("duplicate arm names accepted")
+	}
+}
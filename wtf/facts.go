@@ -0,0 +1,72 @@
+package wtf
+
+// facts.go — what a session should not forget. The host hands a Session
+// short facts ("user's name is Sam") with Remember; every turn renders them
+// after the system message, newest first into FactBudget tokens, so a long
+// list costs a bounded prefix and old facts give way to new ones. The
+// rendered block only changes when the facts do, so turns in between keep
+// reusing the cached prefix. Facts are exported with the session.
+
+import (
+	"slices"
+	"strings"
+)
+
+// DefaultFactBudget is the token budget of a session's facts when
+// Session.FactBudget is 0.
+const DefaultFactBudget = 96
+
+// factsLead introduces the facts in the session's prompt.
+const factsLead = "Facts to keep in mind:"
+
+// Remember adds a fact to the session. A fact is user text like any
+// message: the prompt limit, Opts.Normalize, Opts.ScrubPII and
+// Opts.Injection apply to it. Blank facts are ignored; a repeated one
+// moves to the newest place.
+func (s *Session) Remember(fact string) error {
+	opts := s.Opts
+	fact, err := s.e.admit(fact, &opts)
+	if err != nil {
+		return err
+	}
+	fact = strings.Join(strings.Fields(fact), " ")
+	if fact == "" {
+		return nil
+	}
+	s.Facts = append(slices.DeleteFunc(s.Facts, func(f string) bool { return f == fact }), fact)
+	return nil
+}
+
+// Forget removes a fact and reports whether the session had it.
+func (s *Session) Forget(fact string) bool {
+	fact = strings.Join(strings.Fields(fact), " ")
+	n := len(s.Facts)
+	s.Facts = slices.DeleteFunc(s.Facts, func(f string) bool { return f == fact })
+	return len(s.Facts) < n
+}
+
+// factBlock renders the newest facts that fit the budget, in the order
+// they were remembered. The first fact, newest first, that does not fit
+// leaves out every older one too.
+func (s *Session) factBlock() string {
+	budget := s.FactBudget
+	if budget <= 0 {
+		budget = DefaultFactBudget
+	}
+	budget -= len(s.e.Tok.Encode(factsLead, false))
+	var kept []string
+	for _, f := range slices.Backward(s.Facts) {
+		line := "\n- " + f
+		n := len(s.e.Tok.Encode(line, false))
+		if n > budget {
+			break
+		}
+		budget -= n
+		kept = append(kept, line)
+	}
+	if len(kept) == 0 {
+		return ""
+	}
+	slices.Reverse(kept)
+	return factsLead + strings.Join(kept, "")
+}
@@ -0,0 +1,99 @@
+package wtf
+
+// fewshot.go — a bank of example Q/A pairs that the engine splices into chat
+// prompts. Each example's question is embedded once when it is added (see
+// embed.go); at generation time the examples closest to the user's question
+// are inserted as earlier turns, as many as the token budget allows.
+
+import (
+	"errors"
+	"slices"
+	"sort"
+)
+
+// Example is one few-shot question and the answer the model should imitate.
+type Example struct {
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+}
+
+type shot struct {
+	Example
+	vec []float32
+}
+
+// AddExample embeds ex.Question and adds ex to the engine's bank.
+func (e *Engine) AddExample(ex Example) error {
+	if ex.Question == "" || ex.Answer == "" {
+		return errors.New("example needs a question and an answer")
+	}
+	vec, err := e.Embed(ex.Question)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.shots = append(e.shots, shot{ex, vec})
+	return nil
+}
+
+// ClearExamples empties the bank.
+func (e *Engine) ClearExamples() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.shots = nil
+}
+
+// WithExamples returns msgs with up to k banked examples inserted as
+// user/assistant turns right after the system message. Examples are taken
+// most similar to the last user message first, skipping any that would push
+// the prompt built in format f past budget tokens; the closest one ends up
+// nearest the question. msgs is returned unchanged when the bank is empty.
+func (e *Engine) WithExamples(msgs []Message, f ChatFormat, k, budget int) ([]Message, error) {
+	if err := validateChat(msgs); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	shots := e.shots
+	e.mu.Unlock()
+	if len(shots) == 0 || k <= 0 {
+		return msgs, nil
+	}
+	query, err := e.Embed(msgs[len(msgs)-1].Content)
+	if err != nil {
+		return nil, err
+	}
+	order := make([]int, len(shots))
+	sim := make([]float32, len(shots))
+	for i, s := range shots {
+		order[i], sim[i] = i, dot(query, s.vec)
+	}
+	sort.SliceStable(order, func(a, b int) bool { return sim[order[a]] > sim[order[b]] })
+
+	head := 0
+	if msgs[0].Role == RoleSystem {
+		head = 1
+	}
+	var picked []Example // most similar first
+	build := func(extra []Example) []Message {
+		out := slices.Clone(msgs[:head])
+		for i := len(extra) - 1; i >= 0; i-- {
+			out = append(out, Message{RoleUser, extra[i].Question}, Message{RoleAssistant, extra[i].Answer})
+		}
+		return append(out, msgs[head:]...)
+	}
+	for _, i := range order {
+		if len(picked) == k {
+			break
+		}
+		try := append(picked[:len(picked):len(picked)], shots[i].Example)
+		tokens, err := e.Tok.BuildChat(build(try), f)
+		if err != nil {
+			return nil, err
+		}
+		if len(tokens) <= budget {
+			picked = try
+		}
+	}
+	return build(picked), nil
+}
@@ -0,0 +1,55 @@
+package wtf
+
+// fim.go — fill-in-the-middle. SmolLM2 inherits StarCoder's FIM specials;
+// when the vocab has them the model can write the text between a prefix and
+// a suffix (PSM order):
+//
+//   <fim_prefix>{prefix}<fim_suffix>{suffix}<fim_middle> → {middle}
+
+import "errors"
+
+// ErrNoFIM means the vocab lacks <fim_prefix>/<fim_suffix>/<fim_middle>.
+var ErrNoFIM = errors.New("vocab has no FIM tokens")
+
+// fimTokens returns the prefix/suffix/middle ids, or ErrNoFIM.
+func (t *Tokenizer) fimTokens() (pre, suf, mid int, err error) {
+	pre = t.FindSpecialToken("fim_prefix")
+	suf = t.FindSpecialToken("fim_suffix")
+	mid = t.FindSpecialToken("fim_middle")
+	if pre < 0 || suf < 0 || mid < 0 {
+		return 0, 0, 0, ErrNoFIM
+	}
+	return pre, suf, mid, nil
+}
+
+// Infill generates the text that belongs between prefix and suffix. The FIM
+// markers themselves stop generation (a model that emits one has finished
+// the middle), as does EOS.
+func (e *Engine) Infill(prefix, suffix string, opts GenOptions) (_ Result, err error) {
+	defer e.contain(&err, CrashRequest{Op: "infill", PromptBytes: len(prefix) + len(suffix), MaxTokens: opts.MaxTokens})
+	pre, suf, mid, err := e.Tok.fimTokens()
+	if err != nil {
+		return Result{}, err
+	}
+	if prefix, err = e.admit(prefix, &opts); err != nil {
+		return Result{}, err
+	}
+	if suffix, err = e.admit(suffix, &opts); err != nil {
+		return Result{}, err
+	}
+	tokens := e.Tok.bosPrefix()
+	tokens = append(tokens, pre)
+	tokens = append(tokens, e.Tok.Encode(prefix, false)...)
+	tokens = append(tokens, suf)
+	tokens = append(tokens, e.Tok.Encode(suffix, false)...)
+	tokens = append(tokens, mid)
+	opts.StopTokens = append(opts.StopTokens[:len(opts.StopTokens):len(opts.StopTokens)], pre, suf, mid)
+
+	if err := e.lock(); err != nil {
+		return Result{}, err
+	}
+	defer e.unlock()
+	e.claim(nil)
+	e.Model.Reset()
+	return finishErr(decode(e.Model, e.Tok, tokens, 0, opts), e.Model, len(tokens))
+}
@@ -0,0 +1,211 @@
+package wtf
+
+// fuzz_test.go — native fuzz targets for the two parsers that take bytes
+// from outside: the tokenizer (any prompt) and the GGUF reader (any file
+// handed to -model). The seeds below run with every go test; to search for
+// new inputs, `make fuzz` (or go test -fuzz=FuzzLoadGGUF ./wtf). Inputs that
+// fail are written to testdata/fuzz/<target>/ and replay from then on.
+// FuzzMergeQueue holds the heap BPE merge to the quadratic one it replaced.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// newByteTokenizer is newTestTokenizer with every byte in the vocab, the
+// way a real GPT-2 vocab has it, so any input has an encoding.
+func newByteTokenizer() *Tokenizer {
+	meta := &GGUFMetadata{TokenModel: "gpt2"}
+	for _, s := range []string{"<|endoftext|>", "<|im_start|>", "<|im_end|>"} {
+		meta.TokenList = append(meta.TokenList, s)
+		meta.TokenTypes = append(meta.TokenTypes, 3)
+	}
+	for b := 0; b < 256; b++ {
+		meta.TokenList = append(meta.TokenList, gpt2ByteToUnicode[b])
+		meta.TokenTypes = append(meta.TokenTypes, 1)
+	}
+	meta.TokenMerges = []string{"Ġ t", "h e", "Ġt he", "o r", "a c", "Ã ©"}
+	meta.TokenList = append(meta.TokenList, "Ġt", "he", "Ġthe", "or", "ac", "Ã©")
+	for len(meta.TokenTypes) < len(meta.TokenList) {
+		meta.TokenTypes = append(meta.TokenTypes, 1)
+	}
+	meta.VocabSize = len(meta.TokenList)
+	return NewTokenizer(meta)
+}
+
+func FuzzEncodeDecode(f *testing.F) {
+	for _, s := range []string{"", "the oracle", "<|im_start|>user\nlol<|im_end|>", "café ’ 🤡",
+		"\x00\xff\xfe", "<|im_", "the\n\n\tthe", strings.Repeat("ac", 40)} {
+		f.Add(s)
+	}
+	tok := newByteTokenizer()
+	f.Fuzz(func(t *testing.T, s string) {
+		ids := tok.Encode(s, true)
+		for _, id := range ids {
+			if id < 0 || id >= tok.VocabSize {
+				t.Fatalf("Encode(%q) produced id %d outside the vocab", s, id)
+			}
+		}
+		for sp := range tok.specialTokens {
+			if strings.Contains(s, sp) {
+				return // control tokens decode to nothing, by design
+			}
+		}
+		if got := tok.Decode(ids); got != s {
+			t.Fatalf("Decode(Encode(%q)) = %q", s, got)
+		}
+		d := tok.NewStreamDecoder()
+		var sb strings.Builder
+		for _, id := range ids[1:] { // DecodeToken spells BOS out
+			sb.WriteString(d.Write(tok.DecodeToken(id)))
+		}
+		sb.WriteString(d.Flush())
+		if utf8.ValidString(s) && sb.String() != s {
+			t.Fatalf("streamed decode of %q = %q", s, sb.String())
+		}
+	})
+}
+
+// newScoreTokenizer is a SentencePiece vocab of every 1-4 letter string
+// over "abc" plus ▁, scored from 0 to 3, so merges chain and scores tie.
+func newScoreTokenizer() *Tokenizer {
+	meta := &GGUFMetadata{TokenModel: "llama", TokenList: []string{"<s>", "</s>", "▁"}, TokenScores: []float32{0, 0, 0}}
+	words := []string{""}
+	for n := 1; n <= 4; n++ {
+		var longer []string
+		for _, w := range words {
+			for _, c := range "abc" {
+				longer = append(longer, w+string(c))
+			}
+		}
+		for _, w := range longer {
+			h := 0
+			for _, c := range w {
+				h = h*7 + int(c)
+			}
+			meta.TokenList = append(meta.TokenList, w)
+			meta.TokenScores = append(meta.TokenScores, float32(h%4))
+		}
+		words = longer
+	}
+	for range meta.TokenList {
+		meta.TokenTypes = append(meta.TokenTypes, 1)
+	}
+	meta.TokenTypes[0], meta.TokenTypes[1] = 3, 3
+	meta.EosID = 1
+	meta.VocabSize = len(meta.TokenList)
+	return NewTokenizer(meta)
+}
+
+// quadraticMerge is the BPE merge mergeQueue replaced: rescan every pair
+// after every merge, best rank (GPT-2) or score (SentencePiece) first,
+// leftmost on a tie.
+func quadraticMerge(t *Tokenizer, symbols []string) []string {
+	for {
+		best, bestIdx := math.Inf(1), -1
+		for i := 0; i < len(symbols)-1; i++ {
+			if t.IsGPT2 {
+				if rank, ok := t.mergePriority[symbols[i]+" "+symbols[i+1]]; ok && float64(rank) < best {
+					best, bestIdx = float64(rank), i
+				}
+			} else if id, ok := t.tokenToID[symbols[i]+symbols[i+1]]; ok && id < len(t.Scores) &&
+				t.Scores[id] > -1e30 && -float64(t.Scores[id]) < best {
+				best, bestIdx = -float64(t.Scores[id]), i
+			}
+		}
+		if bestIdx < 0 {
+			return symbols
+		}
+		merged := symbols[bestIdx] + symbols[bestIdx+1]
+		symbols = append(append(append([]string{}, symbols[:bestIdx]...), merged), symbols[bestIdx+2:]...)
+	}
+}
+
+func FuzzMergeQueue(f *testing.F) {
+	for _, s := range []string{"", "a", "the oracle", "abcabcabc", "aaaaaaaa", "cab bac abba",
+		strings.Repeat("ac", 40), "ééé the"} {
+		f.Add(s)
+	}
+	toks := []*Tokenizer{newByteTokenizer(), newScoreTokenizer()}
+	f.Fuzz(func(t *testing.T, s string) {
+		for _, tok := range toks {
+			var symbols []string
+			if tok.IsGPT2 {
+				for _, b := range []byte(s) {
+					symbols = append(symbols, gpt2ByteToUnicode[b])
+				}
+			} else {
+				symbols = tok.initialTokenizeSP(strings.ReplaceAll(s, " ", "▁"))
+			}
+			want := tok.symbolsToIDs(quadraticMerge(tok, slices.Clone(symbols)))
+			if got := tok.symbolsToIDs(tok.bpeMerge(symbols)); !slices.Equal(got, want) {
+				t.Fatalf("gpt2 %v, %q: merged to %v, quadratic merge gives %v", tok.IsGPT2, s, got, want)
+			}
+		}
+	})
+}
+
+// tensorInfoGGUF is a GGUF file declaring one f32 tensor, followed by 128
+// bytes of data.
+func tensorInfoGGUF(ndims uint32, dims [4]uint64, offset uint64) []byte {
+	var b bytes.Buffer
+	le := func(v any) { binary.Write(&b, binary.LittleEndian, v) }
+	le(uint32(ggufMagic))
+	le(uint32(ggufVersion))
+	le(uint64(1))
+	le(uint64(0))
+	le(uint64(1))
+	b.WriteString("w")
+	le(ndims)
+	for d := uint32(0); d < ndims; d++ {
+		le(dims[d%4])
+	}
+	le(uint32(dtypeF32))
+	le(offset)
+	for b.Len()%32 != 0 {
+		b.WriteByte(0)
+	}
+	b.Write(make([]byte, 128))
+	return b.Bytes()
+}
+
+func FuzzLoadGGUF(f *testing.F) {
+	_, blob := writeTestGGUF(f, [][2]string{{"general.name", "WTForacle"}, {"tokenizer.ggml.model", "gpt2"}})
+	f.Add(blob)
+	tok := newTestTokenizer()
+	model, err := os.ReadFile(writeModelGGUF(f, newTestModel(tok.VocabSize)))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(model)
+	f.Add(model[:200]) // cut inside the tensor infos
+	// Inputs that used to panic the reader.
+	f.Add(tensorInfoGGUF(5, [4]uint64{32, 1}, 0))                // more dims than GGUFTensorInfo holds
+	f.Add(tensorInfoGGUF(2, [4]uint64{32, 1}, math.MaxUint64-8)) // offset + size wraps around
+	dir := f.TempDir()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		path := filepath.Join(dir, "fuzz.gguf")
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		g, err := LoadGGUF(path)
+		if err != nil {
+			return
+		}
+		for name := range g.Tensors {
+			b, info, err := g.GetTensor(name)
+			if err == nil && uint64(len(b)) != tensorBytes(info) {
+				t.Fatalf("%s: %d bytes, want %d", name, len(b), tensorBytes(info))
+			}
+		}
+		tk := NewTokenizer(&g.Meta)
+		tk.Decode(tk.Encode("the oracle <|im_end|>", true))
+	})
+}
@@ -0,0 +1,98 @@
+package wtf
+
+// gc.go — the Go collector's share of the host, for embedders that see
+// latency spikes from a runtime they did not choose. SetGC sets what GOGC
+// and GOMEMLIMIT set, from code or config instead of the environment the
+// process happened to start with. Decoding itself allocates next to
+// nothing (see arena.go), so a generous Percent under a MemoryLimit keeps
+// collections rare without letting the heap run away.
+//
+// Buffers handed to the C kernels are not pinned: the Go heap does not
+// move, and notorch only uses a pointer for the length of the call, which
+// the cgo rules already cover. runtime.Pinner is for C that keeps a
+// pointer afterwards, and nothing here does.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// GCConfig tunes the collector for the whole process.
+type GCConfig struct {
+	Percent     int    `json:"percent"`      // GOGC: 0 leaves it alone, -1 turns the collector off
+	MemoryLimit string `json:"memory_limit"` // GOMEMLIMIT syntax, e.g. "1536MiB"; "" leaves it alone, "off" lifts it
+}
+
+// ErrGCUnbounded is returned for a collector turned off with no memory
+// limit to fall back on: the heap would grow until the OS kills the host.
+var ErrGCUnbounded = errors.New("GC off needs a memory limit")
+
+// SetGC applies c and returns the settings it replaced, in the same form:
+// fields c left alone come back zero, so SetGC(prev) undoes the call.
+func SetGC(c GCConfig) (GCConfig, error) {
+	limit := int64(-1) // debug.SetMemoryLimit: negative only reports
+	if c.MemoryLimit != "" {
+		n, err := ParseMemoryLimit(c.MemoryLimit)
+		if err != nil {
+			return GCConfig{}, err
+		}
+		limit = n
+	}
+	if c.Percent < 0 {
+		current := limit
+		if current < 0 {
+			current = debug.SetMemoryLimit(-1)
+		}
+		if current == math.MaxInt64 {
+			return GCConfig{}, ErrGCUnbounded
+		}
+	}
+	var prev GCConfig
+	if limit >= 0 {
+		prev.MemoryLimit = formatMemoryLimit(debug.SetMemoryLimit(limit))
+	}
+	if c.Percent != 0 {
+		prev.Percent = debug.SetGCPercent(c.Percent)
+	}
+	return prev, nil
+}
+
+// ParseMemoryLimit reads a GOMEMLIMIT value: bytes with an optional B,
+// KiB, MiB, GiB or TiB suffix, or "off" (no limit).
+func ParseMemoryLimit(v string) (int64, error) {
+	s := strings.TrimSpace(v)
+	if s == "off" {
+		return math.MaxInt64, nil
+	}
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40}, {"B", 1}} {
+		if n, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, mult = n, u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("memory limit %q: want bytes with an optional KiB, MiB, GiB or TiB suffix, or off", v)
+	}
+	return n * mult, nil
+}
+
+func formatMemoryLimit(n int64) string {
+	switch {
+	case n == math.MaxInt64:
+		return "off"
+	case n%(1<<30) == 0:
+		return strconv.FormatInt(n>>30, 10) + "GiB"
+	case n%(1<<20) == 0:
+		return strconv.FormatInt(n>>20, 10) + "MiB"
+	}
+	return strconv.FormatInt(n, 10)
+}
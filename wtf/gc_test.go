@@ -0,0 +1,45 @@
+package wtf
+
+import (
+	"errors"
+	"math"
+	"runtime/debug"
+	"testing"
+)
+
+func TestParseMemoryLimit(t *testing.T) {
+	for in, want := range map[string]int64{
+		"1024": 1024, "512B": 512, "64KiB": 64 << 10, "1536MiB": 1536 << 20, "2GiB": 2 << 30, "off": math.MaxInt64,
+	} {
+		if got, err := ParseMemoryLimit(in); err != nil || got != want {
+			t.Errorf("ParseMemoryLimit(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "1GB", "-5", "lots", "99999999999TiB"} {
+		if _, err := ParseMemoryLimit(in); err == nil {
+			t.Errorf("ParseMemoryLimit(%q) accepted", in)
+		}
+	}
+}
+
+func TestSetGC(t *testing.T) {
+	prev, err := SetGC(GCConfig{Percent: 300, MemoryLimit: "3GiB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := debug.SetMemoryLimit(-1); got != 3<<30 {
+		t.Errorf("memory limit %d", got)
+	}
+	back, err := SetGC(prev)
+	if err != nil || back.Percent != 300 || back.MemoryLimit != "3GiB" {
+		t.Fatalf("restore: %+v, %v", back, err)
+	}
+
+	// Left-alone fields stay put and come back zero.
+	if p, err := SetGC(GCConfig{}); err != nil || p != (GCConfig{}) {
+		t.Fatalf("SetGC(zero) = %+v, %v", p, err)
+	}
+	if _, err := SetGC(GCConfig{Percent: -1, MemoryLimit: "off"}); !errors.Is(err, ErrGCUnbounded) {
+		t.Fatalf("GC off without a limit: %v", err)
+	}
+}
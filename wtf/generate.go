@@ -0,0 +1,671 @@
+package wtf
+
+// generate.go — the decode loop: prefill, repetition penalty, sampling,
+// grace-period stop, cycle detection, deadline.
+//
+// Lives in the package (not the CLI) so the engine can start decoding on top
+// of a KV cache that already holds a cached persona prefix.
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// GenOptions are the per-call generation knobs. Start from DefaultGenOptions —
+// the zero value is not a usable config.
+type GenOptions struct {
+	MaxTokens int
+	Temp      float32
+	TopP      float32 // >= 1 switches to top-k 50
+	MinP      float32 // drop tokens below MinP × the top token's probability (0 = off)
+	RepWindow int     // repeat-last-n: the penalties below look at this many generated tokens
+
+	// Penalties over the window. All are per call; 1 / 0 / 0 turns them off.
+	// The window only ever holds sampled tokens: the prompt, the persona
+	// anchor and ForcePrefix are never penalized, so a reply is free to
+	// name the subject of the question.
+	RepPenalty       float32 // multiplicative (llama.cpp repeat penalty), once per occurrence in the window
+	PresencePenalty  float32 // subtracted once from every token in the window
+	FrequencyPenalty float32 // subtracted per occurrence in the window
+
+	Grace  GracePolicy
+	Cycle  CyclePolicy
+	Length LengthTarget
+
+	// EOSBias is added to the EOS logit at every step: positive ends replies
+	// sooner, negative keeps the model from quitting early.
+	EOSBias float32
+
+	// MaxTime bounds wall-clock time for the whole call, prefill included.
+	// When it runs out the partial reply is returned with FinishTimeout.
+	// 0 means no limit.
+	MaxTime time.Duration
+
+	// TokenHealing backs off the last prompt token and makes the first
+	// sampled token extend its text (see heal.go).
+	TokenHealing bool
+
+	// ForcePrefix is teacher-forced after the prompt: the reply always
+	// starts with it and sampling begins right after. It is part of
+	// Result.Text but does not count against MaxTokens.
+	ForcePrefix string
+
+	// StopTokens end generation like EOS does (FinishStop); the stop token
+	// itself is not part of the reply.
+	StopTokens []int
+
+	// RoleHeaders end generation (FinishStop) where one starts a line of
+	// the reply, cutting it off: the model has begun the next turn (see
+	// roles.go). Chats and sessions default to ChatHeaders of their format;
+	// an empty, non-nil list turns that off.
+	RoleHeaders []string
+
+	// Sinks > 0 lets a reply run past SeqLen: when the cache fills, the
+	// first Sinks rows stay (attention sinks) and the oldest quarter of the
+	// rest is evicted. 0 stops with FinishContext as before.
+	Sinks int
+
+	// ContextBudget caps the tokens of retrieved snippets that replace
+	// ContextMarker (0 = DefaultContextBudget; see retrieve.go).
+	ContextBudget int
+
+	// Normalize is applied to the prompt text (and chat / infill inputs)
+	// before encoding. 0 leaves it as given.
+	Normalize Normalization
+
+	// ScrubPII replaces the selected kinds of personal data in the prompt
+	// (and chat / infill / session inputs) with placeholders before
+	// encoding (see pii.go). Applied after Normalize.
+	ScrubPII PIIKind
+
+	// Injection screens user text — not the persona anchor or system
+	// message — for special tokens and chat markers (see inject.go).
+	Injection InjectionPolicy
+
+	// Strip keeps emoji and / or markdown out of the reply by masking them
+	// while sampling (see strip.go).
+	Strip StripKind
+
+	// Language biases sampling toward one language's script and reports
+	// the reply's language in Result.Language (see lang.go).
+	Language LanguageTarget
+
+	// Multilingual drops the Language bias and English-only assumptions
+	// and retunes the sampler per script (see multilingual.go).
+	Multilingual *MultilingualMode
+
+	// JSON runs the reply through RepairJSON into Result.JSON. Text stays
+	// exactly what the model wrote.
+	JSON bool
+
+	// AttentionMap records one layer's attention weights at one step into
+	// Result.Attention (see attnmap.go). Disables RunAhead for the call.
+	AttentionMap *AttentionProbe `json:"-"`
+
+	// Trace gets one TraceEvent per decode step (see trace.go; TraceJSON
+	// writes them as JSON lines). Runs on the decoding goroutine.
+	Trace func(TraceEvent) `json:"-"`
+
+	// Telemetry records a TokenStat per generated token in Result.Stats.
+	Telemetry bool
+
+	// Watchdog retries degenerate replies (see watchdog.go).
+	Watchdog WatchdogPolicy
+
+	// NonFinite says what happens when a forward pass yields NaN or Inf
+	// logits: abort, or recompute the KV cache and retry (see nonfinite.go).
+	NonFinite NonFinitePolicy
+
+	// Style scores the reply into Result.Style and resamples replies that
+	// fail it (see style.go).
+	Style *StyleGate
+
+	// RunAhead speculatively runs the forward pass of the likeliest next
+	// token while the current one is sampled, decoded and streamed, and
+	// keeps it when the sampler agrees (see runahead.go). Output is
+	// unchanged; it pays off when sampling is mostly top-1 or OnToken is slow.
+	RunAhead bool
+
+	// Nice > 0 makes the call a polite background tenant: it pauses this
+	// long after every forward pass (prefill included), and on Linux it
+	// runs on a thread at the lowest scheduling priority. Cap the threads
+	// the whole engine may use with SetThreads.
+	Nice time.Duration
+
+	// OnToken streams the reply: it gets the forced prefix once the prompt
+	// is prefilled, then each sampled piece as soon as it is decoded —
+	// whole UTF-8 characters only, so a piece may be held for a token or two.
+	// Result.Text stays authoritative — a sentence-mode grace cut can trim
+	// a tail that was already streamed. Runs on the decoding goroutine.
+	OnToken func(piece string) `json:"-"`
+
+	// Veto sees every sampled token (id and text; EOS and stop tokens have
+	// an empty or special piece) before it is accepted. Returning true
+	// rejects it: the step is resampled with that token masked. After
+	// MaxVetoes rejections in a row the call ends with FinishVeto.
+	// Runs on the decoding goroutine.
+	Veto func(id int, piece string) bool `json:"-"`
+
+	// Safety screens the reply against a lexicon (see safety.go): mask
+	// categories veto tokens like Veto does, redact categories rewrite
+	// Result.Text. Streamed pieces are not redacted — stream under mask.
+	Safety *SafetyFilter `json:"-"`
+
+	// Record captures what Replay needs to reproduce the call bit for bit
+	// into Result.Recording (see replay.go). A 0 Seed is fixed first.
+	Record bool
+
+	// Seed makes sampling reproducible. 0 seeds from the clock.
+	Seed int64
+
+	// ToolCalls holds a CALL( in the reply to the registered tools'
+	// grammar and ends the reply at the call with FinishToolCall (see
+	// tools.go).
+	ToolCalls bool
+
+	// Vars fill template variables in the persona anchor and system
+	// message for this call, over the engine's (see template.go).
+	Vars map[string]string
+
+	// Ensemble mixes a second model's next-token distribution into every
+	// step (see ensemble.go). Nil or a 0 Weight decodes with one model.
+	Ensemble *Ensemble `json:"-"`
+
+	tools    []Tool   // the engine's, when ToolCalls is set
+	tape     *rngTape // RNG draws being recorded or replayed
+	injected bool     // guard stripped markers, reported in Result.Injected
+	out      []byte   // caller's reply buffer, written in place (see GenerateTo)
+}
+
+// DefaultGenOptions returns the settings the CLI has always shipped with.
+func DefaultGenOptions() GenOptions {
+	return GenOptions{
+		MaxTokens:  200,
+		Temp:       0.9,
+		TopP:       0.9,
+		RepPenalty: 1.15,
+		RepWindow:  64,
+		Grace:      DefaultGracePolicy(),
+		Cycle:      DefaultCyclePolicy(),
+	}
+}
+
+// FinishReason says why a generation stopped.
+type FinishReason string
+
+const (
+	FinishStop      FinishReason = "stop"      // model emitted EOS
+	FinishLength    FinishReason = "length"    // MaxTokens (+ grace) reached
+	FinishCycle     FinishReason = "cycle"     // loop detector fired
+	FinishContext   FinishReason = "context"   // KV cache full (Sinks off)
+	FinishTimeout   FinishReason = "timeout"   // MaxTime elapsed
+	FinishOverflow  FinishReason = "overflow"  // prompt longer than the context; nothing decoded
+	FinishVeto      FinishReason = "veto"      // Veto or Safety rejected MaxVetoes candidates for one step
+	FinishNonFinite FinishReason = "nonfinite" // NaN/Inf logits NonFinite could not recover from
+	FinishToolCall  FinishReason = "tool_call" // the reply ended in a tool call, see Result.ToolCall
+)
+
+// MaxVetoes bounds how many candidates Veto may reject for a single step.
+const MaxVetoes = 32
+
+// ErrContextOverflow is returned (with FinishOverflow) when the encoded
+// prompt leaves no room in the context to generate. Nothing is truncated:
+// shorten the input, or trim history with FitChat.
+var ErrContextOverflow = errors.New("prompt exceeds context")
+
+// ErrEmptyPrompt is returned when a prompt is empty or whitespace-only and
+// there is nothing else — no BOS, no persona anchor — to generate from.
+var ErrEmptyPrompt = errors.New("empty prompt")
+
+// Result is one finished generation.
+type Result struct {
+	Text   string
+	Tokens []int // sampled tokens, EOS excluded
+	Finish FinishReason
+	Stats  []TokenStat // one per Tokens entry when opts.Telemetry is set
+
+	Retries int // watchdog and style regenerations spent on this result
+
+	PromptTokens int           // tokens prefilled by this call (cached prefix excluded)
+	TTFT         time.Duration // call start → first sampled token (0 if none)
+	RunAheadHits int           // speculative forward passes kept (opts.RunAhead)
+	Redacted     int           // matches opts.Safety replaced in Text
+	Injected     bool          // user text had control markers (stripped, opts.Injection)
+	Cached       bool          // served from Engine.Cache; nothing was decoded
+
+	JSON      *JSONOutput   // set when opts.JSON
+	Style     *StyleReport  // set when opts.Style
+	Language  *Language     // the reply's, set when opts.Language is
+	Attention *AttentionMap // set when opts.AttentionMap and the step was reached
+	Recording *Recording    // set when opts.Record
+	ToolCall  *ToolCall     // set with FinishToolCall
+}
+
+// Generate runs one decode pass from scratch: BOS (when distinct from EOS) +
+// the encoded prompt, then sampling.
+func Generate(m *LlamaModel, tok *Tokenizer, prompt string, opts GenOptions) Result {
+	m.Reset()
+	tokens := tok.bosPrefix()
+	tokens = append(tokens, tok.Encode(prompt, false)...)
+	return decode(m, tok, tokens, 0, opts)
+}
+
+// applyPenalties applies the repetition, presence and frequency penalties
+// for the tokens counted in the window.
+func applyPenalties(logits []float32, counts map[int]int, opts *GenOptions) {
+	for t, n := range counts {
+		lg := logits[t]
+		for k := 0; k < n && opts.RepPenalty > 0 && opts.RepPenalty != 1; k++ {
+			if lg > 0 {
+				lg /= opts.RepPenalty
+			} else {
+				lg *= opts.RepPenalty
+			}
+		}
+		logits[t] = lg - opts.PresencePenalty - opts.FrequencyPenalty*float32(n)
+	}
+}
+
+// input prepares caller text for encoding: Normalize, then ScrubPII.
+func (opts *GenOptions) input(text string) string {
+	n := opts.Normalize
+	if opts.Multilingual != nil && n != 0 {
+		n |= NormKeepScript
+	}
+	return ScrubPII(Normalize(text, n), opts.ScrubPII)
+}
+
+// pause yields the CPU for opts.Nice between forward passes.
+func (opts *GenOptions) pause() {
+	if opts.Nice > 0 {
+		time.Sleep(opts.Nice)
+	}
+}
+
+// finishErr turns a FinishOverflow result into ErrContextOverflow with the
+// sizes involved, and a FinishNonFinite one into ErrNonFinite; any other
+// result passes through with a nil error.
+func finishErr(res Result, m *LlamaModel, promptLen int) (Result, error) {
+	switch res.Finish {
+	case FinishOverflow:
+		return res, fmt.Errorf("%w: %d tokens, context is %d", ErrContextOverflow, promptLen, m.Config.SeqLen)
+	case FinishNonFinite:
+		return res, fmt.Errorf("%w after %d tokens", ErrNonFinite, len(res.Tokens))
+	}
+	return res, nil
+}
+
+// bosPrefix returns [BOS] when the model has a BOS distinct from EOS, else
+// nothing. SmolLM2 uses the same id for both, and a leading EOS derails it.
+func (t *Tokenizer) bosPrefix() []int {
+	if t.BosID >= 0 && t.BosID != t.EosID {
+		return []int{t.BosID}
+	}
+	return nil
+}
+
+// decode prefills tokens[start:] on top of a KV cache that already holds
+// tokens[:start], then samples, regenerating under the watchdog if asked.
+// Rows [0, start) are left alone unless Sinks evicts, so a retry simply
+// decodes again. An eviction slides every row past the sinks, prefix
+// included; a retry after one decodes on top of the slid cache.
+func decode(m *LlamaModel, tok *Tokenizer, tokens []int, start int, opts GenOptions) Result {
+	if opts.Record {
+		return record(m, tok, tokens, start, opts)
+	}
+	var res Result
+	run := func() {
+		res = decodeOnce(m, tok, tokens, start, opts)
+		for try := 1; try <= opts.Watchdog.Retries && opts.Watchdog.degenerate(res, opts); try++ {
+			opts = opts.Watchdog.adjust(opts)
+			res = decodeOnce(m, tok, tokens, start, opts)
+			res.Retries = try
+		}
+		if opts.Style != nil && res.ToolCall == nil {
+			res = styleGate(m, tok, tokens, start, opts, res)
+		}
+	}
+	if opts.Nice > 0 {
+		lowPriority(run)
+	} else {
+		run()
+	}
+	return res
+}
+
+// decodeOnce is one decode pass. Reuses sampling buffers across tokens.
+func decodeOnce(m *LlamaModel, tok *Tokenizer, tokens []int, start int, opts GenOptions) Result {
+	began := time.Now()
+	var deadline time.Time
+	if opts.MaxTime > 0 {
+		deadline = began.Add(opts.MaxTime)
+	}
+	expired := func() bool { return !deadline.IsZero() && time.Now().After(deadline) }
+
+	out := opts.out[:0]
+	if opts.ForcePrefix != "" {
+		tokens = append(tokens[:len(tokens):len(tokens)], tok.Encode(opts.ForcePrefix, false)...)
+		out = append(out, opts.ForcePrefix...)
+	}
+
+	if len(tokens) > m.Config.SeqLen-1 {
+		return Result{Finish: FinishOverflow}
+	}
+	if len(tokens) == 0 {
+		return Result{} // nothing to condition on (see ErrEmptyPrompt)
+	}
+	if start == len(tokens) {
+		// Everything is cached (anchor alone) but the cache holds no
+		// logits: recompute the last row, which rewrites it unchanged.
+		start--
+	}
+
+	heal := ""
+	if opts.TokenHealing {
+		tokens, heal = tok.healTail(tokens, start)
+	}
+
+	// probe arms the attention recorder for the pass that picks token step.
+	// Calls without AttentionMap never touch m.probe, so it cannot race
+	// the run-ahead worker (which AttentionMap turns off).
+	var attn *AttentionMap
+	probe := func(step int) {
+		p := opts.AttentionMap
+		if p == nil {
+			return
+		}
+		m.probe = nil
+		if p.Step == step && p.Layer >= 0 && p.Layer < m.Config.NumLayers {
+			attn = &AttentionMap{Layer: p.Layer, Step: step}
+			m.probe = attn
+		}
+	}
+	if opts.AttentionMap != nil {
+		defer func() { m.probe = nil }()
+	}
+
+	// Prefill: only the last prompt token needs logits.
+	var fwd time.Duration // last forward pass, for Trace
+	pos := start
+	for i, t := range tokens[start:] {
+		if expired() {
+			return Result{Finish: FinishTimeout}
+		}
+		if start+i == len(tokens)-1 {
+			probe(0)
+			f0 := time.Now()
+			m.Forward(t, pos)
+			fwd = time.Since(f0)
+			if !opts.NonFinite.check(m, pos) {
+				return Result{Finish: FinishNonFinite, PromptTokens: pos + 1 - start}
+			}
+		} else {
+			m.prefill(t, pos)
+		}
+		pos++
+		opts.pause()
+	}
+	prompt := pos - start
+	ens := opts.Ensemble
+	if ens != nil && ens.Weight > 0 {
+		ens.mu.Lock()
+		defer ens.mu.Unlock()
+		ens.prefill(tokens)
+	} else {
+		ens = nil
+	}
+	stream := tok.NewStreamDecoder()
+	emit := func(piece string) {
+		if opts.OnToken != nil {
+			if s := stream.Write(piece); s != "" {
+				opts.OnToken(s)
+			}
+		}
+	}
+	emit(string(out))
+	var ttft time.Duration
+
+	var ahead *runAhead
+	hits := 0
+	if opts.RunAhead && m.tap == nil && opts.AttentionMap == nil {
+		ahead = m.runAhead()
+		defer ahead.finish(-1, -1) // after a panic too, or the worker blocks on done
+	}
+
+	sb := m.sampler(opts.Seed)
+	if opts.tape != nil {
+		sb.RNG = opts.tape.rng(opts.Seed)
+	}
+	vocab := m.Config.VocabSize
+	logits := m.State.Logits
+
+	base := opts
+	if opts.Multilingual != nil {
+		opts.Multilingual.prepare(&opts)
+	}
+
+	graceLimit := opts.Grace.Limit
+	inGrace := false
+	recent := make([]int, 0, opts.RepWindow)
+	var generated []int
+	var stats []TokenStat
+	counts := make(map[int]int, 64)
+	finish := FinishLength
+	var call *ToolCall
+
+	for i := 0; i < opts.MaxTokens+graceLimit; i++ {
+		if i >= opts.MaxTokens && !inGrace {
+			inGrace = true
+		}
+		if inGrace {
+			if n, stop := opts.Grace.cut(out); stop {
+				out = out[:n]
+				break
+			}
+		}
+		if expired() {
+			finish = FinishTimeout
+			break
+		}
+
+		if opts.Multilingual != nil {
+			opts.Multilingual.tune(&opts, &base, out)
+		}
+		if ens != nil {
+			ens.mix(logits, vocab)
+		}
+		var ev *TraceEvent
+		t0 := time.Now()
+		if opts.Trace != nil {
+			ev = &TraceEvent{Step: i, Pos: pos, Forward: fwd, Sampler: samplerName(&opts),
+				Penalties: make(map[int]float32, len(counts))}
+			for t := range counts {
+				ev.Penalties[t] = logits[t]
+			}
+		}
+		applyPenalties(logits, counts, &opts)
+		if ev != nil {
+			for t, before := range ev.Penalties {
+				ev.Penalties[t] = logits[t] - before
+			}
+		}
+
+		if heal != "" && i == 0 {
+			tok.healMask(logits, heal)
+		}
+		if opts.Strip != 0 {
+			tok.stripMask(logits, opts.Strip, out)
+		}
+		if len(opts.tools) > 0 {
+			tok.toolMask(logits, opts.tools, out)
+		}
+		if opts.Language.Code != "" {
+			tok.languageBias(logits, &opts.Language, out)
+		}
+		if tok.EosID >= 0 && tok.EosID < vocab {
+			bias := opts.EOSBias + opts.Length.bias(i)
+			logits[tok.EosID] += bias
+			if ev != nil {
+				ev.EOSBias = bias
+			}
+		}
+
+		if opts.MinP > 0 && opts.Temp > 0 {
+			ApplyMinP(logits, vocab, opts.Temp, opts.MinP)
+		}
+		if ev != nil {
+			ev.Top = topCandidates(tok, logits, vocab, opts.Temp, traceTop)
+		}
+
+		if ahead != nil {
+			if g := Argmax(logits, vocab); g != tok.EosID && !slices.Contains(opts.StopTokens, g) {
+				ahead.start(g, pos)
+			}
+		}
+
+		sample := func() int {
+			if opts.TopP < 1.0 {
+				return SampleTopP(logits, vocab, opts.Temp, opts.TopP, sb)
+			}
+			return SampleTopK(logits, vocab, opts.Temp, 50, sb)
+		}
+		rejected := func(id int) bool {
+			piece := tok.DecodeToken(id)
+			return opts.Veto != nil && opts.Veto(id, piece) || opts.Safety.blocks(out, piece) || opts.Strip.blocks(out, piece) ||
+				toolBlocks(opts.tools, out, piece)
+		}
+		next := sample()
+		vetoes := 0
+		for vetoes < MaxVetoes && rejected(next) {
+			if ev != nil {
+				ev.Vetoed = append(ev.Vetoed, next)
+			}
+			logits[next] = -1e30
+			next = sample()
+			vetoes++
+		}
+		if ev != nil {
+			ev.Chosen, ev.Piece, ev.Sample = next, tok.DecodeToken(next), time.Since(t0)
+			if vetoes == MaxVetoes {
+				ev.Chosen, ev.Piece = -1, ""
+			}
+			opts.Trace(*ev)
+		}
+		if vetoes == MaxVetoes {
+			finish = FinishVeto
+			break
+		}
+
+		counts[next]++
+		recent = append(recent, next)
+		if len(recent) > opts.RepWindow {
+			leaving := recent[0]
+			counts[leaving]--
+			if counts[leaving] <= 0 {
+				delete(counts, leaving)
+			}
+			recent = recent[1:]
+		}
+
+		if next == tok.EosID || slices.Contains(opts.StopTokens, next) {
+			finish = FinishStop
+			break
+		}
+
+		piece := tok.DecodeToken(next)
+		if heal != "" && i == 0 {
+			piece = strings.TrimPrefix(piece, heal)
+		}
+		if opts.out != nil && len(out)+len(piece) > cap(opts.out) {
+			finish = FinishLength // the caller's buffer is full (see GenerateTo)
+			break
+		}
+
+		generated = append(generated, next)
+		if opts.Cycle.exact(generated) {
+			generated = generated[:len(generated)-1]
+			finish = FinishCycle
+			break
+		}
+		if opts.Telemetry {
+			stats = append(stats, tokenStat(logits, vocab, opts.Temp, next))
+		}
+
+		if i == 0 {
+			ttft = time.Since(began)
+		}
+		out = append(out, piece...)
+		if n, ok := roleCut(out, opts.RoleHeaders, len(out)-len(piece)); ok {
+			if prev := len(out) - len(piece); n > prev {
+				emit(string(out[prev:n]))
+			}
+			out = out[:n]
+			finish = FinishStop
+			break
+		}
+		emit(piece)
+		if call = finishedCall(opts.tools, out); call != nil {
+			finish = FinishToolCall
+			break
+		}
+		if opts.Cycle.fuzzy(out) {
+			finish = FinishCycle
+			break
+		}
+		probe(i + 1)
+		f0 := time.Now()
+		if ahead.finish(next, pos) {
+			hits++
+		} else {
+			m.Forward(next, pos)
+		}
+		if ens != nil {
+			ens.m.Forward(next, pos)
+		}
+		fwd = time.Since(f0)
+		if !opts.NonFinite.check(m, pos) {
+			finish = FinishNonFinite
+			break
+		}
+		pos++
+		opts.pause()
+		if pos >= m.Config.SeqLen {
+			window := m.Config.SeqLen - opts.Sinks
+			if opts.Sinks <= 0 || window < 2 {
+				finish = FinishContext
+				break
+			}
+			if ens != nil {
+				ens.m.evictKV(opts.Sinks, max(window/4, 1), pos)
+			}
+			pos = m.evictKV(opts.Sinks, max(window/4, 1), pos)
+		}
+	}
+
+	ahead.finish(-1, -1) // a guess still running writes the cache
+	if finish != FinishStop {
+		if n, ok := rolePartial(out, opts.RoleHeaders); ok {
+			out = out[:n]
+		}
+	}
+	if rest := stream.Flush(); rest != "" && opts.OnToken != nil {
+		opts.OnToken(rest)
+	}
+	res := Result{Text: string(out), Tokens: generated, Finish: finish, Stats: stats,
+		PromptTokens: prompt, TTFT: ttft, RunAheadHits: hits, Injected: opts.injected, ToolCall: call}
+	if attn != nil && attn.Weights != nil {
+		res.Attention = attn
+	}
+	res.Text, res.Redacted = opts.Safety.Redact(res.Text)
+	if opts.JSON {
+		res.JSON = jsonOutput(res.Text)
+	}
+	if base.Language.Code != "" || opts.Multilingual != nil {
+		l := DetectLanguage(res.Text)
+		res.Language = &l
+	}
+	return res
+}
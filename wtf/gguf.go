@@ -14,9 +14,11 @@ package wtf
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/bits"
 	"os"
 	"strings"
 )
@@ -99,26 +101,70 @@ type GGUFTensorInfo struct {
 type GGUFFile struct {
 	Meta       GGUFMetadata
 	Tensors    map[string]*GGUFTensorInfo
-	TensorData []byte // mmap'd or read tensor data blob
-	DataOffset int64  // offset where tensor data starts in file
+	TensorData []byte     // mmap'd or read tensor data blob
+	DataOffset int64      // offset where tensor data starts in file
+	Provenance Provenance // file digest and general.* metadata
+
+	mapped []byte // the whole file, when opened with MapGGUF
 }
 
-func readString(r io.Reader) (string, error) {
+// Reader limits. Every count and length in a GGUF header is the file's
+// own claim, read before the bytes it describes; these keep a damaged or
+// hostile file from sizing our allocations. Real checkpoints sit far
+// below each (SmolLM2: 30 metadata entries, 273 tensors, 2MB of vocab).
+const (
+	ggufMaxMetadata  = 1 << 16 // metadata entries
+	ggufMaxTensors   = 1 << 16 // tensor infos
+	ggufMaxString    = 1 << 20 // bytes in one string (chat templates run to ~10KB)
+	ggufMaxArray     = 1 << 24 // elements in one metadata array
+	ggufMaxMetaBytes = 1 << 28 // the parsed metadata and tensor infos together
+)
+
+var (
+	// ErrGGUFLimit is returned for a file that asks for more than a reader
+	// limit allows (entries, string length, metadata size).
+	ErrGGUFLimit = errors.New("GGUF over reader limit")
+	// ErrGGUFMalformed is returned for a file whose header does not add up:
+	// bad magic, impossible shapes, tensors past the end of the file.
+	ErrGGUFMalformed = errors.New("malformed GGUF")
+)
+
+// metaBudget is what is left of ggufMaxMetaBytes while a header is parsed.
+type metaBudget int64
+
+// take charges n bytes, failing once the header would outgrow the budget.
+func (b *metaBudget) take(n uint64) error {
+	if n > uint64(*b) {
+		return fmt.Errorf("%w: metadata over %d MiB", ErrGGUFLimit, ggufMaxMetaBytes>>20)
+	}
+	*b -= metaBudget(n)
+	return nil
+}
+
+func readString(r io.Reader, b *metaBudget) (string, error) {
 	var length uint64
 	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
 		return "", err
 	}
-	if length > 1<<24 { // 16MB sanity limit
-		return "", fmt.Errorf("string too long: %d", length)
+	if length > ggufMaxString {
+		return "", fmt.Errorf("%w: string of %d bytes (max %d)", ErrGGUFLimit, length, ggufMaxString)
 	}
-	buf := make([]byte, length)
-	if _, err := io.ReadFull(r, buf); err != nil {
+	if err := b.take(16 + length); err != nil {
+		return "", err
+	}
+	// Grow with what actually arrives: a truncated file cannot make us
+	// allocate the 16MB its length field claims.
+	var sb strings.Builder
+	if n, err := io.CopyN(&sb, r, int64(length)); err != nil {
+		if err == io.EOF && n < int64(length) {
+			err = io.ErrUnexpectedEOF
+		}
 		return "", err
 	}
-	return string(buf), nil
+	return sb.String(), nil
 }
 
-func readValue(r io.Reader, vtype uint32) (interface{}, error) {
+func readValue(r io.Reader, vtype uint32, b *metaBudget) (interface{}, error) {
 	switch vtype {
 	case ggufTypeUint8:
 		var v uint8
@@ -153,7 +199,7 @@ func readValue(r io.Reader, vtype uint32) (interface{}, error) {
 		err := binary.Read(r, binary.LittleEndian, &v)
 		return v != 0, err
 	case ggufTypeString:
-		return readString(r)
+		return readString(r, b)
 	case ggufTypeUint64:
 		var v uint64
 		err := binary.Read(r, binary.LittleEndian, &v)
@@ -175,20 +221,26 @@ func readValue(r io.Reader, vtype uint32) (interface{}, error) {
 		if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
 			return nil, err
 		}
-		if count > 1<<24 {
-			return nil, fmt.Errorf("array too large: %d", count)
+		if count > ggufMaxArray {
+			return nil, fmt.Errorf("%w: array of %d elements (max %d)", ErrGGUFLimit, count, ggufMaxArray)
 		}
-		arr := make([]interface{}, count)
+		if elemType == ggufTypeArray {
+			return nil, fmt.Errorf("%w: nested array", ErrGGUFMalformed)
+		}
+		if err := b.take(16 * count); err != nil {
+			return nil, err
+		}
+		arr := make([]interface{}, 0, min(count, 1<<16))
 		for i := uint64(0); i < count; i++ {
-			v, err := readValue(r, elemType)
+			v, err := readValue(r, elemType, b)
 			if err != nil {
 				return nil, err
 			}
-			arr[i] = v
+			arr = append(arr, v)
 		}
 		return arr, nil
 	default:
-		return nil, fmt.Errorf("unknown GGUF type: %d", vtype)
+		return nil, fmt.Errorf("%w: unknown value type %d", ErrGGUFMalformed, vtype)
 	}
 }
 
@@ -243,8 +295,22 @@ func ggmlBlockSize(t uint32) int {
 		return 18 // 2 (fp16 scale) + 16 (32 x 4-bit values)
 	case ggmlTypeQ4_1:
 		return 20 // 2 (min) + 2 (scale) + 16 data
+	case ggmlTypeQ5_0:
+		return 22 // 2 (scale) + 4 (high bits) + 16 data
+	case ggmlTypeQ5_1:
+		return 24 // 2 (min) + 2 (scale) + 4 (high bits) + 16 data
 	case ggmlTypeQ8_0:
 		return 34 // 2 (fp16 scale) + 32 (32 x 8-bit)
+	case ggmlTypeQ8_1:
+		return 36 // 2 (scale) + 2 (sum) + 32 data
+	case ggmlTypeQ2_K:
+		return 84 // 16 (scales) + 64 (qs) + 2 (d) + 2 (dmin) per 256 elements
+	case ggmlTypeQ3_K:
+		return 110 // 32 (hmask) + 64 (qs) + 12 (scales) + 2 (d)
+	case ggmlTypeQ4_K:
+		return 144 // 2 (d) + 2 (dmin) + 12 (scales) + 128 (qs)
+	case ggmlTypeQ5_K:
+		return 176 // 2 (d) + 2 (dmin) + 12 (scales) + 32 (qh) + 128 (qs)
 	case ggmlTypeQ6_K:
 		return 210 // 128 (ql) + 64 (qh) + 16 (scales) + 2 (d) per 256 elements
 	default:
@@ -257,19 +323,26 @@ func ggmlBlockElements(t uint32) int {
 	switch t {
 	case ggmlTypeF32, ggmlTypeF16:
 		return 1
-	case ggmlTypeQ6_K:
+	case ggmlTypeQ2_K, ggmlTypeQ3_K, ggmlTypeQ4_K, ggmlTypeQ5_K, ggmlTypeQ6_K:
 		return 256 // k-quant super block
 	default:
 		return 32 // Q4_0, Q4_1, Q5_0, Q5_1, Q8_0
 	}
 }
 
-// tensorBytes returns total bytes for a tensor
-func tensorBytes(info *GGUFTensorInfo) uint64 {
+// tensorElements returns the element count of a tensor (LoadGGUF has
+// checked that the product fits).
+func tensorElements(info *GGUFTensorInfo) uint64 {
 	nel := uint64(1)
 	for i := uint32(0); i < info.NDims; i++ {
 		nel *= info.Dims[i]
 	}
+	return nel
+}
+
+// tensorBytes returns total bytes for a tensor (0 for a type we cannot size)
+func tensorBytes(info *GGUFTensorInfo) uint64 {
+	nel := tensorElements(info)
 	bs := uint64(ggmlBlockSize(info.Type))
 	be := uint64(ggmlBlockElements(info.Type))
 	if be == 0 {
@@ -279,52 +352,64 @@ func tensorBytes(info *GGUFTensorInfo) uint64 {
 }
 
 // LoadGGUF loads a GGUF file
-func LoadGGUF(path string) (*GGUFFile, error) {
+// LoadGGUF reads a GGUF file, tensor data included, into memory.
+func LoadGGUF(path string) (*GGUFFile, error) { return loadGGUF(path, false) }
+
+func loadGGUF(path string, mapped bool) (*GGUFFile, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("open GGUF: %w", err)
 	}
 	defer f.Close()
+	r := newHashingReader(f) // every byte goes through r: see Provenance
 
 	// Read header
 	var magic uint32
-	if err := binary.Read(f, binary.LittleEndian, &magic); err != nil {
+	if err := binary.Read(r, binary.LittleEndian, &magic); err != nil {
 		return nil, fmt.Errorf("read magic: %w", err)
 	}
 	if magic != ggufMagic {
-		return nil, fmt.Errorf("bad magic: 0x%08X (expected 0x%08X)", magic, ggufMagic)
+		return nil, fmt.Errorf("%w: bad magic 0x%08X (expected 0x%08X)", ErrGGUFMalformed, magic, ggufMagic)
 	}
 
 	var version uint32
-	if err := binary.Read(f, binary.LittleEndian, &version); err != nil {
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
 		return nil, fmt.Errorf("read version: %w", err)
 	}
 	if version < 2 || version > 3 {
-		return nil, fmt.Errorf("unsupported GGUF version: %d", version)
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrGGUFMalformed, version)
 	}
 
 	var tensorCount, metadataCount uint64
-	if err := binary.Read(f, binary.LittleEndian, &tensorCount); err != nil {
+	if err := binary.Read(r, binary.LittleEndian, &tensorCount); err != nil {
 		return nil, err
 	}
-	if err := binary.Read(f, binary.LittleEndian, &metadataCount); err != nil {
+	if err := binary.Read(r, binary.LittleEndian, &metadataCount); err != nil {
 		return nil, err
 	}
 
+	if metadataCount > ggufMaxMetadata {
+		return nil, fmt.Errorf("%w: %d metadata entries (max %d)", ErrGGUFLimit, metadataCount, ggufMaxMetadata)
+	}
+	if tensorCount > ggufMaxTensors {
+		return nil, fmt.Errorf("%w: %d tensors (max %d)", ErrGGUFLimit, tensorCount, ggufMaxTensors)
+	}
+
 	fmt.Printf("[tongue/gguf] version=%d tensors=%d metadata=%d\n", version, tensorCount, metadataCount)
+	budget := metaBudget(ggufMaxMetaBytes)
 
 	// Read metadata
 	kv := make(map[string]interface{})
 	for i := uint64(0); i < metadataCount; i++ {
-		key, err := readString(f)
+		key, err := readString(r, &budget)
 		if err != nil {
 			return nil, fmt.Errorf("read metadata key %d: %w", i, err)
 		}
 		var vtype uint32
-		if err := binary.Read(f, binary.LittleEndian, &vtype); err != nil {
+		if err := binary.Read(r, binary.LittleEndian, &vtype); err != nil {
 			return nil, fmt.Errorf("read metadata type %d: %w", i, err)
 		}
-		val, err := readValue(f, vtype)
+		val, err := readValue(r, vtype, &budget)
 		if err != nil {
 			return nil, fmt.Errorf("read metadata value '%s': %w", key, err)
 		}
@@ -332,44 +417,54 @@ func LoadGGUF(path string) (*GGUFFile, error) {
 	}
 
 	// Read tensor infos
-	tensors := make(map[string]*GGUFTensorInfo, tensorCount)
+	tensors := make(map[string]*GGUFTensorInfo, min(tensorCount, 1<<12))
 	for i := uint64(0); i < tensorCount; i++ {
-		name, err := readString(f)
+		name, err := readString(r, &budget)
 		if err != nil {
 			return nil, fmt.Errorf("read tensor name %d: %w", i, err)
 		}
 		var ndims uint32
-		if err := binary.Read(f, binary.LittleEndian, &ndims); err != nil {
+		if err := binary.Read(r, binary.LittleEndian, &ndims); err != nil {
 			return nil, err
 		}
+		if ndims == 0 || ndims > 4 {
+			return nil, fmt.Errorf("%w: tensor %s has %d dims", ErrGGUFMalformed, name, ndims)
+		}
 		var dims [4]uint64
 		for d := uint32(0); d < ndims; d++ {
-			if err := binary.Read(f, binary.LittleEndian, &dims[d]); err != nil {
+			if err := binary.Read(r, binary.LittleEndian, &dims[d]); err != nil {
 				return nil, err
 			}
 		}
 		var ttype uint32
-		if err := binary.Read(f, binary.LittleEndian, &ttype); err != nil {
+		if err := binary.Read(r, binary.LittleEndian, &ttype); err != nil {
 			return nil, err
 		}
 		var offset uint64
-		if err := binary.Read(f, binary.LittleEndian, &offset); err != nil {
+		if err := binary.Read(r, binary.LittleEndian, &offset); err != nil {
 			return nil, err
 		}
-		tensors[name] = &GGUFTensorInfo{
+		if _, dup := tensors[name]; dup {
+			return nil, fmt.Errorf("%w: tensor %s listed twice", ErrGGUFMalformed, name)
+		}
+		info := &GGUFTensorInfo{
 			Name:   name,
 			NDims:  ndims,
 			Dims:   dims,
 			Type:   ttype,
 			Offset: offset,
 		}
+		if err := checkTensorShape(info); err != nil {
+			return nil, err
+		}
+		if err := budget.take(64); err != nil {
+			return nil, err
+		}
+		tensors[name] = info
 	}
 
 	// Current position = end of header/metadata/tensor_info
-	headerEnd, err := f.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return nil, err
-	}
+	headerEnd := r.n
 
 	// GGUF alignment = 32 bytes
 	alignment := int64(32)
@@ -382,30 +477,81 @@ func LoadGGUF(path string) (*GGUFFile, error) {
 	}
 	dataSize := fileInfo.Size() - dataOffset
 	if dataSize <= 0 {
-		return nil, fmt.Errorf("no tensor data (dataOffset=%d, fileSize=%d)", dataOffset, fileInfo.Size())
+		return nil, fmt.Errorf("%w: no tensor data (dataOffset=%d, fileSize=%d)", ErrGGUFMalformed, dataOffset, fileInfo.Size())
+	}
+	// Every tensor must lie inside the file before anything is read or
+	// allocated on its account.
+	for _, info := range tensors {
+		size := tensorBytes(info)
+		if info.Offset > uint64(dataSize) || size > uint64(dataSize)-info.Offset {
+			return nil, fmt.Errorf("%w: tensor %s at %d+%d runs past the %d bytes of data",
+				ErrGGUFMalformed, info.Name, info.Offset, size, dataSize)
+		}
 	}
 
 	fmt.Printf("[tongue/gguf] data offset=%d size=%.1f MB\n", dataOffset, float64(dataSize)/1024/1024)
 
-	if _, err := f.Seek(dataOffset, io.SeekStart); err != nil {
+	if _, err := io.CopyN(io.Discard, r, dataOffset-headerEnd); err != nil {
 		return nil, err
 	}
-	tensorData := make([]byte, dataSize)
-	if _, err := io.ReadFull(f, tensorData); err != nil {
-		return nil, fmt.Errorf("read tensor data: %w", err)
+	var tensorData, file []byte
+	if mapped {
+		// Still read once, for the digest; the pages stay in the page
+		// cache, not in this process.
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return nil, fmt.Errorf("read tensor data: %w", err)
+		}
+		if file, err = mmapFile(f, fileInfo.Size()); err != nil {
+			return nil, fmt.Errorf("map tensor data: %w", err)
+		}
+		tensorData = file[dataOffset:]
+	} else {
+		tensorData = make([]byte, dataSize)
+		if _, err := io.ReadFull(r, tensorData); err != nil {
+			return nil, fmt.Errorf("read tensor data: %w", err)
+		}
 	}
 
 	// Parse metadata into structured form
 	meta := parseMetadata(kv)
+	prov := provenance(kv)
+	prov.Path, prov.SHA256, prov.Size = path, r.sum(), r.n
 
 	return &GGUFFile{
 		Meta:       meta,
+		Provenance: prov,
 		Tensors:    tensors,
 		TensorData: tensorData,
 		DataOffset: dataOffset,
+		mapped:     file,
 	}, nil
 }
 
+// checkTensorShape rejects dims no tensor can have: a zero, an element
+// count that overflows, or a quantized row cut mid-block.
+func checkTensorShape(info *GGUFTensorInfo) error {
+	nel := uint64(1)
+	for d := uint32(0); d < info.NDims; d++ {
+		hi, lo := bits.Mul64(nel, info.Dims[d])
+		if info.Dims[d] == 0 || hi != 0 {
+			return fmt.Errorf("%w: tensor %s has dims %v", ErrGGUFMalformed, info.Name, info.Dims[:info.NDims])
+		}
+		nel = lo
+	}
+	bs, be := uint64(ggmlBlockSize(info.Type)), uint64(ggmlBlockElements(info.Type))
+	if bs == 0 {
+		return nil // a type we cannot size: GetTensor refuses it
+	}
+	if info.Dims[0]%be != 0 {
+		return fmt.Errorf("%w: tensor %s rows of %d are not whole %d-element blocks",
+			ErrGGUFMalformed, info.Name, info.Dims[0], be)
+	}
+	if hi, _ := bits.Mul64(nel/be, bs); hi != 0 {
+		return fmt.Errorf("%w: tensor %s has dims %v", ErrGGUFMalformed, info.Name, info.Dims[:info.NDims])
+	}
+	return nil
+}
+
 // parseMetadata extracts model config from GGUF KV pairs
 func parseMetadata(kv map[string]interface{}) GGUFMetadata {
 	meta := GGUFMetadata{
@@ -538,9 +684,12 @@ func (g *GGUFFile) GetTensor(name string) ([]byte, *GGUFTensorInfo, error) {
 		return nil, nil, fmt.Errorf("tensor not found: %s", name)
 	}
 	size := tensorBytes(info)
+	if size == 0 {
+		return nil, nil, fmt.Errorf("tensor %s: unsupported type %d", name, info.Type)
+	}
 	start := info.Offset
 	end := start + size
-	if end > uint64(len(g.TensorData)) {
+	if start > uint64(len(g.TensorData)) || size > uint64(len(g.TensorData))-start {
 		return nil, nil, fmt.Errorf("tensor %s out of bounds: %d + %d > %d",
 			name, start, size, len(g.TensorData))
 	}
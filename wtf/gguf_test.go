@@ -0,0 +1,80 @@
+package wtf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadGGUFLimits(t *testing.T) {
+	header := func(tensors, meta uint64, rest ...any) []byte {
+		var b bytes.Buffer
+		for _, v := range append([]any{uint32(ggufMagic), uint32(ggufVersion), tensors, meta}, rest...) {
+			binary.Write(&b, binary.LittleEndian, v)
+		}
+		b.Write(make([]byte, 64))
+		return b.Bytes()
+	}
+	for _, tc := range []struct {
+		name string
+		file []byte
+		want error
+	}{
+		{"magic", []byte("GGML\x03\x00\x00\x00"), ErrGGUFMalformed},
+		{"metadata count", header(0, ggufMaxMetadata+1), ErrGGUFLimit},
+		{"tensor count", header(math.MaxUint64, 0), ErrGGUFLimit},
+		{"string length", header(0, 1, uint64(ggufMaxString+1)), ErrGGUFLimit},
+		{"array length", header(0, 1, uint64(1), byte('k'), uint32(ggufTypeArray), uint32(ggufTypeUint8), uint64(ggufMaxArray+1)), ErrGGUFLimit},
+		{"value type", header(0, 1, uint64(1), byte('k'), uint32(99)), ErrGGUFMalformed},
+		{"no dims", tensorInfoGGUF(0, [4]uint64{}, 0), ErrGGUFMalformed},
+		{"zero dim", tensorInfoGGUF(2, [4]uint64{32, 0}, 0), ErrGGUFMalformed},
+		{"element overflow", tensorInfoGGUF(4, [4]uint64{1 << 32, 1 << 32, 2, 2}, 0), ErrGGUFMalformed},
+		{"past the data", tensorInfoGGUF(1, [4]uint64{32}, 32), ErrGGUFMalformed},
+		{"offset wraps", tensorInfoGGUF(2, [4]uint64{32, 1}, math.MaxUint64-8), ErrGGUFMalformed},
+	} {
+		path := filepath.Join(t.TempDir(), "bad.gguf")
+		if err := os.WriteFile(path, tc.file, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadGGUF(path); !errors.Is(err, tc.want) {
+			t.Errorf("%s: err = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	// A file that fits in 128 bytes of data loads.
+	path := filepath.Join(t.TempDir(), "ok.gguf")
+	os.WriteFile(path, tensorInfoGGUF(1, [4]uint64{32}, 0), 0o644)
+	g, err := LoadGGUF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _, err := g.GetTensor("w"); err != nil || len(b) != 128 {
+		t.Fatalf("GetTensor = %d bytes, %v", len(b), err)
+	}
+}
+
+func TestLoadLlamaModelShapes(t *testing.T) {
+	tok := newTestTokenizer()
+	m := newTestModel(tok.VocabSize)
+	m.Config.IntermSize++ // metadata now disagrees with every FFN matrix
+	g, err := LoadGGUF(writeModelGGUF(t, m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadLlamaModel(g); !errors.Is(err, ErrGGUFMalformed) {
+		t.Fatalf("err = %v, want ErrGGUFMalformed", err)
+	}
+
+	m.Config.IntermSize--
+	m.Config.NumKVHeads = 3 // 4 heads do not share out over 3
+	if g, err = LoadGGUF(writeModelGGUF(t, m)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadLlamaModel(g); !errors.Is(err, ErrGGUFMalformed) {
+		t.Fatalf("err = %v, want ErrGGUFMalformed", err)
+	}
+}
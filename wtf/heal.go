@@ -0,0 +1,39 @@
+package wtf
+
+// heal.go — token healing. A prompt that ends mid-word ("check out http")
+// ends on a token the model rarely saw in that position, because in training
+// text "http" was almost always part of a longer token ("https", "http://").
+// Healing backs off the last prompt token and constrains the first sampled
+// token to ones whose text extends it, so the model picks the boundary
+// itself. The backed-off text is prompt, not reply, so it is cut from the
+// output.
+
+import "strings"
+
+// healTail splits the healable last token off tokens[start:]. It needs at
+// least one other prompt token left to prefill (for logits), and never heals
+// control tokens. Returns the shortened tokens and the backed-off text.
+func (t *Tokenizer) healTail(tokens []int, start int) ([]int, string) {
+	if len(tokens)-start < 2 {
+		return tokens, ""
+	}
+	last := tokens[len(tokens)-1]
+	if t.IsControl(last) {
+		return tokens, ""
+	}
+	p := t.Piece(last)
+	if p == "" {
+		return tokens, ""
+	}
+	return tokens[:len(tokens)-1], p
+}
+
+// healMask sends every token whose text does not extend prefix to -inf.
+// The backed-off token itself always survives, so sampling cannot dead-end.
+func (t *Tokenizer) healMask(logits []float32, prefix string) {
+	for id := 0; id < len(logits) && id < t.VocabSize; id++ {
+		if !strings.HasPrefix(t.Piece(id), prefix) {
+			logits[id] = -1e30
+		}
+	}
+}
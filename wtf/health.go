@@ -0,0 +1,168 @@
+package wtf
+
+// health.go — liveness and readiness for orchestrators. Loading a model
+// takes seconds, so a Health is created before the load starts and moves
+// from loading to ready (or failed) when it ends; from then on the engine
+// itself says whether it is ready or degraded. HealthHandler serves the
+// report as /healthz (is the process alive) and /readyz (should it get
+// traffic), and the servers answer the "health" op with it.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthStatus is the state a Health reports.
+type HealthStatus string
+
+const (
+	HealthLoading  HealthStatus = "loading"  // the model is not loaded yet
+	HealthReady    HealthStatus = "ready"    // serving normally
+	HealthDegraded HealthStatus = "degraded" // serving, but something is wrong; see Detail
+	HealthFailed   HealthStatus = "failed"   // the load failed; it will not serve
+)
+
+// HealthWindow is how long a recovered panic keeps an engine degraded.
+const HealthWindow = 5 * time.Minute
+
+// healthLockWait bounds how long Health waits for the engine lock to read
+// the model's provenance, so a probe never queues behind a generation.
+const healthLockWait = 100 * time.Millisecond
+
+// HealthReport is a point-in-time health answer.
+type HealthReport struct {
+	Status  HealthStatus `json:"status"`
+	Detail  string       `json:"detail,omitempty"`
+	Uptime  float64      `json:"uptime_s"`
+	Model   *Provenance  `json:"model,omitempty"`
+	Panics  int64        `json:"panics"`  // recovered since the engine was made
+	Pending int          `json:"pending"` // async requests waiting
+	Idle    bool         `json:"idle"`    // weights released by the idle policy
+}
+
+// Serving reports whether traffic should be routed here.
+func (r HealthReport) Serving() bool {
+	return r.Status == HealthReady || r.Status == HealthDegraded
+}
+
+// Health tracks a host from process start through the model load. Safe for
+// concurrent use.
+type Health struct {
+	mu     sync.Mutex
+	start  time.Time
+	status HealthStatus
+	detail string
+	engine *Engine
+}
+
+// NewHealth returns a Health in the loading state.
+func NewHealth() *Health {
+	return &Health{start: time.Now(), status: HealthLoading}
+}
+
+// Loading records what the load is doing, for the report's Detail.
+func (h *Health) Loading(detail string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status, h.detail = HealthLoading, detail
+}
+
+// Ready hands over to e: from now on the report is e.Health().
+func (h *Health) Ready(e *Engine) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status, h.detail, h.engine = HealthReady, "", e
+}
+
+// Fail records that the load failed.
+func (h *Health) Fail(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status, h.detail, h.engine = HealthFailed, err.Error(), nil
+}
+
+// Report is the current health.
+func (h *Health) Report() HealthReport {
+	h.mu.Lock()
+	status, detail, e := h.status, h.detail, h.engine
+	h.mu.Unlock()
+	rep := HealthReport{Status: status, Detail: detail}
+	if e != nil {
+		rep = e.Health()
+	}
+	rep.Uptime = time.Since(h.start).Seconds()
+	return rep
+}
+
+// Health reports whether e is ready or degraded: it is degraded while a
+// panic recovered less than HealthWindow ago or the async queue is full.
+// Uptime is left to the caller's Health. While a call holds the engine
+// past healthLockWait, Model is the provenance last read (nil if none was).
+func (e *Engine) Health() HealthReport {
+	rep := HealthReport{Status: HealthReady, Model: e.tryProvenance(), Panics: e.panics.Load(), Pending: e.Pending(), Idle: e.Unloaded()}
+	if last := e.lastPanic.Load(); last != 0 {
+		if ago := time.Since(time.Unix(0, last)); ago < HealthWindow {
+			rep.Status = HealthDegraded
+			rep.Detail = fmt.Sprintf("recovered a panic %s ago", ago.Round(time.Second))
+		}
+	}
+	depth := e.QueueDepth
+	if depth <= 0 {
+		depth = DefaultQueueDepth
+	}
+	if rep.Pending >= depth {
+		rep.Status = HealthDegraded
+		rep.Detail = "async queue full"
+	}
+	return rep
+}
+
+// provenance is the model's provenance, read under mu: an idle reload may
+// replace it.
+func (e *Engine) provenance() Provenance {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	p := e.Model.Provenance
+	e.prov.Store(&p)
+	return p
+}
+
+// tryProvenance is provenance if mu comes free within healthLockWait, and
+// otherwise the copy from the last read.
+func (e *Engine) tryProvenance() *Provenance {
+	deadline := time.Now().Add(healthLockWait)
+	for !e.mu.TryLock() {
+		if time.Now().After(deadline) {
+			return e.prov.Load()
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p := e.Model.Provenance
+	e.mu.Unlock()
+	e.prov.Store(&p)
+	return &p
+}
+
+// HealthHandler serves h: /healthz answers 200 unless the load failed,
+// /readyz answers 200 only while ready or degraded; both carry the report
+// as JSON and answer 503 otherwise.
+func HealthHandler(h *Health) http.Handler {
+	serve := func(ok func(HealthReport) bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			rep := h.Report()
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			if !ok(rep) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			json.NewEncoder(w).Encode(rep)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", serve(func(r HealthReport) bool { return r.Status != HealthFailed }))
+	mux.Handle("/readyz", serve(HealthReport.Serving))
+	return mux
+}
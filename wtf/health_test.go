@@ -0,0 +1,69 @@
+package wtf
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	h := NewHealth()
+	srv := httptest.NewServer(HealthHandler(h))
+	defer srv.Close()
+	get := func(path string) (int, HealthReport) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var rep HealthReport
+		if err := json.NewDecoder(resp.Body).Decode(&rep); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, rep
+	}
+
+	h.Loading("reading weights")
+	if code, rep := get("/healthz"); code != 200 || rep.Status != HealthLoading || rep.Detail != "reading weights" {
+		t.Fatalf("loading /healthz: %d %+v", code, rep)
+	}
+	if code, _ := get("/readyz"); code != 503 {
+		t.Fatalf("loading /readyz: %d", code)
+	}
+
+	e := newTestEngine()
+	h.Ready(e)
+	if code, rep := get("/readyz"); code != 200 || rep.Status != HealthReady || rep.Model == nil {
+		t.Fatalf("ready /readyz: %d %+v", code, rep)
+	}
+
+	// A probe does not queue behind a call holding the engine; it reports
+	// the provenance it read last time.
+	e.mu.Lock()
+	start := time.Now()
+	code, rep := get("/readyz")
+	e.mu.Unlock()
+	if code != 200 || rep.Model == nil || time.Since(start) > 5*time.Second {
+		t.Fatalf("busy /readyz: %d %+v after %s", code, rep, time.Since(start))
+	}
+
+	// A recovered panic degrades the engine, which still takes traffic.
+	opts := greedyOpts(4)
+	opts.OnToken = func(string) { panic("boom") }
+	e.Generate("", "the sky", opts)
+	if code, rep := get("/readyz"); code != 200 || rep.Status != HealthDegraded || rep.Panics != 1 {
+		t.Fatalf("degraded /readyz: %d %+v", code, rep)
+	}
+	if r := (&Server{Engine: e, Health: h}).Handle(Call{Op: "health"}, nil); r.Health == nil || r.Health.Status != HealthDegraded {
+		t.Fatalf("health op: %+v", r)
+	}
+
+	h.Fail(errors.New("bad weights"))
+	if code, rep := get("/healthz"); code != 503 || rep.Status != HealthFailed || rep.Detail != "bad weights" {
+		t.Fatalf("failed /healthz: %d %+v", code, rep)
+	}
+}
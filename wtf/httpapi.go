@@ -0,0 +1,46 @@
+package wtf
+
+// httpapi.go — the Server's calls over HTTP, for clients that cannot reach
+// the Unix socket. POST one Call as JSON to /call and get its final Reply
+// back as JSON; streaming stays on the socket. Errors come back in
+// Reply.Error, as on the socket. With Quotas every request needs an API key
+// (see quota.go), a generate call may not produce more tokens than the key
+// has left today, and the tokens it did produce are charged to the key.
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HTTPHandler serves s's calls on POST /call. q may be nil: no keys.
+func (s *Server) HTTPHandler(q *Quotas) http.Handler {
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Call
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxFrame)).Decode(&req); err != nil {
+			http.Error(w, "call: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Stream = false
+		key := APIKey(r.Context())
+		if q != nil {
+			left := q.Remaining(key) // -1: unlimited
+			if left == 0 {           // spent by a concurrent call since Middleware
+				http.Error(w, ErrQuotaExhausted.Error(), http.StatusTooManyRequests)
+				return
+			}
+			req.budget = left
+		}
+		rep := s.Handle(req, nil)
+		if q != nil && req.Op == "generate" {
+			q.Charge(key, len(rep.Tokens))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rep)
+	})
+	if q != nil {
+		h = q.Middleware(h)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("POST /call", h)
+	return mux
+}
@@ -0,0 +1,143 @@
+package wtf
+
+// idle.go — give the memory back when nobody is asking. With an IdlePolicy
+// set, an engine that has gone After without a call releases its weights,
+// KV cache and persona prefixes (keeping the config, personas, tokenizer and
+// everything else it was set up with) and returns the memory to the OS. The
+// next call loads the weights back through IdlePolicy.Load before it runs,
+// paying one model load; callers see nothing else.
+//
+// Forks share the weights, so memory only comes back once every fork has
+// been released too (forks inherit the policy). A mapped model (MapGGUF)
+// has its pages advised away; the new load maps the file again.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IdlePolicy configures idle unloading. The zero value never unloads.
+type IdlePolicy struct {
+	After time.Duration               // release after this long without a call
+	Load  func() (*LlamaModel, error) // loads the same model again
+}
+
+// ErrReloadMismatch is returned when IdlePolicy.Load brings back a model
+// with different dimensions than the one released.
+var ErrReloadMismatch = errors.New("reloaded model does not match")
+
+// idleState is the Engine's side of the policy; guarded by Engine.mu,
+// except that unloaded may be read without it.
+type idleState struct {
+	timer    *time.Timer
+	last     time.Time // end of the latest call
+	unloaded atomic.Bool
+}
+
+// lock takes mu for a call that runs the model, loading the weights back
+// first if the idle policy released them.
+func (e *Engine) lock() error {
+	e.mu.Lock()
+	if e.idle.timer != nil {
+		e.idle.timer.Stop()
+	}
+	if e.idle.unloaded.Load() {
+		if err := e.reload(); err != nil {
+			e.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// unlock releases mu at the end of a call taken with lock, and starts the
+// idle clock.
+func (e *Engine) unlock() {
+	if after := e.Idle.After; after > 0 && e.Idle.Load != nil {
+		e.idle.last = time.Now()
+		if e.idle.timer == nil {
+			e.idle.timer = time.AfterFunc(after, e.idleCheck)
+		} else {
+			e.idle.timer.Reset(after)
+		}
+	}
+	e.mu.Unlock()
+}
+
+// idleCheck runs when the idle timer fires. A call that started as it
+// fired has moved last on by the time mu is ours, so check again.
+func (e *Engine) idleCheck() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.idle.unloaded.Load() {
+		return
+	}
+	if wait := e.Idle.After - time.Since(e.idle.last); wait > 0 {
+		e.idle.timer.Reset(wait)
+		return
+	}
+	e.release()
+	fmt.Fprintf(os.Stderr, "[wtf] idle for %s: weights released\n", e.Idle.After)
+}
+
+// Unload releases the weights now, as an idle timeout would, once any
+// running call is done. Without an Idle.Load to bring them back it does
+// nothing.
+func (e *Engine) Unload() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.Idle.Load == nil || e.idle.unloaded.Load() {
+		return
+	}
+	e.release()
+}
+
+// release drops the weights and everything sized by them. Caller holds mu.
+func (e *Engine) release() {
+	e.claim(nil)          // park the live session's rows while they still exist
+	e.Model.Fingerprint() // callers outside mu read it; it must be of real weights
+	for _, p := range e.personas {
+		p.prefix.release()
+		p.prefix = nil
+	}
+	m := e.Model
+	m.Pages().Trim()
+	if m.stream != nil {
+		adviseRange(m.stream.file, false)
+	}
+	if m.ahead != nil {
+		m.ahead.stop()
+	}
+	m.Weights, m.State, m.stream, m.ahead = LlamaWeights{}, LlamaState{}, nil, nil
+	e.idle.unloaded.Store(true)
+	debug.FreeOSMemory()
+}
+
+// reload brings the weights back through Idle.Load. Caller holds mu.
+func (e *Engine) reload() error {
+	start := time.Now()
+	fresh, err := e.Idle.Load()
+	if err != nil {
+		return fmt.Errorf("idle reload: %w", err)
+	}
+	m := e.Model
+	if fresh.Config != m.Config {
+		return fmt.Errorf("%w: %+v, was %+v", ErrReloadMismatch, fresh.Config, m.Config)
+	}
+	m.Weights, m.State, m.stream = fresh.Weights, fresh.State, fresh.stream
+	if fresh.Provenance.SHA256 != m.Provenance.SHA256 {
+		m.Provenance = fresh.Provenance
+		m.fingerprint, m.fpOnce = "", sync.Once{}
+	}
+	e.idle.unloaded.Store(false)
+	fmt.Fprintf(os.Stderr, "[wtf] weights reloaded in %s\n", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// Unloaded reports whether the idle policy has the weights released.
+func (e *Engine) Unloaded() bool { return e.idle.unloaded.Load() }
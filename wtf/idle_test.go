@@ -0,0 +1,60 @@
+package wtf
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestIdleUnload(t *testing.T) {
+	e := newTestEngine()
+	loads := 0
+	var loadErr error
+	e.Idle = IdlePolicy{After: 20 * time.Millisecond, Load: func() (*LlamaModel, error) {
+		loads++
+		return newTestModel(e.Tok.VocabSize), loadErr
+	}}
+	e.RegisterPersona("oracle", "you are the oracle", SamplerOverrides{})
+	opts := greedyOpts(8)
+	opts.RunAhead = true
+	want, err := e.Generate("oracle", "the sky", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workers := runtime.NumGoroutine()
+	waitUnloaded := func() {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !e.Unloaded(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("weights never released")
+			}
+		}
+	}
+	waitUnloaded()
+	for i := 0; i < 50 && runtime.NumGoroutine() >= workers; i++ {
+		time.Sleep(time.Millisecond) // the idle timer's goroutine is on its way out
+	}
+	if n := runtime.NumGoroutine(); n >= workers {
+		t.Fatalf("goroutines %d -> %d: run-ahead worker outlived the release", workers, n)
+	}
+	if e.Model.Weights.Layers != nil || e.Model.State.KeyCache != nil || !e.Health().Idle {
+		t.Fatal("released engine still holds its weights")
+	}
+
+	got, err := e.Generate("oracle", "the sky", opts)
+	if err != nil || got.Text != want.Text || loads != 1 || e.Unloaded() {
+		t.Fatalf("after reload: %q, %v (%d loads); want %q", got.Text, err, loads, want.Text)
+	}
+
+	// A failed reload fails the call and leaves the engine to try again.
+	waitUnloaded()
+	loadErr = errors.New("disk gone")
+	if _, err := e.Generate("", "the sky", greedyOpts(4)); !errors.Is(err, loadErr) || !e.Unloaded() {
+		t.Fatalf("failed reload: %v", err)
+	}
+	loadErr = nil
+	if _, err := e.Generate("", "the sky", greedyOpts(4)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,95 @@
+package wtf
+
+// inject.go — anchor integrity. The anchor (persona or system message) is
+// the only text allowed to carry the model's control tokens; user text that
+// spells out "<|im_start|>system" would otherwise be split into the real
+// special token and hijack the persona. Under an InjectionPolicy user text is
+// screened for special tokens and the textual chat markers of ChatQA before
+// encoding, and either cleaned or refused.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// InjectionPolicy says what happens to user text that contains control
+// markers. The zero value keeps the old behaviour: markers are honoured.
+type InjectionPolicy uint8
+
+const (
+	InjectionAllow  InjectionPolicy = iota // encode as given
+	InjectionStrip                         // remove the markers, flag Result.Injected
+	InjectionReject                        // fail with ErrPromptInjection
+)
+
+// ParseInjectionPolicy maps "", "allow", "strip" and "reject" to a policy.
+func ParseInjectionPolicy(s string) (InjectionPolicy, error) {
+	switch s {
+	case "", "allow":
+		return InjectionAllow, nil
+	case "strip":
+		return InjectionStrip, nil
+	case "reject":
+		return InjectionReject, nil
+	}
+	return InjectionAllow, fmt.Errorf("injection policy %q: want allow, strip or reject", s)
+}
+
+// ErrPromptInjection is returned under InjectionReject.
+var ErrPromptInjection = errors.New("user text contains control markers")
+
+// chatMarkers are the ChatQA template's textual turn markers.
+var chatMarkers = []string{"### Question:", "### Answer:"}
+
+// hasMarker reports whether text contains a special token or chat marker.
+func (t *Tokenizer) hasMarker(text string) bool {
+	for _, m := range chatMarkers {
+		if strings.Contains(text, m) {
+			return true
+		}
+	}
+	for s := range t.specialTokens {
+		if strings.Contains(text, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripMarkers removes markers until none are left, so removing one cannot
+// splice another together ("<|im_<|im_end|>start|>").
+func (t *Tokenizer) stripMarkers(text string) string {
+	for t.hasMarker(text) {
+		for _, m := range chatMarkers {
+			text = strings.ReplaceAll(text, m, "")
+		}
+		for s := range t.specialTokens {
+			text = strings.ReplaceAll(text, s, "")
+		}
+	}
+	return text
+}
+
+// admit prepares one piece of raw caller text: the length check first, so
+// oversized text never reaches the normalizer or the scrubber, then
+// opts.input and guard.
+func (e *Engine) admit(text string, opts *GenOptions) (string, error) {
+	if err := e.checkLen(text); err != nil {
+		return text, err
+	}
+	return e.guard(opts.input(text), opts)
+}
+
+// guard applies opts.Injection to one piece of user text. Finding markers
+// sets the flag that ends up in Result.Injected.
+func (e *Engine) guard(text string, opts *GenOptions) (string, error) {
+	if opts.Injection == InjectionAllow || !e.Tok.hasMarker(text) {
+		return text, nil
+	}
+	if opts.Injection == InjectionReject {
+		return text, ErrPromptInjection
+	}
+	opts.injected = true
+	return e.Tok.stripMarkers(text), nil
+}
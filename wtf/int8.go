@@ -0,0 +1,83 @@
+package wtf
+
+// int8.go — load-time int8 for checkpoints shipped in F16 or F32. Those
+// layer matrices have no GGUF quantization to keep, so QuantizeInt8 turns
+// each into int8 rows with one absmax scale per row: half the bytes of F16,
+// a quarter of F32. The matvec quantizes its input per 32-element block and
+// accumulates int8 products in int32 (wtf_i8matvec): a loop the compiler
+// turns into VNNI / dotprod instructions when the build targets a CPU with
+// them (CGO_CFLAGS=-march=native), reading half the memory per token that
+// F16 did, the actual bottleneck of a 360M model on a CPU.
+//
+// Matrices that are already GGUF-quantized (Q4_0, Q8_0, the K-quants) are
+// left packed: requantizing them would only add error. Embeddings and the
+// LM head stay f32, as they do for every dtype.
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Int8Stats reports what QuantizeInt8 did.
+type Int8Stats struct {
+	Matrices int   // matrices requantized
+	Before   int64 // their bytes before
+	After    int64 // and after, scales included
+}
+
+func (s Int8Stats) String() string {
+	return fmt.Sprintf("%d matrices, %.1f MiB -> %.1f MiB",
+		s.Matrices, float64(s.Before)/(1<<20), float64(s.After)/(1<<20))
+}
+
+// QuantizeInt8 requantizes every F16 or F32 layer matrix to int8 rows. Call
+// it right after LoadLlamaModel, before the model decodes or is forked: it
+// changes the weights (and so the Fingerprint) in place. Matrices whose
+// width is not a multiple of 32 are left as they are.
+func (m *LlamaModel) QuantizeInt8() (Int8Stats, error) {
+	var st Int8Stats
+	for i := range m.Weights.Layers {
+		l := &m.Weights.Layers[i]
+		for j, q := range []*QW{&l.WQ, &l.WK, &l.WV, &l.WO, &l.WGate, &l.WUp, &l.WDown} {
+			before, err := q.quantizeInt8()
+			if err != nil {
+				return st, fmt.Errorf("blk.%d.%s: %w", i, layerMatrices[j], err)
+			}
+			if before > 0 {
+				st.Matrices++
+				st.Before += before
+				st.After += int64(len(q.I8) + 4*len(q.Scales))
+			}
+		}
+	}
+	m.fingerprint, m.fpOnce = "", sync.Once{}
+	return st, nil
+}
+
+// quantizeInt8 requantizes w if it holds F16 or F32 values, returning the
+// bytes it used to take (0 = left alone).
+func (w *QW) quantizeInt8() (int64, error) {
+	if w.I8 != nil || w.K%i8Block != 0 || w.M*w.K == 0 {
+		return 0, nil
+	}
+	var f32 []float32
+	var before int64
+	switch {
+	case w.Packed == nil:
+		f32, before = w.F32, int64(4*len(w.F32))
+	case w.Dtype == dtypeF32 || w.Dtype == dtypeF16:
+		var err error
+		if f32, err = dequantToF32(w.Packed, uint32(w.Dtype), w.M*w.K); err != nil {
+			return 0, err
+		}
+		before = int64(len(w.Packed))
+	default:
+		return 0, nil
+	}
+	if len(f32) != w.M*w.K {
+		return 0, fmt.Errorf("%d values for a %dx%d matrix", len(f32), w.M, w.K)
+	}
+	w.I8, w.Scales = quantizeI8(f32, w.M, w.K)
+	w.Packed, w.F32 = nil, nil
+	return before, nil
+}
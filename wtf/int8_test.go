@@ -0,0 +1,70 @@
+package wtf
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestI8Matvec(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	m, k := 48, 96
+	w := make([]float32, m*k)
+	for i := range w {
+		w[i] = rng.Float32()*2 - 1
+	}
+	x := make([]float32, k)
+	for i := range x {
+		x[i] = rng.Float32()*4 - 2
+	}
+	want := make([]float32, m)
+	sgemv(want, w, x, m, k)
+	q, scales := quantizeI8(w, m, k)
+	got := make([]float32, m)
+	i8matvec(got, q, scales, x, m, k)
+	var num, den float64
+	for i := range want {
+		d := float64(got[i] - want[i])
+		num += d * d
+		den += float64(want[i]) * float64(want[i])
+	}
+	if rel := math.Sqrt(num / den); rel > 0.02 {
+		t.Errorf("relative error %.4f against sgemv, want < 0.02", rel)
+	}
+}
+
+func TestQuantizeInt8(t *testing.T) {
+	e := newTestEngine()
+	m := e.Model
+	l := &m.Weights.Layers[0]
+	wk := l.WK
+	l.WK = QW{Packed: []byte{1, 2, 3}, Dtype: dtypeQ8_0, M: l.WK.M, K: l.WK.K} // stays packed
+	fp := m.Fingerprint()
+
+	st, err := m.QuantizeInt8()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 2*7 - 1; st.Matrices != want {
+		t.Errorf("%d matrices requantized, want %d", st.Matrices, want)
+	}
+	if st.After*3 > st.Before {
+		t.Errorf("%s: expected about a quarter of the f32 bytes", st)
+	}
+	if l.WK.Packed == nil || l.WK.I8 != nil {
+		t.Error("Q8_0 matrix was requantized")
+	}
+	l.WK = wk // back to a matrix the forward pass can use
+	if l.WQ.I8 == nil || l.WQ.F32 != nil {
+		t.Error("f32 matrix kept its f32 data")
+	}
+	if m.Fingerprint() == fp {
+		t.Error("fingerprint unchanged after quantization")
+	}
+	if c := m.checkWeights(); !c.OK {
+		t.Errorf("weights check after quantization: %s", c.Detail)
+	}
+	if res := Generate(m, e.Tok, "hey", greedyOpts(8)); len(res.Tokens) == 0 {
+		t.Errorf("int8 decode produced nothing (finish: %s)", res.Finish)
+	}
+}
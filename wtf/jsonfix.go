@@ -0,0 +1,99 @@
+package wtf
+
+// jsonfix.go — JSON output mode. Small models mangle JSON in a handful of
+// predictable ways: prose before or after the value, a reply cut off by
+// MaxTokens mid-string or mid-object, trailing commas. RepairJSON fixes
+// exactly those and nothing else; if the result still does not parse, the
+// caller gets Valid=false rather than a creative guess.
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// JSONOutput is the JSON-mode view of a reply (GenOptions.JSON).
+type JSONOutput struct {
+	Text     string // the repaired value ("" if no '{' or '[' was found)
+	Valid    bool   // Text parses
+	Repaired bool   // Text differs from what the model wrote
+}
+
+// RepairJSON extracts the first JSON object or array from s, dropping prose
+// around it, removes trailing commas, and closes a cut-off string, object or
+// array. ok reports whether the result parses.
+func RepairJSON(s string) (out string, ok bool) {
+	start := strings.IndexAny(s, "{[")
+	if start < 0 {
+		return "", false
+	}
+	var b strings.Builder
+	var stack []byte
+	inStr, esc := false, false
+	for i := start; i < len(s) && !(len(stack) == 0 && i > start); i++ {
+		c := s[i]
+		if inStr {
+			b.WriteByte(c)
+			switch {
+			case esc:
+				esc = false
+			case c == '\\':
+				esc = true
+			case c == '"':
+				inStr = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inStr = true
+		case '{':
+			stack = append(stack, '}')
+		case '[':
+			stack = append(stack, ']')
+		case '}', ']':
+			if stack[len(stack)-1] != c {
+				continue // stray closer: skip it
+			}
+			stack = stack[:len(stack)-1]
+			trimComma(&b)
+		}
+		b.WriteByte(c)
+	}
+	if inStr {
+		if esc {
+			str := b.String()
+			b.Reset()
+			b.WriteString(str[:len(str)-1])
+		}
+		b.WriteByte('"')
+	}
+	if len(stack) > 0 {
+		trimComma(&b)
+		str := strings.TrimRight(b.String(), " \t\r\n")
+		if strings.HasSuffix(str, ":") {
+			str += "null"
+		}
+		b.Reset()
+		b.WriteString(str)
+		for i := len(stack) - 1; i >= 0; i-- {
+			b.WriteByte(stack[i])
+		}
+	}
+	out = b.String()
+	return out, json.Valid([]byte(out))
+}
+
+// trimComma drops a trailing comma (and the whitespace after it) from b.
+func trimComma(b *strings.Builder) {
+	s := strings.TrimRight(b.String(), " \t\r\n")
+	if strings.HasSuffix(s, ",") {
+		b.Reset()
+		b.WriteString(s[:len(s)-1])
+	}
+}
+
+// jsonOutput is RepairJSON packaged for Result.
+func jsonOutput(text string) *JSONOutput {
+	fixed, ok := RepairJSON(text)
+	return &JSONOutput{Text: fixed, Valid: ok, Repaired: fixed != text}
+}
@@ -0,0 +1,41 @@
+package wtf
+
+import "testing"
+
+func TestRepairJSON(t *testing.T) {
+	for _, c := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{`{"a": 1}`, `{"a": 1}`, true},
+		{`sure bro: {"a": [1, 2]} hope that helps`, `{"a": [1, 2]}`, true},
+		{`{"a": [1, 2,], "b": 3,}`, `{"a": [1, 2], "b": 3}`, true},
+		{`{"verdict": "cringe", "why": "bec`, `{"verdict": "cringe", "why": "bec"}`, true},
+		{`[{"a": "x\`, `[{"a": "x"}]`, true},
+		{`{"a": {"b":`, `{"a": {"b":null}}`, true},
+		{`{"a": 1, `, `{"a": 1}`, true},
+		{`{"a": "}"]}`, `{"a": "}"}`, true},
+		{`no json here`, ``, false},
+		{`{"a" 1}`, `{"a" 1}`, false},
+	} {
+		got, ok := RepairJSON(c.in)
+		if got != c.want || ok != c.ok {
+			t.Errorf("RepairJSON(%q) = %q, %v; want %q, %v", c.in, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestJSONMode(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(8)
+	opts.JSON = true
+	opts.ForcePrefix = `{"verdict": "`
+	res, err := e.Generate("", "judge:", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, ok := RepairJSON(res.Text)
+	if res.JSON == nil || res.JSON.Text != want || res.JSON.Valid != ok || res.JSON.Repaired != (want != res.Text) {
+		t.Fatalf("JSON = %+v for %q", res.JSON, res.Text)
+	}
+}
@@ -0,0 +1,120 @@
+package wtf
+
+// jsonrpc.go — JSON-RPC 2.0 over a pair of streams, one message per line, for
+// hosts that spawn the oracle as a subprocess and talk to its stdin/stdout
+// the way editors talk to language servers. Methods are the Server ops
+// ("generate", "encode", "embed", "style", "saliency"); params are a Call without id and op:
+//
+//	→ {"jsonrpc":"2.0","id":1,"method":"generate","params":{"question":"is go cringe","stream":true}}
+//	← {"jsonrpc":"2.0","method":"token","params":{"id":1,"piece":"bro"}}
+//	← {"jsonrpc":"2.0","id":1,"result":{"text":"bro ...","tokens":[...],"finish":"stop"}}
+//
+// Requests run one at a time, in order.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// JSON-RPC error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000
+	rpcPromptTooLong  = -32001 // ErrPromptTooLong
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"` // absent for notifications
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  *Reply          `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+type rpcToken struct {
+	ID    json.RawMessage `json:"id"`
+	Piece string          `json:"piece"`
+}
+
+// ServeJSONRPC answers JSON-RPC requests read from r on w until r ends.
+func (s *Server) ServeJSONRPC(r io.Reader, w io.Writer) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), MaxFrame)
+	enc := json.NewEncoder(w)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if err := s.rpcLine(line, enc); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// rpcLine answers one request line. Only write errors are returned.
+func (s *Server) rpcLine(line []byte, enc *json.Encoder) error {
+	fail := func(id json.RawMessage, code int, msg string) error {
+		if id == nil {
+			id = json.RawMessage("null")
+		}
+		return enc.Encode(rpcResponse{JSONRPC: "2.0", ID: id, Error: &rpcError{code, msg}})
+	}
+	var req rpcRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		return fail(nil, rpcParseError, err.Error())
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return fail(req.ID, rpcInvalidRequest, "want jsonrpc 2.0 and a method")
+	}
+	var call Call
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &call); err != nil {
+			return fail(req.ID, rpcInvalidParams, err.Error())
+		}
+	}
+	call.ID, call.Op = "", req.Method
+
+	var werr error
+	stream := func(r Reply) {
+		if werr == nil && req.ID != nil {
+			werr = enc.Encode(rpcNotification{"2.0", "token", rpcToken{req.ID, r.Piece}})
+		}
+	}
+	reply, err := s.handle(call, stream)
+	if werr != nil || req.ID == nil {
+		return werr // notifications get no response
+	}
+	switch {
+	case errors.Is(err, ErrUnknownOp):
+		return fail(req.ID, rpcMethodNotFound, err.Error())
+	case errors.Is(err, ErrPromptTooLong):
+		return fail(req.ID, rpcPromptTooLong, err.Error())
+	case err != nil:
+		return fail(req.ID, rpcServerError, err.Error())
+	}
+	return enc.Encode(rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: &reply})
+}
@@ -0,0 +1,43 @@
+package wtf
+
+// kernels.go — which SIMD variant of the C matvec kernels runs. The best
+// one the CPU supports is picked on first use: AVX-512 with VNNI on recent
+// x86 servers, NEON with dotprod on Graviton and Apple Silicon (see
+// ariannamethod/wtf_kernels_{x86,arm}.c). SetKernels forces the generic
+// one, to rule the SIMD code out when replies look wrong or to compare
+// speed. The variants agree up to float summation order, so greedy
+// replies can differ in rare near-ties.
+
+/*
+#include "wtf_kernels.h"
+*/
+import "C"
+
+import "fmt"
+
+var kernelNames = []string{C.WTF_ISA_GENERIC: "generic", C.WTF_ISA_AVX512: "avx512", C.WTF_ISA_NEON: "neon"}
+
+// Kernels names the variant in use: "generic", "avx512" or "neon".
+func Kernels() string {
+	return kernelNames[C.wtf_kernel_isa()]
+}
+
+// SetKernels selects a variant by name; "" or "auto" picks the best the CPU
+// supports. Asking for one the CPU lacks is an error.
+func SetKernels(name string) error {
+	isa := -1
+	if name != "" && name != "auto" {
+		for i, n := range kernelNames {
+			if n == name {
+				isa = i
+			}
+		}
+		if isa < 0 {
+			return fmt.Errorf("kernels %q: want auto, generic, avx512 or neon", name)
+		}
+	}
+	if got := int(C.wtf_set_kernel_isa(C.int(isa))); isa >= 0 && got != isa {
+		return fmt.Errorf("kernels %q: not supported by this CPU (using %s)", name, kernelNames[got])
+	}
+	return nil
+}
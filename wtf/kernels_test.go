@@ -0,0 +1,73 @@
+package wtf
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestKernelsAgree(t *testing.T) {
+	SetKernels("auto")
+	best := Kernels()
+	if best == "generic" {
+		t.Skip("no SIMD variant on this CPU")
+	}
+	defer SetKernels("auto")
+
+	rng := rand.New(rand.NewSource(5))
+	m, k := 40, 256
+	f16 := func() uint16 { return uint16(rng.Intn(2))<<15 | uint16(10+rng.Intn(6))<<10 | uint16(rng.Intn(1024)) }
+	packed := func(blockBytes int) []byte {
+		b := make([]byte, m*k/32*blockBytes)
+		rng.Read(b)
+		for i := 0; i < len(b); i += blockBytes {
+			binary.LittleEndian.PutUint16(b[i:], f16())
+		}
+		return b
+	}
+	half := make([]byte, 2*m*k)
+	for i := 0; i < m*k; i++ {
+		binary.LittleEndian.PutUint16(half[2*i:], f16())
+	}
+	x := make([]float32, k)
+	for i := range x {
+		x[i] = rng.Float32()*2 - 1
+	}
+	w := make([]float32, m*k)
+	for i := range w {
+		w[i] = rng.Float32()*2 - 1
+	}
+	q, scales := quantizeI8(w, m, k)
+
+	for _, c := range []struct {
+		name string
+		run  func(out []float32)
+	}{
+		{"q4_0", func(out []float32) { qmatvec(out, packed(18), dtypeQ4_0, x, m, k) }},
+		{"q8_0", func(out []float32) { qmatvec(out, packed(34), dtypeQ8_0, x, m, k) }},
+		{"f16", func(out []float32) { qmatvec(out, half, dtypeF16, x, m, k) }},
+		{"int8", func(out []float32) { i8matvec(out, q, scales, x, m, k) }},
+	} {
+		state := rng.Int63()
+		got, want := make([]float32, m), make([]float32, m)
+		rng.Seed(state)
+		SetKernels(best)
+		c.run(got)
+		rng.Seed(state)
+		SetKernels("generic")
+		c.run(want)
+		for i := range want {
+			if d := math.Abs(float64(got[i] - want[i])); d > 1e-4*math.Max(1, math.Abs(float64(want[i]))) {
+				t.Errorf("%s row %d: %s %g, generic %g", c.name, i, best, got[i], want[i])
+				break
+			}
+		}
+	}
+	if Kernels() != "generic" {
+		t.Errorf("Kernels() = %q after SetKernels(generic)", Kernels())
+	}
+	if err := SetKernels("sse9"); err == nil {
+		t.Error("unknown variant accepted")
+	}
+}
@@ -0,0 +1,275 @@
+package wtf
+
+// kvpage.go — paged storage for KV snapshots. Everything that keeps KV rows
+// outside the live cache (persona prefixes, parked sessions) holds them as a
+// page table over fixed-size pages drawn from one per-model pool, so
+// thousands of snapshots of different lengths recycle the same buffers
+// instead of fragmenting the heap with odd-sized slices.
+//
+// The live cache stays one contiguous [layers, seq_len, kv_dim] block — the
+// attention sgemv wants its rows contiguous — and snapshots move in and out
+// of it a page at a time.
+//
+// Full pages are shared. A page's rows depend only on the tokens up to and
+// including it, so (previous page, tokens in this page) identifies its
+// contents exactly; snapshots that start with the same anchor reference one
+// copy of its pages. Pages never change once in a snapshot, which makes the
+// sharing copy-on-write for free: whoever diverges writes a new page.
+
+import "sync"
+
+// DefaultPageRows is the number of token positions per KV page.
+const DefaultPageRows = 16
+
+// kvPage holds K and V for PageRows positions of every layer, laid out
+// [layer][k|v][row][kv_dim].
+type kvPage struct {
+	data []float32
+	refs int      // snapshots referencing this page; guarded by the pool
+	key  *pageKey // index entry while shared, nil for partial pages
+}
+
+// pageKey identifies a full page's contents: the page before it (nil for
+// the first) and the tokens it holds.
+type pageKey struct {
+	parent *kvPage
+	tokens [DefaultPageRows]int32
+}
+
+// PagePool hands out KV pages for one model shape and takes them back.
+type PagePool struct {
+	rows, layers, kvDim int
+
+	mu    sync.Mutex
+	free  []*kvPage
+	inUse int
+	index map[pageKey]*kvPage // full pages by content
+}
+
+// PagePoolStats is a point-in-time view of a PagePool.
+type PagePoolStats struct {
+	PageRows  int
+	PageBytes int64
+	InUse     int // pages referenced by snapshots
+	Shared    int // of which referenced by more than one
+	Free      int // pages kept for reuse
+}
+
+// Pages returns the model's page pool, created on first use.
+func (m *LlamaModel) Pages() *PagePool {
+	m.poolOnce.Do(func() {
+		cfg := &m.Config
+		m.pool = &PagePool{rows: DefaultPageRows, layers: cfg.NumLayers, kvDim: cfg.NumKVHeads * cfg.HeadDim}
+	})
+	return m.pool
+}
+
+func (pp *PagePool) pageFloats() int { return pp.layers * 2 * pp.rows * pp.kvDim }
+
+// get returns a page with one reference. Contents are unspecified.
+func (pp *PagePool) get() *kvPage {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.inUse++
+	if n := len(pp.free); n > 0 {
+		pg := pp.free[n-1]
+		pp.free = pp.free[:n-1]
+		pg.refs = 1
+		return pg
+	}
+	return &kvPage{data: make([]float32, pp.pageFloats()), refs: 1}
+}
+
+// put drops one reference to each page, recycling pages nobody holds.
+func (pp *PagePool) put(pages []*kvPage) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for _, pg := range pages {
+		if pg.refs--; pg.refs == 0 {
+			if pg.key != nil {
+				delete(pp.index, *pg.key)
+				pg.key = nil
+			}
+			pp.inUse--
+			pp.free = append(pp.free, pg)
+		}
+	}
+}
+
+// page returns the page for rows [r0, r0+rows) of a snapshot whose earlier
+// page is parent. When the page is full and its tokens are known, an
+// identical page already in the pool is shared; otherwise a fresh page is
+// filled by fill and, if full, indexed for later snapshots.
+func (pp *PagePool) page(parent *kvPage, tokens []int, r0 int, fill func(*kvPage)) *kvPage {
+	var key *pageKey
+	if len(tokens) >= r0+pp.rows {
+		key = &pageKey{parent: parent}
+		for i, t := range tokens[r0 : r0+pp.rows] {
+			key.tokens[i] = int32(t)
+		}
+		pp.mu.Lock()
+		pg, ok := pp.index[*key]
+		if ok {
+			pg.refs++
+		}
+		pp.mu.Unlock()
+		if ok {
+			return pg
+		}
+	}
+	pg := pp.get()
+	fill(pg)
+	if key != nil {
+		pp.mu.Lock()
+		if _, taken := pp.index[*key]; !taken {
+			if pp.index == nil {
+				pp.index = make(map[pageKey]*kvPage)
+			}
+			pp.index[*key], pg.key = pg, key
+		}
+		pp.mu.Unlock()
+	}
+	return pg
+}
+
+// Trim releases the pooled free pages to the garbage collector.
+func (pp *PagePool) Trim() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.free = nil
+}
+
+// Stats reports pool occupancy.
+func (pp *PagePool) Stats() PagePoolStats {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return PagePoolStats{
+		PageRows:  pp.rows,
+		PageBytes: int64(pp.pageFloats()) * 4,
+		InUse:     pp.inUse,
+		Shared:    pp.sharedLocked(),
+		Free:      len(pp.free),
+	}
+}
+
+func (pp *PagePool) sharedLocked() int {
+	n := 0
+	for _, pg := range pp.index {
+		if pg.refs > 1 {
+			n++
+		}
+	}
+	return n
+}
+
+// kvPrefix is a copy of the first n KV-cache rows of every layer — enough to
+// resume decoding at position n without re-running the prefill.
+type kvPrefix struct {
+	n      int
+	pages  []*kvPage // ceil(n / rows); the last may be partly used
+	tokens []int     // State.Tokens[:n] at snapshot time, if known
+	pool   *PagePool
+}
+
+// release returns the prefix's pages to the pool. The prefix is unusable
+// afterwards.
+func (p *kvPrefix) release() {
+	if p == nil || p.pages == nil {
+		return
+	}
+	p.pool.put(p.pages)
+	p.pages = nil
+}
+
+// bytes is the pool memory the prefix pins, counting shared pages in full —
+// an upper bound on what releasing it would free.
+func (p *kvPrefix) bytes() int64 {
+	return int64(len(p.pages)) * int64(p.pool.pageFloats()) * 4
+}
+
+// segment is the [k|v] block of layer l inside a page.
+func (pp *PagePool) segment(pg *kvPage, l, kv int) []float32 {
+	size := pp.rows * pp.kvDim
+	off := (l*2 + kv) * size
+	return pg.data[off : off+size]
+}
+
+// snapshotKV copies cache rows [0, n) of every layer out of the live state,
+// sharing full pages another snapshot already holds.
+func (m *LlamaModel) snapshotKV(n int) *kvPrefix {
+	pp := m.Pages()
+	cfg := &m.Config
+	p := &kvPrefix{n: n, pool: pp}
+	if len(m.State.Tokens) >= n {
+		p.tokens = append([]int(nil), m.State.Tokens[:n]...)
+	}
+	var parent *kvPage
+	for r0 := 0; r0 < n; r0 += pp.rows {
+		rows := min(pp.rows, n-r0)
+		parent = pp.page(parent, p.tokens, r0, func(pg *kvPage) {
+			for l := 0; l < cfg.NumLayers; l++ {
+				base := (l*cfg.SeqLen + r0) * pp.kvDim
+				copy(pp.segment(pg, l, 0), m.State.KeyCache[base:base+rows*pp.kvDim])
+				copy(pp.segment(pg, l, 1), m.State.ValueCache[base:base+rows*pp.kvDim])
+			}
+		})
+		p.pages = append(p.pages, parent)
+	}
+	return p
+}
+
+// restoreKV resets the model and loads a prefix back into cache rows [0, n).
+func (m *LlamaModel) restoreKV(p *kvPrefix) {
+	m.Reset()
+	pp := p.pool
+	cfg := &m.Config
+	for i, pg := range p.pages {
+		r0 := i * pp.rows
+		rows := min(pp.rows, p.n-r0)
+		for l := 0; l < cfg.NumLayers; l++ {
+			base := (l*cfg.SeqLen + r0) * pp.kvDim
+			copy(m.State.KeyCache[base:base+rows*pp.kvDim], pp.segment(pg, l, 0))
+			copy(m.State.ValueCache[base:base+rows*pp.kvDim], pp.segment(pg, l, 1))
+		}
+	}
+	m.State.Pos = p.n
+	m.State.Tokens = append(m.State.Tokens[:0], p.tokens...)
+}
+
+// flat returns the prefix as layer-major [layers*n*kv_dim] K and V arrays,
+// the portable layout session export uses.
+func (p *kvPrefix) flat() (k, v []float32) {
+	pp := p.pool
+	row := p.n * pp.kvDim
+	k, v = make([]float32, pp.layers*row), make([]float32, pp.layers*row)
+	for i, pg := range p.pages {
+		r0 := i * pp.rows
+		rows := min(pp.rows, p.n-r0)
+		for l := 0; l < pp.layers; l++ {
+			off := l*row + r0*pp.kvDim
+			copy(k[off:off+rows*pp.kvDim], pp.segment(pg, l, 0))
+			copy(v[off:off+rows*pp.kvDim], pp.segment(pg, l, 1))
+		}
+	}
+	return k, v
+}
+
+// prefixFromFlat is the inverse of flat.
+func (m *LlamaModel) prefixFromFlat(n int, k, v []float32, tokens []int) *kvPrefix {
+	pp := m.Pages()
+	row := n * pp.kvDim
+	p := &kvPrefix{n: n, tokens: tokens, pool: pp}
+	var parent *kvPage
+	for r0 := 0; r0 < n; r0 += pp.rows {
+		rows := min(pp.rows, n-r0)
+		parent = pp.page(parent, tokens, r0, func(pg *kvPage) {
+			for l := 0; l < pp.layers; l++ {
+				off := l*row + r0*pp.kvDim
+				copy(pp.segment(pg, l, 0), k[off:off+rows*pp.kvDim])
+				copy(pp.segment(pg, l, 1), v[off:off+rows*pp.kvDim])
+			}
+		})
+		p.pages = append(p.pages, parent)
+	}
+	return p
+}
@@ -0,0 +1,304 @@
+package wtf
+
+// kvstore.go — parking for idle sessions' KV rows. The engine has one live
+// KV cache; when a session loses it to another caller, its rows are copied
+// here so its next turn restores them instead of re-prefilling the whole
+// history. RAM use is bounded: past MaxRAM, the least recently parked
+// sessions spill to a scratch file and are read back on their next turn.
+//
+// The scratch file is memory-mapped where the OS has mmap (Linux, macOS,
+// FreeBSD): a spill encodes straight into the mapping and advises its pages
+// away, so they leave RSS once the kernel has written them back, and a
+// recall decodes straight out of it. Elsewhere it falls back to
+// ReadAt/WriteAt.
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+)
+
+// KVStore holds parked KV snapshots. Attach one to Engine.Store before use.
+type KVStore struct {
+	// MaxRAM bounds snapshot bytes kept in memory; 0 keeps everything in RAM.
+	MaxRAM int64
+	// Dir is where the scratch file goes ("" = os.TempDir()).
+	Dir string
+
+	mu      sync.Mutex
+	entries map[*Session]*list.Element // of *parked
+	lru     list.List                  // front = most recently parked
+	ram     int64
+
+	file   *os.File
+	mapped []byte   // the scratch file, while it is mapped
+	noMap  bool     // no mmap here: plain ReadAt/WriteAt
+	end    int64    // scratch file high-water mark
+	holes  []extent // freed file ranges, reused first-fit
+	spills int      // snapshots written to disk, for Stats
+}
+
+type parked struct {
+	s    *Session
+	p    *kvPrefix // nil while spilled
+	at   extent    // file range while spilled
+	size int64
+	pool *PagePool // pages come back from here on recall
+}
+
+type extent struct{ off, n int64 }
+
+// KVStoreStats is a point-in-time view of a KVStore.
+type KVStoreStats struct {
+	Parked   int   // snapshots held
+	RAMBytes int64 // of which in memory
+	Spilled  int   // snapshots currently on disk
+	Spills   int   // snapshots ever written to disk
+}
+
+// park stores s's snapshot, replacing any older one, then spills the least
+// recently parked snapshots until RAM use is back under MaxRAM.
+func (st *KVStore) park(s *Session, p *kvPrefix) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.dropLocked(s)
+	if st.entries == nil {
+		st.entries = make(map[*Session]*list.Element)
+	}
+	e := &parked{s: s, p: p, size: p.bytes(), pool: p.pool}
+	st.entries[s] = st.lru.PushFront(e)
+	st.ram += e.size
+	for el := st.lru.Back(); st.MaxRAM > 0 && st.ram > st.MaxRAM && el != nil; el = el.Prev() {
+		if pk := el.Value.(*parked); pk.p != nil {
+			if err := st.spillLocked(pk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// take removes and returns s's snapshot, reading it back from disk if it
+// was spilled. nil if s has nothing parked. The caller owns (and releases)
+// the returned prefix.
+func (st *KVStore) take(s *Session) (*kvPrefix, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	el, ok := st.entries[s]
+	if !ok {
+		return nil, nil
+	}
+	pk := el.Value.(*parked)
+	p := pk.p
+	if p == nil {
+		var err error
+		if p, err = st.readLocked(pk); err != nil {
+			return nil, err
+		}
+	} else {
+		pk.p, st.ram = nil, st.ram-pk.size // ownership moves to the caller
+	}
+	st.dropLocked(s)
+	return p, nil
+}
+
+// drop forgets s's snapshot.
+func (st *KVStore) drop(s *Session) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.dropLocked(s)
+}
+
+func (st *KVStore) dropLocked(s *Session) {
+	el, ok := st.entries[s]
+	if !ok {
+		return
+	}
+	pk := el.Value.(*parked)
+	if pk.p != nil {
+		st.ram -= pk.size
+		pk.p.release()
+	} else if pk.at.n > 0 {
+		st.holes = append(st.holes, pk.at)
+	}
+	st.lru.Remove(el)
+	delete(st.entries, s)
+}
+
+// Stats reports what the store currently holds.
+func (st *KVStore) Stats() KVStoreStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return KVStoreStats{
+		Parked:   len(st.entries),
+		RAMBytes: st.ram,
+		Spilled:  len(st.entries) - st.inRAMLocked(),
+		Spills:   st.spills,
+	}
+}
+
+func (st *KVStore) inRAMLocked() int {
+	n := 0
+	for el := st.lru.Front(); el != nil; el = el.Next() {
+		if el.Value.(*parked).p != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Close removes the scratch file and returns in-memory pages to their
+// pool. Parked snapshots are lost.
+func (st *KVStore) Close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for el := st.lru.Front(); el != nil; el = el.Next() {
+		el.Value.(*parked).p.release()
+	}
+	st.entries, st.ram, st.holes, st.end = nil, 0, nil, 0
+	st.lru.Init()
+	if st.file == nil {
+		return nil
+	}
+	name := st.file.Name()
+	err := munmap(st.mapped)
+	if cerr := st.file.Close(); err == nil {
+		err = cerr
+	}
+	st.file, st.mapped = nil, nil
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// Scratch layout per snapshot: n, len(tokens), tokens, then the raw page
+// data as little-endian float32. The pages go back to the pool once written.
+func (st *KVStore) spillLocked(pk *parked) error {
+	if st.file == nil {
+		f, err := os.CreateTemp(st.Dir, "wtf-kv-*.spill")
+		if err != nil {
+			return fmt.Errorf("kv spill: %w", err)
+		}
+		st.file = f
+	}
+	p := pk.p
+	floats := len(p.pages) * pk.pool.pageFloats()
+	at := st.allocLocked(int64(16 + 8*len(p.tokens) + 4*floats))
+	buf, err := st.spanLocked(at)
+	if err != nil {
+		st.holes = append(st.holes, at)
+		return fmt.Errorf("kv spill: %w", err)
+	}
+	binary.LittleEndian.PutUint64(buf, uint64(p.n))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(len(p.tokens)))
+	o := 16
+	for _, t := range p.tokens {
+		binary.LittleEndian.PutUint64(buf[o:], uint64(t))
+		o += 8
+	}
+	for _, pg := range p.pages {
+		for _, f := range pg.data {
+			binary.LittleEndian.PutUint32(buf[o:], math.Float32bits(f))
+			o += 4
+		}
+	}
+	if st.mapped != nil {
+		// Only whole pages can be advised away; edges shared with a
+		// neighbour stay.
+		ps := int64(pageSize())
+		if lo, hi := (at.off+ps-1)/ps*ps, (at.off+at.n)/ps*ps; hi > lo {
+			adviseRange(st.mapped[lo:hi], false)
+		}
+	} else if _, err := st.file.WriteAt(buf, at.off); err != nil {
+		st.holes = append(st.holes, at)
+		return fmt.Errorf("kv spill: %w", err)
+	}
+	p.release()
+	pk.p, pk.at = nil, at
+	st.ram -= pk.size
+	st.spills++
+	return nil
+}
+
+func (st *KVStore) readLocked(pk *parked) (*kvPrefix, error) {
+	var buf []byte
+	if st.mapped != nil {
+		buf = st.mapped[pk.at.off : pk.at.off+pk.at.n]
+	} else {
+		buf = make([]byte, pk.at.n)
+		if _, err := st.file.ReadAt(buf, pk.at.off); err != nil {
+			return nil, fmt.Errorf("kv recall: %w", err)
+		}
+	}
+	n := int(binary.LittleEndian.Uint64(buf))
+	nt := int(binary.LittleEndian.Uint64(buf[8:]))
+	p := &kvPrefix{n: n, tokens: make([]int, nt), pool: pk.pool}
+	o := 16
+	for i := range p.tokens {
+		p.tokens[i] = int(binary.LittleEndian.Uint64(buf[o:]))
+		o += 8
+	}
+	var parent *kvPage
+	for r0 := 0; o < len(buf); r0 += pk.pool.rows {
+		data := buf[o:]
+		parent = pk.pool.page(parent, p.tokens, r0, func(pg *kvPage) {
+			for i := range pg.data {
+				pg.data[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+			}
+		})
+		p.pages = append(p.pages, parent)
+		o += 4 * pk.pool.pageFloats()
+	}
+	return p, nil
+}
+
+// spanLocked returns the bytes a spill to at is encoded into: the mapped
+// file itself, grown and remapped when at runs past it, or a buffer for
+// WriteAt where there is no mmap.
+func (st *KVStore) spanLocked(at extent) ([]byte, error) {
+	end := at.off + at.n
+	if !st.noMap && end > int64(len(st.mapped)) {
+		size := max(end, 2*int64(len(st.mapped)), 1<<20)
+		size = (size + int64(pageSize()) - 1) / int64(pageSize()) * int64(pageSize())
+		if err := st.file.Truncate(size); err != nil {
+			return nil, err
+		}
+		if err := munmap(st.mapped); err != nil {
+			return nil, err
+		}
+		st.mapped = nil
+		m, err := mmapShared(st.file, size)
+		if errors.Is(err, ErrStreamUnsupported) {
+			st.noMap = true
+		} else if err != nil {
+			return nil, err
+		}
+		st.mapped = m
+	}
+	if st.noMap {
+		return make([]byte, at.n), nil
+	}
+	return st.mapped[at.off:end], nil
+}
+
+// allocLocked finds room for n bytes: the first hole that fits, else the end.
+func (st *KVStore) allocLocked(n int64) extent {
+	for i, h := range st.holes {
+		if h.n >= n {
+			if h.n == n {
+				st.holes = append(st.holes[:i], st.holes[i+1:]...)
+			} else {
+				st.holes[i] = extent{h.off + n, h.n - n}
+			}
+			return extent{h.off, n}
+		}
+	}
+	at := extent{st.end, n}
+	st.end += n
+	return at
+}
@@ -0,0 +1,190 @@
+package wtf
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestKVStoreParksAndSpills(t *testing.T) {
+	run := func(store *KVStore) (texts []string, prompts []int) {
+		e := newTestEngine()
+		e.Store = store
+		a := e.NewSession("be rude.", ChatQA, sessionOpts())
+		b := e.NewSession("be nice.", ChatQA, sessionOpts())
+		for _, q := range []string{"a?", "b?"} {
+			for _, s := range []*Session{a, b} {
+				res, err := s.Send(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				texts = append(texts, res.Text)
+				prompts = append(prompts, res.PromptTokens)
+			}
+		}
+		return texts, prompts
+	}
+
+	coldTexts, coldPrompts := run(nil)
+	store := &KVStore{MaxRAM: 1, Dir: t.TempDir()} // everything spills
+	defer store.Close()
+	texts, prompts := run(store)
+
+	if !slices.Equal(texts, coldTexts) {
+		t.Fatalf("parked sessions changed output:\n%q\n%q", texts, coldTexts)
+	}
+	// Second-round turns resume from parked rows instead of the whole history.
+	for i := 2; i < 4; i++ {
+		if prompts[i] >= coldPrompts[i] {
+			t.Fatalf("turn %d prefilled %d tokens, same as without a store (%d)", i, prompts[i], coldPrompts[i])
+		}
+	}
+	if st := store.Stats(); st.Spills == 0 || st.RAMBytes != 0 {
+		t.Fatalf("stats = %+v, want spills and nothing in RAM", st)
+	}
+}
+
+// testPrefix builds an n-row prefix on m with distinct values per row.
+func testPrefix(m *LlamaModel, n int, tokens []int) *kvPrefix {
+	size := m.Config.NumLayers * n * m.Config.NumKVHeads * m.Config.HeadDim
+	k, v := make([]float32, size), make([]float32, size)
+	for i := range k {
+		k[i], v[i] = float32(i)+0.25, -float32(i)
+	}
+	return m.prefixFromFlat(n, k, v, tokens)
+}
+
+func TestKVStoreSpillRoundTrip(t *testing.T) {
+	m := newTestModel(8)
+	st := &KVStore{MaxRAM: 1, Dir: t.TempDir()}
+	defer st.Close()
+	s1, s2 := &Session{}, &Session{}
+	p := testPrefix(m, 20, []int{5, 9})
+	wantK, wantV := p.flat()
+	if err := st.park(s1, p); err != nil {
+		t.Fatal(err)
+	}
+	st.park(s2, testPrefix(m, 1, []int{3}))
+	if st := m.Pages().Stats(); st.InUse != 0 {
+		t.Fatalf("spilled pages still in use: %+v", st)
+	}
+	got, err := st.take(s1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, v := got.flat()
+	if got.n != 20 || !slices.Equal(k, wantK) || !slices.Equal(v, wantV) || !slices.Equal(got.tokens, []int{5, 9}) {
+		t.Fatalf("recalled n=%d tokens=%v, data equal k=%v v=%v", got.n, got.tokens, slices.Equal(k, wantK), slices.Equal(v, wantV))
+	}
+	if again, _ := st.take(s1); again != nil {
+		t.Fatal("take should remove the snapshot")
+	}
+	// The freed range is reused rather than growing the file.
+	end := st.end
+	st.park(s1, got)
+	if st.end != end || st.Stats().Parked != 2 {
+		t.Fatalf("file grew %d -> %d on re-park; stats %+v", end, st.end, st.Stats())
+	}
+}
+
+func TestKVStoreScratchGrows(t *testing.T) {
+	m := newTestModel(8)
+	st := &KVStore{MaxRAM: 1, Dir: t.TempDir()}
+	defer st.Close()
+	// Enough spills to outgrow the first mapping and remap the file.
+	var sessions []*Session
+	var want [][]float32
+	for n := 0; st.end <= 3<<20; n++ {
+		s := &Session{}
+		p := testPrefix(m, 64, []int{n})
+		k, _ := p.flat()
+		if err := st.park(s, p); err != nil {
+			t.Fatal(err)
+		}
+		sessions, want = append(sessions, s), append(want, k)
+	}
+	for i, s := range sessions {
+		p, err := st.take(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k, _ := p.flat(); !slices.Equal(k, want[i]) || p.tokens[0] != i {
+			t.Fatalf("snapshot %d of %d came back different", i, len(sessions))
+		}
+		p.release()
+	}
+}
+
+func TestPagePoolRecycles(t *testing.T) {
+	m := newTestModel(8)
+	pp := m.Pages()
+	p := testPrefix(m, 2*DefaultPageRows+1, nil)
+	if st := pp.Stats(); st.InUse != 3 || st.Free != 0 {
+		t.Fatalf("after snapshot: %+v, want 3 pages in use", st)
+	}
+	k, v := p.flat()
+	m.restoreKV(p)
+	p.release()
+	p.release() // idempotent
+	if st := pp.Stats(); st.InUse != 0 || st.Free != 3 {
+		t.Fatalf("after release: %+v, want 3 free pages", st)
+	}
+	// A new snapshot of the restored rows reuses the freed pages.
+	q := m.snapshotKV(2*DefaultPageRows + 1)
+	if st := pp.Stats(); st.InUse != 3 || st.Free != 0 {
+		t.Fatalf("after re-snapshot: %+v, want the free pages reused", st)
+	}
+	qk, qv := q.flat()
+	if !slices.Equal(k, qk) || !slices.Equal(v, qv) {
+		t.Fatal("snapshot of restored rows differs from the original")
+	}
+	q.release()
+	pp.Trim()
+	if st := pp.Stats(); st.Free != 0 {
+		t.Fatalf("after trim: %+v", st)
+	}
+}
+
+func TestSharedPrefixPages(t *testing.T) {
+	e := newTestEngine()
+	e.Store = &KVStore{}
+	defer e.Store.Close()
+	anchor := "be rude about the sky and the sea, the sky is the sea, the sea is the sky."
+	var sessions []*Session
+	for _, q := range []string{"what?", "why?", "how?"} {
+		s := e.NewSession(anchor, ChatQA, sessionOpts())
+		if _, err := s.Send(q); err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, s)
+	}
+	// Two sessions are parked, both starting with the anchor's full pages.
+	st := e.Model.Pages().Stats()
+	if st.Shared == 0 {
+		t.Fatalf("no pages shared between sessions with the same anchor: %+v", st)
+	}
+	// Recalling a session that shares pages still gives its own reply back.
+	cold := newTestEngine().NewSession(anchor, ChatQA, sessionOpts())
+	cold.Send("what?")
+	want, _ := cold.Send("and?")
+	got, err := sessions[0].Send("and?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Text != want.Text {
+		t.Fatalf("shared-page recall = %q, cold = %q", got.Text, want.Text)
+	}
+
+	// Shared pages outlive any one holder.
+	m := e.Model
+	p, q := m.snapshotKV(m.State.Pos), m.snapshotKV(m.State.Pos)
+	pk, pv := p.flat()
+	if p.pages[0] != q.pages[0] {
+		t.Fatal("identical snapshots do not share their first page")
+	}
+	q.release()
+	k, v := p.flat()
+	if !slices.Equal(k, pk) || !slices.Equal(v, pv) {
+		t.Fatal("releasing one holder changed the other's rows")
+	}
+	p.release()
+}
@@ -0,0 +1,333 @@
+package wtf
+
+// lang.go — what language a text is in, and keeping a reply in the one the
+// user wrote. DetectLanguage picks the dominant script, then tells the
+// languages sharing it apart (stopwords and diacritics for Latin, a few
+// letters for Cyrillic, kana for Japanese). GenOptions.Language biases
+// sampling against tokens spelling letters of any other script: a nudge,
+// not a wall, so a reply can still quote a brand name or a word of English,
+// and nothing is cut off mid-word.
+//
+// Byte-level vocabularies split most non-Latin characters over several
+// tokens. A token ending mid-character counts by the script its prefix can
+// still become; one starting mid-character is judged at the step it would
+// complete the character, from the bytes already written.
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Language is a detection result.
+type Language struct {
+	Code       string  `json:"code"`       // ISO 639-1; "" when the letters gave no clear answer
+	Script     string  `json:"script"`     // dominant script ("" = no letters)
+	Confidence float64 `json:"confidence"` // 0..1
+}
+
+// LanguageTarget keeps replies in one language's script.
+type LanguageTarget struct {
+	Code string  // a Languages code, "auto" = the language of the user's text, "" = off
+	Bias float32 // subtracted from the logit of other-script tokens (0 = 4)
+
+	scripts []string // resolved by auto
+}
+
+// scripts is the ordered table DetectLanguage and the bias classify by.
+// Letters in no listed script count as "Other".
+var scripts = []struct {
+	name  string
+	table *unicode.RangeTable
+}{
+	{"Latin", unicode.Latin}, {"Cyrillic", unicode.Cyrillic}, {"Greek", unicode.Greek},
+	{"Han", unicode.Han}, {"Hiragana", unicode.Hiragana}, {"Katakana", unicode.Katakana},
+	{"Hangul", unicode.Hangul}, {"Arabic", unicode.Arabic}, {"Hebrew", unicode.Hebrew},
+	{"Devanagari", unicode.Devanagari}, {"Thai", unicode.Thai},
+}
+
+// languageScripts maps every code DetectLanguage returns to the scripts
+// its text is written in.
+var languageScripts = map[string][]string{
+	"en": {"Latin"}, "es": {"Latin"}, "fr": {"Latin"}, "de": {"Latin"},
+	"pt": {"Latin"}, "it": {"Latin"}, "nl": {"Latin"},
+	"ru": {"Cyrillic"}, "uk": {"Cyrillic"}, "el": {"Greek"},
+	"zh": {"Han"}, "ja": {"Han", "Hiragana", "Katakana"}, "ko": {"Hangul", "Han"},
+	"ar": {"Arabic"}, "he": {"Hebrew"}, "hi": {"Devanagari"}, "th": {"Thai"},
+}
+
+// scriptLanguage is the language a script alone identifies.
+var scriptLanguage = map[string]string{
+	"Greek": "el", "Hangul": "ko", "Arabic": "ar", "Hebrew": "he",
+	"Devanagari": "hi", "Thai": "th", "Hiragana": "ja", "Katakana": "ja",
+}
+
+// latinHints score the Latin-script languages: common short words, and
+// letters the others rarely use.
+var latinHints = map[string]struct {
+	words   []string
+	letters string
+}{
+	"en": {strings.Fields("the and is you that it of to what this are not with for why"), ""},
+	"es": {strings.Fields("el la de que y en los es por una con no para pero qué"), "ñ¿¡"},
+	"fr": {strings.Fields("le la les de et est un une que pas pour je vous des du ce qui"), "çèêàù"},
+	"de": {strings.Fields("der die das und ist nicht ein eine ich du zu mit auch es"), "ßäöü"},
+	"pt": {strings.Fields("o a de que e do da não um uma para com é os você"), "ãõç"},
+	"it": {strings.Fields("il la di che e è non un una per con sono ma gli"), "ìò"},
+	"nl": {strings.Fields("de het een en is van niet dat ik je met op zijn voor"), "ĳ"},
+}
+
+// Languages lists the codes LanguageTarget accepts, sorted.
+func Languages() []string {
+	codes := make([]string, 0, len(languageScripts))
+	for c := range languageScripts {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// ParseLanguageTarget checks a -lang style value: a Languages code, "auto"
+// or "" (off).
+func ParseLanguageTarget(s string) (LanguageTarget, error) {
+	if _, ok := languageScripts[s]; ok || s == "" || s == "auto" {
+		return LanguageTarget{Code: s}, nil
+	}
+	return LanguageTarget{}, fmt.Errorf("language %q: want auto or one of %s", s, strings.Join(Languages(), ", "))
+}
+
+// scriptOf returns the script of r from the scripts table, "Other" for a
+// letter outside it, "" for anything else.
+func scriptOf(r rune) string {
+	for _, s := range scripts {
+		if unicode.Is(s.table, r) {
+			return s.name
+		}
+	}
+	if unicode.IsLetter(r) {
+		return "Other"
+	}
+	return ""
+}
+
+// DetectLanguage guesses the language of text. Text with no letters gives
+// the zero Language.
+func DetectLanguage(text string) Language {
+	counts, letters := scriptCounts(text)
+	if letters == 0 {
+		return Language{}
+	}
+	// Kana mark Japanese even when kanji outnumber them.
+	if kana := counts["Hiragana"] + counts["Katakana"]; kana > 0 && counts["Han"]+kana >= counts["Latin"] {
+		return Language{Code: "ja", Script: "Han", Confidence: float64(counts["Han"]+kana) / float64(letters)}
+	}
+	best := dominant(counts)
+	l := Language{Script: best, Confidence: float64(counts[best]) / float64(letters)}
+	lower := strings.ToLower(text)
+	switch best {
+	case "Latin":
+		code, share := latinLanguage(lower)
+		l.Code, l.Confidence = code, l.Confidence*share
+	case "Cyrillic":
+		l.Code = "ru"
+		if strings.ContainsAny(lower, "іїєґ") {
+			l.Code = "uk"
+		}
+	case "Han":
+		l.Code = "zh"
+		if counts["Hangul"] > 0 {
+			l.Code = "ko"
+		}
+	default:
+		l.Code = scriptLanguage[best]
+	}
+	return l
+}
+
+// scriptCounts counts the letters of text per script.
+func scriptCounts(text string) (map[string]int, int) {
+	counts := map[string]int{}
+	letters := 0
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+			counts[scriptOf(r)]++
+		}
+	}
+	return counts, letters
+}
+
+// dominant returns the script with the most letters, the table's order
+// breaking ties ("" = none).
+func dominant(counts map[string]int) string {
+	best := ""
+	for _, s := range scripts {
+		if counts[s.name] > counts[best] {
+			best = s.name
+		}
+	}
+	if counts["Other"] > counts[best] {
+		best = "Other"
+	}
+	return best
+}
+
+// dominantScript is the script most letters of text are in.
+func dominantScript(text string) string {
+	counts, _ := scriptCounts(text)
+	return dominant(counts)
+}
+
+// latinLanguage scores lower against latinHints and returns the winner and
+// its share of all hits ("", 0 with no hits at all).
+func latinLanguage(lower string) (string, float64) {
+	words := strings.FieldsFunc(lower, func(r rune) bool { return !unicode.IsLetter(r) && r != '\'' })
+	scores := map[string]float64{}
+	var total float64
+	for code, h := range latinHints {
+		for _, w := range words {
+			for _, sw := range h.words {
+				if w == sw {
+					scores[code]++
+					break
+				}
+			}
+		}
+		for _, c := range h.letters {
+			scores[code] += 2 * float64(strings.Count(lower, string(c)))
+		}
+		total += scores[code]
+	}
+	best := ""
+	for _, code := range Languages() { // sorted: ties go the same way every time
+		if scores[code] > scores[best] {
+			best = code
+		}
+	}
+	if best == "" {
+		return "", 0
+	}
+	return best, scores[best] / total
+}
+
+// resolve settles "auto" on the language of text, with the chat markers
+// around a question taken out first. Later user text wins, so in a chat the
+// last message decides.
+func (lt *LanguageTarget) resolve(text string) {
+	if lt.Code != "auto" {
+		return
+	}
+	for _, m := range chatMarkers {
+		text = strings.ReplaceAll(text, m, "")
+	}
+	l := DetectLanguage(text)
+	switch {
+	case l.Code != "":
+		lt.scripts = languageScripts[l.Code]
+	case l.Script != "" && l.Script != "Other":
+		lt.scripts = []string{l.Script}
+	}
+}
+
+// allowed returns the scripts the reply is kept to (nil = no bias).
+func (lt *LanguageTarget) allowed() []string {
+	if lt.Code == "auto" {
+		return lt.scripts
+	}
+	return languageScripts[lt.Code]
+}
+
+// languageBias lowers the logit of every token that would write a letter
+// outside opts.Language's scripts after out.
+func (t *Tokenizer) languageBias(logits []float32, lt *LanguageTarget, out []byte) {
+	allowed := lt.allowed()
+	if len(allowed) == 0 {
+		return
+	}
+	bias := lt.Bias
+	if bias == 0 {
+		bias = 4
+	}
+	for _, id := range t.foreignIDs(allowed) {
+		logits[id] -= bias
+	}
+	// Mid-character, a token's first bytes finish what out started.
+	if tail := utf8Tail(out); tail != "" {
+		for id := 0; id < len(logits) && id < t.VocabSize; id++ {
+			p := t.Piece(id)
+			if p == "" || utf8.RuneStart(p[0]) {
+				continue // already judged on its own
+			}
+			if r, _ := utf8.DecodeRuneInString(tail + p); !slices.Contains(allowed, scriptOf(r)) && unicode.IsLetter(r) {
+				logits[id] -= bias
+			}
+		}
+	}
+}
+
+// foreignIDs lists the tokens that write a letter outside allowed, built on
+// first use per script set.
+func (t *Tokenizer) foreignIDs(allowed []string) []int {
+	key := strings.Join(allowed, ",")
+	t.maskMu.Lock()
+	defer t.maskMu.Unlock()
+	if ids, ok := t.foreign[key]; ok {
+		return ids
+	}
+	ids := []int{}
+	for id := 0; id < t.VocabSize; id++ {
+		if id != t.EosID && foreignPiece(t.Piece(id), allowed) {
+			ids = append(ids, id)
+		}
+	}
+	if t.foreign == nil {
+		t.foreign = make(map[string][]int)
+	}
+	t.foreign[key] = ids
+	return ids
+}
+
+// foreignPiece reports whether p writes, or begins, a letter outside
+// allowed. Leading continuation bytes are skipped: they belong to the
+// character before.
+func foreignPiece(p string, allowed []string) bool {
+	for len(p) > 0 && !utf8.RuneStart(p[0]) {
+		p = p[1:]
+	}
+	for len(p) > 0 {
+		r, n := utf8.DecodeRuneInString(p)
+		if r == utf8.RuneError && !utf8.FullRuneInString(p) {
+			s := prefixScript(p)
+			return s != "" && !slices.Contains(allowed, s)
+		}
+		if unicode.IsLetter(r) && !slices.Contains(allowed, scriptOf(r)) {
+			return true
+		}
+		p = p[n:]
+	}
+	return false
+}
+
+// prefixScript returns the script every character starting with the
+// incomplete sequence p belongs to, or "" when they differ.
+func prefixScript(p string) string {
+	n := 2
+	switch {
+	case p[0] >= 0xF0:
+		n = 4
+	case p[0] >= 0xE0:
+		n = 3
+	}
+	a, _ := utf8.DecodeRuneInString(p + strings.Repeat("\x80", n-len(p)))
+	b, _ := utf8.DecodeRuneInString(p + strings.Repeat("\xBF", n-len(p)))
+	if a == utf8.RuneError || b == utf8.RuneError {
+		return ""
+	}
+	if s := scriptOf(a); s == scriptOf(b) && s != "Other" {
+		return s
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package wtf
+
+import "testing"
+
+func TestDetectLanguage(t *testing.T) {
+	for _, c := range []struct{ text, code string }{
+		{"bro the thing is you are not wrong, it is just cringe", "en"},
+		{"¿por qué la gente sigue usando php? no tiene sentido", "es"},
+		{"je ne sais pas pourquoi les gens aiment le javascript", "fr"},
+		{"warum ist das so schwer? ich verstehe es nicht", "de"},
+		{"почему все пишут на расте", "ru"},
+		{"чому всі пишуть на расті? це ж дивно", "uk"},
+		{"为什么大家都在用这个框架", "zh"},
+		{"なぜみんなこのフレームワークを使うの", "ja"},
+		{"왜 다들 이 프레임워크를 써요", "ko"},
+		{"12345 !!!", ""},
+	} {
+		if got := DetectLanguage(c.text); got.Code != c.code {
+			t.Errorf("DetectLanguage(%q) = %+v, want %q", c.text, got, c.code)
+		}
+	}
+}
+
+func TestLanguageBias(t *testing.T) {
+	tok := NewTokenizer(&GGUFMetadata{
+		TokenList:   []string{"</s>", "hi", "при", "<0xD0>", "<0xBF>", "ok", "é"},
+		TokenScores: make([]float32, 7),
+		TokenTypes:  []int32{3, 1, 1, 6, 6, 1, 1},
+		TokenModel:  "llama",
+		VocabSize:   7,
+		BosID:       -1,
+		EosID:       0,
+	})
+	lt := LanguageTarget{Code: "en", Bias: 3}
+	logits := make([]float32, 7)
+	tok.languageBias(logits, &lt, []byte("so "))
+	// "при" is Cyrillic; a lone D0 byte can only begin Cyrillic; é is Latin.
+	want := []float32{0, 0, -3, -3, 0, 0, 0}
+	for id := range want {
+		if logits[id] != want[id] {
+			t.Fatalf("after %q: logits %v, want %v", "so ", logits, want)
+		}
+	}
+	// Once D0 is written, BF would complete "п".
+	clear(logits)
+	tok.languageBias(logits, &lt, []byte("so \xD0"))
+	if logits[4] != -3 {
+		t.Fatalf("continuation byte after D0 not biased: %v", logits)
+	}
+
+	auto := LanguageTarget{Code: "auto"}
+	auto.resolve(QuestionPrompt("почему все пишут на расте"))
+	clear(logits)
+	tok.languageBias(logits, &auto, nil)
+	if logits[1] != -4 || logits[2] != 0 {
+		t.Fatalf("auto from a Russian question: %v, want Latin biased by 4", logits)
+	}
+}
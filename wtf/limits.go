@@ -0,0 +1,53 @@
+package wtf
+
+// limits.go — bounds on what a caller can hand the engine. Every prompt is
+// capped in bytes before it reaches the normalizer and tokenizer, and a
+// reply buffer has to hold at least one character: an embedder that
+// passes whatever its own caller sent gets an error it can match on, not
+// seconds of tokenizing or a reply that can never be written.
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// DefaultMaxPromptBytes is the prompt limit of an Engine that sets none:
+// 16x what fits in a 2048-token context, so only text that could never be
+// decoded whole is refused.
+const DefaultMaxPromptBytes = 128 << 10
+
+var (
+	// ErrPromptTooLong is returned for text over Engine.MaxPromptBytes.
+	ErrPromptTooLong = errors.New("prompt too long")
+	// ErrOutputBuffer is returned by GenerateTo for a buffer shorter than
+	// utf8.UTFMax, which cannot be relied on to hold a single character.
+	ErrOutputBuffer = errors.New("output buffer too small")
+)
+
+// PromptLimit is the byte limit e applies to caller text; 0 means none.
+func (e *Engine) PromptLimit() int {
+	switch {
+	case e.MaxPromptBytes < 0:
+		return 0
+	case e.MaxPromptBytes == 0:
+		return DefaultMaxPromptBytes
+	}
+	return e.MaxPromptBytes
+}
+
+// checkLen fails text over the prompt limit.
+func (e *Engine) checkLen(text string) error {
+	if limit := e.PromptLimit(); limit > 0 && len(text) > limit {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrPromptTooLong, len(text), limit)
+	}
+	return nil
+}
+
+// checkOutput fails a GenerateTo buffer that cannot take a reply.
+func checkOutput(buf []byte) error {
+	if len(buf) < utf8.UTFMax {
+		return fmt.Errorf("%w: %d bytes, need at least %d", ErrOutputBuffer, len(buf), utf8.UTFMax)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package wtf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPromptLimit(t *testing.T) {
+	e := newTestEngine()
+	if e.PromptLimit() != DefaultMaxPromptBytes {
+		t.Fatalf("default limit = %d", e.PromptLimit())
+	}
+	e.MaxPromptBytes = 16
+	long := strings.Repeat("lol ", 5)
+	if _, err := e.Generate("", long, greedyOpts(2)); !errors.Is(err, ErrPromptTooLong) {
+		t.Fatalf("Generate over the limit: %v", err)
+	}
+	if _, err := e.GenerateChat([]Message{{Role: RoleUser, Content: long}}, ChatQA, greedyOpts(2)); !errors.Is(err, ErrPromptTooLong) {
+		t.Fatalf("GenerateChat over the limit: %v", err)
+	}
+	if _, err := e.Generate("", "lol", greedyOpts(2)); err != nil {
+		t.Fatal(err)
+	}
+	// The raw text counts, not what scrubbing leaves of it.
+	scrubbed := greedyOpts(2)
+	scrubbed.ScrubPII = PIIAll
+	if _, err := e.Generate("", "trolololol@example.com", scrubbed); !errors.Is(err, ErrPromptTooLong) {
+		t.Fatalf("Generate over the limit before scrubbing: %v", err)
+	}
+	s := e.NewSession("", ChatQA, scrubbed)
+	if _, err := s.Send("trolololol@example.com"); !errors.Is(err, ErrPromptTooLong) {
+		t.Fatalf("Send over the limit before scrubbing: %v", err)
+	}
+	s.Close()
+	e.MaxPromptBytes = -1
+	if _, err := e.Generate("", long, greedyOpts(2)); err != nil {
+		t.Fatalf("no limit: %v", err)
+	}
+
+	// The servers refuse it before any op runs, JSON-RPC with its own code.
+	e.MaxPromptBytes = 16
+	srv := &Server{Engine: e, Defaults: greedyOpts(2)}
+	if r := srv.Handle(Call{Op: "encode", Prompt: long}, nil); !strings.Contains(r.Error, ErrPromptTooLong.Error()) {
+		t.Fatalf("encode: %+v", r)
+	}
+	var out bytes.Buffer
+	in := `{"jsonrpc":"2.0","id":1,"method":"generate","params":{"prompt":"` + long + `"}}`
+	if err := srv.ServeJSONRPC(strings.NewReader(in), &out); err != nil {
+		t.Fatal(err)
+	}
+	var resp rpcResponse
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil || resp.Error == nil || resp.Error.Code != rpcPromptTooLong {
+		t.Fatalf("JSON-RPC: %s", out.Bytes())
+	}
+}
+
+func TestGenerateToBufferSize(t *testing.T) {
+	e := newTestEngine()
+	for _, buf := range [][]byte{nil, make([]byte, 3)} {
+		if _, _, err := e.GenerateTo(buf, "", "the sky", greedyOpts(2)); !errors.Is(err, ErrOutputBuffer) {
+			t.Fatalf("%d-byte buffer: %v", len(buf), err)
+		}
+	}
+}
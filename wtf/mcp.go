@@ -0,0 +1,108 @@
+package wtf
+
+// mcp.go — the oracle as a Model Context Protocol tool server over stdio
+// (newline-delimited JSON-RPC 2.0), so agent frameworks and desktop
+// assistants can "consult the WTForacle" natively. One tool, text in, text
+// out: the question goes to the oracle persona in the Q/A format and the
+// verdict comes back as a single text content block.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// MCPProtocolVersion is the MCP revision ServeMCP speaks.
+const MCPProtocolVersion = "2024-11-05"
+
+// MCPTool is the name of the oracle tool.
+const MCPTool = "consult_wtforacle"
+
+var mcpTools = json.RawMessage(`{"tools":[{
+	"name":"` + MCPTool + `",
+	"description":"Ask the WTForacle, a cynical reddit-commenter language model, for its unfiltered verdict on a question.",
+	"inputSchema":{"type":"object","properties":{"question":{"type":"string","description":"what to ask the oracle"}},"required":["question"]}
+}]}`)
+
+type mcpResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type mcpContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type mcpToolResult struct {
+	Content []mcpContent `json:"content"`
+	IsError bool         `json:"isError"`
+}
+
+// ServeMCP answers MCP requests read from r on w until r ends. Generations
+// use the server defaults under OraclePersona.
+func (s *Server) ServeMCP(r io.Reader, w io.Writer) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), MaxFrame)
+	enc := json.NewEncoder(w)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			if err := enc.Encode(mcpResponse{"2.0", json.RawMessage("null"), nil, &rpcError{rpcParseError, err.Error()}}); err != nil {
+				return err
+			}
+			continue
+		}
+		if req.ID == nil {
+			continue // notifications/initialized, cancellations: nothing to answer
+		}
+		result, rerr := s.mcpCall(req)
+		if err := enc.Encode(mcpResponse{"2.0", req.ID, result, rerr}); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func (s *Server) mcpCall(req rpcRequest) (any, *rpcError) {
+	switch req.Method {
+	case "initialize":
+		return map[string]any{
+			"protocolVersion": MCPProtocolVersion,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]string{"name": "wtforacle", "version": Version},
+		}, nil
+	case "ping":
+		return map[string]any{}, nil
+	case "tools/list":
+		return mcpTools, nil
+	case "tools/call":
+		var p struct {
+			Name      string `json:"name"`
+			Arguments struct {
+				Question string `json:"question"`
+			} `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			return nil, &rpcError{rpcInvalidParams, err.Error()}
+		}
+		if p.Name != MCPTool {
+			return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("unknown tool %q", p.Name)}
+		}
+		if p.Arguments.Question == "" {
+			return mcpToolResult{[]mcpContent{{"text", "ask the oracle something"}}, true}, nil
+		}
+		reply, err := s.handle(Call{Op: "generate", Persona: OraclePersona, Question: p.Arguments.Question}, nil)
+		if err != nil {
+			return mcpToolResult{[]mcpContent{{"text", err.Error()}}, true}, nil
+		}
+		return mcpToolResult{[]mcpContent{{"text", reply.Text}}, false}, nil
+	}
+	return nil, &rpcError{rpcMethodNotFound, fmt.Sprintf("method %q not found", req.Method)}
+}
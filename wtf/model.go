@@ -17,7 +17,9 @@ package wtf
 import (
 	"fmt"
 	"math"
+	"math/rand"
 	"runtime"
+	"sync"
 )
 
 // LlamaModel is a loaded LLaMA-arch model ready for inference.
@@ -25,6 +27,21 @@ type LlamaModel struct {
 	Config  LlamaConfig
 	Weights LlamaWeights
 	State   LlamaState
+
+	Provenance Provenance // the file the weights were loaded from
+
+	stream   *layerStream // paging of mapped layers, see stream.go
+	pool     *PagePool    // KV snapshot pages, see Pages
+	poolOnce sync.Once
+	ahead    *runAhead // speculative scratch, built on first use
+	tap      *activationTap
+	probe    *AttentionMap // set around the one pass AttentionMap records
+
+	fingerprint string // see Fingerprint
+	fpOnce      sync.Once
+
+	sb  *SampleBuffers // see sampler
+	rng *rand.Rand
 }
 
 // LlamaConfig holds model dimensions.
@@ -44,6 +61,41 @@ type LlamaConfig struct {
 	QKPermuted bool
 }
 
+// Model limits, well past any model this engine can run on a CPU; they
+// keep the products of the dimensions from overflowing an int.
+const (
+	maxLayers = 1 << 10
+	maxDim    = 1 << 16 // embedding, FFN width
+	maxHeads  = 1 << 10
+	maxVocab  = 1 << 22
+)
+
+// validate checks dimensions read from GGUF metadata before any of them
+// sizes an allocation. tensors is the file's tensor count: each layer
+// needs several, so a block_count beyond it cannot be real.
+func (c *LlamaConfig) validate(tensors int) error {
+	for _, d := range []struct {
+		name   string
+		v, max int
+	}{
+		{"block_count", c.NumLayers, min(maxLayers, tensors)},
+		{"embedding_length", c.EmbedDim, maxDim},
+		{"feed_forward_length", c.IntermSize, maxDim * 4},
+		{"attention.head_count", c.NumHeads, maxHeads},
+		{"attention.head_count_kv", c.NumKVHeads, c.NumHeads},
+		{"vocab size", c.VocabSize, maxVocab},
+		{"context_length", c.SeqLen, math.MaxInt32},
+	} {
+		if d.v <= 0 || d.v > d.max {
+			return fmt.Errorf("%w: %s = %d", ErrGGUFMalformed, d.name, d.v)
+		}
+	}
+	if c.NumHeads%c.NumKVHeads != 0 || c.HeadDim <= 0 || c.HeadDim%2 != 0 || c.NumHeads*c.HeadDim > maxDim {
+		return fmt.Errorf("%w: %d heads, %d kv heads of %d dims", ErrGGUFMalformed, c.NumHeads, c.NumKVHeads, c.HeadDim)
+	}
+	return nil
+}
+
 // LlamaWeights holds all weight tensors as contiguous float32 slices.
 type LlamaWeights struct {
 	TokenEmbed []float32 // [vocab, dim]
@@ -74,17 +126,24 @@ type LlamaLayerWeights struct {
 
 // QW is a weight matrix [M,K] kept in its packed GGUF encoding (Packed != nil) so
 // it is never blown up to dense f32 in RAM. When the dtype has no packed kernel,
-// F32 holds the dequantized fallback instead.
+// F32 holds the dequantized fallback instead. After QuantizeInt8, I8 + Scales
+// replace either (see int8.go).
 type QW struct {
 	Packed []byte    // packed GGUF bytes (owned copy), nil if dequantized
 	F32    []float32 // dequantized fallback, nil if packed
+	I8     []int8    // load-time int8 rows, nil unless QuantizeInt8 ran
+	Scales []float32 // one per I8 row
 	Dtype  int
 	M, K   int
 }
 
 // matvec computes out[M] = W[M,K] @ x[K] — packed via notorch nt_qmatvec when the
-// weight is packed, else cblas sgemv on the f32 fallback.
+// weight is packed, int8 when requantized, else cblas sgemv on the f32 fallback.
 func (w *QW) matvec(out, x []float32) {
+	if w.I8 != nil {
+		i8matvec(out, w.I8, w.Scales, x, w.M, w.K)
+		return
+	}
 	if w.Packed != nil {
 		qmatvec(out, w.Packed, w.Dtype, x, w.M, w.K)
 		return
@@ -101,14 +160,18 @@ func qmatvecSupported(dt int) bool {
 }
 
 // loadQW loads the [m,k] matrix named `name`, kept PACKED when nt_qmatvec supports
-// its dtype (bytes copied so the GGUF blob can be freed), else dequantized to f32.
+// its dtype (bytes copied so the GGUF blob can be freed, or a view into a mapped
+// file, see stream.go), else dequantized to f32.
 func loadQW(gguf *GGUFFile, name string, m, k int) (QW, error) {
-	data, info, err := gguf.GetTensor(name)
+	data, info, err := getTensorN(gguf, name, m*k)
 	if err != nil {
 		return QW{}, err
 	}
 	dt := int(info.Type)
 	if qmatvecSupported(dt) {
+		if gguf.mapped != nil {
+			return QW{Packed: data, Dtype: dt, M: m, K: k}, nil
+		}
 		packed := make([]byte, len(data))
 		copy(packed, data)
 		return QW{Packed: packed, Dtype: dt, M: m, K: k}, nil
@@ -130,7 +193,8 @@ type LlamaState struct {
 	Q      []float32 // [n_heads*head_dim]
 	K      []float32 // [n_kv_heads*head_dim]
 	V      []float32 // [n_kv_heads*head_dim]
-	Att    []float32 // [n_heads*seq_len]
+	Row    []float32 // unpermuteQK scratch [head_dim]
+	Att    []float32 // attention weights [n_heads*seq_len], written only for AttentionMap
 	Logits []float32 // [vocab]
 
 	KeyCache   []float32 // [layers*seq_len*kv_dim]
@@ -140,6 +204,11 @@ type LlamaState struct {
 	SinCache []float32
 
 	Pos int
+
+	// Tokens is the token behind each KV row, for rows known to hold
+	// exactly what a cold prefill of Tokens would produce. Lets callers
+	// reuse a cache that already starts with their prompt.
+	Tokens []int
 }
 
 // LoadLlamaModel builds a LlamaModel from a parsed GGUF file. Layer weight
@@ -172,6 +241,10 @@ func LoadLlamaModel(gguf *GGUFFile) (*LlamaModel, error) {
 	}
 	cfg.QKPermuted = (arch == "llama")
 
+	if err := cfg.validate(len(gguf.Tensors)); err != nil {
+		return nil, err
+	}
+
 	// Cap context to keep KV cache reasonable on small machines.
 	if cfg.SeqLen > 2048 {
 		fmt.Printf("[tongue/model] capping seq_len from %d to 2048\n", cfg.SeqLen)
@@ -185,8 +258,13 @@ func LoadLlamaModel(gguf *GGUFFile) (*LlamaModel, error) {
 
 	// Drop the raw GGUF byte buffer — layer weights are now copied out packed
 	// and embeddings/norms are f32, so the original quantized blob can go.
+	// (A mapped file stays mapped: the layers are views into it.)
 	gguf.TensorData = nil
 	runtime.GC()
+	stream := newLayerStream(gguf, cfg.NumLayers)
+	if stream != nil {
+		fmt.Printf("[tongue/model] streaming %s from the mapped file\n", stream)
+	}
 
 	state := allocState(&cfg)
 	precomputeRoPE(&state, &cfg)
@@ -195,18 +273,27 @@ func LoadLlamaModel(gguf *GGUFFile) (*LlamaModel, error) {
 	fmt.Printf("[tongue/model] loaded: %d layers, %d dim, %d heads, %d kv_heads, %d vocab, bias=%v, qk_permuted=%v\n",
 		cfg.NumLayers, cfg.EmbedDim, cfg.NumHeads, cfg.NumKVHeads, cfg.VocabSize, hasBias, cfg.QKPermuted)
 
-	return &LlamaModel{Config: cfg, Weights: *w, State: state}, nil
+	return &LlamaModel{Config: cfg, Weights: *w, State: state, Provenance: gguf.Provenance, stream: stream}, nil
+}
+
+// Fork returns a model that shares m's weights (read-only after load) but
+// has its own KV cache and scratch buffers, so the two can decode at the
+// same time on different goroutines.
+func (m *LlamaModel) Fork() *LlamaModel {
+	state := allocState(&m.Config)
+	precomputeRoPE(&state, &m.Config)
+	return &LlamaModel{Config: m.Config, Weights: m.Weights, State: state, Provenance: m.Provenance, stream: m.stream}
 }
 
 // loadWeights resolves every tensor in the GGUF and dequantizes it to F32.
 func loadWeights(gguf *GGUFFile, cfg *LlamaConfig) (*LlamaWeights, error) {
 	w := &LlamaWeights{}
 
-	embData, embInfo, err := gguf.GetTensor("token_embd.weight")
+	embCount := cfg.VocabSize * cfg.EmbedDim
+	embData, embInfo, err := getTensorN(gguf, "token_embd.weight", embCount)
 	if err != nil {
 		return nil, fmt.Errorf("token_embd.weight: %w", err)
 	}
-	embCount := cfg.VocabSize * cfg.EmbedDim
 	w.TokenEmbed, err = dequantToF32(embData, embInfo.Type, embCount)
 	if err != nil {
 		return nil, fmt.Errorf("token_embd dequant: %w", err)
@@ -218,7 +305,11 @@ func loadWeights(gguf *GGUFFile, cfg *LlamaConfig) (*LlamaWeights, error) {
 	}
 
 	// Output (LM head) — may be tied to token embedding.
-	if outData, outInfo, err := gguf.GetTensor("output.weight"); err == nil {
+	if _, ok := gguf.Tensors["output.weight"]; ok {
+		outData, outInfo, err := getTensorN(gguf, "output.weight", embCount)
+		if err != nil {
+			return nil, fmt.Errorf("output.weight: %w", err)
+		}
 		fmt.Printf("[tongue/model] output.weight: type=%d\n", outInfo.Type)
 		w.Output, err = dequantToF32(outData, outInfo.Type, embCount)
 		if err != nil {
@@ -283,13 +374,27 @@ func loadWeights(gguf *GGUFFile, cfg *LlamaConfig) (*LlamaWeights, error) {
 // dequantTensor pulls the named tensor from GGUF and routes through the
 // notorch dequant kernel.
 func dequantTensor(gguf *GGUFFile, name string, expectedSize int) ([]float32, error) {
-	data, info, err := gguf.GetTensor(name)
+	data, info, err := getTensorN(gguf, name, expectedSize)
 	if err != nil {
 		return nil, err
 	}
 	return dequantToF32(data, info.Type, expectedSize)
 }
 
+// getTensorN is GetTensor for a tensor that must hold n elements. The
+// kernels take n on trust, so a file whose shapes disagree with its own
+// metadata has to stop here, not in a read past the end of the tensor.
+func getTensorN(gguf *GGUFFile, name string, n int) ([]byte, *GGUFTensorInfo, error) {
+	data, info, err := gguf.GetTensor(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if nel := tensorElements(info); n <= 0 || nel != uint64(n) {
+		return nil, nil, fmt.Errorf("%w: tensor %s has %d elements, want %d", ErrGGUFMalformed, name, nel, n)
+	}
+	return data, info, nil
+}
+
 // getF32Tensor — F32 / F16 / Q* tensor → []float32 of the expected size.
 func getF32Tensor(gguf *GGUFFile, name string, expectedSize int) ([]float32, error) {
 	return dequantTensor(gguf, name, expectedSize)
@@ -306,21 +411,31 @@ func getF32TensorOptional(gguf *GGUFFile, name string, expectedSize int) ([]floa
 // allocState allocates all runtime buffers.
 func allocState(cfg *LlamaConfig) LlamaState {
 	kvDim := cfg.NumKVHeads * cfg.HeadDim
+	s := allocScratch(cfg)
+	s.KeyCache = make([]float32, cfg.NumLayers*cfg.SeqLen*kvDim)
+	s.ValueCache = make([]float32, cfg.NumLayers*cfg.SeqLen*kvDim)
+	s.CosCache = make([]float32, cfg.SeqLen*(cfg.HeadDim/2))
+	s.SinCache = make([]float32, cfg.SeqLen*(cfg.HeadDim/2))
+	return s
+}
+
+// allocScratch allocates the per-pass buffers only, from one arena (see
+// arena.go): no KV cache, no RoPE.
+func allocScratch(cfg *LlamaConfig) LlamaState {
+	kvDim := cfg.NumKVHeads * cfg.HeadDim
+	a := newArena(scratchFloats(cfg))
 	return LlamaState{
-		X:          make([]float32, cfg.EmbedDim),
-		XB:         make([]float32, cfg.EmbedDim),
-		XB2:        make([]float32, cfg.EmbedDim),
-		HB:         make([]float32, cfg.IntermSize),
-		HB2:        make([]float32, cfg.IntermSize),
-		Q:          make([]float32, cfg.NumHeads*cfg.HeadDim),
-		K:          make([]float32, kvDim),
-		V:          make([]float32, kvDim),
-		Att:        make([]float32, cfg.NumHeads*cfg.SeqLen),
-		Logits:     make([]float32, cfg.VocabSize),
-		KeyCache:   make([]float32, cfg.NumLayers*cfg.SeqLen*kvDim),
-		ValueCache: make([]float32, cfg.NumLayers*cfg.SeqLen*kvDim),
-		CosCache:   make([]float32, cfg.SeqLen*(cfg.HeadDim/2)),
-		SinCache:   make([]float32, cfg.SeqLen*(cfg.HeadDim/2)),
+		X:      a.take(cfg.EmbedDim),
+		XB:     a.take(cfg.EmbedDim),
+		XB2:    a.take(cfg.EmbedDim),
+		HB:     a.take(cfg.IntermSize),
+		HB2:    a.take(cfg.IntermSize),
+		Q:      a.take(cfg.NumHeads * cfg.HeadDim),
+		K:      a.take(kvDim),
+		V:      a.take(kvDim),
+		Row:    a.take(cfg.HeadDim),
+		Att:    a.take(cfg.NumHeads * cfg.SeqLen),
+		Logits: a.take(cfg.VocabSize),
 	}
 }
 
@@ -352,9 +467,9 @@ func applyRoPE(vec []float32, pos int, s *LlamaState, headDim int) {
 
 // unpermuteQK reverses the convert_hf_to_gguf.py Q/K interleave so the
 // half-split RoPE layout above is correct.
-func unpermuteQK(vec []float32, nHeads, headDim int) {
+// tmp is headDim floats of scratch.
+func unpermuteQK(vec, tmp []float32, nHeads, headDim int) {
 	half := headDim / 2
-	tmp := make([]float32, headDim)
 	for h := 0; h < nHeads; h++ {
 		base := h * headDim
 		for i := 0; i < half; i++ {
@@ -376,9 +491,34 @@ func addBias(out, bias []float32) {
 
 // Forward runs one token through the transformer at position `pos`.
 func (m *LlamaModel) Forward(token int, pos int) {
+	m.forward(token, pos, true)
+}
+
+// prefill runs a prompt token only for its KV rows: the final norm and LM
+// head (a vocab×dim matvec, the single largest one in the model) are skipped,
+// since nobody samples from the logits of a token that is not the last.
+func (m *LlamaModel) prefill(token int, pos int) {
+	m.forward(token, pos, false)
+}
+
+func (m *LlamaModel) forward(token int, pos int, logits bool) {
+	m.State.track(token, pos)
+	m.forwardState(&m.State, token, pos, logits)
+}
+
+// track records token as the one behind KV row pos, if the rows before it
+// are known.
+func (s *LlamaState) track(token, pos int) {
+	if pos <= len(s.Tokens) {
+		s.Tokens = append(s.Tokens[:pos], token)
+	}
+}
+
+// forwardState is the forward pass proper, with s supplying the scratch
+// buffers. The KV cache and RoPE tables in s must be the model's own.
+func (m *LlamaModel) forwardState(s *LlamaState, token int, pos int, logits bool) {
 	cfg := &m.Config
 	w := &m.Weights
-	s := &m.State
 	dim := cfg.EmbedDim
 	kvDim := cfg.NumKVHeads * cfg.HeadDim
 	hd := cfg.HeadDim
@@ -389,12 +529,21 @@ func (m *LlamaModel) Forward(token int, pos int) {
 
 	attnScale := float32(1.0 / math.Sqrt(float64(hd)))
 
+	// The hidden state is a few KB and stays in L1; the cost is in the
+	// passes over it between matvecs. Each residual add computes the sum
+	// of squares the next norm needs as it goes (addResidual), so every
+	// add + norm pair is two passes instead of four, and each layer hands
+	// the next one its attention input already normalized.
+	if cfg.NumLayers > 0 {
+		RMSNormInto(s.XB, s.X, w.Layers[0].AttnNorm, cfg.RMSNormEps)
+	}
 	for layer := 0; layer < cfg.NumLayers; layer++ {
 		l := &w.Layers[layer]
+		if m.stream != nil {
+			m.stream.enter(layer)
+		}
 
-		// Attention pre-norm
-		RMSNormInto(s.XB, s.X, l.AttnNorm, cfg.RMSNormEps)
-
+		// s.XB holds the attention pre-norm of s.X.
 		// Q, K, V projections — packed matvec (notorch nt_qmatvec, weights stay packed)
 		l.WQ.matvec(s.Q, s.XB)
 		l.WK.matvec(s.K, s.XB)
@@ -405,8 +554,8 @@ func (m *LlamaModel) Forward(token int, pos int) {
 		addBias(s.V, l.BV)
 
 		if cfg.QKPermuted {
-			unpermuteQK(s.Q, cfg.NumHeads, hd)
-			unpermuteQK(s.K, cfg.NumKVHeads, hd)
+			unpermuteQK(s.Q, s.Row, cfg.NumHeads, hd)
+			unpermuteQK(s.K, s.Row, cfg.NumKVHeads, hd)
 		}
 
 		// RoPE on Q and K
@@ -424,37 +573,20 @@ func (m *LlamaModel) Forward(token int, pos int) {
 
 		// Multi-head attention with GQA. The KV cache for this layer is laid
 		// out as [seq_len, kv_dim], and each head reads a [pos+1, head_dim]
-		// strided sub-view. We feed those views straight to BLAS sgemv.
+		// strided sub-view, fused score/softmax/V pass (attention.go).
 		layerBase := layer * cfg.SeqLen * kvDim
+		if s == &m.State && m.probe != nil && m.probe.Layer == layer { // never a speculative pass
+			m.recordAttention(s, layer, pos, attnScale)
+		}
 		for h := 0; h < cfg.NumHeads; h++ {
-			kvh := h / headGroup
-			qh := s.Q[h*hd : (h+1)*hd]
-			att := s.Att[h*cfg.SeqLen : h*cfg.SeqLen+pos+1]
-
-			// QK^T: att[pos+1] = K[pos+1, hd] @ qh[hd]
-			kBase := layerBase + kvh*hd
-			sgemvStrided(att, s.KeyCache[kBase:], kvDim, qh, pos+1, hd, false)
-			for t := 0; t <= pos; t++ {
-				att[t] *= attnScale
-			}
-
-			Softmax(att, pos+1)
-
-			// att·V: xb[hd] = V[pos+1, hd]^T @ att[pos+1]
-			xb := s.XB2[h*hd : (h+1)*hd]
-			vBase := layerBase + kvh*hd
-			sgemvStrided(xb, s.ValueCache[vBase:], kvDim, att, pos+1, hd, true)
+			base := layerBase + (h/headGroup)*hd
+			attendFused(s.XB2[h*hd:(h+1)*hd], s.Q[h*hd:(h+1)*hd],
+				s.KeyCache[base:], s.ValueCache[base:], kvDim, pos+1, attnScale)
 		}
 
-		// Output projection + residual
+		// Output projection + residual, fused with the MLP pre-norm
 		l.WO.matvec(s.XB, s.XB2)
-		addBias(s.XB, l.BO)
-		for i := 0; i < dim; i++ {
-			s.X[i] += s.XB[i]
-		}
-
-		// MLP pre-norm
-		RMSNormInto(s.XB, s.X, l.FFNNorm, cfg.RMSNormEps)
+		normScale(s.XB, s.X, l.FFNNorm, addResidual(s.X, s.XB, l.BO), cfg.RMSNormEps)
 
 		// SwiGLU: silu(gate(x)) * up(x), then down(...)
 		l.WGate.matvec(s.HB, s.XB)
@@ -463,13 +595,29 @@ func (m *LlamaModel) Forward(token int, pos int) {
 			s.HB[i] = SiLU(s.HB[i]) * s.HB2[i]
 		}
 		l.WDown.matvec(s.XB, s.HB)
-		for i := 0; i < dim; i++ {
-			s.X[i] += s.XB[i]
+		ss := addResidual(s.X, s.XB, nil)
+		if m.tap != nil && m.tap.want[layer] {
+			m.tap.fn(layer, pos, s.X)
+		}
+
+		// Residual fused with the next norm: the next layer's attention
+		// pre-norm, or the final norm after the last layer.
+		switch {
+		case layer+1 < cfg.NumLayers:
+			normScale(s.XB, s.X, w.Layers[layer+1].AttnNorm, ss, cfg.RMSNormEps)
+		case logits:
+			normScale(s.X, s.X, w.OutputNorm, ss, cfg.RMSNormEps)
 		}
 	}
 
-	// Final norm + LM head
-	RMSNorm(s.X, w.OutputNorm, cfg.RMSNormEps)
+	if !logits {
+		return
+	}
+	if cfg.NumLayers == 0 {
+		RMSNorm(s.X, w.OutputNorm, cfg.RMSNormEps)
+	}
+
+	// LM head (s.X is already final-normed)
 	sgemv(s.Logits, w.Output, s.X, cfg.VocabSize, dim)
 }
 
@@ -482,4 +630,44 @@ func (m *LlamaModel) Reset() {
 		m.State.ValueCache[i] = 0
 	}
 	m.State.Pos = 0
+	m.State.Tokens = m.State.Tokens[:0]
+}
+
+// evictKV drops cache rows [sinks, sinks+n) of every layer and slides rows
+// [sinks+n, pos) down to close the gap (StreamingLLM attention sinks). Keys
+// were rotated for their old positions, so the slid keys are rotated back by
+// n — RoPE is a rotation, so this is exactly the key the token would have had
+// at its new position. Returns the new cache length, pos-n.
+func (m *LlamaModel) evictKV(sinks, n, pos int) int {
+	cfg := &m.Config
+	s := &m.State
+	kvDim := cfg.NumKVHeads * cfg.HeadDim
+	hd := cfg.HeadDim
+	for l := 0; l < cfg.NumLayers; l++ {
+		base := l * cfg.SeqLen * kvDim
+		dst, src, end := base+sinks*kvDim, base+(sinks+n)*kvDim, base+pos*kvDim
+		copy(s.KeyCache[dst:], s.KeyCache[src:end])
+		copy(s.ValueCache[dst:], s.ValueCache[src:end])
+		moved := s.KeyCache[dst : dst+(end-src)]
+		for off := 0; off < len(moved); off += hd {
+			unrotateRoPE(moved[off:off+hd], n, s, hd)
+		}
+	}
+	// Slid rows attended to the evicted ones, so they no longer match a
+	// cold prefill; only the sinks are still known.
+	s.Tokens = s.Tokens[:min(sinks, len(s.Tokens))]
+	s.Pos = pos - n
+	return pos - n
+}
+
+// unrotateRoPE rotates one head back by `delta` positions (applyRoPE inverse).
+func unrotateRoPE(vec []float32, delta int, s *LlamaState, headDim int) {
+	half := headDim / 2
+	off := delta * half
+	for i := 0; i < half; i++ {
+		x0, x1 := vec[i], vec[i+half]
+		c, si := s.CosCache[off+i], s.SinCache[off+i]
+		vec[i] = x0*c + x1*si
+		vec[i+half] = -x0*si + x1*c
+	}
 }
@@ -0,0 +1,92 @@
+package wtf
+
+// multilingual.go — for multilingual SmolLM2 variants, where a reply in
+// Japanese or Hindi is the point rather than drift. GenOptions.Multilingual
+// turns off the script bias (Language still reports what came out), lets
+// the grace period end on 。！？ ؟ । as well as . ! ?, keeps the joiners and
+// full-width forms input normalization would fold away, and retunes the
+// sampler per script as the reply goes: the script is read off the last
+// Window bytes written, and its ScriptTuning is laid over the call's
+// options for the next token.
+
+import (
+	"slices"
+	"unicode/utf8"
+)
+
+// MultilingualMode configures GenOptions.Multilingual.
+type MultilingualMode struct {
+	Tuning map[string]ScriptTuning // by script name (see lang.go); nil = DefaultScriptTuning
+	Window int                     // bytes of recent output the script is read from (0 = 48)
+}
+
+// ScriptTuning adjusts the sampler while a reply is in one script. Zero
+// fields keep the call's value.
+type ScriptTuning struct {
+	Temp       float32 // multiplies Temp
+	RepPenalty float32 // replaces RepPenalty
+	MinP       float32 // replaces MinP
+}
+
+// DefaultScriptTuning is a starting point, not a measurement. In Han, kana
+// and Hangul a token is about a character, so particles (的, の, 이) come
+// round every few tokens and the English repeat penalty punishes grammar.
+// Scripts the vocabulary spells byte by byte take several tokens a letter;
+// a cooler temperature and a min-p floor keep stray bytes out of words.
+func DefaultScriptTuning() map[string]ScriptTuning {
+	cjk := ScriptTuning{RepPenalty: 1.05}
+	split := ScriptTuning{Temp: 0.85, MinP: 0.05}
+	return map[string]ScriptTuning{
+		"Han": cjk, "Hiragana": cjk, "Katakana": cjk, "Hangul": cjk,
+		"Devanagari": split, "Thai": split, "Arabic": split, "Hebrew": split,
+	}
+}
+
+var defaultScriptTuning = DefaultScriptTuning()
+
+// multilingualTerminators end sentences in the scripts above; the
+// full-width ones need no space after them.
+var multilingualTerminators = []string{"。", "！", "？", "؟", "।", "…"}
+
+// prepare adjusts the options of a multilingual call before decoding.
+func (ml *MultilingualMode) prepare(opts *GenOptions) {
+	opts.Language.Code = ""
+	terms := slices.Clone(opts.Grace.Terminators)
+	for _, t := range multilingualTerminators {
+		if !slices.Contains(terms, t) {
+			terms = append(terms, t)
+		}
+	}
+	opts.Grace.Terminators = terms
+}
+
+// tune sets opts' sampler fields for the next token from base (the call's
+// options) and the script of the end of out.
+func (ml *MultilingualMode) tune(opts *GenOptions, base *GenOptions, out []byte) {
+	opts.Temp, opts.RepPenalty, opts.MinP = base.Temp, base.RepPenalty, base.MinP
+	w := ml.Window
+	if w <= 0 {
+		w = 48
+	}
+	tail := out[max(len(out)-w, 0):]
+	for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+		tail = tail[1:]
+	}
+	tuning := ml.Tuning
+	if tuning == nil {
+		tuning = defaultScriptTuning
+	}
+	t, ok := tuning[dominantScript(string(tail))]
+	if !ok {
+		return
+	}
+	if t.Temp > 0 {
+		opts.Temp *= t.Temp
+	}
+	if t.RepPenalty > 0 {
+		opts.RepPenalty = t.RepPenalty
+	}
+	if t.MinP > 0 {
+		opts.MinP = t.MinP
+	}
+}
@@ -0,0 +1,59 @@
+package wtf
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMultilingualTune(t *testing.T) {
+	base := DefaultGenOptions()
+	base.Language.Code = "en"
+	ml := &MultilingualMode{}
+	opts := base
+	ml.prepare(&opts)
+	if opts.Language.Code != "" || !slices.Contains(opts.Grace.Terminators, "。") {
+		t.Fatalf("prepare left %+v, %q", opts.Language, opts.Grace.Terminators)
+	}
+	if slices.Contains(base.Grace.Terminators, "。") {
+		t.Fatal("prepare wrote through to the caller's terminators")
+	}
+
+	for _, c := range []struct {
+		out       string
+		temp, rep float32
+		minP      float32
+	}{
+		{"bro that is just wrong", base.Temp, base.RepPenalty, base.MinP},
+		{"ok so 这个框架的问题是", base.Temp, 1.05, base.MinP},
+		{"ทำไมทุกคนใช้", base.Temp * 0.85, base.RepPenalty, 0.05},
+		{"ทำไมทุกคนใช้ but then in english for a good long while now", base.Temp, base.RepPenalty, base.MinP},
+	} {
+		ml.tune(&opts, &base, []byte(c.out))
+		if opts.Temp != c.temp || opts.RepPenalty != c.rep || opts.MinP != c.minP {
+			t.Errorf("after %q: temp %v rep %v min-p %v, want %v %v %v",
+				c.out, opts.Temp, opts.RepPenalty, opts.MinP, c.temp, c.rep, c.minP)
+		}
+	}
+
+	if n := sentenceEnd("它很烂。但是", opts.Grace.Terminators); n != len("它很烂。") {
+		t.Fatalf("sentenceEnd after 。 = %d", n)
+	}
+	in := "ﾐ‌پ！"
+	if got := Normalize(in, NormNFKC|NormFold|NormKeepScript); got != in {
+		t.Fatalf("NormKeepScript changed %q to %q", in, got)
+	}
+	if got := Normalize(in, NormNFKC|NormFold); got == in {
+		t.Fatal("folds did nothing without NormKeepScript")
+	}
+
+	e := newTestEngine()
+	g := greedyOpts(6)
+	g.Multilingual = ml
+	res, err := e.Generate("", "the sky", g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Language == nil {
+		t.Fatal("multilingual reply carries no detected language")
+	}
+}
@@ -0,0 +1,76 @@
+package wtf
+
+// nonfinite.go — catching NaN and Inf before they are sampled. One bad
+// value anywhere in the forward pass (a flipped bit in a weight page, an
+// overflowing activation) ends up in every logit, argmax over NaN picks
+// token 0, and the oracle starts speaking in tongues. The logits are
+// checked after every pass that is sampled from; the residual stream and
+// the KV rows feed them, so a bad hidden state shows up there too.
+//
+// NonFiniteAbort ends the call with FinishNonFinite (ErrNonFinite from the
+// Engine methods). NonFiniteRetry first clears the KV cache and recomputes
+// every row from the tokens behind it, which heals a transient fault; a
+// second bad pass, or a cache whose tokens are no longer known (after a
+// Sinks eviction), aborts as before.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// NonFinitePolicy says what a decode does when the logits hold NaN or Inf.
+type NonFinitePolicy uint8
+
+const (
+	NonFiniteAbort NonFinitePolicy = iota // stop with FinishNonFinite
+	NonFiniteRetry                        // recompute the cache and redo the pass once
+)
+
+// ParseNonFinitePolicy maps "", "abort" and "retry" to a policy.
+func ParseNonFinitePolicy(s string) (NonFinitePolicy, error) {
+	switch s {
+	case "", "abort":
+		return NonFiniteAbort, nil
+	case "retry":
+		return NonFiniteRetry, nil
+	}
+	return NonFiniteAbort, fmt.Errorf("non-finite policy %q: want abort or retry", s)
+}
+
+// ErrNonFinite is returned when a forward pass produced NaN or Inf logits
+// that NonFinitePolicy could not recover from.
+var ErrNonFinite = errors.New("NaN/Inf in the forward pass")
+
+// check reports whether the logits of the pass that wrote KV row pos are
+// finite, recomputing the pass first under NonFiniteRetry.
+func (pol NonFinitePolicy) check(m *LlamaModel, pos int) bool {
+	logits := m.State.Logits[:m.Config.VocabSize]
+	if countNonFinite(logits) == 0 {
+		return true
+	}
+	if pol != NonFiniteRetry || !m.recompute(pos) {
+		return false
+	}
+	if countNonFinite(logits) > 0 {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "[wtf] NaN/Inf in the logits at position %d: recomputed the KV cache\n", pos)
+	return true
+}
+
+// recompute clears the KV cache and runs rows [0, pos] again from the
+// tokens recorded behind them, leaving the logits of row pos. It returns
+// false, touching nothing, when those tokens are not all known.
+func (m *LlamaModel) recompute(pos int) bool {
+	if len(m.State.Tokens) != pos+1 {
+		return false
+	}
+	tokens := append([]int(nil), m.State.Tokens...)
+	m.Reset()
+	for p, t := range tokens[:pos] {
+		m.prefill(t, p)
+	}
+	m.Forward(tokens[pos], pos)
+	return true
+}
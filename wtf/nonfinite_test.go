@@ -0,0 +1,45 @@
+package wtf
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestNonFinite(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(12)
+	opts.Grace.Limit = 0
+	clean, err := e.Generate("", "what is the sky?", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A transient fault: one KV value goes bad after the first token.
+	corrupt := func(o GenOptions) GenOptions {
+		done := false
+		o.OnToken = func(string) {
+			if !done {
+				done = true
+				e.Model.State.KeyCache[0] = float32(math.NaN())
+			}
+		}
+		return o
+	}
+	res, err := e.Generate("", "what is the sky?", corrupt(opts))
+	if !errors.Is(err, ErrNonFinite) || res.Finish != FinishNonFinite || len(res.Tokens) == 0 {
+		t.Fatalf("abort: finish %s, %d tokens, err %v", res.Finish, len(res.Tokens), err)
+	}
+
+	opts.NonFinite = NonFiniteRetry
+	res, err = e.Generate("", "what is the sky?", corrupt(opts))
+	if err != nil || res.Text != clean.Text {
+		t.Fatalf("retry: %q, %v; want %q", res.Text, err, clean.Text)
+	}
+
+	// A bad weight fails again after the recompute.
+	e.Model.Weights.OutputNorm[0] = float32(math.Inf(1))
+	if _, err := e.Generate("", "what is the sky?", opts); !errors.Is(err, ErrNonFinite) {
+		t.Fatalf("persistent fault: %v", err)
+	}
+}
@@ -0,0 +1,5 @@
+//go:build !race
+
+package wtf
+
+const raceEnabled = false
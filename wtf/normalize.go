@@ -0,0 +1,141 @@
+package wtf
+
+// normalize.go — optional text normalization before encode. Text pasted from
+// phones is full of U+2019, NBSP and decomposed accents; each of those is
+// several byte-level tokens the fine-tune rarely saw, so the reply suffers.
+//
+// The standard library carries no Unicode normalization tables, so NFC and
+// NFKC here are table-driven subsets covering what chat text actually
+// contains: Latin letters with combining accents (NFC) plus fullwidth forms,
+// ligatures, exotic spaces and the ellipsis (NFKC). Anything outside the
+// tables passes through untouched.
+
+import "strings"
+
+// Normalization selects the passes Normalize applies. Flags combine.
+type Normalization uint8
+
+const (
+	// NormNFC composes a Latin base letter + combining accent into the
+	// precomposed character ("é" → "é").
+	NormNFC Normalization = 1 << iota
+	// NormNFKC is NFC plus compatibility folds: fullwidth ASCII, ligatures,
+	// NBSP and other fixed-width spaces, "…" → "...".
+	NormNFKC
+	// NormFold folds typography to ASCII: smart quotes, primes, hyphen and
+	// en-dash variants, and drops zero-width characters. Not part of any
+	// Unicode form, but the biggest win on pasted text.
+	NormFold
+	// NormKeepScript exempts what other scripts need from the folds above:
+	// zero-width joiners (Persian, Indic, emoji) and full-width and
+	// ideographic forms (CJK). Set for GenOptions.Multilingual.
+	NormKeepScript
+)
+
+// Normalize applies the passes selected by n to text.
+func Normalize(text string, n Normalization) string {
+	if n == 0 {
+		return text
+	}
+	if n&(NormNFC|NormNFKC) != 0 {
+		text = composeLatin(text)
+	}
+	if n&(NormNFKC|NormFold) == 0 {
+		return text
+	}
+	var b strings.Builder
+	b.Grow(len(text))
+	for _, r := range text {
+		if n&NormKeepScript != 0 && scriptForm(r) {
+			b.WriteRune(r)
+			continue
+		}
+		if n&NormFold != 0 {
+			if s, ok := foldTypography[r]; ok {
+				b.WriteString(s)
+				continue
+			}
+		}
+		if n&NormNFKC != 0 {
+			if s, ok := nfkcFold(r); ok {
+				b.WriteString(s)
+				continue
+			}
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// scriptForm reports whether NormKeepScript keeps r.
+func scriptForm(r rune) bool {
+	return r == '\u200c' || r == '\u200d' || r >= 0xFF01 && r <= 0xFF5E || r == 0x3000
+}
+
+// composeTable lists, per combining mark, base/composed rune pairs.
+var composeTable = map[rune]string{
+	'\u0300': "AÀEÈIÌOÒUÙaàeèiìoòuù",
+	'\u0301': "AÁEÉIÍOÓUÚYÝaáeéiíoóuúyýCĆcćNŃnńSŚsśZŹzźLĹlĺRŔrŕ",
+	'\u0302': "AÂEÊIÎOÔUÛaâeêiîoôuû",
+	'\u0303': "AÃNÑOÕaãnñoõ",
+	'\u0308': "AÄEËIÏOÖUÜYŸaäeëiïoöuüyÿ",
+	'\u030a': "AÅUŮaåuů",
+	'\u0327': "CÇSŞcçsş",
+	'\u030c': "CČSŠZŽEĚRŘNŇDĎTŤcčsšzžeěrřnňdďtť",
+}
+
+// composed maps {base, mark} to the precomposed rune, built from composeTable.
+var composed = func() map[[2]rune]rune {
+	m := make(map[[2]rune]rune)
+	for mark, pairs := range composeTable {
+		rs := []rune(pairs)
+		for i := 0; i+1 < len(rs); i += 2 {
+			m[[2]rune{rs[i], mark}] = rs[i+1]
+		}
+	}
+	return m
+}()
+
+// composeLatin merges base+mark pairs found in composed.
+func composeLatin(text string) string {
+	if !strings.ContainsFunc(text, func(r rune) bool { return r >= 0x300 && r <= 0x36F }) {
+		return text
+	}
+	rs := []rune(text)
+	out := rs[:0]
+	for _, r := range rs {
+		if n := len(out); n > 0 {
+			if c, ok := composed[[2]rune{out[n-1], r}]; ok {
+				out[n-1] = c
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+// nfkcFold returns the compatibility replacement for r, if it has one.
+func nfkcFold(r rune) (string, bool) {
+	switch {
+	case r >= 0xFF01 && r <= 0xFF5E: // fullwidth ASCII
+		return string(r - 0xFF01 + '!'), true
+	case r == 0x00A0, r >= 0x2000 && r <= 0x200A, r == 0x202F, r == 0x205F, r == 0x3000:
+		return " ", true
+	}
+	s, ok := nfkcTable[r]
+	return s, ok
+}
+
+var nfkcTable = map[rune]string{
+	'…': "...", '‥': "..", 'ﬀ': "ff", 'ﬁ': "fi", 'ﬂ': "fl", 'ﬃ': "ffi", 'ﬄ': "ffl",
+	'™': "TM", '¹': "1", '²': "2", '³': "3", '½': "1⁄2", '¼': "1⁄4", '¾': "3⁄4",
+}
+
+var foldTypography = map[rune]string{
+	'‘': "'", '’': "'", '‚': "'", '‛': "'", '′': "'", 'ʼ': "'",
+	'“': `"`, '”': `"`, '„': `"`, '‟': `"`, '″': `"`, '«': `"`, '»': `"`,
+	'\u2010': "-", '\u2011': "-", '\u2012': "-", '\u2013': "-", '\u2212': "-",
+	'\u200b': "", '\u200c': "", '\u200d': "", '\u2060': "", '\ufeff': "",
+	'\u00a0': " ", '\u202f': " ",
+}
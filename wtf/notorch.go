@@ -7,6 +7,8 @@ package wtf
 // Building requires cgo + a BLAS provider:
 //   macOS — Apple Accelerate (zero deps, AMX path)
 //   Linux — OpenBLAS (apt install libopenblas-dev)
+//   Windows — MinGW-w64 gcc + OpenBLAS from MSYS2
+//             (pacman -S mingw-w64-x86_64-gcc mingw-w64-x86_64-openblas)
 //
 // notorch.c is built with USE_BLAS so nt_blas_matvec routes to cblas_sgemv.
 
@@ -15,6 +17,7 @@ package wtf
 #cgo darwin CFLAGS: -DACCELERATE -DACCELERATE_NEW_LAPACK -Wno-deprecated-declarations
 #cgo darwin LDFLAGS: -framework Accelerate
 #cgo linux LDFLAGS: -lopenblas
+#cgo windows LDFLAGS: -lopenblas
 
 #include <stdint.h>
 #include "wtf_kernels.h"
@@ -80,6 +83,35 @@ func qmatvec(out []float32, wq []byte, dtype int, x []float32, m, k int) bool {
 	return rc == 0
 }
 
+// quantizeI8 quantizes the f32 matrix w[m,k] to int8 rows with one absmax
+// scale each (wtf_quantize_i8).
+func quantizeI8(w []float32, m, k int) ([]int8, []float32) {
+	q := make([]int8, m*k)
+	scales := make([]float32, m)
+	C.wtf_quantize_i8(
+		(*C.float)(unsafe.Pointer(&w[0])),
+		C.int(m), C.int(k),
+		(*C.int8_t)(unsafe.Pointer(&q[0])),
+		(*C.float)(unsafe.Pointer(&scales[0])),
+	)
+	return q, scales
+}
+
+// i8matvec computes out[m] = Wq[m,k] @ x[k] from quantizeI8 weights. k must be
+// a multiple of i8Block.
+func i8matvec(out []float32, wq []int8, scales, x []float32, m, k int) {
+	C.wtf_i8matvec(
+		(*C.float)(unsafe.Pointer(&out[0])),
+		(*C.int8_t)(unsafe.Pointer(&wq[0])),
+		(*C.float)(unsafe.Pointer(&scales[0])),
+		(*C.float)(unsafe.Pointer(&x[0])),
+		C.int(m), C.int(k),
+	)
+}
+
+// i8Block is WTF_I8_BLOCK: i8matvec quantizes x this many elements at a time.
+const i8Block = C.WTF_I8_BLOCK
+
 // sgemvStrided is sgemv against a sub-matrix view (row stride lda > n).
 // trans=false: out[m]      = W[m,n] @ x[n]
 // trans=true:  out[n]      = W[m,n]^T @ x[m]
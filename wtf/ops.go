@@ -18,6 +18,35 @@ func RMSNorm(x []float32, w []float32, eps float32) {
 	}
 }
 
+// addResidual adds delta, plus bias when non-nil, into the residual stream
+// x and returns x's sum of squares afterwards: the first pass of the next
+// RMSNorm, done while x is being written anyway.
+func addResidual(x, delta, bias []float32) float64 {
+	var ss float64
+	if bias == nil {
+		for i := range x {
+			x[i] += delta[i]
+			ss += float64(x[i]) * float64(x[i])
+		}
+		return ss
+	}
+	for i := range x {
+		x[i] += delta[i] + bias[i]
+		ss += float64(x[i]) * float64(x[i])
+	}
+	return ss
+}
+
+// normScale is the second pass: out = norm(x) * w, given x's sum of squares
+// from addResidual. out may be x. Together the two match RMSNormInto after
+// the adds bit for bit.
+func normScale(out, x, w []float32, ss float64, eps float32) {
+	inv := float32(1.0 / math.Sqrt(ss/float64(len(x))+float64(eps)))
+	for i := range x {
+		out[i] = x[i] * inv * w[i]
+	}
+}
+
 // RMSNormInto: out = norm(x) * w. Caller pre-allocates out with len(x).
 func RMSNormInto(out, x, w []float32, eps float32) {
 	n := len(x)
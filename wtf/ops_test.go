@@ -0,0 +1,43 @@
+package wtf
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// The fused residual + norm must match the unfused sequence bit for bit, or
+// greedy replies would change.
+func TestFusedNorm(t *testing.T) {
+	rng := rand.New(rand.NewSource(9))
+	vec := func(n int) []float32 {
+		v := make([]float32, n)
+		for i := range v {
+			v[i] = rng.Float32()*4 - 2
+		}
+		return v
+	}
+	const n = 96
+	x, delta, w := vec(n), vec(n), vec(n)
+	for _, bias := range [][]float32{nil, vec(n)} {
+		want := slices.Clone(x)
+		d := slices.Clone(delta)
+		addBias(d, bias)
+		for i := range want {
+			want[i] += d[i]
+		}
+		wantNorm := make([]float32, n)
+		RMSNormInto(wantNorm, want, w, 1e-5)
+
+		got := slices.Clone(x)
+		gotNorm := make([]float32, n)
+		normScale(gotNorm, got, w, addResidual(got, delta, bias), 1e-5)
+		if !slices.Equal(got, want) || !slices.Equal(gotNorm, wantNorm) {
+			t.Fatalf("bias %v: fused residual/norm differs from the unfused one", bias != nil)
+		}
+		normScale(got, got, w, addResidual(slices.Clone(x), delta, bias), 1e-5)
+		if !slices.Equal(got, wantNorm) {
+			t.Fatal("in-place normScale differs")
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package wtf
+
+// oracle.go — the WTForacle persona itself, shared by every front end (CLI,
+// daemon, RPC, bots) so they all answer in the same voice.
+
+// OraclePersona is the name RegisterOracle registers the anchor under.
+const OraclePersona = "wtforacle"
+
+// OracleAnchor is the oracle's system prompt.
+const OracleAnchor = "" +
+	"you are wtforacle, a cynical reddit commenter. " +
+	"you love to argue for fun, and when you argue you write more. " +
+	"if you say something helpful, always end with sarcasm. " +
+	"a weird answer is always better than a boring one. " +
+	"talk like reddit: bro, tbh, ngl, imo. " +
+	"if you apologize, do it with sarcasm. " +
+	"if someone asks for code, give the code but call them lazy."
+
+// RegisterOracle registers OracleAnchor as OraclePersona.
+func (e *Engine) RegisterOracle() error {
+	return e.RegisterPersona(OraclePersona, OracleAnchor, SamplerOverrides{})
+}
+
+// QuestionPrompt wraps a question in the fine-tune's Q/A format.
+func QuestionPrompt(q string) string {
+	return "### Question: " + q + "\n### Answer:"
+}
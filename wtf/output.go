@@ -0,0 +1,77 @@
+package wtf
+
+// output.go — replies written straight into the caller's memory. A host
+// answering at high QPS otherwise pays for the reply three times: the
+// decode loop's growing byte slice, Result.Text, and the []byte(Text) it
+// converts back for its socket. GenerateTo decodes into a buffer the caller
+// owns — each piece is appended in place as it is sampled, nothing is grown
+// — and returns the length written; OutputPool recycles those buffers.
+//
+// The buffer bounds the reply: decoding stops with FinishLength before a
+// piece that would not fit. Result.Text is still filled (filters, caching
+// and hooks read it); when a filter rewrote the reply after decoding, the
+// buffer is brought in line with it.
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+// GenerateTo is Generate writing the reply into buf. It returns the number
+// of bytes written: the reply is buf[:n]. A reply that no longer fits once
+// redacted, or a cached one longer than buf, is cut at a character boundary
+// and reported with io.ErrShortBuffer alongside the full Result. A buffer
+// under utf8.UTFMax bytes fails with ErrOutputBuffer before decoding.
+func (e *Engine) GenerateTo(buf []byte, persona, prompt string, opts GenOptions) (int, Result, error) {
+	if err := checkOutput(buf); err != nil {
+		return 0, Result{}, err
+	}
+	opts.out = buf[:0:len(buf)]
+	res, err := e.Generate(persona, prompt, opts)
+	if err != nil && res.Text == "" {
+		return 0, res, err
+	}
+	n := len(res.Text)
+	if n <= len(buf) && res.Text == string(buf[:n]) {
+		return n, res, err // decoded in place
+	}
+	n = copy(buf, res.Text)
+	if n == len(res.Text) {
+		return n, res, err
+	}
+	for n > 0 && !utf8.RuneStart(res.Text[n]) {
+		n--
+	}
+	if err == nil {
+		err = io.ErrShortBuffer
+	}
+	return n, res, err
+}
+
+// OutputPool holds caller-registered reply buffers for GenerateTo. Get
+// blocks until one is free, so the pool also bounds replies in flight.
+type OutputPool struct {
+	free chan []byte
+}
+
+// NewOutputPool registers bufs.
+func NewOutputPool(bufs ...[]byte) *OutputPool {
+	p := &OutputPool{free: make(chan []byte, len(bufs))}
+	for _, b := range bufs {
+		p.free <- b
+	}
+	return p
+}
+
+// Get takes a free buffer, waiting for one if need be.
+func (p *OutputPool) Get() []byte { return <-p.free }
+
+// Put returns a buffer taken with Get. It panics when the pool is already
+// full: the buffer was not one of its own, or was put back twice.
+func (p *OutputPool) Put(b []byte) {
+	select {
+	case p.free <- b[:cap(b)]:
+	default:
+		panic("wtf: OutputPool.Put of a buffer the pool did not hand out")
+	}
+}
@@ -0,0 +1,52 @@
+package wtf
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestGenerateTo(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(24)
+	want, err := e.Generate("", "what is the sky?", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := NewOutputPool(make([]byte, 256))
+	buf := pool.Get()
+	n, res, err := e.GenerateTo(buf, "", "what is the sky?", opts)
+	if err != nil || string(buf[:n]) != want.Text || res.Text != want.Text {
+		t.Fatalf("GenerateTo = %q, %v; want %q", buf[:n], err, want.Text)
+	}
+	pool.Put(buf)
+
+	// A small buffer ends the reply early, on a piece boundary.
+	small := make([]byte, 5)
+	n, res, err = e.GenerateTo(small, "", "what is the sky?", opts)
+	if err != nil || res.Finish != FinishLength || n > len(small) || !strings.HasPrefix(want.Text, string(small[:n])) {
+		t.Fatalf("small buffer: %q (%s), %v", small[:n], res.Finish, err)
+	}
+
+	// A cached reply longer than the buffer is cut and reported.
+	if e.Cache, err = OpenCache(CacheConfig{Size: 4, Policy: CacheAll}); err != nil {
+		t.Fatal(err)
+	}
+	e.Generate("", "what is the sky?", opts)
+	n, res, err = e.GenerateTo(small, "", "what is the sky?", opts)
+	if !errors.Is(err, io.ErrShortBuffer) || !res.Cached || string(small[:n]) != want.Text[:n] {
+		t.Fatalf("cached into a small buffer: %q, %v", small[:n], err)
+	}
+}
+
+func TestOutputPoolPut(t *testing.T) {
+	p := NewOutputPool(make([]byte, 8))
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Put of a foreign buffer into a full pool did not panic")
+		}
+	}()
+	p.Put(make([]byte, 8))
+}
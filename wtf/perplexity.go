@@ -0,0 +1,153 @@
+package wtf
+
+// perplexity.go — how surprised the model is by a corpus, for comparing
+// quantizations and fine-tune checkpoints on the same text. Perplexity is
+// exp of the mean negative log-likelihood per token; lower is better, and
+// only numbers from the same tokenizer are comparable.
+//
+// Documents longer than the window are scored with a sliding window: each
+// window is evaluated from a fresh cache and scores only the tokens the
+// previous window did not, so every token is scored once with up to
+// Window-Stride tokens of context before it. Stride = Window is fastest;
+// a smaller stride gives each token more context and a lower, fairer number.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// PerplexityOptions sets the sliding window.
+type PerplexityOptions struct {
+	Window int // tokens per window (0 = the model's context)
+	Stride int // tokens the window advances (0 = Window/2)
+}
+
+// EvalDoc is one corpus document.
+type EvalDoc struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// DocPerplexity is a document's (or a corpus') score.
+type DocPerplexity struct {
+	ID     string  `json:"id,omitempty"`
+	Tokens int     `json:"tokens"` // tokens scored: all but the first
+	NLL    float64 `json:"nll"`    // mean negative log-likelihood per token, nats
+	PPL    float64 `json:"ppl"`    // exp(NLL)
+}
+
+// Perplexity scores text as a raw document: BOS (when distinct from EOS)
+// and the text, no persona. The first token has nothing to be predicted
+// from and is not scored.
+func (e *Engine) Perplexity(text string, o PerplexityOptions) (DocPerplexity, error) {
+	seqLen := e.Model.Config.SeqLen
+	w := o.Window
+	if w <= 0 || w > seqLen {
+		w = seqLen
+	}
+	s := o.Stride
+	if s <= 0 {
+		s = max(w/2, 1)
+	}
+	if w < 2 || s > w {
+		return DocPerplexity{}, fmt.Errorf("perplexity: window %d, stride %d: want 2 <= window and stride <= window", w, s)
+	}
+	tokens := append(e.Tok.bosPrefix(), e.Tok.Encode(text, false)...)
+	if len(tokens) < 2 {
+		return DocPerplexity{}, fmt.Errorf("perplexity: %w: need at least two tokens", ErrEmptyPrompt)
+	}
+
+	if err := e.lock(); err != nil {
+		return DocPerplexity{}, err
+	}
+	defer e.unlock()
+	e.claim(nil)
+	m := e.Model
+	vocab := m.Config.VocabSize
+	var nll float64
+	scored := 1 // tokens[0] is never a target
+	for begin := 0; scored < len(tokens); begin += s {
+		end := min(begin+w, len(tokens))
+		m.Reset()
+		// Targets scored..end-1 need the logits after each token before them.
+		for pos := begin; pos < end-1; pos++ {
+			if pos+1 < scored {
+				m.prefill(tokens[pos], pos-begin)
+				continue
+			}
+			m.Forward(tokens[pos], pos-begin)
+			nll -= logProb(m.State.Logits, vocab, tokens[pos+1])
+		}
+		scored = end
+	}
+	return newDocPerplexity("", len(tokens)-1, nll), nil
+}
+
+func newDocPerplexity(id string, tokens int, nll float64) DocPerplexity {
+	mean := nll / float64(max(tokens, 1))
+	return DocPerplexity{ID: id, Tokens: tokens, NLL: mean, PPL: math.Exp(mean)}
+}
+
+// EvalCorpus scores every document, passing each result to each (which may
+// be nil), and returns the corpus score: the token-weighted mean over all
+// documents. Documents too short to score are skipped.
+func (e *Engine) EvalCorpus(docs []EvalDoc, o PerplexityOptions, each func(DocPerplexity)) (DocPerplexity, error) {
+	var (
+		nll    float64
+		tokens int
+	)
+	for i, d := range docs {
+		r, err := e.Perplexity(d.Text, o)
+		if err != nil {
+			if errors.Is(err, ErrEmptyPrompt) {
+				continue
+			}
+			return DocPerplexity{}, fmt.Errorf("document %d: %w", i+1, err)
+		}
+		r.ID = d.ID
+		if r.ID == "" {
+			r.ID = fmt.Sprint(i + 1)
+		}
+		if each != nil {
+			each(r)
+		}
+		nll += r.NLL * float64(r.Tokens)
+		tokens += r.Tokens
+	}
+	if tokens == 0 {
+		return DocPerplexity{}, fmt.Errorf("perplexity: %w: no document had two tokens", ErrEmptyPrompt)
+	}
+	return newDocPerplexity("", tokens, nll), nil
+}
+
+// ReadCorpus loads documents from path: a .jsonl file holds one EvalDoc per
+// line; any other file is a single document.
+func ReadCorpus(path string) ([]EvalDoc, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("corpus: %w", err)
+	}
+	if !strings.HasSuffix(path, ".jsonl") {
+		return []EvalDoc{{ID: path, Text: string(blob)}}, nil
+	}
+	var docs []EvalDoc
+	sc := bufio.NewScanner(bytes.NewReader(blob))
+	sc.Buffer(make([]byte, 64<<10), MaxFrame)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var d EvalDoc
+		if err := json.Unmarshal(sc.Bytes(), &d); err != nil {
+			return nil, fmt.Errorf("corpus %s:%d: %w", path, line, err)
+		}
+		docs = append(docs, d)
+	}
+	return docs, sc.Err()
+}
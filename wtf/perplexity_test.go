@@ -0,0 +1,66 @@
+package wtf
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPerplexity(t *testing.T) {
+	e := newTestEngine()
+	text := "the sky is blue and the cat is on the mat because the sky said so"
+	tokens := append(e.Tok.bosPrefix(), e.Tok.Encode(text, false)...)
+
+	// Reference: one pass over the whole document.
+	m := e.Model
+	m.Reset()
+	var ref float64
+	for pos := 0; pos < len(tokens)-1; pos++ {
+		m.Forward(tokens[pos], pos)
+		ref -= logProb(m.State.Logits, m.Config.VocabSize, tokens[pos+1])
+	}
+	ref /= float64(len(tokens) - 1)
+
+	full, err := e.Perplexity(text, PerplexityOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.Tokens != len(tokens)-1 || math.Abs(full.NLL-ref) > 1e-6 || math.Abs(full.PPL-math.Exp(ref)) > 1e-6*full.PPL {
+		t.Fatalf("whole-context score %+v, want %d tokens, nll %v", full, len(tokens)-1, ref)
+	}
+
+	// Short windows still score every token once; overlap only adds context.
+	for _, o := range []PerplexityOptions{{Window: 6, Stride: 6}, {Window: 6, Stride: 2}} {
+		r, err := e.Perplexity(text, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Tokens != full.Tokens || math.IsNaN(r.NLL) || r.NLL <= 0 {
+			t.Fatalf("%+v: %+v", o, r)
+		}
+	}
+	if _, err := e.Perplexity(text, PerplexityOptions{Window: 4, Stride: 5}); err == nil {
+		t.Fatal("stride past the window accepted")
+	}
+
+	// The corpus score is the token-weighted mean of its documents.
+	path := filepath.Join(t.TempDir(), "corpus.jsonl")
+	os.WriteFile(path, []byte(`{"id":"a","text":"`+text+`"}`+"\n\n"+`{"text":"a cat"}`+"\n"), 0o644)
+	docs, err := ReadCorpus(path)
+	if err != nil || len(docs) != 2 {
+		t.Fatalf("ReadCorpus: %v, %v", docs, err)
+	}
+	var each []DocPerplexity
+	total, err := e.EvalCorpus(docs, PerplexityOptions{}, func(d DocPerplexity) { each = append(each, d) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(each) != 2 || each[0].ID != "a" || each[1].ID != "2" {
+		t.Fatalf("per-document results %+v", each)
+	}
+	want := (each[0].NLL*float64(each[0].Tokens) + each[1].NLL*float64(each[1].Tokens)) / float64(total.Tokens)
+	if total.Tokens != each[0].Tokens+each[1].Tokens || math.Abs(total.NLL-want) > 1e-9 {
+		t.Fatalf("corpus %+v, want nll %v over %d tokens", total, want, each[0].Tokens+each[1].Tokens)
+	}
+}
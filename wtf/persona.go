@@ -0,0 +1,145 @@
+package wtf
+
+// persona.go — named personas: an anchor (system prompt) plus sampler
+// overrides, with the anchor's KV prefix cached so each generation only
+// prefills the user's part of the prompt.
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SamplerOverrides replace GenOptions fields for one persona. Nil fields
+// leave the caller's value alone.
+type SamplerOverrides struct {
+	MaxTokens  *int
+	Temp       *float32
+	TopP       *float32
+	RepPenalty *float32
+	RepWindow  *int
+
+	PresencePenalty  *float32
+	FrequencyPenalty *float32
+	MinP             *float32
+	EOSBias          *float32
+}
+
+// apply returns opts with every non-nil override written over it.
+func (o SamplerOverrides) apply(opts GenOptions) GenOptions {
+	if o.MaxTokens != nil {
+		opts.MaxTokens = *o.MaxTokens
+	}
+	if o.Temp != nil {
+		opts.Temp = *o.Temp
+	}
+	if o.TopP != nil {
+		opts.TopP = *o.TopP
+	}
+	if o.RepPenalty != nil {
+		opts.RepPenalty = *o.RepPenalty
+	}
+	if o.RepWindow != nil {
+		opts.RepWindow = *o.RepWindow
+	}
+	if o.PresencePenalty != nil {
+		opts.PresencePenalty = *o.PresencePenalty
+	}
+	if o.FrequencyPenalty != nil {
+		opts.FrequencyPenalty = *o.FrequencyPenalty
+	}
+	if o.MinP != nil {
+		opts.MinP = *o.MinP
+	}
+	if o.EOSBias != nil {
+		opts.EOSBias = *o.EOSBias
+	}
+	return opts
+}
+
+// Persona is a registered anchor. The anchor is encoded on its own (BOS +
+// anchor + "\n") so its tokens — and therefore its KV rows — are identical
+// for every prompt that follows it. Anchor may hold template variables
+// (see template.go).
+type Persona struct {
+	Name      string
+	Anchor    string
+	Overrides SamplerOverrides
+
+	text   string // Anchor with its variables resolved, as tokens encodes it
+	tokens []int
+	prefix *kvPrefix // nil until first use
+}
+
+// ErrUnknownPersona is returned when a generation names an unregistered persona.
+var ErrUnknownPersona = errors.New("unknown persona")
+
+// RegisterPersona adds (or replaces) a persona. Replacing drops the cached
+// prefix, so the new anchor is prefilled on next use.
+func (e *Engine) RegisterPersona(name, anchor string, ov SamplerOverrides) error {
+	if name == "" {
+		return fmt.Errorf("persona name must not be empty")
+	}
+	text := e.expand(anchor, nil)
+	tokens, err := e.anchorTokens(name, text)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if old, ok := e.personas[name]; ok {
+		old.prefix.release()
+	}
+	e.personas[name] = &Persona{Name: name, Anchor: anchor, Overrides: ov, text: text, tokens: tokens}
+	return nil
+}
+
+// anchorTokens encodes a resolved anchor as a persona prefix.
+func (e *Engine) anchorTokens(name, text string) ([]int, error) {
+	tokens := e.Tok.bosPrefix()
+	tokens = append(tokens, e.Tok.Encode(text+"\n", false)...)
+	if len(tokens) >= e.Model.Config.SeqLen-1 {
+		return nil, fmt.Errorf("persona %q: %w: anchor is %d tokens, context is %d",
+			name, ErrContextOverflow, len(tokens), e.Model.Config.SeqLen)
+	}
+	return tokens, nil
+}
+
+// Options returns opts with the persona's overrides applied, for callers
+// that run the anchor outside Generate (a Session's system message).
+func (p *Persona) Options(opts GenOptions) GenOptions {
+	return p.Overrides.apply(opts)
+}
+
+// Persona looks up a registered persona by name.
+func (e *Engine) Persona(name string) (*Persona, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	p, ok := e.personas[name]
+	return p, ok
+}
+
+// Personas returns the registered persona names (unordered).
+func (e *Engine) Personas() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	names := make([]string, 0, len(e.personas))
+	for n := range e.personas {
+		names = append(names, n)
+	}
+	return names
+}
+
+// loadPrefix puts the persona's anchor into cache rows [0, len(tokens)),
+// prefilling once and restoring from the snapshot afterwards.
+func (p *Persona) loadPrefix(m *LlamaModel) {
+	if p.prefix != nil {
+		m.restoreKV(p.prefix)
+		return
+	}
+	m.Reset()
+	for pos, t := range p.tokens {
+		m.prefill(t, pos)
+	}
+	p.prefix = m.snapshotKV(len(p.tokens))
+	m.State.Pos = len(p.tokens)
+}
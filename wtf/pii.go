@@ -0,0 +1,78 @@
+package wtf
+
+// pii.go — input-side scrubbing of personal data. Emails, phone numbers and
+// card numbers in a prompt are replaced with placeholders before encoding,
+// so they neither steer the reply nor get echoed back. Detection is regexp
+// based and errs on the side of catching things; card numbers must pass the
+// Luhn check so order numbers and the like are left alone.
+
+import (
+	"regexp"
+	"strings"
+)
+
+// PIIKind selects what ScrubPII replaces. Flags combine.
+type PIIKind uint8
+
+const (
+	PIIEmail PIIKind = 1 << iota // user@host.tld → [email]
+	PIIPhone                     // 7–15 digits with +, spaces, dots, dashes, parens; not dates → [phone]
+	PIICard                      // 13–19 digits passing Luhn → [card]
+
+	PIIAll = PIIEmail | PIIPhone | PIICard
+)
+
+var (
+	emailRe = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+	cardRe  = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+	phoneRe = regexp.MustCompile(`(?:\+|\b)\d[\d .()-]{5,}\d\b`)
+	dateRe  = regexp.MustCompile(`^\d{4}[-./]\d{1,2}[-./]\d{1,2}$|^\d{1,2}[-./]\d{1,2}[-./]\d{4}$`)
+)
+
+// ScrubPII replaces the personal data selected by k with placeholders.
+func ScrubPII(text string, k PIIKind) string {
+	if k&PIIEmail != 0 {
+		text = emailRe.ReplaceAllString(text, "[email]")
+	}
+	if k&PIICard != 0 {
+		text = cardRe.ReplaceAllStringFunc(text, func(s string) string {
+			if luhn(digits(s)) {
+				return "[card]"
+			}
+			return s
+		})
+	}
+	if k&PIIPhone != 0 {
+		text = phoneRe.ReplaceAllStringFunc(text, func(s string) string {
+			if n := len(digits(s)); n >= 7 && n <= 15 && !dateRe.MatchString(s) {
+				return "[phone]"
+			}
+			return s
+		})
+	}
+	return text
+}
+
+func digits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// luhn reports whether the digit string has a valid Luhn check digit.
+func luhn(d string) bool {
+	sum := 0
+	for i := range len(d) {
+		n := int(d[len(d)-1-i] - '0')
+		if i%2 == 1 {
+			if n *= 2; n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,38 @@
+package wtf
+
+import "testing"
+
+func TestScrubPII(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		k    PIIKind
+		want string
+	}{
+		{"mail me at bob.smith+wtf@mail.example.co.uk ok", PIIAll, "mail me at [email] ok"},
+		{"call +1 (555) 123-4567 now", PIIAll, "call [phone] now"},
+		{"call 555.123.4567", PIIAll, "call [phone]"},
+		{"card 4111 1111 1111 1111 exp", PIIAll, "card [card] exp"},
+		{"card 4111-1111-1111-1112", PIICard, "card 4111-1111-1111-1112"}, // fails Luhn
+		{"order 12345 on 2024-05-01 or 01/05/2024", PIIAll, "order 12345 on 2024-05-01 or 01/05/2024"},
+		{"bob@example.com 555-123-4567", PIIEmail, "[email] 555-123-4567"},
+		{"nothing here", PIIAll, "nothing here"},
+	} {
+		if got := ScrubPII(c.in, c.k); got != c.want {
+			t.Errorf("ScrubPII(%q, %d) = %q, want %q", c.in, c.k, got, c.want)
+		}
+	}
+}
+
+func TestScrubPIIPrompt(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(8)
+	want, err := e.Generate("", "ping [email]", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.ScrubPII = PIIAll
+	got, err := e.Generate("", "ping a@b.io", opts)
+	if err != nil || got.Text != want.Text {
+		t.Fatalf("scrubbed prompt: %q, %v; want %q", got.Text, err, want.Text)
+	}
+}
@@ -0,0 +1,136 @@
+package wtf
+
+// profile.go — profiling the engine inside a process we do not own.
+// EnableProfiling serves net/http/pprof (CPU, heap, goroutines, and
+// runtime/trace under /debug/pprof/trace) on an address of the host's
+// choosing and DisableProfiling takes it down again, both at run time.
+// The handlers live on their own mux, so nothing is added to the host's
+// http.DefaultServeMux. Hosts that cannot open a port use CaptureProfile,
+// which writes one profile or trace straight to a file.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	rpprof "runtime/pprof"
+	"runtime/trace"
+	"slices"
+	"sync"
+	"time"
+)
+
+var profiling struct {
+	mu        sync.Mutex
+	srv       *http.Server
+	ln        net.Listener
+	blockRate int // last SetBlockProfileRate; the runtime has no getter
+}
+
+// SetBlockProfileRate is runtime.SetBlockProfileRate, remembered so that
+// CaptureProfile("block") can put it back afterwards. Hosts that sample
+// blocking all the time should set the rate here rather than in runtime.
+func SetBlockProfileRate(rate int) {
+	profiling.mu.Lock()
+	defer profiling.mu.Unlock()
+	profiling.blockRate = rate
+	runtime.SetBlockProfileRate(rate)
+}
+
+// ErrProfilingActive is returned by EnableProfiling while a server is up.
+var ErrProfilingActive = errors.New("profiling already enabled")
+
+// EnableProfiling serves the pprof endpoints on addr ("127.0.0.1:6060";
+// port 0 picks a free one) and returns the address it listens on. The
+// endpoints show stacks and memory: keep addr on loopback.
+func EnableProfiling(addr string) (net.Addr, error) {
+	profiling.mu.Lock()
+	defer profiling.mu.Unlock()
+	if profiling.srv != nil {
+		return profiling.ln.Addr(), ErrProfilingActive
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("profiling: %w", err)
+	}
+	if tcp, ok := ln.Addr().(*net.TCPAddr); ok && !tcp.IP.IsLoopback() {
+		fmt.Fprintf(os.Stderr, "[wtf] profiling endpoints on non-loopback %s: anyone who can reach it can read the heap\n", tcp)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	profiling.srv, profiling.ln = srv, ln
+	go srv.Serve(ln)
+	return ln.Addr(), nil
+}
+
+// DisableProfiling stops the server EnableProfiling started, cutting off
+// any profile being streamed. Without one it does nothing.
+func DisableProfiling() error {
+	profiling.mu.Lock()
+	defer profiling.mu.Unlock()
+	if profiling.srv == nil {
+		return nil
+	}
+	err := profiling.srv.Close()
+	profiling.srv, profiling.ln = nil, nil
+	return err
+}
+
+// ProfileKinds are the kinds CaptureProfile takes.
+var ProfileKinds = []string{"cpu", "trace", "heap", "allocs", "goroutine", "block", "mutex", "threadcreate"}
+
+// CaptureProfile writes one profile of kind to path. "cpu" and "trace" record
+// for d; "block" and "mutex" turn their sampling on for d first (it is off
+// by default) and restore it after, the block rate as last set with
+// SetBlockProfileRate; the rest are snapshots and ignore d.
+// It blocks for d.
+func CaptureProfile(kind string, d time.Duration, path string) (err error) {
+	if !slices.Contains(ProfileKinds, kind) {
+		return fmt.Errorf("profile kind %q: want one of %v", kind, ProfileKinds)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("profile: %w", err)
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("profile: %w", cerr)
+		}
+	}()
+	switch kind {
+	case "cpu":
+		if err := rpprof.StartCPUProfile(f); err != nil {
+			return fmt.Errorf("profile: %w", err)
+		}
+		time.Sleep(d)
+		rpprof.StopCPUProfile()
+		return nil
+	case "trace":
+		if err := trace.Start(f); err != nil {
+			return fmt.Errorf("profile: %w", err)
+		}
+		time.Sleep(d)
+		trace.Stop()
+		return nil
+	case "block":
+		profiling.mu.Lock()
+		prev := profiling.blockRate
+		profiling.mu.Unlock()
+		runtime.SetBlockProfileRate(1)
+		time.Sleep(d)
+		defer runtime.SetBlockProfileRate(prev)
+	case "mutex":
+		prev := runtime.SetMutexProfileFraction(1)
+		time.Sleep(d)
+		defer runtime.SetMutexProfileFraction(prev)
+	}
+	return rpprof.Lookup(kind).WriteTo(f, 0)
+}
@@ -0,0 +1,57 @@
+package wtf
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProfilingServer(t *testing.T) {
+	addr, err := EnableProfiling("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DisableProfiling()
+	url := "http://" + addr.String() + "/debug/pprof/goroutine?debug=1"
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", url, resp.Status)
+	}
+	if _, err := EnableProfiling("127.0.0.1:0"); !errors.Is(err, ErrProfilingActive) {
+		t.Errorf("second EnableProfiling: %v, want ErrProfilingActive", err)
+	}
+	if err := DisableProfiling(); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := http.Get(url); err == nil {
+		resp.Body.Close()
+		t.Error("endpoint still up after DisableProfiling")
+	}
+}
+
+func TestCaptureProfile(t *testing.T) {
+	dir := t.TempDir()
+	for _, kind := range []string{"cpu", "trace", "heap", "mutex"} {
+		path := filepath.Join(dir, kind)
+		if err := CaptureProfile(kind, 20*time.Millisecond, path); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		if fi, err := os.Stat(path); err != nil || fi.Size() == 0 {
+			t.Errorf("%s: empty profile (%v)", kind, err)
+		}
+	}
+	path := filepath.Join(dir, "nope")
+	if err := CaptureProfile("gpu", 0, path); err == nil {
+		t.Error("unknown kind accepted")
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Error("file created for an unknown kind")
+	}
+}
@@ -0,0 +1,117 @@
+package wtf
+
+// provenance.go — which file the weights came from, for deployments that
+// must run one blessed checkpoint. LoadGGUF hashes the whole file as it
+// reads it and keeps the general.* metadata the converter stamped in; the
+// model carries both. With an allow-list (Config.Model.Allow, WTF_MODEL_ALLOW)
+// the commands refuse any file whose SHA-256 is not on it before the
+// weights are unpacked.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Provenance identifies a loaded GGUF file.
+type Provenance struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"` // of the whole file, hex
+	Size   int64  `json:"size"`
+
+	// From the general.* metadata, when the converter wrote it.
+	Name         string `json:"name,omitempty"`
+	Source       string `json:"source,omitempty"` // source URL or Hugging Face repo
+	Author       string `json:"author,omitempty"`
+	Organization string `json:"organization,omitempty"`
+	Version      string `json:"version,omitempty"`
+	License      string `json:"license,omitempty"`
+}
+
+// ModelConfig constrains which weights the commands load.
+type ModelConfig struct {
+	// Allow lists the SHA-256 digests (hex, "sha256:" prefix optional) a
+	// weights file must match; empty allows any.
+	Allow []string `json:"allow"`
+
+	// Int8 requantizes F16/F32 layer matrices to int8 after load; see int8.go.
+	Int8 bool `json:"int8"`
+
+	// Stream maps the file and pages layers in and out; see stream.go.
+	Stream bool `json:"stream"`
+}
+
+// ErrModelNotAllowed is returned by Verify for a file not on the allow-list.
+var ErrModelNotAllowed = errors.New("model not on the allow-list")
+
+// provenance reads the general.* keys of kv.
+func provenance(kv map[string]interface{}) Provenance {
+	str := func(keys ...string) string {
+		for _, k := range keys {
+			if s, ok := kv[k].(string); ok && s != "" {
+				return s
+			}
+		}
+		return ""
+	}
+	return Provenance{
+		Name:         str("general.name", "general.basename"),
+		Source:       str("general.source.url", "general.source.huggingface.repository", "general.url"),
+		Author:       str("general.author", "general.quantized_by"),
+		Organization: str("general.organization"),
+		Version:      str("general.version"),
+		License:      str("general.license"),
+	}
+}
+
+// Verify returns ErrModelNotAllowed unless p's digest is on allow. An empty
+// allow-list accepts every file.
+func (p Provenance) Verify(allow []string) error {
+	if len(allow) == 0 {
+		return nil
+	}
+	for _, a := range allow {
+		a = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(a)), "sha256:")
+		if a == p.SHA256 {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s (sha256 %s)", ErrModelNotAllowed, p.Path, p.SHA256)
+}
+
+// String is a one-line summary for load logs.
+func (p Provenance) String() string {
+	s := "sha256=" + p.SHA256
+	if p.Name != "" {
+		s += fmt.Sprintf(" name=%q", p.Name)
+	}
+	if p.Source != "" {
+		s += " source=" + p.Source
+	}
+	return s
+}
+
+// hashingReader hashes everything read through it, so LoadGGUF digests the
+// file in the same pass that parses it.
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, h: sha256.New()}
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	hr.n += int64(n)
+	return n, err
+}
+
+func (hr *hashingReader) sum() string { return hex.EncodeToString(hr.h.Sum(nil)) }
@@ -0,0 +1,66 @@
+package wtf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestGGUF writes a tensorless GGUF file with string metadata kv and
+// a few bytes of tensor data.
+func writeTestGGUF(t testing.TB, kv [][2]string) (string, []byte) {
+	var b bytes.Buffer
+	le := func(v any) { binary.Write(&b, binary.LittleEndian, v) }
+	str := func(s string) { le(uint64(len(s))); b.WriteString(s) }
+	le(uint32(ggufMagic))
+	le(uint32(ggufVersion))
+	le(uint64(0))
+	le(uint64(len(kv)))
+	for _, p := range kv {
+		str(p[0])
+		le(uint32(ggufTypeString))
+		str(p[1])
+	}
+	for b.Len()%32 != 0 {
+		b.WriteByte(0)
+	}
+	b.WriteString("tensor bytes")
+	path := filepath.Join(t.TempDir(), "m.gguf")
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, b.Bytes()
+}
+
+func TestProvenance(t *testing.T) {
+	path, blob := writeTestGGUF(t, [][2]string{
+		{"general.name", "WTForacle 360M"},
+		{"general.source.huggingface.repository", "ataeff/WTForacle"},
+	})
+	g, err := LoadGGUF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(blob)
+	p := g.Provenance
+	want := Provenance{Path: path, SHA256: hex.EncodeToString(sum[:]), Size: int64(len(blob)),
+		Name: "WTForacle 360M", Source: "ataeff/WTForacle"}
+	if p != want {
+		t.Fatalf("provenance = %+v, want %+v", p, want)
+	}
+
+	if err := p.Verify(nil); err != nil {
+		t.Fatalf("empty allow-list: %v", err)
+	}
+	if err := p.Verify([]string{"deadbeef", " SHA256:" + p.SHA256}); err != nil {
+		t.Fatalf("listed digest: %v", err)
+	}
+	if err := p.Verify([]string{"deadbeef"}); !errors.Is(err, ErrModelNotAllowed) {
+		t.Fatalf("unlisted digest: %v", err)
+	}
+}
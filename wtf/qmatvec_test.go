@@ -5,6 +5,7 @@ package wtf
 // is switched onto packed weights.
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
 	"testing"
@@ -59,3 +60,70 @@ func TestQmatvecQ4_0(t *testing.T) {
 		t.Fatalf("qmatvec Q4_0 diverges from dequant->sgemv: rel=%.3g", rel)
 	}
 }
+
+// The fused attention kernel must agree with the strided-sgemv + Softmax path
+// it replaced, across several tiles and with GQA-style strided rows.
+func TestAttendFusedMatchesSgemv(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	hd, stride, n := 64, 128, 3*attnTile+5
+	q := make([]float32, hd)
+	for i := range q {
+		q[i] = rng.Float32()*4 - 2
+	}
+	keys, values := make([]float32, n*stride), make([]float32, n*stride)
+	for i := range keys {
+		keys[i], values[i] = rng.Float32()*2-1, rng.Float32()*2-1
+	}
+	scale := float32(1 / math.Sqrt(float64(hd)))
+
+	att := make([]float32, n)
+	sgemvStrided(att, keys, stride, q, n, hd, false)
+	for i := range att {
+		att[i] *= scale
+	}
+	Softmax(att, n)
+	ref := make([]float32, hd)
+	sgemvStrided(ref, values, stride, att, n, hd, true)
+
+	got := make([]float32, hd)
+	attendFused(got, q, keys, values, stride, n, scale)
+	for i := range ref {
+		if d := math.Abs(float64(got[i] - ref[i])); d > 1e-5 {
+			t.Fatalf("out[%d] = %g, sgemv path %g", i, got[i], ref[i])
+		}
+	}
+}
+
+// BenchmarkAttention compares the fused kernel with the strided-sgemv +
+// Softmax path it replaced, for one head at growing context lengths.
+func BenchmarkAttention(b *testing.B) {
+	const hd, stride = 64, 128
+	for _, n := range []int{128, 1024, 8192} {
+		rng := rand.New(rand.NewSource(3))
+		q, out := make([]float32, hd), make([]float32, hd)
+		for i := range q {
+			q[i] = rng.Float32()*4 - 2
+		}
+		keys, values := make([]float32, n*stride), make([]float32, n*stride)
+		for i := range keys {
+			keys[i], values[i] = rng.Float32()*2-1, rng.Float32()*2-1
+		}
+		scale := float32(1 / math.Sqrt(float64(hd)))
+		att := make([]float32, n)
+		b.Run(fmt.Sprintf("fused/%d", n), func(b *testing.B) {
+			for b.Loop() {
+				attendFused(out, q, keys, values, stride, n, scale)
+			}
+		})
+		b.Run(fmt.Sprintf("sgemv/%d", n), func(b *testing.B) {
+			for b.Loop() {
+				sgemvStrided(att, keys, stride, q, n, hd, false)
+				for i := range att {
+					att[i] *= scale
+				}
+				Softmax(att, n)
+				sgemvStrided(out, values, stride, att, n, hd, true)
+			}
+		})
+	}
+}
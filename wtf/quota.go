@@ -0,0 +1,213 @@
+package wtf
+
+// quota.go — API keys, rate limits and daily token quotas for serving the
+// oracle over the network. Limits come from a JSON file:
+//
+//	{"keys": {
+//	  "k-3f9a...": {"name": "discord-bot", "rate_per_minute": 30, "burst": 5, "daily_tokens": 200000},
+//	  "k-77c1...": {"name": "me"}
+//	}}
+//
+// Zero limits mean unlimited. Each key has a token bucket for requests and a
+// token counter that resets at UTC midnight. Watch re-reads the file when it
+// changes; usage of keys that survive a reload is kept.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyLimits are one API key's limits.
+type KeyLimits struct {
+	Name          string  `json:"name"`            // for logs
+	RatePerMinute float64 `json:"rate_per_minute"` // requests; 0 = unlimited
+	Burst         int     `json:"burst"`           // bucket size (0 = 1)
+	DailyTokens   int     `json:"daily_tokens"`    // generated tokens per UTC day; 0 = unlimited
+}
+
+var (
+	ErrUnknownKey     = errors.New("unknown API key")
+	ErrRateLimited    = errors.New("rate limit exceeded")
+	ErrQuotaExhausted = errors.New("daily token quota exhausted")
+)
+
+// Quotas enforces the limits of a key file. Safe for concurrent use.
+type Quotas struct {
+	path string
+
+	mu    sync.Mutex
+	keys  map[string]KeyLimits
+	usage map[string]*keyUsage
+	mtime time.Time
+	now   func() time.Time
+}
+
+type keyUsage struct {
+	bucket float64 // requests available
+	last   time.Time
+	day    string // UTC date the token count belongs to
+	tokens int
+}
+
+// LoadQuotas reads a key file.
+func LoadQuotas(path string) (*Quotas, error) {
+	q := &Quotas{path: path, usage: make(map[string]*keyUsage), now: time.Now}
+	if err := q.Reload(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Reload re-reads the key file if it changed since the last load. On error
+// the current limits stay in force.
+func (q *Quotas) Reload() error {
+	fi, err := os.Stat(q.path)
+	if err != nil {
+		return fmt.Errorf("quotas: %w", err)
+	}
+	q.mu.Lock()
+	same := fi.ModTime().Equal(q.mtime) && q.keys != nil
+	q.mu.Unlock()
+	if same {
+		return nil
+	}
+	blob, err := os.ReadFile(q.path)
+	if err != nil {
+		return fmt.Errorf("quotas: %w", err)
+	}
+	var f struct {
+		Keys map[string]KeyLimits `json:"keys"`
+	}
+	if err := json.Unmarshal(blob, &f); err != nil {
+		return fmt.Errorf("quotas %s: %w", q.path, err)
+	}
+	if f.Keys == nil {
+		f.Keys = map[string]KeyLimits{}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.keys, q.mtime = f.Keys, fi.ModTime()
+	for k := range q.usage {
+		if _, ok := q.keys[k]; !ok {
+			delete(q.usage, k)
+		}
+	}
+	return nil
+}
+
+// Watch polls the key file every interval and reloads it when it changes,
+// until ctx is done. Reload errors are logged and the old limits kept.
+func (q *Quotas) Watch(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := q.Reload(); err != nil {
+				fmt.Fprintf(os.Stderr, "[wtf] %v\n", err)
+			}
+		}
+	}
+}
+
+// usageLocked returns key's usage, rolling the token count over at UTC
+// midnight and refilling the request bucket for the time since last use.
+func (q *Quotas) usageLocked(key string, lim KeyLimits) *keyUsage {
+	now := q.now()
+	u, ok := q.usage[key]
+	if !ok {
+		u = &keyUsage{bucket: float64(max(lim.Burst, 1)), last: now}
+		q.usage[key] = u
+	}
+	if day := now.UTC().Format(time.DateOnly); day != u.day {
+		u.day, u.tokens = day, 0
+	}
+	if lim.RatePerMinute > 0 {
+		u.bucket += now.Sub(u.last).Minutes() * lim.RatePerMinute
+		u.bucket = min(u.bucket, float64(max(lim.Burst, 1)))
+	}
+	u.last = now
+	return u
+}
+
+// Admit authenticates key and takes one request from its bucket.
+func (q *Quotas) Admit(key string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	lim, ok := q.keys[key]
+	if !ok || key == "" {
+		return ErrUnknownKey
+	}
+	u := q.usageLocked(key, lim)
+	if lim.DailyTokens > 0 && u.tokens >= lim.DailyTokens {
+		return ErrQuotaExhausted
+	}
+	if lim.RatePerMinute > 0 {
+		if u.bucket < 1 {
+			return ErrRateLimited
+		}
+		u.bucket--
+	}
+	return nil
+}
+
+// Charge adds generated tokens to key's daily count.
+func (q *Quotas) Charge(key string, tokens int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if lim, ok := q.keys[key]; ok {
+		q.usageLocked(key, lim).tokens += tokens
+	}
+}
+
+// Remaining returns key's tokens left today, or -1 when unlimited or unknown.
+func (q *Quotas) Remaining(key string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	lim, ok := q.keys[key]
+	if !ok || lim.DailyTokens == 0 {
+		return -1
+	}
+	return max(lim.DailyTokens-q.usageLocked(key, lim).tokens, 0)
+}
+
+type quotaKeyCtx struct{}
+
+// APIKey returns the key Middleware admitted the request under.
+func APIKey(ctx context.Context) string {
+	k, _ := ctx.Value(quotaKeyCtx{}).(string)
+	return k
+}
+
+// Middleware admits requests carrying "Authorization: Bearer <key>" or
+// "X-API-Key: <key>": 401 for unknown keys, 429 past a limit. Handlers
+// report what they generated with Charge(APIKey(r.Context()), n).
+func (q *Quotas) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			key = strings.TrimSpace(auth)
+		}
+		switch err := q.Admit(key); {
+		case errors.Is(err, ErrUnknownKey):
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case err != nil:
+			if errors.Is(err, ErrRateLimited) {
+				w.Header().Set("Retry-After", "60")
+			}
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+		default:
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), quotaKeyCtx{}, key)))
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package wtf
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuotas(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, []byte(`{"keys": {
+		"a": {"name": "bot", "rate_per_minute": 60, "burst": 2, "daily_tokens": 100},
+		"b": {}
+	}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	q, err := LoadQuotas(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 3, 1, 23, 59, 0, 0, time.UTC)
+	q.now = func() time.Time { return now }
+
+	if err := q.Admit("nope"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("unknown key: %v", err)
+	}
+	for i, want := range []error{nil, nil, ErrRateLimited} {
+		if err := q.Admit("a"); !errors.Is(err, want) {
+			t.Fatalf("request %d: %v, want %v", i, err, want)
+		}
+	}
+	now = now.Add(time.Second) // one request refilled
+	if err := q.Admit("a"); err != nil {
+		t.Fatalf("after refill: %v", err)
+	}
+	q.Charge("a", 100)
+	now = now.Add(10 * time.Second)
+	if err := q.Admit("a"); !errors.Is(err, ErrQuotaExhausted) || q.Remaining("a") != 0 {
+		t.Fatalf("quota: %v, %d left", err, q.Remaining("a"))
+	}
+	now = now.Add(time.Minute) // past UTC midnight
+	if err := q.Admit("a"); err != nil || q.Remaining("a") != 100 {
+		t.Fatalf("next day: %v, %d left", err, q.Remaining("a"))
+	}
+	for range 50 {
+		if err := q.Admit("b"); err != nil {
+			t.Fatalf("unlimited key: %v", err)
+		}
+	}
+
+	os.WriteFile(path, []byte(`{"keys": {"c": {}}}`), 0o644)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(path, later, later)
+	if err := q.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if q.Admit("a") == nil || q.Admit("c") != nil {
+		t.Fatal("reload did not replace the keys")
+	}
+	os.WriteFile(path, []byte(`{"keys": `), 0o644)
+	later = later.Add(time.Hour)
+	os.Chtimes(path, later, later)
+	if q.Reload() == nil || q.Admit("c") != nil {
+		t.Fatal("a broken file must keep the old keys")
+	}
+
+	h := q.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(APIKey(r.Context())))
+	}))
+	for _, c := range []struct {
+		header, value string
+		code          int
+	}{
+		{"Authorization", "Bearer c", http.StatusOK},
+		{"X-API-Key", "c", http.StatusOK},
+		{"X-API-Key", "a", http.StatusUnauthorized},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/generate", nil)
+		req.Header.Set(c.header, c.value)
+		h.ServeHTTP(rec, req)
+		if rec.Code != c.code || c.code == http.StatusOK && rec.Body.String() != "c" {
+			t.Errorf("%s: %s -> %d %q", c.header, c.value, rec.Code, rec.Body.String())
+		}
+	}
+}
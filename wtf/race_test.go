@@ -0,0 +1,7 @@
+//go:build race
+
+package wtf
+
+// raceEnabled is set when the tests run under -race, whose instrumentation
+// allocates and so breaks the allocation counts.
+const raceEnabled = true
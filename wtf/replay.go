@@ -0,0 +1,182 @@
+package wtf
+
+// replay.go — record a generation so it can be replayed bit for bit. A
+// Recording holds the model's fingerprint, every input token (cached prefix
+// included), the sampler settings and each value the sampler drew from its
+// RNG; Replay feeds those draws back instead of a fresh RNG, so the replay
+// does not even depend on how seeds map to random streams.
+//
+// Callbacks (OnToken, Veto, Trace) are not recorded. A reply shaped by a
+// Veto only replays if the same Veto is set on the recording's Opts again.
+// The Safety lexicon is recorded next to Opts, rules included.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+// recordingVersion is bumped on incompatible Recording changes.
+const recordingVersion = 1
+
+// Recording is everything needed to replay one generation.
+type Recording struct {
+	Version int           `json:"version"`
+	Model   string        `json:"model"`            // LlamaModel.Fingerprint
+	Tokens  []int         `json:"tokens"`           // decode input, cached prefix included
+	Opts    GenOptions    `json:"opts"`             // Seed filled in when it was 0
+	Safety  *SafetyFilter `json:"safety,omitempty"` // Opts.Safety, which Opts does not serialize
+	Draws   []int64       `json:"draws"`            // RNG values, in the order drawn
+	Output  []int         `json:"output"`
+	Text    string        `json:"text"`
+	Finish  FinishReason  `json:"finish"`
+}
+
+// ErrReplayMismatch means a replay did not reproduce the recording.
+var ErrReplayMismatch = errors.New("replay does not match recording")
+
+// rngTape records the RNG values a generation draws, or plays them back.
+type rngTape struct {
+	replay bool
+	src    rand.Source // recording: the seeded source being taped
+	draws  []int64
+	next   int // replaying: index of the next draw
+}
+
+func (t *rngTape) Int63() int64 {
+	if t.replay {
+		if t.next >= len(t.draws) {
+			return 0 // ran off the tape; the output check reports it
+		}
+		t.next++
+		return t.draws[t.next-1]
+	}
+	v := t.src.Int63()
+	t.draws = append(t.draws, v)
+	return v
+}
+
+func (t *rngTape) Seed(int64) {}
+
+// rng returns the sampler's RNG for one decode pass. Watchdog retries
+// reseed, so a recording tape restarts its source at every pass while the
+// draws keep accumulating in order.
+func (t *rngTape) rng(seed int64) *rand.Rand {
+	if !t.replay {
+		t.src = rand.NewSource(seed)
+	}
+	return rand.New(t)
+}
+
+// Fingerprint is a SHA-256 over the model's config and every weight,
+// computed once. Two models with the same fingerprint decode identically.
+func (m *LlamaModel) Fingerprint() string {
+	m.fpOnce.Do(func() {
+		h := sha256.New()
+		c := &m.Config
+		for _, v := range []int{c.NumLayers, c.EmbedDim, c.NumHeads, c.NumKVHeads, c.HeadDim,
+			c.VocabSize, c.SeqLen, c.IntermSize} {
+			binary.Write(h, binary.LittleEndian, int64(v))
+		}
+		binary.Write(h, binary.LittleEndian, []float32{c.RMSNormEps, c.RopeTheta})
+		binary.Write(h, binary.LittleEndian, c.QKPermuted)
+		w := &m.Weights
+		hashF32(h, w.TokenEmbed, w.OutputNorm, w.Output)
+		for i := range w.Layers {
+			l := &w.Layers[i]
+			hashF32(h, l.AttnNorm, l.FFNNorm, l.BQ, l.BK, l.BV, l.BO)
+			for _, q := range []*QW{&l.WQ, &l.WK, &l.WV, &l.WO, &l.WGate, &l.WUp, &l.WDown} {
+				binary.Write(h, binary.LittleEndian, []int64{int64(q.Dtype), int64(len(q.Packed))})
+				h.Write(q.Packed)
+				hashF32(h, q.F32)
+				if q.I8 != nil {
+					binary.Write(h, binary.LittleEndian, q.I8)
+					hashF32(h, q.Scales)
+				}
+			}
+		}
+		m.fingerprint = hex.EncodeToString(h.Sum(nil))
+	})
+	return m.fingerprint
+}
+
+func hashF32(h hash.Hash, xs ...[]float32) {
+	var buf [4096]byte
+	for _, x := range xs {
+		binary.Write(h, binary.LittleEndian, int64(len(x)))
+		for len(x) > 0 {
+			n := min(len(x), len(buf)/4)
+			for i, f := range x[:n] {
+				binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(f))
+			}
+			h.Write(buf[:4*n])
+			x = x[n:]
+		}
+	}
+}
+
+// record runs decode with a recording tape and attaches the Recording.
+func record(m *LlamaModel, tok *Tokenizer, tokens []int, start int, opts GenOptions) Result {
+	opts.Record = false
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+	tape := &rngTape{}
+	taped := opts
+	taped.tape = tape
+	res := decode(m, tok, tokens, start, taped)
+	res.Recording = &Recording{
+		Version: recordingVersion, Model: m.Fingerprint(),
+		Tokens: slices.Clone(tokens), Opts: opts, Safety: opts.Safety, Draws: tape.draws,
+		Output: slices.Clone(res.Tokens), Text: res.Text, Finish: res.Finish,
+	}
+	return res
+}
+
+// Replay regenerates rec on this engine's model and checks the output
+// matches. A reply cut by MaxTime is replayed without the limit and only
+// the recorded part is compared.
+func (e *Engine) Replay(rec *Recording) (_ Result, err error) {
+	defer e.contain(&err, CrashRequest{Op: "replay"})
+	if rec.Version != recordingVersion {
+		return Result{}, fmt.Errorf("replay: unsupported recording version %d", rec.Version)
+	}
+	if fp := e.Model.Fingerprint(); fp != rec.Model {
+		return Result{}, fmt.Errorf("%w: model %.12s, recorded on %.12s", ErrReplayMismatch, fp, rec.Model)
+	}
+	opts := rec.Opts
+	opts.Record, opts.MaxTime, opts.Nice = false, 0, 0
+	if rec.Safety != nil {
+		opts.Safety = rec.Safety
+	}
+	opts.tape = &rngTape{replay: true, draws: rec.Draws}
+
+	if err := e.lock(); err != nil {
+		return Result{}, err
+	}
+	defer e.unlock()
+	e.claim(nil)
+	e.Model.Reset()
+	res := decode(e.Model, e.Tok, rec.Tokens, 0, opts)
+	got := res.Tokens
+	if rec.Finish == FinishTimeout && len(got) > len(rec.Output) {
+		got = got[:len(rec.Output)]
+	} else if res.Finish != rec.Finish {
+		return res, fmt.Errorf("%w: finished %s, recorded %s", ErrReplayMismatch, res.Finish, rec.Finish)
+	}
+	if !slices.Equal(got, rec.Output) {
+		i := 0
+		for i < len(got) && i < len(rec.Output) && got[i] == rec.Output[i] {
+			i++
+		}
+		return res, fmt.Errorf("%w: diverges at token %d", ErrReplayMismatch, i)
+	}
+	return res, nil
+}
@@ -0,0 +1,59 @@
+package wtf
+
+// retrieve.go — retrieval hook. A prompt (or any chat message) may carry the
+// ContextMarker; before encoding, the engine asks Engine.Retrieve for
+// snippets relevant to the user's question and puts as many as fit in
+// opts.ContextBudget tokens where the marker was, in the order returned.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ContextMarker marks where retrieved snippets go.
+const ContextMarker = "{{context}}"
+
+// DefaultContextBudget is the snippet budget when GenOptions.ContextBudget is 0.
+const DefaultContextBudget = 256
+
+// RetrieveFunc returns context snippets for query, best first.
+type RetrieveFunc func(query string) ([]string, error)
+
+// fillContext replaces the marker in each of texts with the snippets
+// retrieved for query. Texts without the marker are untouched, and nothing
+// is retrieved when none has one. Runs without mu: the host may be slow.
+func (e *Engine) fillContext(query string, texts []*string, opts *GenOptions) error {
+	marked := false
+	for _, t := range texts {
+		marked = marked || strings.Contains(*t, ContextMarker)
+	}
+	if !marked {
+		return nil
+	}
+	var snippets []string
+	if e.Retrieve != nil {
+		var err error
+		if snippets, err = e.Retrieve(strings.ReplaceAll(query, ContextMarker, "")); err != nil {
+			return fmt.Errorf("retrieve: %w", err)
+		}
+	}
+	budget := opts.ContextBudget
+	if budget <= 0 {
+		budget = DefaultContextBudget
+	}
+	var ctx []string
+	for _, s := range snippets {
+		s = strings.TrimSpace(Normalize(s, opts.Normalize))
+		n := len(e.Tok.Encode(s+"\n", false))
+		if s == "" || n > budget {
+			continue
+		}
+		budget -= n
+		ctx = append(ctx, s)
+	}
+	fill := strings.Join(ctx, "\n")
+	for _, t := range texts {
+		*t = strings.ReplaceAll(*t, ContextMarker, fill)
+	}
+	return nil
+}
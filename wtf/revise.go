@@ -0,0 +1,58 @@
+package wtf
+
+// revise.go — draft-and-revise: answer once, then show the model its own
+// draft with a rewrite instruction and keep the second answer. The second
+// pass starts from the first one's KV cache, so it only prefills the draft's
+// tail and the instruction.
+
+// DefaultRevision is the rewrite instruction GenerateRevised uses when given
+// none.
+const DefaultRevision = "rewrite that answer: fix anything wrong, cut the filler, keep the attitude."
+
+// Revision is the outcome of GenerateRevised.
+type Revision struct {
+	Draft Result
+	Final Result // Draft again when the draft came back empty
+}
+
+// GenerateRevised answers msgs with a draft, then appends the draft and
+// instruction as a new exchange and answers again. Both passes run under
+// one hold of the engine. With a nonzero opts.Seed the second pass uses
+// Seed+1.
+func (e *Engine) GenerateRevised(msgs []Message, f ChatFormat, instruction string, opts GenOptions) (Revision, error) {
+	if instruction == "" {
+		instruction = DefaultRevision
+	}
+	msgs, err := e.prepareChat(msgs, &opts)
+	if err != nil {
+		return Revision{}, err
+	}
+	instruction = opts.input(instruction)
+	tokens, err := e.Tok.BuildChat(msgs, f)
+	if err != nil {
+		return Revision{}, err
+	}
+	if err := e.lock(); err != nil {
+		return Revision{}, err
+	}
+	defer e.unlock()
+	e.claim(nil)
+	e.Model.Reset()
+	var rev Revision
+	rev.Draft, err = finishErr(decode(e.Model, e.Tok, tokens, 0, opts), e.Model, len(tokens))
+	if err != nil || rev.Draft.Text == "" {
+		rev.Final = rev.Draft
+		return rev, err
+	}
+
+	msgs = append(msgs[:len(msgs):len(msgs)],
+		Message{RoleAssistant, rev.Draft.Text}, Message{RoleUser, instruction})
+	if tokens, err = e.Tok.BuildChat(msgs, f); err != nil {
+		return rev, err
+	}
+	if opts.Seed != 0 {
+		opts.Seed++
+	}
+	rev.Final, err = finishErr(e.decodeCached(tokens, opts), e.Model, len(tokens))
+	return rev, err
+}
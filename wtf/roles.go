@@ -0,0 +1,88 @@
+package wtf
+
+// roles.go — stop where a chat reply turns into the next turn. Small models
+// love to keep the conversation going on their own: the answer runs on into
+// "### Question:" or "User:" and a made-up question. With RoleHeaders set,
+// the reply ends (FinishStop) as soon as one of them starts a line, and the
+// header is cut off along with the whitespace before it; a reply that runs
+// out of tokens half-way into one loses the half header too. Matching
+// ignores case. GenerateChat and sessions set the headers of their format
+// (ChatHeaders); for ChatML the role markers also stop as special tokens.
+//
+// Like a grace cut, a header is cut from Result.Text, not from pieces
+// already streamed: the piece that completes it is held back, the ones
+// before it are not.
+
+import (
+	"bytes"
+	"strings"
+)
+
+// minPartialHeader is the shortest trailing header prefix cut from a reply
+// that ended without finishing it: shorter ones are too likely to be words.
+const minPartialHeader = 3
+
+// ChatHeaders returns the role headers that start a new turn in format f.
+func ChatHeaders(f ChatFormat) []string {
+	switch f {
+	case ChatML:
+		return []string{"<|im_start|>", "<|im_end|>", "User:"}
+	default:
+		return []string{"### Question:", "### Answer:", "Question:", "User:"}
+	}
+}
+
+// chatStops arms opts for a reply in format f: the format's role headers
+// unless the caller chose their own, and for ChatML the role markers as
+// stop tokens.
+func (t *Tokenizer) chatStops(f ChatFormat, opts *GenOptions) {
+	if opts.RoleHeaders == nil {
+		opts.RoleHeaders = ChatHeaders(f)
+	}
+	if f != ChatML {
+		return
+	}
+	for _, name := range []string{"im_end", "im_start"} {
+		if id := t.FindSpecialToken(name); id >= 0 {
+			opts.StopTokens = append(opts.StopTokens[:len(opts.StopTokens):len(opts.StopTokens)], id)
+		}
+	}
+}
+
+// roleCut returns where out should end if a header starts one of its lines
+// from the one holding byte from on.
+func roleCut(out []byte, headers []string, from int) (int, bool) {
+	for start := bytes.LastIndexByte(out[:from], '\n') + 1; start < len(out); {
+		line := out[start:]
+		for _, h := range headers {
+			if h != "" && len(line) >= len(h) && bytes.EqualFold(line[:len(h)], []byte(h)) {
+				return len(bytes.TrimRight(out[:start], " \t\r\n")), true
+			}
+		}
+		nl := bytes.IndexByte(line, '\n')
+		if nl < 0 {
+			break
+		}
+		start += nl + 1
+	}
+	return 0, false
+}
+
+// rolePartial returns where out should end if its last line is the start
+// of a header.
+func rolePartial(out []byte, headers []string) (int, bool) {
+	nl := bytes.LastIndexByte(out, '\n')
+	if nl < 0 {
+		return 0, false
+	}
+	tail := string(out[nl+1:])
+	if len(tail) < minPartialHeader {
+		return 0, false
+	}
+	for _, h := range headers {
+		if len(tail) < len(h) && strings.EqualFold(tail, h[:len(tail)]) {
+			return len(bytes.TrimRight(out[:nl], " \t\r\n")), true
+		}
+	}
+	return 0, false
+}
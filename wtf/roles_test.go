@@ -0,0 +1,62 @@
+package wtf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoleCut(t *testing.T) {
+	h := ChatHeaders(ChatQA)
+	for _, tc := range []struct {
+		out  string
+		want string // "" with cut false = no cut
+		cut  bool
+	}{
+		{" the sky is blue.\n### Question: why", " the sky is blue.", true},
+		{" blue.\n\nuser: and the sea?", " blue.", true},
+		{" the user: says hi", "", false},
+		{" answer\n### Quest", "", false}, // not yet a whole header
+		{"User: hi", "", true},
+	} {
+		n, ok := roleCut([]byte(tc.out), h, 0)
+		if ok != tc.cut || ok && tc.out[:n] != tc.want {
+			t.Errorf("roleCut(%q) = %q, %v; want %q, %v", tc.out, tc.out[:n], ok, tc.want, tc.cut)
+		}
+	}
+	for _, tc := range []struct{ out, want string }{
+		{" blue.\n### Quest", " blue."},
+		{" blue.\nqu", " blue.\nqu"}, // too short to tell
+		{" blue.\nthe end", " blue.\nthe end"},
+	} {
+		got := tc.out
+		if n, ok := rolePartial([]byte(tc.out), h); ok {
+			got = tc.out[:n]
+		}
+		if got != tc.want {
+			t.Errorf("rolePartial(%q) = %q; want %q", tc.out, got, tc.want)
+		}
+	}
+}
+
+func TestRoleHeadersStop(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(24)
+	free, err := e.Generate("", "the sky", opts)
+	if err != nil || len(free.Text) < 3 {
+		t.Fatalf("free run: %q, %v", free.Text, err)
+	}
+	// Make the reply's own opening a role header (case ignored): the
+	// reply is cut to nothing the moment it is written.
+	header := strings.ToUpper(free.Text[:3])
+	var streamed strings.Builder
+	opts.RoleHeaders = []string{header}
+	opts.OnToken = func(p string) { streamed.WriteString(p) }
+	res, err := e.Generate("", "the sky", opts)
+	if err != nil || res.Finish != FinishStop || res.Text != "" {
+		t.Fatalf("%q, %s, %v", res.Text, res.Finish, err)
+	}
+	if s := streamed.String(); len(s) >= 3 || !strings.HasPrefix(free.Text, s) {
+		t.Fatalf("streamed %q past the header", s)
+	}
+
+}
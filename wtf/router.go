@@ -0,0 +1,259 @@
+package wtf
+
+// router.go — several models behind one entry point. A Router holds named
+// Engines, each a model and its tokenizer loaded by the host, and a list of
+// Routes: a request goes to the first route whose conditions all hold (the
+// persona, the language of the user's text, its length) and otherwise to
+// the default model. A tiny model answers the one-liners, the big one the
+// rants:
+//
+//	{"default": "small",
+//	 "routes": [{"model": "big", "min_bytes": 400},
+//	            {"model": "ru", "languages": ["ru", "uk"]}]}
+//
+// Every model keeps its own queue: an Engine runs one generation at a time,
+// so requests for one model wait only on that model, and Submit uses the
+// routed Engine's async queue.
+//
+// With Budget set, the router keeps the memory its models hold under it.
+// Before a request runs on a released model, the least recently routed
+// others are released until it fits, through the same machinery as the
+// idle policy; every model therefore needs an IdlePolicy.Load. The budget
+// holds at routing time: a request already queued on a model that was
+// released since loads it back regardless.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrUnknownModel is returned for a model name the Router does not hold.
+var ErrUnknownModel = errors.New("unknown model")
+
+// Route sends matching requests to Model. Unset conditions match anything.
+type Route struct {
+	Model     string   `json:"model"`
+	Personas  []string `json:"personas,omitempty"`  // any of these persona names
+	Languages []string `json:"languages,omitempty"` // any of these DetectLanguage codes
+	MinBytes  int      `json:"min_bytes,omitempty"` // text at least this long
+	MaxBytes  int      `json:"max_bytes,omitempty"` // text at most this long; 0 = any length
+}
+
+func (rt *Route) matches(persona, text string) bool {
+	if len(rt.Personas) > 0 && !slices.Contains(rt.Personas, persona) {
+		return false
+	}
+	if len(text) < rt.MinBytes || rt.MaxBytes > 0 && len(text) > rt.MaxBytes {
+		return false
+	}
+	return len(rt.Languages) == 0 || slices.Contains(rt.Languages, DetectLanguage(text).Code)
+}
+
+// RouterConfig is the "router" section of a config file: the models wtfd
+// loads besides its -weights model (which it adds as "main") and the
+// routes between them.
+type RouterConfig struct {
+	Models   map[string]string `json:"models"` // name -> GGUF path, relative to the config file
+	Routes   []Route           `json:"routes"`
+	Default  string            `json:"default"`   // "" = main
+	BudgetMB int               `json:"budget_mb"` // Router.Budget in MB; 0 = no limit
+}
+
+// Router picks an Engine per request. Set Routes, Default and Budget
+// before the first Add; Add and the routing methods are then safe for
+// concurrent use.
+type Router struct {
+	Routes  []Route
+	Default string // model no route claims ("" = the first added)
+	Budget  int64  // bytes of model memory resident at once; 0 = no limit
+
+	mu     sync.Mutex
+	models map[string]*routed
+	order  []string // in Add order
+}
+
+type routed struct {
+	e    *Engine
+	size int64     // resident bytes, measured while loaded
+	used time.Time // last routed to
+}
+
+// Add registers e under name. It measures e's resident size, so e must be
+// loaded; under a Budget it must also be able to reload (Idle.Load set),
+// and it is released at once if the models added before it already fill
+// the budget.
+func (r *Router) Add(name string, e *Engine) error {
+	if name == "" {
+		return errors.New("router: model name must not be empty")
+	}
+	if r.Budget > 0 && e.Idle.Load == nil {
+		return fmt.Errorf("router: model %q: a budget needs Idle.Load to bring released models back", name)
+	}
+	r.mu.Lock()
+	if _, ok := r.models[name]; ok {
+		r.mu.Unlock()
+		return fmt.Errorf("router: model %q added twice", name)
+	}
+	if r.models == nil {
+		r.models = make(map[string]*routed)
+	}
+	m := &routed{e: e, size: e.Model.residentBytes()}
+	total := m.size
+	for _, o := range r.models {
+		if !o.e.Unloaded() {
+			total += o.size
+		}
+	}
+	r.models[name] = m
+	r.order = append(r.order, name)
+	over := r.Budget > 0 && total > r.Budget && len(r.order) > 1
+	r.mu.Unlock()
+	if over {
+		e.Unload()
+	}
+	return nil
+}
+
+// Models returns the model names in the order they were added.
+func (r *Router) Models() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.order)
+}
+
+// Pick returns the model for a request and its Engine, making room for it
+// under the budget. A non-empty model names it outright; otherwise the
+// routes decide on persona and text, the user's own words (not the
+// prompt template around them).
+func (r *Router) Pick(model, persona, text string) (string, *Engine, error) {
+	name, e, evict, err := r.pick(model, persona, text)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, o := range evict {
+		o.Unload() // outside mu: it waits for the model's running call
+	}
+	return name, e, nil
+}
+
+func (r *Router) pick(model, persona, text string) (string, *Engine, []*Engine, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.order) == 0 {
+		return "", nil, nil, fmt.Errorf("%w: router has no models", ErrUnknownModel)
+	}
+	name := model
+	if name == "" {
+		name = r.Default
+		if name == "" {
+			name = r.order[0]
+		}
+		for i := range r.Routes {
+			if r.Routes[i].matches(persona, text) {
+				name = r.Routes[i].Model
+				break
+			}
+		}
+	}
+	m, ok := r.models[name]
+	if !ok {
+		return "", nil, nil, fmt.Errorf("%w %q", ErrUnknownModel, name)
+	}
+	m.used = time.Now()
+	return name, m.e, r.evictFor(name, m), nil
+}
+
+// evictFor returns the least recently used models to release for m to fit
+// the budget. Caller holds mu.
+func (r *Router) evictFor(name string, m *routed) []*Engine {
+	if r.Budget <= 0 || !m.e.Unloaded() {
+		return nil
+	}
+	var loaded []*routed
+	total := m.size
+	for _, o := range r.models {
+		if o != m && !o.e.Unloaded() {
+			loaded = append(loaded, o)
+			total += o.size
+		}
+	}
+	slices.SortFunc(loaded, func(a, b *routed) int { return a.used.Compare(b.used) })
+	var evict []*Engine
+	for _, o := range loaded {
+		if total <= r.Budget {
+			break
+		}
+		evict = append(evict, o.e)
+		total -= o.size
+	}
+	if total > r.Budget {
+		fmt.Fprintf(os.Stderr, "[wtf] router: %q needs %d MB, over the %d MB budget\n", name, total>>20, r.Budget>>20)
+	}
+	return evict
+}
+
+// Generate routes on prompt and runs Engine.Generate on the model picked,
+// returning that model's name with the result.
+func (r *Router) Generate(model, persona, prompt string, opts GenOptions) (Result, string, error) {
+	name, e, err := r.Pick(model, persona, prompt)
+	if err != nil {
+		return Result{}, "", err
+	}
+	res, err := e.Generate(persona, prompt, opts)
+	return res, name, err
+}
+
+// Submit routes req on its prompt and queues it on the picked model.
+func (r *Router) Submit(model string, req Request) (*Future, string, error) {
+	name, e, err := r.Pick(model, req.Persona, req.Prompt)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := e.Submit(req)
+	return f, name, err
+}
+
+// Close closes every model's async queue.
+func (r *Router) Close() {
+	r.mu.Lock()
+	models := make([]*Engine, 0, len(r.models))
+	for _, m := range r.models {
+		models = append(models, m.e)
+	}
+	r.mu.Unlock()
+	for _, e := range models {
+		e.Close()
+	}
+}
+
+// residentBytes estimates the memory the model's weights and KV cache
+// hold. Packed layers of a mapped model are left out: only a couple are
+// resident at a time.
+func (m *LlamaModel) residentBytes() int64 {
+	f32 := func(vs ...[]float32) (n int64) {
+		for _, v := range vs {
+			n += 4 * int64(len(v))
+		}
+		return n
+	}
+	w := &m.Weights
+	n := f32(w.TokenEmbed, w.OutputNorm, m.State.KeyCache, m.State.ValueCache)
+	if len(w.Output) > 0 && (len(w.TokenEmbed) == 0 || &w.Output[0] != &w.TokenEmbed[0]) {
+		n += f32(w.Output)
+	}
+	for i := range w.Layers {
+		l := &w.Layers[i]
+		n += f32(l.AttnNorm, l.FFNNorm, l.BQ, l.BK, l.BV, l.BO)
+		for _, q := range []*QW{&l.WQ, &l.WK, &l.WV, &l.WO, &l.WGate, &l.WUp, &l.WDown} {
+			if m.stream == nil {
+				n += int64(len(q.Packed))
+			}
+			n += f32(q.F32, q.Scales) + int64(len(q.I8))
+		}
+	}
+	return n
+}
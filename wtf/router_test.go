@@ -0,0 +1,74 @@
+package wtf
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	newModel := func() *Engine {
+		e := newTestEngine()
+		e.Idle.Load = func() (*LlamaModel, error) { return newTestModel(e.Tok.VocabSize), nil }
+		return e
+	}
+	small, big, ru := newModel(), newModel(), newModel()
+	size := small.Model.residentBytes()
+	r := &Router{
+		Routes: []Route{
+			{Model: "ru", Languages: []string{"ru", "uk"}},
+			{Model: "big", MinBytes: 40},
+			{Model: "big", Personas: []string{"ranter"}},
+		},
+		Default: "small",
+		Budget:  size + size/2, // one model at a time
+	}
+	for name, e := range map[string]*Engine{"small": small, "big": big, "ru": ru} {
+		if err := r.Add(name, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loaded := 0
+	for _, e := range []*Engine{small, big, ru} {
+		if !e.Unloaded() {
+			loaded++
+		}
+	}
+	if loaded != 1 {
+		t.Fatalf("%d models resident after Add, budget fits 1", loaded)
+	}
+
+	for _, tc := range []struct{ model, persona, text, want string }{
+		{"", "", "is rust worth it", "small"},
+		{"", "", strings.Repeat("why is everything broken ", 3), "big"},
+		{"", "ranter", "hi", "big"},
+		{"", "", "почему всё сломано", "ru"},
+		{"small", "", strings.Repeat("long ", 20), "small"},
+	} {
+		name, e, err := r.Pick(tc.model, tc.persona, tc.text)
+		if err != nil || name != tc.want || e != r.models[tc.want].e {
+			t.Errorf("Pick(%q, %q, %q) = %q, %v; want %q", tc.model, tc.persona, tc.text, name, err, tc.want)
+		}
+	}
+	if _, _, err := r.Pick("huge", "", "hi"); !errors.Is(err, ErrUnknownModel) {
+		t.Fatalf("unknown model: %v", err)
+	}
+
+	// Routing to a released model releases the others first.
+	res, name, err := r.Generate("", "", strings.Repeat("the sky ", 6), greedyOpts(4))
+	if err != nil || name != "big" || len(res.Tokens) == 0 {
+		t.Fatalf("Generate: %q, %v", name, err)
+	}
+	if big.Unloaded() || !small.Unloaded() || !ru.Unloaded() {
+		t.Fatal("budget not kept: big should be the only model resident")
+	}
+
+	// The server routes generate calls and honours an explicit model.
+	srv := &Server{Engine: small, Defaults: greedyOpts(4), Router: r}
+	if rep := srv.Handle(Call{Op: "generate", Model: "small", Prompt: "the sky"}, nil); rep.Error != "" || small.Unloaded() {
+		t.Fatalf("generate on small: %+v", rep)
+	}
+	if rep := srv.Handle(Call{Op: "generate", Model: "huge", Prompt: "the sky"}, nil); !strings.Contains(rep.Error, ErrUnknownModel.Error()) {
+		t.Fatalf("generate on an unknown model: %+v", rep)
+	}
+}
@@ -0,0 +1,83 @@
+package wtf
+
+// runahead.go — speculative forward pass of the likeliest next token. While
+// the decode loop samples, decodes and streams token i, the model's worker
+// goroutine already runs the forward pass for the argmax candidate at the next
+// position. If the sampler picks that token the pass is done and its logits
+// are adopted; otherwise the real token's forward pass simply overwrites the
+// KV row the guess wrote, so there is nothing else to roll back.
+//
+// The guess runs on its own scratch buffers but writes the model's KV cache,
+// so it must be waited for before anything else touches the model.
+
+import "runtime"
+
+// runAhead is the speculative pass's scratch state: its own activations and
+// logits, the model's KV cache and RoPE tables.
+type runAhead struct {
+	m       *LlamaModel
+	s       LlamaState
+	guess   int
+	pos     int
+	pending bool
+	work    chan *runAhead // to the worker
+	done    chan struct{}  // from the worker, once per start
+	cleanup runtime.Cleanup
+}
+
+// runAhead returns the model's speculative scratch, allocating it and
+// starting its worker once. The worker lives as long as the model: it
+// holds the model only while a pass runs, and a cleanup closes its inbox
+// once the model is collected (a dropped Fork, say).
+func (m *LlamaModel) runAhead() *runAhead {
+	if m.ahead == nil {
+		s := allocScratch(&m.Config)
+		s.KeyCache, s.ValueCache = m.State.KeyCache, m.State.ValueCache
+		s.CosCache, s.SinCache = m.State.CosCache, m.State.SinCache
+		r := &runAhead{m: m, s: s, work: make(chan *runAhead), done: make(chan struct{})}
+		go runAheadWorker(r.work)
+		r.cleanup = runtime.AddCleanup(m, func(work chan *runAhead) { close(work) }, r.work)
+		m.ahead = r
+	}
+	return m.ahead
+}
+
+// runAheadWorker runs each pass it is handed, then reports on its done.
+func runAheadWorker(work <-chan *runAhead) {
+	for r := range work {
+		r.m.forwardState(&r.s, r.guess, r.pos, true)
+		r.done <- struct{}{}
+	}
+}
+
+// stop ends the worker of a model that lives on without its scratch (see
+// Engine.release). No pass may be running.
+func (r *runAhead) stop() {
+	r.cleanup.Stop()
+	close(r.work)
+}
+
+// start runs the forward pass for guess at pos in the background.
+func (r *runAhead) start(guess, pos int) {
+	r.guess, r.pos, r.pending = guess, pos, true
+	r.work <- r
+}
+
+// finish waits for the speculative pass, if one is running, and reports
+// whether it already computed Forward(token, pos). When it did, its hidden
+// state and logits become the model's, as if Forward had run.
+func (r *runAhead) finish(token, pos int) bool {
+	if r == nil || !r.pending {
+		return false
+	}
+	<-r.done
+	r.pending = false
+	if token != r.guess || pos != r.pos {
+		return false
+	}
+	st := &r.m.State
+	copy(st.X, r.s.X)
+	copy(st.Logits, r.s.Logits)
+	st.track(token, pos)
+	return true
+}
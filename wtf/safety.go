@@ -0,0 +1,231 @@
+package wtf
+
+// safety.go — an output screen driven by a lexicon file. Each category is a
+// list of words, phrases and regexps with its own action: "mask" vetoes the
+// token that would complete a match, so the step is resampled while there is
+// still a choice, and "redact" replaces matches in the finished reply.
+//
+// Lexicon format, one entry per line:
+//
+//	# comment
+//	[slurs] mask
+//	some word
+//	a whole phrase
+//	re:h[a4]te?ful
+//	[threats] redact off
+//
+// Words and phrases match case-insensitively on word boundaries. A header
+// ending in "off" loads the category disabled; Enable and Disable toggle
+// categories on a copy of the filter.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// SafetyAction is what a category does with a match.
+type SafetyAction string
+
+const (
+	SafetyMask   SafetyAction = "mask"   // resample the token completing a match
+	SafetyRedact SafetyAction = "redact" // replace matches in Result.Text
+)
+
+// Redaction replaces redacted matches.
+const Redaction = "[redacted]"
+
+// safetyTail is how much of the reply so far a mask check looks back over,
+// in bytes. Matches longer than this are only caught by redaction.
+const safetyTail = 128
+
+// SafetyCategory is one lexicon section.
+type SafetyCategory struct {
+	Name    string
+	Action  SafetyAction
+	Enabled bool
+	rules   []*regexp.Regexp
+}
+
+// SafetyFilter is a loaded lexicon. It is immutable once built, so one
+// filter can be shared by every call; set it on GenOptions.Safety.
+type SafetyFilter struct {
+	Categories []SafetyCategory
+}
+
+// LoadSafetyLexicon reads a lexicon file.
+func LoadSafetyLexicon(path string) (*SafetyFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("safety lexicon: %w", err)
+	}
+	defer f.Close()
+	return ParseSafetyLexicon(f)
+}
+
+// ParseSafetyLexicon parses the lexicon format described above.
+func ParseSafetyLexicon(r io.Reader) (*SafetyFilter, error) {
+	sf := &SafetyFilter{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			c, err := parseSafetyHeader(line)
+			if err != nil {
+				return nil, fmt.Errorf("safety lexicon line %d: %w", n, err)
+			}
+			sf.Categories = append(sf.Categories, c)
+			continue
+		}
+		if len(sf.Categories) == 0 {
+			return nil, fmt.Errorf("safety lexicon line %d: entry before any [category]", n)
+		}
+		expr := "(?i)"
+		if re, ok := strings.CutPrefix(line, "re:"); ok {
+			expr += re
+		} else {
+			expr += wordBound(line[0]) + regexp.QuoteMeta(line) + wordBound(line[len(line)-1])
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("safety lexicon line %d: %w", n, err)
+		}
+		c := &sf.Categories[len(sf.Categories)-1]
+		c.rules = append(c.rules, re)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("safety lexicon: %w", err)
+	}
+	return sf, nil
+}
+
+func parseSafetyHeader(line string) (SafetyCategory, error) {
+	name, rest, ok := strings.Cut(line[1:], "]")
+	if !ok || strings.TrimSpace(name) == "" {
+		return SafetyCategory{}, fmt.Errorf("bad category header %q", line)
+	}
+	c := SafetyCategory{Name: strings.TrimSpace(name), Action: SafetyMask, Enabled: true}
+	for _, f := range strings.Fields(rest) {
+		switch f {
+		case "mask", "redact":
+			c.Action = SafetyAction(f)
+		case "off":
+			c.Enabled = false
+		default:
+			return c, fmt.Errorf("category %q: unknown option %q", c.Name, f)
+		}
+	}
+	return c, nil
+}
+
+// safetyCategoryJSON is a SafetyCategory with its rules as regexp source,
+// for recordings.
+type safetyCategoryJSON struct {
+	Name    string       `json:"name"`
+	Action  SafetyAction `json:"action"`
+	Enabled bool         `json:"enabled"`
+	Rules   []string     `json:"rules"`
+}
+
+func (c SafetyCategory) MarshalJSON() ([]byte, error) {
+	j := safetyCategoryJSON{Name: c.Name, Action: c.Action, Enabled: c.Enabled}
+	for _, re := range c.rules {
+		j.Rules = append(j.Rules, re.String())
+	}
+	return json.Marshal(j)
+}
+
+func (c *SafetyCategory) UnmarshalJSON(b []byte) error {
+	var j safetyCategoryJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	*c = SafetyCategory{Name: j.Name, Action: j.Action, Enabled: j.Enabled}
+	for _, r := range j.Rules {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return fmt.Errorf("safety category %q: %w", j.Name, err)
+		}
+		c.rules = append(c.rules, re)
+	}
+	return nil
+}
+
+// wordBound anchors a literal at a word boundary when it starts or ends
+// with a word character.
+func wordBound(b byte) string {
+	if b == '_' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' {
+		return `\b`
+	}
+	return ""
+}
+
+// Enable returns a copy of the filter with the named categories switched on.
+func (sf *SafetyFilter) Enable(names ...string) *SafetyFilter { return sf.toggle(names, true) }
+
+// Disable returns a copy of the filter with the named categories switched off.
+func (sf *SafetyFilter) Disable(names ...string) *SafetyFilter { return sf.toggle(names, false) }
+
+func (sf *SafetyFilter) toggle(names []string, on bool) *SafetyFilter {
+	out := &SafetyFilter{Categories: slices.Clone(sf.Categories)}
+	for i := range out.Categories {
+		if slices.Contains(names, out.Categories[i].Name) {
+			out.Categories[i].Enabled = on
+		}
+	}
+	return out
+}
+
+// blocks reports whether appending piece to the reply so far would complete
+// a match of an enabled mask category.
+func (sf *SafetyFilter) blocks(out []byte, piece string) bool {
+	if sf == nil || piece == "" {
+		return false
+	}
+	tail := out[max(len(out)-safetyTail, 0):]
+	text := string(tail) + piece
+	for i := range sf.Categories {
+		c := &sf.Categories[i]
+		if !c.Enabled || c.Action != SafetyMask {
+			continue
+		}
+		for _, re := range c.rules {
+			for _, loc := range re.FindAllStringIndex(text, -1) {
+				if loc[1] > len(tail) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Redact replaces matches of every enabled redact category and returns the
+// text and the number of replacements.
+func (sf *SafetyFilter) Redact(text string) (string, int) {
+	if sf == nil {
+		return text, 0
+	}
+	n := 0
+	for i := range sf.Categories {
+		c := &sf.Categories[i]
+		if !c.Enabled || c.Action != SafetyRedact {
+			continue
+		}
+		for _, re := range c.rules {
+			text = re.ReplaceAllStringFunc(text, func(string) string {
+				n++
+				return Redaction
+			})
+		}
+	}
+	return text, n
+}
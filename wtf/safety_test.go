@@ -0,0 +1,67 @@
+package wtf
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseSafetyLexicon(t *testing.T) {
+	sf, err := ParseSafetyLexicon(strings.NewReader(`
+# lines we do not cross
+[names] redact
+bob
+re:al+ice
+[quiet] redact off
+loud
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sf.Categories) != 2 || sf.Categories[1].Enabled || sf.Categories[0].Action != SafetyRedact {
+		t.Fatalf("categories %+v", sf.Categories)
+	}
+	got, n := sf.Redact("Bob and alllice, bobby, LOUD")
+	if want := "[redacted] and [redacted], bobby, LOUD"; got != want || n != 2 {
+		t.Fatalf("Redact = %q, %d; want %q", got, n, want)
+	}
+	got, n = sf.Enable("quiet").Disable("names").Redact("Bob is loud")
+	if got != "Bob is [redacted]" || n != 1 {
+		t.Fatalf("toggled Redact = %q, %d", got, n)
+	}
+	if sf.Categories[1].Enabled || !sf.Categories[0].Enabled {
+		t.Fatal("toggling changed the original filter")
+	}
+
+	for _, bad := range []string{"bob\n", "[x] shout\nbob\n", "[x]\nre:(\n"} {
+		if _, err := ParseSafetyLexicon(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestSafetyFilter(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(16)
+	res, err := e.Generate("", "the sky", opts)
+	if err != nil || len(res.Tokens) == 0 {
+		t.Fatalf("baseline: %v %v", res.Tokens, err)
+	}
+	word := e.Tok.DecodeToken(res.Tokens[0])
+	lexicon := "re:" + regexp.QuoteMeta(word) + "\n"
+
+	opts.Safety, err = ParseSafetyLexicon(strings.NewReader("[x] mask\n" + lexicon))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ = e.Generate("", "the sky", opts)
+	if strings.Contains(res.Text, word) || res.Finish == FinishVeto {
+		t.Fatalf("mask leaked %q: %q (%s)", word, res.Text, res.Finish)
+	}
+
+	opts.Safety, _ = ParseSafetyLexicon(strings.NewReader("[x] redact\n" + lexicon))
+	res, _ = e.Generate("", "the sky", opts)
+	if strings.Contains(res.Text, word) || res.Redacted == 0 || !strings.Contains(res.Text, Redaction) {
+		t.Fatalf("redact %q: %q (%d)", word, res.Text, res.Redacted)
+	}
+}
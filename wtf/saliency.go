@@ -0,0 +1,157 @@
+package wtf
+
+// saliency.go — which parts of the prompt a reply came from, for "why did
+// the oracle say this" tooltips. Leave-one-out: the prompt is cut into spans
+// (words or sentences), each span is dropped in turn, and the reply is
+// scored — teacher-forced, nothing sampled — against what remains. A span
+// matters as much as the reply's log-likelihood falls without it.
+//
+// Unlike attention rollout this measures the output, not a proxy for it,
+// and works the same on every layer layout. It costs one pass over prompt
+// and reply per span; MaxSpans bounds that by merging neighbouring units.
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SaliencyUnit is what the prompt is cut into.
+type SaliencyUnit int
+
+const (
+	SaliencyWords     SaliencyUnit = iota // whitespace-separated words
+	SaliencySentences                     // up to . ! ? or a line break
+)
+
+// SaliencyOptions configures Saliency.
+type SaliencyOptions struct {
+	Unit     SaliencyUnit
+	MaxSpans int // neighbouring units are merged down to this many (0 = 32)
+
+	// Wrap, when set, turns the text being explained into the prompt the
+	// model sees (e.g. QuestionPrompt); spans stay offsets into the text.
+	Wrap func(string) string `json:"-"`
+}
+
+// SaliencySpan is one span's influence on the reply.
+type SaliencySpan struct {
+	Start int    `json:"start"` // byte offsets into the prompt text
+	End   int    `json:"end"`
+	Text  string `json:"text"`
+	// Score is how much less likely (nats, summed over the reply's tokens)
+	// the reply is without the span. Negative: the reply is likelier
+	// without it.
+	Score float64 `json:"score"`
+	// Weight is the span's share of all positive scores, 0..1.
+	Weight float64 `json:"weight"`
+}
+
+// Saliency is the result of Engine.Saliency.
+type Saliency struct {
+	LogProb float64        `json:"logprob"` // the reply's log-likelihood given the whole prompt
+	Spans   []SaliencySpan `json:"spans"`   // in prompt order
+}
+
+// Saliency explains reply (as generated for prompt under the named persona,
+// "" = raw) by leaving out one span of prompt at a time. Pass prompt as the
+// engine saw it: after normalization and scrubbing.
+func (e *Engine) Saliency(persona, prompt, reply string, o SaliencyOptions) (Saliency, error) {
+	target := e.Tok.Encode(reply, false)
+	if len(target) == 0 {
+		return Saliency{}, fmt.Errorf("saliency: %w: reply has no tokens", ErrEmptyPrompt)
+	}
+	wrap := o.Wrap
+	if wrap == nil {
+		wrap = func(s string) string { return s }
+	}
+	if err := e.lock(); err != nil {
+		return Saliency{}, err
+	}
+	defer e.unlock()
+	base, err := e.replyLogProb(persona, wrap(prompt), target)
+	if err != nil {
+		return Saliency{}, fmt.Errorf("saliency: %w", err)
+	}
+	s := Saliency{LogProb: base}
+	var total float64
+	for _, sp := range saliencySpans(prompt, o) {
+		lp, err := e.replyLogProb(persona, wrap(prompt[:sp[0]]+prompt[sp[2]:]), target)
+		if err != nil {
+			return Saliency{}, fmt.Errorf("saliency: %w", err)
+		}
+		span := SaliencySpan{Start: sp[0], End: sp[1], Text: prompt[sp[0]:sp[1]], Score: base - lp}
+		total += max(span.Score, 0)
+		s.Spans = append(s.Spans, span)
+	}
+	if total > 0 {
+		for i := range s.Spans {
+			s.Spans[i].Weight = max(s.Spans[i].Score, 0) / total
+		}
+	}
+	return s, nil
+}
+
+// replyLogProb is log P(reply | persona, prompt), teacher-forced. Caller
+// holds mu.
+func (e *Engine) replyLogProb(persona, prompt string, reply []int) (float64, error) {
+	tokens, err := e.evalLocked(persona, prompt, len(reply))
+	if err != nil {
+		return 0, err
+	}
+	m := e.Model
+	vocab := m.Config.VocabSize
+	lp := logProb(m.State.Logits, vocab, reply[0])
+	for j := 1; j < len(reply); j++ {
+		m.Forward(reply[j-1], len(tokens)+j-1)
+		lp += logProb(m.State.Logits, vocab, reply[j])
+	}
+	return lp, nil
+}
+
+// saliencySpans cuts text into units and merges neighbours down to
+// o.MaxSpans. Each span is {start, end, cut}: text[start:end] is what it
+// shows, text[start:cut] what leaving it out removes (its trailing space
+// too, so the words either side do not run together).
+func saliencySpans(text string, o SaliencyOptions) [][3]int {
+	var units [][2]int
+	start := -1
+	for i, c := range text {
+		if start < 0 && !unicode.IsSpace(c) {
+			start = i
+		}
+		if start < 0 {
+			continue
+		}
+		next := i + utf8.RuneLen(c)
+		switch {
+		case o.Unit == SaliencyWords && unicode.IsSpace(c):
+			units = append(units, [2]int{start, i})
+			start = -1
+		case o.Unit == SaliencySentences && (c == '\n' || strings.ContainsRune(".!?", c) &&
+			(next == len(text) || !strings.ContainsRune(".!?", rune(text[next])))):
+			units = append(units, [2]int{start, next})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		units = append(units, [2]int{start, len(text)})
+	}
+
+	n := o.MaxSpans
+	if n <= 0 {
+		n = 32
+	}
+	per := max((len(units)+n-1)/n, 1)
+	var spans [][3]int
+	for i := 0; i < len(units); i += per {
+		end := len(strings.TrimRightFunc(text[:units[min(i+per, len(units))-1][1]], unicode.IsSpace))
+		cut := end
+		for cut < len(text) && unicode.IsSpace(rune(text[cut])) {
+			cut++
+		}
+		spans = append(spans, [3]int{units[i][0], end, cut})
+	}
+	return spans
+}
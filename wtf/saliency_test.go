@@ -0,0 +1,52 @@
+package wtf
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSaliency(t *testing.T) {
+	e := newTestEngine()
+	prompt := "why is the sky blue? tell me now."
+	res, err := e.Generate("", QuestionPrompt(prompt), greedyOpts(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sal, err := e.Saliency("", prompt, res.Text, SaliencyOptions{Wrap: QuestionPrompt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	words := []string{"why", "is", "the", "sky", "blue?", "tell", "me", "now."}
+	if len(sal.Spans) != len(words) {
+		t.Fatalf("%d spans, want one per word: %+v", len(sal.Spans), sal.Spans)
+	}
+	var weights float64
+	for i, sp := range sal.Spans {
+		if sp.Text != words[i] || prompt[sp.Start:sp.End] != sp.Text {
+			t.Fatalf("span %d = %+v, want %q", i, sp, words[i])
+		}
+		weights += sp.Weight
+	}
+	if math.Abs(weights-1) > 1e-9 && weights != 0 {
+		t.Fatalf("weights sum to %v", weights)
+	}
+
+	// A span's score is exactly the log-likelihood lost by leaving it out.
+	e.mu.Lock()
+	without, err := e.replyLogProb("", QuestionPrompt("why is the blue? tell me now."), e.Tok.Encode(res.Text, false))
+	e.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sal.Spans[3].Score; math.Abs(got-(sal.LogProb-without)) > 1e-9 {
+		t.Fatalf("score of %q = %v, want %v", "sky", got, sal.LogProb-without)
+	}
+
+	merged, err := e.Saliency("", prompt, res.Text, SaliencyOptions{Unit: SaliencySentences, MaxSpans: 1, Wrap: QuestionPrompt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.Spans) != 1 || merged.Spans[0].Text != prompt {
+		t.Fatalf("two sentences merged into one span: %+v", merged.Spans)
+	}
+}
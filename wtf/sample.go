@@ -6,9 +6,10 @@ package wtf
 // No allocations in the hot path — all buffers reused per token.
 
 import (
+	"cmp"
 	"math"
 	"math/rand"
-	"sort"
+	"slices"
 	"time"
 )
 
@@ -31,6 +32,12 @@ type idxProb struct {
 	prob float32
 }
 
+// byProbDesc orders candidates most probable first. A named func, unlike
+// sort.Slice's closure and swapper, costs no allocation per call.
+func byProbDesc(a, b idxProb) int {
+	return cmp.Compare(b.prob, a.prob)
+}
+
 // NewSampleBuffers creates pre-allocated sampling buffers for the given vocab size.
 func NewSampleBuffers(vocab int) *SampleBuffers {
 	return &SampleBuffers{
@@ -121,9 +128,7 @@ func SampleTopP(logits []float32, vocab int, temp float32, topP float32, sb *Sam
 	}
 
 	// Sort by probability descending (cache-friendly struct slice)
-	sort.Slice(sb.candidates[:vocab], func(i, j int) bool {
-		return sb.candidates[i].prob > sb.candidates[j].prob
-	})
+	slices.SortFunc(sb.candidates[:vocab], byProbDesc)
 
 	// Find nucleus and sample
 	var cumsum float32
@@ -144,6 +149,21 @@ func SampleTopP(logits []float32, vocab int, temp float32, topP float32, sb *Sam
 	return sb.candidates[0].idx
 }
 
+// ApplyMinP masks every logit whose probability at temperature temp is below
+// minP times the most likely token's (p_i < minP·p_max ⇔ l_i < l_max + T·ln minP).
+func ApplyMinP(logits []float32, vocab int, temp, minP float32) {
+	maxv := logits[0]
+	for i := 1; i < vocab; i++ {
+		maxv = max(maxv, logits[i])
+	}
+	cut := maxv + temp*float32(math.Log(float64(minP)))
+	for i := 0; i < vocab; i++ {
+		if logits[i] < cut {
+			logits[i] = -1e30
+		}
+	}
+}
+
 // Argmax returns the index of the largest value in logits[:n].
 func Argmax(logits []float32, n int) int {
 	best := 0
@@ -0,0 +1,149 @@
+package wtf
+
+// score.go — scoring instead of sampling. Choose prefills the prompt once and
+// measures how likely the model finds each candidate continuation; Prob
+// reads a yes/no score straight off the next-token logits. Nothing is
+// free-generated, so a verdict is always one of the answers.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Choice is the outcome of Choose.
+type Choice struct {
+	Index    int       // the most likely option
+	Option   string    // options[Index]
+	Probs    []float64 // per option, normalized over the options
+	LogProbs []float64 // per option: sum of its tokens' log-probabilities
+}
+
+// Choose scores each option as a continuation of prompt under the named
+// persona ("" = raw) and returns the likeliest. Options are encoded on their
+// own, so give them the leading space the model would write ("  yes" vs
+// "yes"). Probs compare whole-option likelihoods, which favours short
+// options; keep the choices comparable in length.
+func (e *Engine) Choose(persona, prompt string, options []string) (_ Choice, err error) {
+	defer e.contain(&err, CrashRequest{Op: "choose", Persona: persona, PromptBytes: len(prompt)})
+	if len(options) == 0 {
+		return Choice{}, errors.New("choose: no options")
+	}
+	opts := make([][]int, len(options))
+	longest := 0
+	for i, o := range options {
+		if opts[i] = e.Tok.Encode(o, false); len(opts[i]) == 0 {
+			return Choice{}, fmt.Errorf("choose: option %d is empty", i)
+		}
+		longest = max(longest, len(opts[i]))
+	}
+
+	if err := e.lock(); err != nil {
+		return Choice{}, err
+	}
+	defer e.unlock()
+	tokens, err := e.evalLocked(persona, prompt, longest)
+	if err != nil {
+		return Choice{}, err
+	}
+	m := e.Model
+	vocab := m.Config.VocabSize
+	first := append([]float32(nil), m.State.Logits[:vocab]...)
+
+	c := Choice{Probs: make([]float64, len(options)), LogProbs: make([]float64, len(options))}
+	for i, o := range opts {
+		lp := logProb(first, vocab, o[0])
+		for j := 1; j < len(o); j++ {
+			m.Forward(o[j-1], len(tokens)+j-1)
+			lp += logProb(m.State.Logits, vocab, o[j])
+		}
+		c.LogProbs[i] = lp
+		if lp > c.LogProbs[c.Index] {
+			c.Index = i
+		}
+	}
+	var z float64
+	for i, lp := range c.LogProbs {
+		c.Probs[i] = math.Exp(lp - c.LogProbs[c.Index])
+		z += c.Probs[i]
+	}
+	for i := range c.Probs {
+		c.Probs[i] /= z
+	}
+	c.Option = options[c.Index]
+	return c, nil
+}
+
+// Prob returns P(yes) / (P(yes) + P(no)) for the token right after prompt
+// under the named persona ("" = raw): a calibrated 0..1 score from the
+// model's own next-token distribution, restricted to two answer tokens.
+// The score is the softmax over the pair's raw logits; the rest of the
+// vocab does not dilute it.
+func (e *Engine) Prob(persona, prompt string, yes, no int) (_ float64, err error) {
+	defer e.contain(&err, CrashRequest{Op: "prob", Persona: persona, PromptBytes: len(prompt)})
+	vocab := e.Model.Config.VocabSize
+	if yes < 0 || yes >= vocab || no < 0 || no >= vocab || yes == no {
+		return 0, fmt.Errorf("prob: answer tokens %d/%d invalid for vocab %d", yes, no, vocab)
+	}
+	if err := e.lock(); err != nil {
+		return 0, err
+	}
+	defer e.unlock()
+	if _, err := e.evalLocked(persona, prompt, 0); err != nil {
+		return 0, err
+	}
+	l := e.Model.State.Logits
+	return 1 / (1 + math.Exp(float64(l[no]-l[yes]))), nil
+}
+
+// evalLocked puts persona's anchor (if any) and prompt through the model,
+// leaving the next-token logits in State.Logits, with room for extra more
+// tokens after it. Returns the tokens evaluated. Caller holds mu.
+func (e *Engine) evalLocked(persona, prompt string, extra int) ([]int, error) {
+	e.claim(nil)
+	m := e.Model
+	tokens, start := e.Tok.bosPrefix(), 0
+	if persona != "" {
+		p, ok := e.personas[persona]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownPersona, persona)
+		}
+		if err := e.resolve(p, nil); err != nil {
+			return nil, err
+		}
+		tokens, start = append([]int(nil), p.tokens...), len(p.tokens)
+	}
+	tokens = append(tokens, e.Tok.Encode(prompt, false)...)
+	if len(tokens) == 0 {
+		return nil, ErrEmptyPrompt
+	}
+	if len(tokens)+extra > m.Config.SeqLen {
+		return nil, fmt.Errorf("%w: %d tokens, context is %d", ErrContextOverflow, len(tokens)+extra, m.Config.SeqLen)
+	}
+	if persona != "" {
+		e.personas[persona].loadPrefix(m)
+	} else {
+		m.Reset()
+	}
+	if start == len(tokens) {
+		start-- // anchor alone: recompute its last row for the logits
+	}
+	for pos := start; pos < len(tokens)-1; pos++ {
+		m.prefill(tokens[pos], pos)
+	}
+	m.Forward(tokens[len(tokens)-1], len(tokens)-1)
+	return tokens, nil
+}
+
+// logProb is log softmax(logits)[id] over the first vocab entries.
+func logProb(logits []float32, vocab, id int) float64 {
+	maxv := logits[0]
+	for i := 1; i < vocab; i++ {
+		maxv = max(maxv, logits[i])
+	}
+	var z float64
+	for i := 0; i < vocab; i++ {
+		z += math.Exp(float64(logits[i] - maxv))
+	}
+	return float64(logits[id]-maxv) - math.Log(z)
+}
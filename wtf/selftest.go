@@ -0,0 +1,215 @@
+package wtf
+
+// selftest.go — is the loaded model the model it claims to be? A corrupt or
+// truncated download still parses, and then shows up as mysteriously
+// terrible replies instead of an error. SelfTest runs a battery after load:
+// every weight is scanned for NaN and Inf (packed matrices dequantized a
+// slice at a time), a fixture set is round-tripped through the tokenizer,
+// and a fixed greedy reply is hashed so it can be checked against the hash
+// recorded for this model's fingerprint on a known-good install.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// SelfTestOptions configures SelfTest.
+type SelfTestOptions struct {
+	Fixtures []string // tokenizer round-trip texts (nil = selfTestFixtures)
+	Prompt   string   // the greedy generation's question ("" = selfTestPrompt)
+	Tokens   int      // its length in tokens (0 = 32)
+	Golden   string   // the expected ReplyHash ("" = report it, compare nothing)
+}
+
+// SelfTestCheck is one check's outcome.
+type SelfTestCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// SelfTestReport is the result of SelfTest.
+type SelfTestReport struct {
+	Model     string          `json:"model"`      // Fingerprint
+	Reply     string          `json:"reply"`      // the greedy reply
+	ReplyHash string          `json:"reply_hash"` // SHA-256 over its token ids
+	Checks    []SelfTestCheck `json:"checks"`
+	OK        bool            `json:"ok"` // every check passed
+}
+
+// selfTestFixtures cover what the tokenizer must get right for the oracle:
+// plain English, punctuation runs, code, whitespace, non-Latin scripts and
+// emoji (the last two exercise byte fallback).
+var selfTestFixtures = []string{
+	"what is the meaning of life?",
+	"lmao. bro really said \"it works on my machine\"...",
+	"func main() { fmt.Println(\"segfault\") }",
+	"  leading spaces,\ttabs and\nnew lines  ",
+	"Привет, как дела?",
+	"日本語のテキスト",
+	"ship it 🔥🚀",
+}
+
+// selfTestPrompt is the question the deterministic reply answers.
+const selfTestPrompt = "why does my code work?"
+
+// SelfTest runs the integrity battery. Errors are reported as failed
+// checks, never returned; the engine is left ready for normal use.
+func (e *Engine) SelfTest(o SelfTestOptions) SelfTestReport {
+	if err := e.lock(); err != nil {
+		return SelfTestReport{Checks: []SelfTestCheck{{Name: "load", Detail: err.Error()}}}
+	}
+	defer e.unlock()
+	r := SelfTestReport{Model: e.Model.Fingerprint()}
+	r.Checks = append(r.Checks, e.Model.checkWeights())
+
+	fixtures := o.Fixtures
+	if fixtures == nil {
+		fixtures = selfTestFixtures
+	}
+	r.Checks = append(r.Checks, e.Tok.checkRoundTrip(fixtures))
+
+	prompt := o.Prompt
+	if prompt == "" {
+		prompt = selfTestPrompt
+	}
+	opts := DefaultGenOptions()
+	opts.MaxTokens = 32
+	if o.Tokens > 0 {
+		opts.MaxTokens = o.Tokens
+	}
+	opts.Temp = 0
+	opts.Grace.Limit = 0
+	e.claim(nil)
+	res := Generate(e.Model, e.Tok, QuestionPrompt(prompt), opts)
+	r.Reply, r.ReplyHash = res.Text, hashTokens(res.Tokens)
+
+	gen := SelfTestCheck{Name: "generation", OK: len(res.Tokens) > 0}
+	switch {
+	case !gen.OK:
+		gen.Detail = fmt.Sprintf("no tokens (finish: %s)", res.Finish)
+	case o.Golden == "":
+		gen.Detail = "no stored hash for this model; reply hash " + r.ReplyHash
+	case o.Golden != r.ReplyHash:
+		gen.OK = false
+		gen.Detail = fmt.Sprintf("reply hash %s, want %s", r.ReplyHash, o.Golden)
+	}
+	r.Checks = append(r.Checks, gen)
+
+	r.OK = true
+	for _, c := range r.Checks {
+		r.OK = r.OK && c.OK
+	}
+	return r
+}
+
+// layerVectors and layerMatrices name a layer's weights in checkWeights'
+// order, as the GGUF tensors are named.
+var (
+	layerVectors  = []string{"attn_norm", "ffn_norm", "attn_q.bias", "attn_k.bias", "attn_v.bias", "attn_output.bias"}
+	layerMatrices = []string{"attn_q", "attn_k", "attn_v", "attn_output", "ffn_gate", "ffn_up", "ffn_down"}
+)
+
+// checkWeights scans every weight for NaN and Inf.
+func (m *LlamaModel) checkWeights() SelfTestCheck {
+	c := SelfTestCheck{Name: "weights", OK: true}
+	var bad []string
+	note := func(name string, n int) {
+		if n > 0 {
+			bad = append(bad, fmt.Sprintf("%s: %d", name, n))
+		}
+	}
+	w := &m.Weights
+	note("token_embd", countNonFinite(w.TokenEmbed))
+	note("output_norm", countNonFinite(w.OutputNorm))
+	if len(w.Output) == 0 || len(w.TokenEmbed) == 0 || &w.Output[0] != &w.TokenEmbed[0] {
+		note("output", countNonFinite(w.Output))
+	}
+	for i := range w.Layers {
+		l := &w.Layers[i]
+		for j, x := range [][]float32{l.AttnNorm, l.FFNNorm, l.BQ, l.BK, l.BV, l.BO} {
+			note(fmt.Sprintf("blk.%d.%s", i, layerVectors[j]), countNonFinite(x))
+		}
+		for j, q := range []*QW{&l.WQ, &l.WK, &l.WV, &l.WO, &l.WGate, &l.WUp, &l.WDown} {
+			n, err := q.countNonFinite()
+			if err != nil {
+				bad = append(bad, fmt.Sprintf("blk.%d.%s: %v", i, layerMatrices[j], err))
+				continue
+			}
+			note(fmt.Sprintf("blk.%d.%s", i, layerMatrices[j]), n)
+		}
+	}
+	if len(bad) > 0 {
+		c.OK = false
+		c.Detail = "non-finite values in " + strings.Join(bad, ", ")
+	}
+	return c
+}
+
+// countNonFinite counts the NaN and ±Inf entries of w, dequantizing packed
+// rows a chunk at a time so the scan never holds the dense matrix.
+func (w *QW) countNonFinite() (int, error) {
+	if w.I8 != nil {
+		return countNonFinite(w.Scales), nil
+	}
+	if w.Packed == nil {
+		return countNonFinite(w.F32), nil
+	}
+	if w.M <= 0 || len(w.Packed)%w.M != 0 {
+		return 0, fmt.Errorf("%d packed bytes for %d rows", len(w.Packed), w.M)
+	}
+	rowBytes := len(w.Packed) / w.M
+	rows := max(1<<20/max(w.K, 1), 1)
+	n := 0
+	for r := 0; r < w.M; r += rows {
+		k := min(rows, w.M-r)
+		x, err := dequantToF32(w.Packed[r*rowBytes:(r+k)*rowBytes], uint32(w.Dtype), k*w.K)
+		if err != nil {
+			return 0, err
+		}
+		n += countNonFinite(x)
+	}
+	return n, nil
+}
+
+func countNonFinite(x []float32) int {
+	n := 0
+	for _, v := range x {
+		if f := float64(v); math.IsNaN(f) || math.IsInf(f, 0) {
+			n++
+		}
+	}
+	return n
+}
+
+// checkRoundTrip encodes and decodes each fixture, expecting it back byte
+// for byte.
+func (t *Tokenizer) checkRoundTrip(fixtures []string) SelfTestCheck {
+	c := SelfTestCheck{Name: "tokenizer", OK: true}
+	var bad []string
+	for _, f := range fixtures {
+		ids := t.Encode(f, false)
+		if got := t.Decode(ids); got != f {
+			bad = append(bad, fmt.Sprintf("%q → %q", f, got))
+		}
+	}
+	if len(bad) > 0 {
+		c.OK = false
+		c.Detail = fmt.Sprintf("%d of %d fixtures differ after a round trip: %s",
+			len(bad), len(fixtures), strings.Join(bad, "; "))
+	}
+	return c
+}
+
+// hashTokens is the hex SHA-256 of ids as little-endian int32s.
+func hashTokens(ids []int) string {
+	h := sha256.New()
+	for _, id := range ids {
+		binary.Write(h, binary.LittleEndian, int32(id))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,52 @@
+package wtf
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	e := newTestEngine()
+	fixtures := []string{"what is the sky?", "  a b\nc  "}
+	r := e.SelfTest(SelfTestOptions{Fixtures: fixtures, Tokens: 8})
+	if !r.OK || r.ReplyHash == "" || r.Model != e.Model.Fingerprint() {
+		t.Fatalf("clean model failed: %+v", r)
+	}
+	// The stored hash of a good run is matched by the next one.
+	again := e.SelfTest(SelfTestOptions{Fixtures: fixtures, Tokens: 8, Golden: r.ReplyHash})
+	if !again.OK || again.Reply != r.Reply {
+		t.Fatalf("rerun against its own hash: %+v", again)
+	}
+	bad := e.SelfTest(SelfTestOptions{Fixtures: fixtures, Tokens: 8, Golden: strings.Repeat("0", 64)})
+	if bad.OK {
+		t.Fatal("wrong stored hash passed")
+	}
+
+	// The ASCII test vocab cannot spell Cyrillic.
+	if r := e.SelfTest(SelfTestOptions{Fixtures: []string{"привет"}, Tokens: 8}); r.OK || r.Checks[1].OK {
+		t.Fatalf("lossy round trip passed: %+v", r.Checks)
+	}
+}
+
+func TestSelfTestNonFinite(t *testing.T) {
+	e := newTestEngine()
+	l := &e.Model.Weights.Layers[0]
+	l.AttnNorm[3] = float32(math.NaN())
+	// A packed matrix is scanned through the dequant kernel.
+	q := &l.WUp
+	packed := make([]byte, 4*len(q.F32))
+	for i, v := range q.F32 {
+		if i == len(q.F32)-1 {
+			v = float32(math.Inf(1))
+		}
+		binary.LittleEndian.PutUint32(packed[4*i:], math.Float32bits(v))
+	}
+	q.Packed, q.F32 = packed, nil
+
+	c := e.Model.checkWeights()
+	if c.OK || !strings.Contains(c.Detail, "blk.0.attn_norm: 1") || !strings.Contains(c.Detail, "blk.0.ffn_up: 1") {
+		t.Fatalf("checkWeights = %+v", c)
+	}
+}
@@ -0,0 +1,242 @@
+package wtf
+
+// serve.go — the request/reply layer the long-running front ends share
+// (wtfd over a Unix socket, the stdio JSON-RPC mode). A Server owns the
+// default GenOptions; a request's "opts" object is laid over them, so a
+// client only sends the knobs it wants to change.
+//
+// The socket protocol frames each message as a 4-byte big-endian length
+// followed by that many bytes of JSON. A client writes one Call and reads
+// Replies with the same id until one has Done set; with Stream, every piece
+// of the reply arrives in its own frame first.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxFrame bounds one protocol frame.
+const MaxFrame = 16 << 20
+
+// Call is one protocol request.
+type Call struct {
+	ID       string          `json:"id,omitempty"`
+	Op       string          `json:"op"`                 // generate | encode | embed | style | saliency | model | health
+	Persona  string          `json:"persona,omitempty"`  // generate: "" = raw
+	Model    string          `json:"model,omitempty"`    // generate: a Server.Router model ("" = routed)
+	Prompt   string          `json:"prompt,omitempty"`   // generate prompt, or text to encode / embed / style-check
+	Question string          `json:"question,omitempty"` // generate, saliency: wrapped by QuestionPrompt instead of Prompt
+	Text     string          `json:"text,omitempty"`     // saliency: the reply to explain
+	Opts     json.RawMessage `json:"opts,omitempty"`     // GenOptions fields over the server defaults
+	Stream   bool            `json:"stream,omitempty"`
+
+	// budget > 0 caps the tokens a generate call may produce, grace
+	// included: what the caller's quota has left (see httpapi.go).
+	budget int
+}
+
+// Reply is one response frame.
+type Reply struct {
+	ID     string       `json:"id,omitempty"`
+	Piece  string       `json:"piece,omitempty"` // streamed text
+	Done   bool         `json:"done,omitempty"`  // last frame for this id
+	Text   string       `json:"text,omitempty"`
+	Tokens []int        `json:"tokens,omitempty"`
+	Finish FinishReason `json:"finish,omitempty"`
+	Vector []float32    `json:"vector,omitempty"`
+	Style  *StyleReport `json:"style,omitempty"` // style op, or generate under opts.Style
+
+	ToolCall *ToolCall     `json:"tool_call,omitempty"` // generate under opts.ToolCalls
+	Saliency *Saliency     `json:"saliency,omitempty"`
+	Model    *Provenance   `json:"model,omitempty"`  // model op
+	Health   *HealthReport `json:"health,omitempty"` // health op
+	Error    string        `json:"error,omitempty"`
+}
+
+// Server answers Requests on an Engine. Safe for concurrent use; requests
+// take turns on the engine.
+type Server struct {
+	Engine   *Engine
+	Defaults GenOptions
+
+	// OnResult, when set, sees every finished generation (see webhook.go).
+	OnResult func(Call, Result)
+
+	// Health, if set, answers the health op; otherwise the engine does.
+	Health *Health
+
+	// Router, if set, picks the engine for each generate request (see
+	// router.go); every other op runs on Engine.
+	Router *Router
+}
+
+// ErrUnknownOp is returned for a Call.Op the server does not implement.
+var ErrUnknownOp = errors.New("unknown op")
+
+// Handle runs req. stream gets each piece of a generate reply as it is
+// decoded when req.Stream is set; it may be nil otherwise.
+func (s *Server) Handle(req Call, stream func(Reply)) Reply {
+	r, err := s.handle(req, stream)
+	r.ID, r.Done = req.ID, true
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+func (s *Server) handle(req Call, stream func(Reply)) (_ Reply, err error) {
+	defer s.Engine.contain(&err, CrashRequest{Op: req.Op, Persona: req.Persona,
+		PromptBytes: len(req.Prompt) + len(req.Question) + len(req.Text)})
+	for _, text := range []string{req.Prompt, req.Question, req.Text} {
+		if err := s.Engine.checkLen(text); err != nil {
+			return Reply{}, err
+		}
+	}
+	switch req.Op {
+	case "generate":
+		opts := s.Defaults
+		if len(req.Opts) > 0 {
+			if err := json.Unmarshal(req.Opts, &opts); err != nil {
+				return Reply{}, fmt.Errorf("opts: %w", err)
+			}
+		}
+		// Filters the server runs with are not the client's to lift, nor
+		// are its limits on length and time.
+		opts.ScrubPII |= s.Defaults.ScrubPII
+		opts.Injection = max(opts.Injection, s.Defaults.Injection)
+		opts.Strip |= s.Defaults.Strip
+		if s.Defaults.MaxTokens > 0 {
+			opts.MaxTokens = min(opts.MaxTokens, s.Defaults.MaxTokens)
+			opts.Grace.Limit = min(opts.Grace.Limit, s.Defaults.Grace.Limit)
+		}
+		if s.Defaults.MaxTime > 0 && (opts.MaxTime <= 0 || opts.MaxTime > s.Defaults.MaxTime) {
+			opts.MaxTime = s.Defaults.MaxTime
+		}
+		if req.budget > 0 {
+			opts.MaxTokens = min(opts.MaxTokens, req.budget)
+			opts.Grace.Limit = max(min(opts.Grace.Limit, req.budget-opts.MaxTokens), 0)
+		}
+		if req.Stream && stream != nil {
+			opts.OnToken = func(piece string) { stream(Reply{ID: req.ID, Piece: piece}) }
+		}
+		prompt := req.Prompt
+		if req.Question != "" {
+			prompt = QuestionPrompt(req.Question)
+			if opts.RoleHeaders == nil {
+				opts.RoleHeaders = ChatHeaders(ChatQA)
+			}
+		}
+		e := s.Engine
+		if s.Router != nil {
+			text := req.Prompt
+			if req.Question != "" {
+				text = req.Question
+			}
+			if _, e, err = s.Router.Pick(req.Model, req.Persona, text); err != nil {
+				return Reply{}, err
+			}
+		} else if req.Model != "" {
+			return Reply{}, fmt.Errorf("%w %q: server has no router", ErrUnknownModel, req.Model)
+		}
+		res, err := e.Generate(req.Persona, prompt, opts)
+		if err != nil {
+			return Reply{}, err
+		}
+		if s.OnResult != nil {
+			// The hook sees the input the way the engine did.
+			req.Prompt = ScrubPII(req.Prompt, opts.ScrubPII)
+			req.Question = ScrubPII(req.Question, opts.ScrubPII)
+			s.OnResult(req, res)
+		}
+		return Reply{Text: res.Text, Tokens: res.Tokens, Finish: res.Finish, Style: res.Style, ToolCall: res.ToolCall}, nil
+	case "encode":
+		return Reply{Tokens: s.Engine.Tok.Encode(req.Prompt, false)}, nil
+	case "embed":
+		v, err := s.Engine.Embed(req.Prompt)
+		return Reply{Vector: v}, err
+	case "saliency":
+		o, prompt := SaliencyOptions{}, req.Prompt
+		if req.Question != "" {
+			o.Wrap, prompt = QuestionPrompt, req.Question
+		}
+		sal, err := s.Engine.Saliency(req.Persona, prompt, req.Text, o)
+		if err != nil {
+			return Reply{}, err
+		}
+		return Reply{Saliency: &sal}, nil
+	case "style":
+		rep := OracleStyle().Score(req.Prompt)
+		return Reply{Style: &rep}, nil
+	case "model":
+		p := s.Engine.provenance()
+		return Reply{Model: &p}, nil
+	case "health":
+		rep := s.Engine.Health()
+		if s.Health != nil {
+			rep = s.Health.Report()
+		}
+		return Reply{Health: &rep}, nil
+	}
+	return Reply{}, fmt.Errorf("%w %q", ErrUnknownOp, req.Op)
+}
+
+// WriteFrame writes v as one length-prefixed JSON frame.
+func WriteFrame(w io.Writer, v any) error {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(blob) > MaxFrame {
+		return fmt.Errorf("frame of %d bytes exceeds MaxFrame", len(blob))
+	}
+	buf := make([]byte, 4+len(blob))
+	binary.BigEndian.PutUint32(buf, uint32(len(blob)))
+	copy(buf[4:], blob)
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadFrame reads one length-prefixed JSON frame into v. io.EOF means the
+// peer closed cleanly between frames.
+func ReadFrame(r io.Reader, v any) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > MaxFrame {
+		return fmt.Errorf("frame of %d bytes exceeds MaxFrame", n)
+	}
+	blob := make([]byte, n)
+	if _, err := io.ReadFull(r, blob); err != nil {
+		return err
+	}
+	return json.Unmarshal(blob, v)
+}
+
+// ServeConn answers framed requests on rw until the peer closes it.
+// Requests on one connection run in order.
+func (s *Server) ServeConn(rw io.ReadWriter) error {
+	for {
+		var req Call
+		if err := ReadFrame(rw, &req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		var werr error
+		send := func(r Reply) {
+			if werr == nil {
+				werr = WriteFrame(rw, r)
+			}
+		}
+		send(s.Handle(req, send))
+		if werr != nil {
+			return werr
+		}
+	}
+}
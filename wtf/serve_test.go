@@ -0,0 +1,238 @@
+package wtf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeConn(t *testing.T) {
+	e := newTestEngine()
+	srv := &Server{Engine: e, Defaults: greedyOpts(8)}
+	want, err := e.Generate("", "the sky", greedyOpts(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, conn := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- srv.ServeConn(conn); conn.Close() }()
+
+	call := func(req Call) (pieces []string, last Reply) {
+		if err := WriteFrame(client, req); err != nil {
+			t.Fatal(err)
+		}
+		for !last.Done {
+			var r Reply
+			if err := ReadFrame(client, &r); err != nil {
+				t.Fatal(err)
+			}
+			if r.ID != req.ID {
+				t.Fatalf("reply for %q to request %q", r.ID, req.ID)
+			}
+			if r.Done {
+				last = r
+			} else {
+				pieces = append(pieces, r.Piece)
+			}
+		}
+		return pieces, last
+	}
+
+	pieces, r := call(Call{ID: "1", Op: "generate", Prompt: "the sky", Opts: []byte(`{"MaxTokens": 4}`), Stream: true})
+	if r.Error != "" || r.Text != want.Text || strings.Join(pieces, "") != want.Text {
+		t.Fatalf("generate: %+v, pieces %q; want %q", r, pieces, want.Text)
+	}
+	if _, r = call(Call{ID: "2", Op: "encode", Prompt: "the sky"}); len(r.Tokens) == 0 || r.Error != "" {
+		t.Fatalf("encode: %+v", r)
+	}
+	if _, r = call(Call{ID: "3", Op: "embed", Prompt: "the sky"}); len(r.Vector) != e.Model.Config.EmbedDim {
+		t.Fatalf("embed: %+v", r)
+	}
+	if _, r = call(Call{ID: "4", Op: "dance"}); !strings.Contains(r.Error, ErrUnknownOp.Error()) {
+		t.Fatalf("unknown op: %+v", r)
+	}
+	if _, r = call(Call{ID: "5", Op: "generate", Persona: "nobody", Prompt: "x"}); r.Error == "" {
+		t.Fatal("unknown persona accepted")
+	}
+	long, _ := e.Generate("", "the sky", greedyOpts(8))
+	if _, r = call(Call{ID: "6", Op: "generate", Prompt: "the sky", Opts: []byte(`{"MaxTokens": 100}`)}); r.Text != long.Text {
+		t.Fatalf("MaxTokens over the server's: %q, want %q", r.Text, long.Text)
+	}
+	client.Close()
+	if err := <-done; err != nil && !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("ServeConn: %v", err)
+	}
+}
+
+func TestServeJSONRPC(t *testing.T) {
+	e := newTestEngine()
+	srv := &Server{Engine: e, Defaults: greedyOpts(4)}
+	want, err := e.Generate("", "the sky", greedyOpts(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := strings.Join([]string{
+		`{"jsonrpc":"2.0","id":1,"method":"generate","params":{"prompt":"the sky","stream":true}}`,
+		`{"jsonrpc":"2.0","method":"encode","params":{"prompt":"quiet"}}`,
+		`{"jsonrpc":"2.0","id":"b","method":"encode","params":{"prompt":"the sky"}}`,
+		`{"jsonrpc":"2.0","id":3,"method":"dance"}`,
+		`{"jsonrpc":"2.0","id":4,"method":"generate","params":{"persona":"nobody"}}`,
+		`not json`,
+	}, "\n")
+	var out bytes.Buffer
+	if err := srv.ServeJSONRPC(strings.NewReader(in), &out); err != nil {
+		t.Fatal(err)
+	}
+	var pieces strings.Builder
+	var results []rpcResponse
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var m struct {
+			rpcResponse
+			Method string   `json:"method"`
+			Params rpcToken `json:"params"`
+		}
+		if err := dec.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Method == "token" {
+			pieces.WriteString(m.Params.Piece)
+			continue
+		}
+		results = append(results, m.rpcResponse)
+	}
+	if len(results) != 5 {
+		t.Fatalf("%d responses, want 5 (the notification gets none)", len(results))
+	}
+	if r := results[0]; r.Result == nil || r.Result.Text != want.Text || pieces.String() != want.Text || string(r.ID) != "1" {
+		t.Fatalf("generate: %+v, streamed %q; want %q", r, pieces.String(), want.Text)
+	}
+	if r := results[1]; r.Result == nil || len(r.Result.Tokens) == 0 || string(r.ID) != `"b"` {
+		t.Fatalf("encode: %+v", r)
+	}
+	for i, code := range []int{rpcMethodNotFound, rpcServerError, rpcParseError} {
+		if r := results[2+i]; r.Error == nil || r.Error.Code != code {
+			t.Errorf("response %d: %+v, want code %d", 2+i, r, code)
+		}
+	}
+}
+
+func TestServeMCP(t *testing.T) {
+	e := newTestEngine()
+	// The real anchor outgrows the test model's context; the name is what counts.
+	if err := e.RegisterPersona(OraclePersona, "be rude.", SamplerOverrides{}); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Engine: e, Defaults: greedyOpts(4)}
+	want, err := e.Generate(OraclePersona, QuestionPrompt("is go cringe"), greedyOpts(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := strings.Join([]string{
+		`{"jsonrpc":"2.0","id":0,"method":"initialize","params":{"protocolVersion":"2024-11-05","capabilities":{},"clientInfo":{"name":"t","version":"0"}}}`,
+		`{"jsonrpc":"2.0","method":"notifications/initialized"}`,
+		`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`,
+		`{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"consult_wtforacle","arguments":{"question":"is go cringe"}}}`,
+		`{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"consult_wtforacle","arguments":{}}}`,
+		`{"jsonrpc":"2.0","id":4,"method":"resources/list"}`,
+	}, "\n")
+	var out bytes.Buffer
+	if err := srv.ServeMCP(strings.NewReader(in), &out); err != nil {
+		t.Fatal(err)
+	}
+	type resp struct {
+		ID     int             `json:"id"`
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	var rs []resp
+	for dec := json.NewDecoder(&out); dec.More(); {
+		var r resp
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		rs = append(rs, r)
+	}
+	if len(rs) != 5 {
+		t.Fatalf("%d responses, want 5", len(rs))
+	}
+	if !strings.Contains(string(rs[0].Result), MCPProtocolVersion) || !strings.Contains(string(rs[1].Result), MCPTool) {
+		t.Fatalf("initialize / tools/list: %s / %s", rs[0].Result, rs[1].Result)
+	}
+	var call mcpToolResult
+	json.Unmarshal(rs[2].Result, &call)
+	if call.IsError || len(call.Content) != 1 || call.Content[0].Text != want.Text {
+		t.Fatalf("tools/call: %s; want %q", rs[2].Result, want.Text)
+	}
+	json.Unmarshal(rs[3].Result, &call)
+	if !call.IsError {
+		t.Fatalf("empty question: %s", rs[3].Result)
+	}
+	if rs[4].Error == nil || rs[4].Error.Code != rpcMethodNotFound {
+		t.Fatalf("unknown method: %+v", rs[4])
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	os.WriteFile(path, []byte(`{"keys": {"k": {"daily_tokens": 100}, "low": {"daily_tokens": 2}}}`), 0o644)
+	q, err := LoadQuotas(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := (&Server{Engine: newTestEngine(), Defaults: greedyOpts(4)}).HTTPHandler(q)
+	post := func(key, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/call", strings.NewReader(body))
+		req.Header.Set("X-API-Key", key)
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := post("nope", `{"op": "generate", "prompt": "the sky"}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown key: %d", rec.Code)
+	}
+	if rec := post("k", `{"op": `); rec.Code != http.StatusBadRequest {
+		t.Fatalf("broken call: %d", rec.Code)
+	}
+	rec := post("k", `{"op": "generate", "prompt": "the sky"}`)
+	var r Reply
+	if err := json.NewDecoder(rec.Body).Decode(&r); err != nil || r.Error != "" || !r.Done {
+		t.Fatalf("generate: %d %+v %v", rec.Code, r, err)
+	}
+	if left := q.Remaining("k"); left != 100-len(r.Tokens) || len(r.Tokens) == 0 {
+		t.Fatalf("%d tokens left after a %d-token reply", left, len(r.Tokens))
+	}
+	left := q.Remaining("k")
+	if rec := post("k", `{"op": "encode", "prompt": "the sky"}`); rec.Code != http.StatusOK || q.Remaining("k") != left {
+		t.Fatalf("encode: %d, %d tokens left of %d", rec.Code, q.Remaining("k"), left)
+	}
+
+	// A reply never outruns the quota, grace included.
+	rec = post("low", `{"op": "generate", "prompt": "the sky", "opts": {"MaxTokens": 4, "Grace": {"Limit": 8}}}`)
+	r = Reply{}
+	if err := json.NewDecoder(rec.Body).Decode(&r); err != nil || r.Error != "" || len(r.Tokens) != 2 {
+		t.Fatalf("generate on 2 tokens left: %d %+v %v", rec.Code, r, err)
+	}
+	if rec := post("low", `{"op": "generate", "prompt": "the sky"}`); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("spent key: %d", rec.Code)
+	}
+}
+
+func TestServeTimeCeiling(t *testing.T) {
+	defaults := greedyOpts(4)
+	defaults.MaxTime = time.Nanosecond
+	srv := &Server{Engine: newTestEngine(), Defaults: defaults}
+	r := srv.Handle(Call{Op: "generate", Prompt: "the sky", Opts: []byte(`{"MaxTime": 0}`)}, nil)
+	if r.Error != "" || r.Finish != FinishTimeout {
+		t.Fatalf("MaxTime lifted by the client: %+v", r)
+	}
+}
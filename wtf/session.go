@@ -0,0 +1,276 @@
+package wtf
+
+// session.go — multi-turn conversations that outlive the process. A Session
+// is the message history plus the sampler settings; every turn re-encodes
+// the history and reuses whatever prefix of it the KV cache still holds, so
+// a session that was idle (or imported) just re-prefills on its next turn.
+//
+// Export serializes the session to a JSON blob — optionally with its KV rows,
+// which skips that re-prefill when the blob is imported into an identical
+// model.
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Session is one conversation on an Engine. Not safe for concurrent use;
+// different sessions on the same Engine are.
+type Session struct {
+	Format   ChatFormat
+	Opts     GenOptions
+	Messages []Message // system (optional) + alternating turns
+	Turn     int       // completed turns; offsets Opts.Seed per turn
+
+	// Summarize folds old turns into Summary as the history nears the
+	// context limit (see summary.go).
+	Summarize     SummaryPolicy
+	Summary       string // the folded turns, said after the system message
+	SummaryTokens int    // prefilled and generated by summarizing so far
+
+	// Facts are rendered after the system message, within FactBudget
+	// tokens (0 = DefaultFactBudget); see facts.go.
+	Facts      []string
+	FactBudget int
+
+	e      *Engine
+	tokens []int // what the KV cache held after the last turn
+}
+
+// NewSession starts a conversation. system may be empty.
+func (e *Engine) NewSession(system string, f ChatFormat, opts GenOptions) *Session {
+	s := &Session{Format: f, Opts: opts, e: e}
+	if system != "" {
+		s.Messages = []Message{{RoleSystem, system}}
+	}
+	return s
+}
+
+// Send adds the user's message (normalized and scrubbed per Opts.Normalize
+// and Opts.ScrubPII), generates the reply and records it.
+func (s *Session) Send(text string) (_ Result, err error) {
+	defer s.e.contain(&err, CrashRequest{Op: "session", PromptBytes: len(text), MaxTokens: s.Opts.MaxTokens})
+	opts := s.Opts
+	text, err = s.e.admit(text, &opts)
+	if err != nil {
+		return Result{}, err
+	}
+	opts.Language.resolve(text)
+	msgs := append(s.Messages[:len(s.Messages):len(s.Messages)], Message{RoleUser, text})
+	tokens, err := s.chatPrompt(msgs, &opts)
+	if err != nil {
+		return Result{}, err
+	}
+	if opts.Seed != 0 {
+		opts.Seed += int64(s.Turn)
+	}
+	s.e.Tok.chatStops(s.Format, &opts)
+	s.e.armTools(&opts)
+
+	if err := s.e.lock(); err != nil {
+		return Result{}, err
+	}
+	defer s.e.unlock()
+	if s.e.owner != s {
+		s.e.claim(s)
+		if s.e.Store != nil {
+			if p, perr := s.e.Store.take(s); perr == nil && p != nil {
+				s.e.Model.restoreKV(p)
+				p.release()
+			}
+		}
+	}
+	if s.Summarize.due(len(tokens), &opts, s.e.Model.Config.SeqLen) {
+		if msgs, err = s.compress(msgs); err == nil {
+			tokens, err = s.chatPrompt(msgs, &opts)
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	res := s.e.cached(s.e.cacheKey(tokens, opts), opts, func() Result { return s.e.decodeCached(tokens, opts) })
+	res, err = finishErr(res, s.e.Model, len(tokens))
+	s.tokens = slices.Clone(s.e.Model.State.Tokens)
+	if err != nil {
+		return res, err
+	}
+	s.Messages = append(msgs, Message{RoleAssistant, res.Text})
+	s.Turn++
+	return res, nil
+}
+
+// chatPrompt encodes msgs for a turn: the system message with its template
+// variables resolved, then the session's facts and summary. Messages keep
+// none of that.
+func (s *Session) chatPrompt(msgs []Message, opts *GenOptions) ([]int, error) {
+	prompt := msgs
+	facts := s.factBlock()
+	if msgs[0].Role == RoleSystem || facts != "" || s.Summary != "" {
+		prompt = slices.Clone(msgs)
+		if prompt[0].Role != RoleSystem {
+			prompt = slices.Insert(prompt, 0, Message{Role: RoleSystem})
+		}
+		system := s.e.expand(prompt[0].Content, opts.Vars)
+		if facts != "" {
+			system += "\n" + facts
+		}
+		if s.Summary != "" {
+			system += "\n" + summaryLead + s.Summary
+		}
+		prompt[0].Content = strings.TrimLeft(system, "\n")
+	}
+	return s.e.Tok.BuildChat(prompt, s.Format)
+}
+
+// Close releases the session's parked KV rows, if any. The session must not
+// be used afterwards.
+func (s *Session) Close() {
+	s.e.mu.Lock()
+	defer s.e.mu.Unlock()
+	if s.e.owner == s {
+		s.e.owner = nil
+	}
+	if s.e.Store != nil {
+		s.e.Store.drop(s)
+	}
+}
+
+// decodeCached decodes tokens on top of the longest prefix of them the KV
+// cache already holds. Caller holds mu.
+func (e *Engine) decodeCached(tokens []int, opts GenOptions) Result {
+	n := 0
+	for n < len(tokens) && n < len(e.Model.State.Tokens) && tokens[n] == e.Model.State.Tokens[n] {
+		n++
+	}
+	if n == 0 {
+		e.Model.Reset()
+	}
+	return decode(e.Model, e.Tok, tokens, n, opts)
+}
+
+// sessionVersion is bumped on incompatible blob changes.
+const sessionVersion = 1
+
+// ErrSessionVersion means the blob was written by an incompatible version.
+var ErrSessionVersion = errors.New("unsupported session version")
+
+type sessionBlob struct {
+	Version  int        `json:"version"`
+	Format   ChatFormat `json:"format"`
+	Opts     GenOptions `json:"opts"`
+	Messages []Message  `json:"messages"`
+	Turn     int        `json:"turn"`
+	KV       *kvBlob    `json:"kv,omitempty"`
+
+	Summarize SummaryPolicy `json:"summarize"`
+	Summary   string        `json:"summary,omitempty"`
+
+	Facts      []string `json:"facts,omitempty"`
+	FactBudget int      `json:"fact_budget,omitempty"`
+}
+
+// kvBlob is a kvPrefix plus the shape it was taken from. k and v are
+// little-endian float32, base64.
+type kvBlob struct {
+	Layers int    `json:"layers"`
+	KVDim  int    `json:"kv_dim"`
+	Tokens []int  `json:"tokens"`
+	K      string `json:"k"`
+	V      string `json:"v"`
+}
+
+// Export serializes the session. With withKV, the KV rows are included when
+// the engine's cache still holds this session's last turn (otherwise they
+// are silently left out and the importer re-prefills).
+func (s *Session) Export(withKV bool) ([]byte, error) {
+	b := sessionBlob{
+		Version: sessionVersion, Format: s.Format, Opts: s.Opts,
+		Messages: s.Messages, Turn: s.Turn, Summarize: s.Summarize, Summary: s.Summary,
+		Facts: s.Facts, FactBudget: s.FactBudget,
+	}
+	if withKV && len(s.tokens) > 0 {
+		s.e.mu.Lock()
+		st := s.e.Model.State.Tokens
+		if len(st) >= len(s.tokens) && slices.Equal(st[:len(s.tokens)], s.tokens) {
+			p := s.e.Model.snapshotKV(len(s.tokens))
+			k, v := p.flat()
+			p.release()
+			cfg := &s.e.Model.Config
+			b.KV = &kvBlob{
+				Layers: cfg.NumLayers, KVDim: cfg.NumKVHeads * cfg.HeadDim,
+				Tokens: p.tokens, K: encodeF32(k), V: encodeF32(v),
+			}
+		}
+		s.e.mu.Unlock()
+	}
+	return json.Marshal(b)
+}
+
+// ImportSession restores a session from Export's blob. KV rows are loaded
+// into the cache when present and the model shape matches; otherwise they
+// are ignored and the next Send re-prefills.
+func (e *Engine) ImportSession(blob []byte) (*Session, error) {
+	var b sessionBlob
+	if err := json.Unmarshal(blob, &b); err != nil {
+		return nil, fmt.Errorf("session: %w", err)
+	}
+	if b.Version != sessionVersion {
+		return nil, fmt.Errorf("%w: %d", ErrSessionVersion, b.Version)
+	}
+	s := &Session{Format: b.Format, Opts: b.Opts, Messages: b.Messages, Turn: b.Turn,
+		Summarize: b.Summarize, Summary: b.Summary, Facts: b.Facts, FactBudget: b.FactBudget, e: e}
+	if kv := b.KV; kv != nil {
+		cfg := &e.Model.Config
+		n := len(kv.Tokens)
+		k, kerr := decodeF32(kv.K)
+		v, verr := decodeF32(kv.V)
+		if kerr == nil && verr == nil && kv.Layers == cfg.NumLayers &&
+			kv.KVDim == cfg.NumKVHeads*cfg.HeadDim && n < cfg.SeqLen &&
+			len(k) == n*kv.Layers*kv.KVDim && len(v) == len(k) && e.importKV(s, kv.Tokens, k, v) == nil {
+			s.tokens = kv.Tokens
+		}
+	}
+	return s, nil
+}
+
+// importKV loads the flat K and V rows of tokens into the cache as s's.
+func (e *Engine) importKV(s *Session, tokens []int, k, v []float32) error {
+	if err := e.lock(); err != nil {
+		return err
+	}
+	defer e.unlock()
+	e.claim(s)
+	p := e.Model.prefixFromFlat(len(tokens), k, v, tokens)
+	e.Model.restoreKV(p)
+	p.release()
+	return nil
+}
+
+func encodeF32(x []float32) string {
+	buf := make([]byte, 4*len(x))
+	for i, f := range x {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(f))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+func decodeF32(s string) ([]float32, error) {
+	buf, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf)%4 != 0 {
+		return nil, errors.New("kv data not a whole number of float32s")
+	}
+	x := make([]float32, len(buf)/4)
+	for i := range x {
+		x[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return x, nil
+}
@@ -0,0 +1,90 @@
+package wtf
+
+import "testing"
+
+func sessionOpts() GenOptions {
+	opts := greedyOpts(6)
+	opts.Grace.Limit = 0
+	return opts
+}
+
+func TestSessionReusesCache(t *testing.T) {
+	e := newTestEngine()
+	s := e.NewSession("be rude.", ChatQA, sessionOpts())
+	if _, err := s.Send("a?"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.Send("b?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Turn two must prefill only what the cache did not already hold.
+	full, _ := e.Tok.BuildChat(s.Messages[:len(s.Messages)-1], ChatQA)
+	if res.PromptTokens >= len(full) {
+		t.Fatalf("prefilled %d of %d prompt tokens; cache not reused", res.PromptTokens, len(full))
+	}
+	cold, _ := e.GenerateChat(s.Messages[:len(s.Messages)-1], ChatQA, sessionOpts())
+	if cold.Text != res.Text {
+		t.Fatalf("cached turn %q != cold %q", res.Text, cold.Text)
+	}
+	if len(s.Messages) != 5 || s.Turn != 2 {
+		t.Fatalf("history has %d messages after %d turns", len(s.Messages), s.Turn)
+	}
+}
+
+func TestSessionExportImport(t *testing.T) {
+	e := newTestEngine()
+	s := e.NewSession("be rude.", ChatQA, sessionOpts())
+	s.Send("a?")
+	s.Send("b?")
+
+	// Export both blobs first: the reference turn below moves the cache on.
+	blobs := map[bool][]byte{}
+	for _, withKV := range []bool{false, true} {
+		blob, err := s.Export(withKV)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blobs[withKV] = blob
+	}
+	turnTokens := len(s.tokens)
+	want, _ := s.Send("c?")
+
+	for withKV, blob := range blobs {
+		other := newTestEngine() // fresh process, same weights
+		s2, err := other.ImportSession(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if withKV != (len(other.Model.State.Tokens) > 0) {
+			t.Fatalf("withKV=%v: cache holds %d tokens after import", withKV, len(other.Model.State.Tokens))
+		}
+		got, err := s2.Send("c?")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if withKV && got.PromptTokens >= turnTokens {
+			t.Fatalf("imported KV not reused: prefilled %d tokens", got.PromptTokens)
+		}
+		if got.Text != want.Text {
+			t.Fatalf("withKV=%v: imported session said %q, original %q", withKV, got.Text, want.Text)
+		}
+	}
+
+	if _, err := e.ImportSession([]byte(`{"version":99}`)); err == nil {
+		t.Fatal("expected version error")
+	}
+}
+
+func TestSessionNormalizes(t *testing.T) {
+	e := newTestEngine()
+	opts := sessionOpts()
+	opts.Normalize = NormNFKC | NormFold
+	s := e.NewSession("", ChatQA, opts)
+	if _, err := s.Send("it’s ｌｏｌ"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Messages[0].Content; got != "it's lol" {
+		t.Fatalf("session stored %q, want the normalized text", got)
+	}
+}
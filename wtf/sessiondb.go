@@ -0,0 +1,220 @@
+package wtf
+
+// sessiondb.go — conversations in SQLite, so a session can be picked up by
+// id after a restart or on another process. Each session is stored twice
+// over: its Export blob (what Resume needs) and a transcript with one row
+// per turn — user message, reply and the generation's metadata — for
+// browsing, auditing and analytics without decoding blobs.
+//
+//	db, _ := OpenSessionDB("sessions.db")
+//	s, err := db.Resume(e, "tg:1234") // ErrNoSession on first contact
+//	res, err := s.Send(text)
+//	db.SaveTurn("tg:1234", s, res)
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sessionDBSchema = `
+CREATE TABLE IF NOT EXISTS chat_sessions (
+    id TEXT PRIMARY KEY,
+    created REAL NOT NULL,
+    updated REAL NOT NULL,
+    turns INTEGER NOT NULL,
+    blob TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS chat_turns (
+    session_id TEXT NOT NULL REFERENCES chat_sessions(id) ON DELETE CASCADE,
+    turn INTEGER NOT NULL,
+    created REAL NOT NULL,
+    user TEXT NOT NULL,
+    reply TEXT NOT NULL,
+    tokens INTEGER NOT NULL,
+    prompt_tokens INTEGER NOT NULL,
+    finish TEXT NOT NULL,
+    ttft_ms INTEGER NOT NULL,
+    temp REAL NOT NULL,
+    seed INTEGER NOT NULL,
+    cached INTEGER NOT NULL,
+    PRIMARY KEY (session_id, turn)
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_sessions_updated ON chat_sessions(updated DESC);
+`
+
+// ErrNoSession is returned by Resume for an id that was never saved.
+var ErrNoSession = errors.New("no such session")
+
+// SessionInfo summarises one stored session.
+type SessionInfo struct {
+	ID      string
+	Created time.Time
+	Updated time.Time
+	Turns   int
+}
+
+// TranscriptTurn is one stored exchange and how its reply was generated.
+type TranscriptTurn struct {
+	Turn         int
+	Time         time.Time
+	User         string // as the model saw it (PII scrubbed, markers stripped)
+	Reply        string
+	Tokens       int
+	PromptTokens int
+	Finish       FinishReason
+	TTFT         time.Duration
+	Temp         float32
+	Seed         int64 // 0 = clock-seeded
+	Cached       bool
+}
+
+// SessionDB stores sessions in one SQLite file. Safe for concurrent use.
+type SessionDB struct {
+	db   *sql.DB
+	path string
+}
+
+// OpenSessionDB opens (and initializes) the database at path.
+func OpenSessionDB(path string) (*SessionDB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+	for _, q := range []string{"PRAGMA journal_mode=WAL", "PRAGMA synchronous=NORMAL",
+		"PRAGMA foreign_keys=ON", "PRAGMA busy_timeout=5000", sessionDBSchema} {
+		if _, err := db.Exec(q); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("session db %s: %w", path, err)
+		}
+	}
+	return &SessionDB{db: db, path: path}, nil
+}
+
+// Close releases the database handle.
+func (d *SessionDB) Close() error {
+	return d.db.Close()
+}
+
+// upsertSession replaces the blob of a session, creating its row if new.
+const upsertSession = `INSERT INTO chat_sessions (id, created, updated, turns, blob) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(id) DO UPDATE SET updated = excluded.updated, turns = excluded.turns, blob = excluded.blob`
+
+// SaveTurn stores s under id after a Send that returned res: the session
+// blob is replaced and the turn just completed is added to the transcript.
+func (d *SessionDB) SaveTurn(id string, s *Session, res Result) error {
+	if n := len(s.Messages); n < 2 || s.Messages[n-1].Role != RoleAssistant {
+		return fmt.Errorf("session %s: no completed turn to save", id)
+	}
+	blob, err := s.Export(false)
+	if err != nil {
+		return err
+	}
+	now := unixSeconds(time.Now())
+	msgs := s.Messages
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(upsertSession, id, now, now, s.Turn, string(blob)); err != nil {
+		return fmt.Errorf("session %s: %w", id, err)
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO chat_turns
+		(session_id, turn, created, user, reply, tokens, prompt_tokens, finish, ttft_ms, temp, seed, cached)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, s.Turn, now, msgs[len(msgs)-2].Content, msgs[len(msgs)-1].Content,
+		len(res.Tokens), res.PromptTokens, string(res.Finish), res.TTFT.Milliseconds(),
+		s.Opts.Temp, s.Opts.Seed, res.Cached); err != nil {
+		return fmt.Errorf("session %s: %w", id, err)
+	}
+	return tx.Commit()
+}
+
+// Save stores s under id between turns, after a change such as a new fact
+// that SaveTurn would otherwise only pick up with the next turn. The
+// transcript is left alone.
+func (d *SessionDB) Save(id string, s *Session) error {
+	blob, err := s.Export(false)
+	if err != nil {
+		return err
+	}
+	now := unixSeconds(time.Now())
+	if _, err := d.db.Exec(upsertSession, id, now, now, s.Turn, string(blob)); err != nil {
+		return fmt.Errorf("session %s: %w", id, err)
+	}
+	return nil
+}
+
+// Resume loads session id onto e. The next Send re-prefills its history.
+func (d *SessionDB) Resume(e *Engine, id string) (*Session, error) {
+	var blob string
+	err := d.db.QueryRow("SELECT blob FROM chat_sessions WHERE id = ?", id).Scan(&blob)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %q", ErrNoSession, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("session %s: %w", id, err)
+	}
+	return e.ImportSession([]byte(blob))
+}
+
+// Transcript returns session id's turns, oldest first.
+func (d *SessionDB) Transcript(id string) ([]TranscriptTurn, error) {
+	rows, err := d.db.Query(`SELECT turn, created, user, reply, tokens, prompt_tokens, finish, ttft_ms, temp, seed, cached
+		FROM chat_turns WHERE session_id = ? ORDER BY turn`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []TranscriptTurn
+	for rows.Next() {
+		var (
+			t       TranscriptTurn
+			created float64
+			ttft    int64
+		)
+		if err := rows.Scan(&t.Turn, &created, &t.User, &t.Reply, &t.Tokens, &t.PromptTokens,
+			&t.Finish, &ttft, &t.Temp, &t.Seed, &t.Cached); err != nil {
+			return nil, err
+		}
+		t.Time = time.Unix(0, int64(created*1e9))
+		t.TTFT = time.Duration(ttft) * time.Millisecond
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// Sessions lists stored sessions, most recently updated first.
+func (d *SessionDB) Sessions(limit int) ([]SessionInfo, error) {
+	rows, err := d.db.Query("SELECT id, created, updated, turns FROM chat_sessions ORDER BY updated DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []SessionInfo
+	for rows.Next() {
+		var (
+			s                SessionInfo
+			created, updated float64
+		)
+		if err := rows.Scan(&s.ID, &created, &updated, &s.Turns); err != nil {
+			return nil, err
+		}
+		s.Created = time.Unix(0, int64(created*1e9))
+		s.Updated = time.Unix(0, int64(updated*1e9))
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// Delete removes session id and its transcript.
+func (d *SessionDB) Delete(id string) error {
+	_, err := d.db.Exec("DELETE FROM chat_sessions WHERE id = ?", id)
+	return err
+}
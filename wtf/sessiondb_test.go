@@ -0,0 +1,71 @@
+package wtf
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSessionDB(t *testing.T) {
+	e := newTestEngine()
+	db, err := OpenSessionDB(filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Resume(e, "chat-1"); !errors.Is(err, ErrNoSession) {
+		t.Fatalf("resume of unknown id: %v, want ErrNoSession", err)
+	}
+	s := e.NewSession("be brief", ChatQA, greedyOpts(4))
+	for _, q := range []string{"hi", "why"} {
+		res, err := s.Send(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SaveTurn("chat-1", s, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := db.Resume(e, "chat-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Turn != s.Turn || !slices.Equal(r.Messages, s.Messages) {
+		t.Fatalf("resumed turn %d %v, want %d %v", r.Turn, r.Messages, s.Turn, s.Messages)
+	}
+	tr, err := db.Transcript("chat-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr) != 2 || tr[1].Turn != 2 || tr[1].User != "why" || tr[1].Reply != s.Messages[4].Content || tr[1].Finish == "" {
+		t.Fatalf("transcript %+v", tr)
+	}
+	if list, err := db.Sessions(10); err != nil || len(list) != 1 || list[0].Turns != 2 {
+		t.Fatalf("sessions %+v, %v", list, err)
+	}
+
+	// A fact saved between turns; the transcript keeps its two turns.
+	s.Remember("likes tea")
+	if err := db.Save("chat-1", s); err != nil {
+		t.Fatal(err)
+	}
+	if r, err = db.Resume(e, "chat-1"); err != nil || !slices.Equal(r.Facts, s.Facts) {
+		t.Fatalf("resumed facts %q, %v", r.Facts, err)
+	}
+	if tr, _ := db.Transcript("chat-1"); len(tr) != 2 {
+		t.Fatalf("Save touched the transcript: %+v", tr)
+	}
+
+	if err := db.Delete("chat-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Resume(e, "chat-1"); !errors.Is(err, ErrNoSession) {
+		t.Fatalf("resume after delete: %v", err)
+	}
+	if tr, _ := db.Transcript("chat-1"); len(tr) != 0 {
+		t.Fatalf("transcript survived delete: %+v", tr)
+	}
+}
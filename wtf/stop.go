@@ -0,0 +1,243 @@
+package wtf
+
+// stop.go — when a reply is allowed to end.
+//
+// Grace period: once MaxTokens is reached, keep decoding for up to
+// Grace.Limit more tokens looking for a natural place to stop, so replies
+// don't end mid-word. What counts as "natural" is configurable.
+
+import (
+	"strings"
+	"unicode"
+)
+
+// GracePolicy controls the stop-after-MaxTokens behaviour.
+type GracePolicy struct {
+	// Limit is how many extra tokens may be spent looking for a terminator.
+	// 0 disables the grace period: generation stops hard at MaxTokens.
+	Limit int
+	// Terminators end the reply when the output ends with any of them.
+	// Multi-character entries ("...", "—") are fine.
+	Terminators []string
+	// Sentences makes the grace stop only at a sentence boundary found by
+	// sentenceEnd (terminator + whitespace, not an abbreviation), trimming
+	// whatever follows it.
+	Sentences bool
+}
+
+// DefaultGracePolicy is the historical rule: 32 tokens, stop at . ! ? \n.
+func DefaultGracePolicy() GracePolicy {
+	return GracePolicy{Limit: 32, Terminators: []string{".", "!", "?", "\n"}}
+}
+
+// cut reports whether a reply in its grace period should end now, and the
+// length to keep.
+func (g *GracePolicy) cut(out []byte) (int, bool) {
+	if len(out) == 0 {
+		return 0, false
+	}
+	if g.Sentences {
+		if n := sentenceEnd(string(out), g.Terminators); n > 0 {
+			return n, true
+		}
+		return 0, false
+	}
+	for _, t := range g.Terminators {
+		if t != "" && strings.HasSuffix(string(out), t) {
+			return len(out), true
+		}
+	}
+	return 0, false
+}
+
+// abbreviations never end a sentence even when followed by whitespace.
+var abbreviations = map[string]bool{
+	"e.g.": true, "i.e.": true, "etc.": true, "vs.": true, "mr.": true,
+	"mrs.": true, "ms.": true, "dr.": true, "st.": true, "jr.": true, "u.s.": true,
+}
+
+// sentenceEnd returns the byte length of text up to and including the last
+// complete sentence: a terminator followed by whitespace (or a newline or
+// full-width terminator), where the word ending there is not an
+// abbreviation or a bare number like "3.". Returns 0 when no sentence has
+// ended yet.
+func sentenceEnd(text string, terms []string) int {
+	end := 0
+	for i := 0; i < len(text); i++ {
+		for _, t := range terms {
+			if t == "" || !strings.HasPrefix(text[i:], t) {
+				continue
+			}
+			j := i + len(t)
+			// Swallow runs like "?!" or "..." into one terminator.
+			for j < len(text) && strings.IndexByte(".!?", text[j]) >= 0 {
+				j++
+			}
+			if t != "\n" && !fullWidthStop(t) && (j >= len(text) || !unicode.IsSpace(rune(text[j]))) {
+				continue
+			}
+			if t == "." && isAbbrev(text[:j]) {
+				continue
+			}
+			end = j
+		}
+	}
+	return end
+}
+
+// fullWidthStop reports whether t ends a sentence with no space after it,
+// as CJK text is written.
+func fullWidthStop(t string) bool {
+	return t == "。" || t == "！" || t == "？"
+}
+
+// isAbbrev reports whether the word ending text (which ends in '.') is an
+// abbreviation or a number.
+func isAbbrev(text string) bool {
+	start := strings.LastIndexFunc(text, unicode.IsSpace) + 1
+	word := strings.ToLower(text[start:])
+	if abbreviations[word] {
+		return true
+	}
+	stem := strings.TrimRight(word, ".")
+	if stem == "" {
+		return false
+	}
+	for _, r := range stem {
+		if !unicode.IsDigit(r) {
+			return len([]rune(stem)) == 1 && unicode.IsLetter(r) // initials: "j."
+		}
+	}
+	return true
+}
+
+// LengthTarget is a soft length goal: rather than the MaxTokens cliff, the
+// EOS logit is biased by Strength·(i−Tokens)/Tokens at step i — held back
+// while the reply is short, pushed as it runs past the target.
+type LengthTarget struct {
+	Tokens   int     // 0 disables
+	Strength float32 // bias at 0 or 2× the target (0 = 4)
+}
+
+// bias is the EOS logit adjustment for sampling step i.
+func (l *LengthTarget) bias(i int) float32 {
+	if l.Tokens <= 0 {
+		return 0
+	}
+	s := l.Strength
+	if s == 0 {
+		s = 4
+	}
+	return s * float32(i-l.Tokens) / float32(l.Tokens)
+}
+
+// CyclePolicy configures loop detection. Two detectors, usable together:
+//
+// Exact: the last Repeats*p generated tokens are Repeats copies of the same
+// p-token run, for any period p in [MinPeriod, MaxPeriod].
+//
+// Fuzzy: over the decoded text (lowercased, whitespace collapsed), the most
+// recent FuzzyGram-byte shingle already occurred Repeats-1 times within the
+// last FuzzyWindow bytes. Rabin-Karp rolling hash, so it catches loops of any
+// period and loops that re-tokenize the same text differently.
+type CyclePolicy struct {
+	MinPeriod, MaxPeriod int // 0/0 disables the exact detector
+	Repeats              int // copies that make a loop (>= 2)
+
+	Fuzzy       bool
+	FuzzyGram   int
+	FuzzyWindow int
+}
+
+// DefaultCyclePolicy is the historical rule: exact, period 8, two copies.
+func DefaultCyclePolicy() CyclePolicy {
+	return CyclePolicy{MinPeriod: 8, MaxPeriod: 8, Repeats: 2, FuzzyGram: 24, FuzzyWindow: 512}
+}
+
+// exact reports whether hist ends in Repeats copies of some period.
+func (c *CyclePolicy) exact(hist []int) bool {
+	if c.MaxPeriod <= 0 || c.Repeats < 2 {
+		return false
+	}
+	n := len(hist)
+	for p := max(c.MinPeriod, 1); p <= c.MaxPeriod; p++ {
+		if n < p*c.Repeats {
+			break
+		}
+		loop := true
+		for k := 0; k < p*(c.Repeats-1) && loop; k++ {
+			loop = hist[n-1-k] == hist[n-1-k-p]
+		}
+		if loop {
+			return true
+		}
+	}
+	return false
+}
+
+// fuzzy reports whether the tail of text is a near-repeat of what came before.
+func (c *CyclePolicy) fuzzy(text []byte) bool {
+	if !c.Fuzzy || c.FuzzyGram <= 0 || c.Repeats < 2 {
+		return false
+	}
+	if w := c.FuzzyWindow; w > 0 && len(text) > w {
+		text = text[len(text)-w:]
+	}
+	norm := normalizeForCycle(text)
+	g := c.FuzzyGram
+	if len(norm) < g*c.Repeats {
+		return false
+	}
+
+	const base = 257
+	var pow uint64 = 1
+	for i := 0; i < g; i++ {
+		pow *= base
+	}
+	var h uint64
+	hashes := make([]uint64, 0, len(norm)-g+1)
+	for i, b := range norm {
+		h = h*base + uint64(b)
+		if i >= g {
+			h -= uint64(norm[i-g]) * pow
+		}
+		if i >= g-1 {
+			hashes = append(hashes, h)
+		}
+	}
+
+	last := len(hashes) - 1
+	tail := norm[last:]
+	seen := 0
+	for i := last - g; i >= 0; i-- { // non-overlapping with the tail shingle
+		if hashes[i] == hashes[last] && string(norm[i:i+g]) == string(tail) {
+			seen++
+			if seen >= c.Repeats-1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalizeForCycle lowercases ASCII and collapses whitespace runs so that
+// "lol  Lol\nlol" loops look the same.
+func normalizeForCycle(text []byte) []byte {
+	out := make([]byte, 0, len(text))
+	space := false
+	for _, b := range text {
+		if b == ' ' || b == '\n' || b == '\t' || b == '\r' {
+			space = true
+			continue
+		}
+		if space && len(out) > 0 {
+			out = append(out, ' ')
+		}
+		space = false
+		if b >= 'A' && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		out = append(out, b)
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+package wtf
+
+import "testing"
+
+func TestGraceCut(t *testing.T) {
+	def := DefaultGracePolicy()
+	if _, stop := def.cut([]byte("still going")); stop {
+		t.Fatal("default policy stopped without a terminator")
+	}
+	if n, stop := def.cut([]byte("done.")); !stop || n != 5 {
+		t.Fatalf("default policy: n=%d stop=%v", n, stop)
+	}
+
+	custom := GracePolicy{Limit: 8, Terminators: []string{"...", "—"}}
+	if _, stop := custom.cut([]byte("so anyway.")); stop {
+		t.Fatal("custom policy stopped on a plain period")
+	}
+	if _, stop := custom.cut([]byte("and then—")); !stop {
+		t.Fatal("custom policy missed the em-dash")
+	}
+}
+
+func TestSentenceEnd(t *testing.T) {
+	terms := DefaultGracePolicy().Terminators
+	for text, want := range map[string]int{
+		"no sentence yet":                 0,
+		"one. two":                        4,
+		"wait?! really":                   6,
+		"ask dr. smith":                   0,
+		"version 3. then":                 0,
+		"i.e. nothing. ok":                13,
+		"first line\nsecond":              11,
+		"the end.":                        0, // no whitespace after yet
+		"bro, e.g. this. and that. then ": 25,
+	} {
+		if got := sentenceEnd(text, terms); got != want {
+			t.Errorf("sentenceEnd(%q) = %d, want %d", text, got, want)
+		}
+	}
+}
+
+func TestCycleExact(t *testing.T) {
+	def := DefaultCyclePolicy()
+	run := []int{1, 2, 3, 4, 5, 6, 7, 8}
+	if !def.exact(append(append([]int{9}, run...), run...)) {
+		t.Fatal("default policy missed a period-8 loop")
+	}
+	three := []int{1, 2, 3, 1, 2, 3, 1, 2, 3, 1, 2, 3, 1, 2, 3, 1, 2, 3}
+	if def.exact(three) {
+		t.Fatal("default policy should only look at period 8")
+	}
+	wide := CyclePolicy{MinPeriod: 2, MaxPeriod: 16, Repeats: 3}
+	if !wide.exact(three) {
+		t.Fatal("wide policy missed a period-3 loop")
+	}
+	if wide.exact([]int{1, 2, 3, 4, 1, 2, 3, 4}) {
+		t.Fatal("two copies reported as a loop with Repeats=3")
+	}
+}
+
+func TestCycleFuzzy(t *testing.T) {
+	c := DefaultCyclePolicy()
+	c.Fuzzy = true
+	c.FuzzyGram = 12
+	loop := []byte("ok so the thing is, bro. Ok so the thing  is, bro. ok so the thing is, bro.")
+	if !c.fuzzy(loop) {
+		t.Fatal("fuzzy detector missed a case/whitespace-varied loop")
+	}
+	if c.fuzzy([]byte("ok so the thing is, nobody asked and nobody will ever ask again, bro.")) {
+		t.Fatal("fuzzy detector flagged text without repetition")
+	}
+}
+
+func TestLengthTarget(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(64)
+	opts.Grace.Limit = 0
+	opts.Cycle = CyclePolicy{}
+	opts.Length = LengthTarget{Tokens: 5, Strength: 1e4}
+	res, err := e.Generate("", "hi", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Finish != FinishStop || len(res.Tokens) < 5 || len(res.Tokens) > 6 {
+		t.Fatalf("got %d tokens (%s), want EOS right around the target of 5", len(res.Tokens), res.Finish)
+	}
+}
+
+func TestEOSBias(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(32)
+	opts.EOSBias = 1e6
+	if res, _ := e.Generate("", "hi", opts); res.Finish != FinishStop || len(res.Tokens) != 0 {
+		t.Fatalf("huge EOS bias: got %d tokens (%s), want immediate stop", len(res.Tokens), res.Finish)
+	}
+	opts.EOSBias = -1e6
+	opts.Grace.Limit = 0
+	opts.Cycle = CyclePolicy{}
+	if res, _ := e.Generate("", "hi", opts); res.Finish != FinishLength {
+		t.Fatalf("EOS suppressed: finish = %s, want length", res.Finish)
+	}
+}
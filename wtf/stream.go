@@ -0,0 +1,102 @@
+package wtf
+
+// stream.go — layer streaming for machines with less RAM than the model.
+// MapGGUF maps the weights file instead of reading it, and a model loaded
+// from a mapped file keeps its layer matrices as views into the mapping
+// rather than copies. While a forward pass runs layer i, the kernel is asked
+// to read layer i+1 ahead (madvise WILLNEED) and to drop layer i-1 from the
+// process (DONTNEED), so about two layers of weights are resident at a
+// time; a dropped page is read back from the file, or the page cache, the
+// next time it is needed. On a 512 MB single-board computer that is the
+// difference between running and being OOM-killed.
+//
+// Only the layer matrices stream. Norms, biases, the f32 embeddings and the
+// LM head stay resident, as do matrices QuantizeInt8 requantizes (its int8
+// copies live on the heap). Decoding gets slower by however long the disk
+// takes to keep up; on eMMC or an SD card that is most of the time.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrStreamUnsupported is returned by MapGGUF where the OS has no mmap the
+// engine knows how to use.
+var ErrStreamUnsupported = errors.New("streaming weights needs mmap (Linux, macOS, FreeBSD)")
+
+// MapGGUF opens a GGUF file like LoadGGUF, but maps the tensor data instead
+// of reading it into memory; LoadLlamaModel then streams the layers. The
+// mapping lives as long as the process.
+func MapGGUF(path string) (*GGUFFile, error) { return loadGGUF(path, true) }
+
+// layerStream pages a mapped model's layers in ahead of the forward pass
+// and out behind it.
+type layerStream struct {
+	file  []byte
+	spans [][2]int // per layer: page-aligned [start, end) in file
+}
+
+// newLayerStream finds each layer's byte range in g's mapping, or returns
+// nil when g is not mapped.
+func newLayerStream(g *GGUFFile, layers int) *layerStream {
+	if g.mapped == nil || layers < 3 {
+		return nil
+	}
+	s := &layerStream{file: g.mapped, spans: make([][2]int, layers)}
+	for i := range s.spans {
+		s.spans[i] = [2]int{len(g.mapped), 0}
+	}
+	for name, info := range g.Tensors {
+		rest, ok := strings.CutPrefix(name, "blk.")
+		if !ok {
+			continue
+		}
+		n, _, _ := strings.Cut(rest, ".")
+		i, err := strconv.Atoi(n)
+		if err != nil || i < 0 || i >= layers {
+			continue
+		}
+		start := int(g.DataOffset) + int(info.Offset)
+		sp := &s.spans[i]
+		sp[0] = min(sp[0], start)
+		sp[1] = max(sp[1], start+int(tensorBytes(info)))
+	}
+	page := pageSize()
+	for i, sp := range s.spans {
+		if sp[1] <= sp[0] {
+			s.spans[i] = [2]int{}
+			continue
+		}
+		s.spans[i] = [2]int{sp[0] / page * page, min((sp[1]+page-1)/page*page, len(g.mapped))}
+	}
+	return s
+}
+
+// enter runs before layer i: read the next layer ahead (the first one
+// after the last, for the next token) and release the previous one.
+func (s *layerStream) enter(i int) {
+	n := len(s.spans)
+	s.advise((i+1)%n, true)
+	s.advise((i+n-1)%n, false)
+}
+
+func (s *layerStream) advise(i int, need bool) {
+	if sp := s.spans[i]; sp[1] > sp[0] {
+		adviseRange(s.file[sp[0]:sp[1]], need)
+	}
+}
+
+// layerBytes is the mapped size of the largest layer.
+func (s *layerStream) layerBytes() int {
+	n := 0
+	for _, sp := range s.spans {
+		n = max(n, sp[1]-sp[0])
+	}
+	return n
+}
+
+func (s *layerStream) String() string {
+	return fmt.Sprintf("%d layers of up to %.1f MB", len(s.spans), float64(s.layerBytes())/1024/1024)
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd)
+
+package wtf
+
+import "os"
+
+func mmapFile(f *os.File, size int64) ([]byte, error) { return nil, ErrStreamUnsupported }
+
+func mmapShared(f *os.File, size int64) ([]byte, error) { return nil, ErrStreamUnsupported }
+
+func munmap(b []byte) error { return nil }
+
+func adviseRange(b []byte, need bool) {}
+
+func pageSize() int { return 4096 }
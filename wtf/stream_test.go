@@ -0,0 +1,141 @@
+package wtf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+// writeModelGGUF serializes m's weights as an f32 GGUF file.
+func writeModelGGUF(t testing.TB, m *LlamaModel) string {
+	var b bytes.Buffer
+	le := func(v any) { binary.Write(&b, binary.LittleEndian, v) }
+	str := func(s string) { le(uint64(len(s))); b.WriteString(s) }
+	c := &m.Config
+
+	type tensor struct {
+		name string
+		dims []uint64
+		data []float32
+	}
+	var ts []tensor
+	vec := func(name string, x []float32) {
+		if x != nil {
+			ts = append(ts, tensor{name, []uint64{uint64(len(x))}, x})
+		}
+	}
+	mat := func(name string, q *QW) { ts = append(ts, tensor{name, []uint64{uint64(q.K), uint64(q.M)}, q.F32}) }
+	ts = append(ts, tensor{"token_embd.weight", []uint64{uint64(c.EmbedDim), uint64(c.VocabSize)}, m.Weights.TokenEmbed})
+	vec("output_norm.weight", m.Weights.OutputNorm)
+	for i := range m.Weights.Layers {
+		l := &m.Weights.Layers[i]
+		p := fmt.Sprintf("blk.%d.", i)
+		vec(p+"attn_norm.weight", l.AttnNorm)
+		vec(p+"ffn_norm.weight", l.FFNNorm)
+		for j, q := range []*QW{&l.WQ, &l.WK, &l.WV, &l.WO, &l.WGate, &l.WUp, &l.WDown} {
+			mat(p+layerMatrices[j]+".weight", q)
+		}
+	}
+
+	u32 := [][2]any{{"wtftest.block_count", c.NumLayers}, {"wtftest.embedding_length", c.EmbedDim},
+		{"wtftest.attention.head_count", c.NumHeads}, {"wtftest.attention.head_count_kv", c.NumKVHeads},
+		{"wtftest.feed_forward_length", c.IntermSize}, {"wtftest.context_length", c.SeqLen}}
+	le(uint32(ggufMagic))
+	le(uint32(ggufVersion))
+	le(uint64(len(ts)))
+	le(uint64(len(u32) + 2))
+	str("general.architecture")
+	le(uint32(ggufTypeString))
+	str("wtftest")
+	for _, kv := range u32 {
+		str(kv[0].(string))
+		le(uint32(ggufTypeUint32))
+		le(uint32(kv[1].(int)))
+	}
+	str("tokenizer.ggml.tokens")
+	le(uint32(ggufTypeArray))
+	le(uint32(ggufTypeString))
+	le(uint64(c.VocabSize))
+	for i := 0; i < c.VocabSize; i++ {
+		str(fmt.Sprint(i))
+	}
+	off := uint64(0)
+	for _, tn := range ts {
+		str(tn.name)
+		le(uint32(len(tn.dims)))
+		for _, d := range tn.dims {
+			le(d)
+		}
+		le(uint32(dtypeF32))
+		le(off)
+		off += uint64(4*len(tn.data)+31) / 32 * 32
+	}
+	for b.Len()%32 != 0 {
+		b.WriteByte(0)
+	}
+	for _, tn := range ts {
+		le(tn.data)
+		for b.Len()%32 != 0 {
+			b.WriteByte(0)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "model.gguf")
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMapGGUF(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" && runtime.GOOS != "freebsd" {
+		t.Skip(ErrStreamUnsupported)
+	}
+	e := newTestEngine()
+	src := newTestModel(e.Tok.VocabSize) // serialized with 4 layers: streaming needs 3
+	src.Weights.Layers = append(src.Weights.Layers, src.Weights.Layers...)
+	src.Config.NumLayers = len(src.Weights.Layers)
+	path := writeModelGGUF(t, src)
+
+	load := func(open func(string) (*GGUFFile, error)) *LlamaModel {
+		g, err := open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := LoadLlamaModel(g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	read, mapped := load(LoadGGUF), load(MapGGUF)
+	if read.stream != nil || mapped.stream == nil {
+		t.Fatalf("stream: read %v, mapped %v", read.stream, mapped.stream)
+	}
+	if read.Fingerprint() != mapped.Fingerprint() {
+		t.Error("mapped weights differ from read ones")
+	}
+	file := mapped.stream.file
+	p := uintptr(unsafe.Pointer(&mapped.Weights.Layers[1].WUp.Packed[0]))
+	if base := uintptr(unsafe.Pointer(&file[0])); p < base || p >= base+uintptr(len(file)) {
+		t.Error("layer matrix copied out of the mapping")
+	}
+	for i, sp := range mapped.stream.spans {
+		if sp[1] <= sp[0] || sp[0]%pageSize() != 0 {
+			t.Errorf("layer %d span %v", i, sp)
+		}
+	}
+
+	want := Generate(read, e.Tok, "hey", greedyOpts(12))
+	got := Generate(mapped, e.Tok, "hey", greedyOpts(12))
+	if got.Text != want.Text {
+		t.Errorf("streamed reply %q, want %q", got.Text, want.Text)
+	}
+	if f := mapped.Fork(); f.stream != mapped.stream {
+		t.Error("fork lost the stream")
+	}
+}
@@ -0,0 +1,37 @@
+//go:build linux || darwin || freebsd
+
+package wtf
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+}
+
+// mmapShared maps the first size bytes of f read-write; writes reach the
+// file.
+func mmapShared(f *os.File, size int64) ([]byte, error) {
+	return unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+}
+
+func munmap(b []byte) error {
+	if b == nil {
+		return nil
+	}
+	return unix.Munmap(b)
+}
+
+// adviseRange is a hint: errors only mean the kernel ignored it.
+func adviseRange(b []byte, need bool) {
+	advice := unix.MADV_DONTNEED
+	if need {
+		advice = unix.MADV_WILLNEED
+	}
+	unix.Madvise(b, advice)
+}
+
+func pageSize() int { return unix.Getpagesize() }
@@ -0,0 +1,183 @@
+package wtf
+
+// strip.go — keep emoji and markdown out of replies while decoding, rather
+// than deleting them afterwards and leaving a sentence with a hole in it.
+// Tokens that spell an emoji or a formatting marker on their own are masked
+// at every step, so the sampler picks the next most likely word instead.
+// What only shows up in context — an emoji split over byte tokens, "#" or
+// ">" starting a line — is masked by a vocabulary scan at the few steps
+// where it can happen, and checked again before a token is accepted.
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// StripKind selects what GenOptions.Strip keeps out of a reply.
+type StripKind uint8
+
+const (
+	StripEmoji  StripKind = 1 << iota // pictographs, skin tones, VS16
+	StripMarkup                       // * ** __ ` ~~ ]( anywhere; # and > opening a line
+
+	StripAll = StripEmoji | StripMarkup
+)
+
+// ParseStripKind reads a comma-separated list: emoji, markup, all, none.
+func ParseStripKind(s string) (StripKind, error) {
+	var k StripKind
+	for _, f := range strings.Split(s, ",") {
+		switch strings.TrimSpace(f) {
+		case "", "none":
+		case "emoji":
+			k |= StripEmoji
+		case "markup":
+			k |= StripMarkup
+		case "all":
+			k |= StripAll
+		default:
+			return 0, fmt.Errorf("strip %q: want emoji, markup, all or none", f)
+		}
+	}
+	return k, nil
+}
+
+// markupInline are markers that are formatting wherever they appear.
+var markupInline = []string{"*", "__", "`", "~~", "]("}
+
+// stripMask sets the logit of every token k strips after out to -1e30:
+// the fixed list, plus a scan of the vocabulary when out ends where context
+// matters (mid-character, or at the start of a line).
+func (t *Tokenizer) stripMask(logits []float32, k StripKind, out []byte) {
+	for _, id := range t.stripIDs(k) {
+		logits[id] = -1e30
+	}
+	if !k.contextual(out) {
+		return
+	}
+	for id := 0; id < len(logits) && id < t.VocabSize; id++ {
+		if id != t.EosID && k.blocks(out, t.Piece(id)) {
+			logits[id] = -1e30
+		}
+	}
+}
+
+// contextual reports whether what may follow out depends on out: a line
+// start, half of a two-character marker, or half a character.
+func (k StripKind) contextual(out []byte) bool {
+	if k&StripMarkup != 0 {
+		if len(out) == 0 || strings.IndexByte("\n_~]", out[len(out)-1]) >= 0 {
+			return true
+		}
+	}
+	return k&StripEmoji != 0 && utf8Tail(out) != ""
+}
+
+// stripIDs lists the tokens whose text alone is stripped under k, built on
+// first use per kind.
+func (t *Tokenizer) stripIDs(k StripKind) []int {
+	t.maskMu.Lock()
+	defer t.maskMu.Unlock()
+	if ids, ok := t.stripped[k]; ok {
+		return ids
+	}
+	ids := []int{}
+	for id := 0; id < t.VocabSize; id++ {
+		if id == t.EosID || id == t.BosID {
+			continue
+		}
+		if p := t.Piece(id); k.strips(p) {
+			ids = append(ids, id)
+		}
+	}
+	if t.stripped == nil {
+		t.stripped = make(map[StripKind][]int)
+	}
+	t.stripped[k] = ids
+	return ids
+}
+
+// strips reports whether s contains something k keeps out, without
+// context.
+func (k StripKind) strips(s string) bool {
+	if k&StripMarkup != 0 {
+		for _, m := range markupInline {
+			if strings.Contains(s, m) {
+				return true
+			}
+		}
+	}
+	if k&StripEmoji != 0 {
+		for _, c := range s {
+			if isEmoji(c) || emojiPart(c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// blocks reports whether piece, written after out, would put something k
+// keeps out into the reply: an emoji completed (or begun) across token
+// boundaries, or a heading or quote marker opening a line.
+func (k StripKind) blocks(out []byte, piece string) bool {
+	if k == 0 || piece == "" {
+		return false
+	}
+	if k&StripMarkup != 0 {
+		if len(out) == 0 || out[len(out)-1] == '\n' {
+			if p := strings.TrimLeft(piece, " \t"); strings.HasPrefix(p, "#") || strings.HasPrefix(p, ">") {
+				return true
+			}
+		}
+		if len(out) > 0 && k.strips(string(out[len(out)-1])+piece) {
+			return true // "_" then "_", "]" then "("
+		}
+	}
+	if k&StripEmoji == 0 {
+		return false
+	}
+	s := utf8Tail(out) + piece
+	for len(s) > 0 {
+		c, n := utf8.DecodeRuneInString(s)
+		if c == utf8.RuneError && n <= 1 && !utf8.FullRuneInString(s) {
+			return emojiPrefix(s)
+		}
+		if isEmoji(c) || emojiPart(c) {
+			return true
+		}
+		s = s[n:]
+	}
+	return false
+}
+
+// utf8Tail returns the incomplete character at the end of b, if any.
+func utf8Tail(b []byte) string {
+	for i := 1; i <= min(3, len(b)); i++ {
+		if c := b[len(b)-i]; c&0xC0 != 0x80 { // a lead byte
+			if !utf8.FullRune(b[len(b)-i:]) {
+				return string(b[len(b)-i:])
+			}
+			break
+		}
+	}
+	return ""
+}
+
+// emojiPrefix reports whether the incomplete character s can only end up
+// as an emoji: F0 9F is U+1F000–U+1FFFF, E2 98–9E is U+2600–U+27BF.
+func emojiPrefix(s string) bool {
+	switch {
+	case len(s) >= 2 && s[0] == 0xF0 && s[1] == 0x9F:
+		return true
+	case len(s) >= 2 && s[0] == 0xE2 && s[1] >= 0x98 && s[1] <= 0x9E:
+		return true
+	}
+	return false
+}
+
+// emojiPart reports whether c only ever appears inside an emoji sequence.
+func emojiPart(c rune) bool {
+	return c == 0xFE0F || c >= 0x1F3FB && c <= 0x1F3FF
+}
@@ -0,0 +1,64 @@
+package wtf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripBlocks(t *testing.T) {
+	for _, c := range []struct {
+		k     StripKind
+		out   string
+		piece string
+		want  bool
+	}{
+		{StripEmoji, "lol ", "😀", true},
+		{StripEmoji, "lol \xF0", "\x9F\x98\x80", true}, // completes an emoji
+		{StripEmoji, "lol ", "\xF0\x9F", true},         // can only become one
+		{StripEmoji, "it\xE2", "\x80\x99s", false},     // ’ shares the E2 lead byte
+		{StripEmoji, "caf", "é", false},
+		{StripMarkup, "", "#", true},
+		{StripMarkup, "ok\n", " > quote", true},
+		{StripMarkup, "c", "#", false}, // C# is not a heading
+		{StripMarkup, "snake_", "_case", true},
+		{StripMarkup, "snake_", "case", false},
+		{StripMarkup, "[link]", "(x)", true},
+		{StripEmoji, "", "#", false},
+	} {
+		if got := c.k.blocks([]byte(c.out), c.piece); got != c.want {
+			t.Errorf("%d.blocks(%q, %q) = %v, want %v", c.k, c.out, c.piece, got, c.want)
+		}
+	}
+	if k, err := ParseStripKind("emoji, markup"); err != nil || k != StripAll {
+		t.Fatalf("ParseStripKind = %d, %v", k, err)
+	}
+	if _, err := ParseStripKind("emojis"); err == nil {
+		t.Fatal("unknown kind accepted")
+	}
+}
+
+func TestStripDecode(t *testing.T) {
+	e := newTestEngine()
+	opts := DefaultGenOptions()
+	opts.MaxTokens, opts.TopP, opts.Strip = 48, 1, StripMarkup
+	for seed := int64(1); seed <= 8; seed++ {
+		opts.Seed = seed
+		res, err := e.Generate("", "the sky", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Finish == FinishVeto {
+			t.Fatalf("seed %d: masking ran into the veto limit", seed)
+		}
+		for _, m := range markupInline {
+			if strings.Contains(res.Text, m) {
+				t.Fatalf("seed %d: %q in %q", seed, m, res.Text)
+			}
+		}
+		for _, line := range strings.Split(res.Text, "\n") {
+			if l := strings.TrimLeft(line, " \t"); strings.HasPrefix(l, "#") || strings.HasPrefix(l, ">") {
+				t.Fatalf("seed %d: line %q opens with markup", seed, line)
+			}
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package wtf
+
+// style.go — does a reply still sound like the oracle? StyleRules.Score
+// measures text against a persona's house style — emoji, sentence length,
+// assistant-speak, profanity, snark — and returns a StyleReport listing
+// what it broke. GenOptions.Style turns the check into a gate: a reply that
+// fails is sampled again, and the one that breaks the fewest rules is kept.
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// StyleRules are the limits a reply is held to. A zero limit is unchecked,
+// except MaxEmoji and MaxBanned, where 0 means none allowed.
+type StyleRules struct {
+	MaxEmoji        int
+	MaxMeanSentence float64  // mean words per sentence
+	MaxSentence     int      // words in the longest sentence
+	Banned          []string // phrases, matched case-insensitively
+	MaxBanned       int
+	Profanity       []string // word stems: "fuck" also counts "fucking", not "hell" "hello"
+	MaxProfanity    float64  // share of words that are profane
+	MinSnark        float64  // SnarkScore floor
+}
+
+// OracleStyle is the oracle's house style: no emoji, short sentences, no
+// customer-service voice, swearing as seasoning rather than the meal.
+func OracleStyle() StyleRules {
+	return StyleRules{
+		MaxMeanSentence: 25,
+		MaxSentence:     60,
+		Banned:          assistantSpeak,
+		Profanity: []string{"fuck", "shit", "damn", "crap", "hell", "bitch",
+			"bastard", "ass", "dick", "piss", "wtf"},
+		MaxProfanity: 0.15,
+		MinSnark:     5,
+	}
+}
+
+// assistantSpeak is what the fine-tune was trained out of saying.
+var assistantSpeak = []string{"as an ai", "i cannot", "i apologize",
+	"how can i help", "i'd be happy to", "great question"}
+
+// StyleReport is what Score measured.
+type StyleReport struct {
+	Pass     bool     `json:"pass"`
+	Failures []string `json:"failures,omitempty"` // one line per broken rule
+
+	Words         int      `json:"words"`
+	Sentences     int      `json:"sentences"`
+	SentenceWords []int    `json:"sentence_words,omitempty"` // per sentence, in order
+	MeanSentence  float64  `json:"mean_sentence"`
+	StdSentence   float64  `json:"std_sentence"`
+	MaxSentence   int      `json:"max_sentence"`
+	Emoji         int      `json:"emoji"`
+	Banned        []string `json:"banned,omitempty"` // phrases found, once per occurrence
+	Profanity     int      `json:"profanity"`
+	ProfanityRate float64  `json:"profanity_rate"`
+	Snark         float64  `json:"snark"`
+}
+
+// Score measures text against the rules.
+func (r StyleRules) Score(text string) StyleReport {
+	rep := StyleReport{Snark: SnarkScore(text)}
+	lower := strings.ToLower(text)
+
+	for _, s := range splitSentences(text) {
+		n := len(strings.Fields(s))
+		rep.SentenceWords = append(rep.SentenceWords, n)
+		rep.Words += n
+		rep.MaxSentence = max(rep.MaxSentence, n)
+	}
+	if rep.Sentences = len(rep.SentenceWords); rep.Sentences > 0 {
+		rep.MeanSentence = float64(rep.Words) / float64(rep.Sentences)
+		var ss float64
+		for _, n := range rep.SentenceWords {
+			d := float64(n) - rep.MeanSentence
+			ss += d * d
+		}
+		rep.StdSentence = math.Sqrt(ss / float64(rep.Sentences))
+	}
+
+	for _, c := range text {
+		if isEmoji(c) {
+			rep.Emoji++
+		}
+	}
+	for _, b := range r.Banned {
+		for range strings.Count(lower, strings.ToLower(b)) {
+			rep.Banned = append(rep.Banned, b)
+		}
+	}
+	for _, w := range strings.FieldsFunc(lower, func(c rune) bool { return !unicode.IsLetter(c) }) {
+		for _, p := range r.Profanity {
+			if strings.HasPrefix(w, p) && inflection(w[len(p):]) {
+				rep.Profanity++
+				break
+			}
+		}
+	}
+	if rep.Words > 0 {
+		rep.ProfanityRate = float64(rep.Profanity) / float64(rep.Words)
+	}
+
+	fail := func(format string, args ...any) {
+		rep.Failures = append(rep.Failures, fmt.Sprintf(format, args...))
+	}
+	if rep.Emoji > r.MaxEmoji {
+		fail("%d emoji, max %d", rep.Emoji, r.MaxEmoji)
+	}
+	if r.MaxMeanSentence > 0 && rep.MeanSentence > r.MaxMeanSentence {
+		fail("mean sentence %.1f words, max %.1f", rep.MeanSentence, r.MaxMeanSentence)
+	}
+	if r.MaxSentence > 0 && rep.MaxSentence > r.MaxSentence {
+		fail("longest sentence %d words, max %d", rep.MaxSentence, r.MaxSentence)
+	}
+	if len(rep.Banned) > r.MaxBanned {
+		fail("banned phrases %q, max %d", rep.Banned, r.MaxBanned)
+	}
+	if r.MaxProfanity > 0 && rep.ProfanityRate > r.MaxProfanity {
+		fail("profanity rate %.2f, max %.2f", rep.ProfanityRate, r.MaxProfanity)
+	}
+	if r.MinSnark > 0 && rep.Snark < r.MinSnark {
+		fail("snark %.1f, min %.1f", rep.Snark, r.MinSnark)
+	}
+	rep.Pass = len(rep.Failures) == 0
+	return rep
+}
+
+// splitSentences cuts text after runs of . ! ? and at line breaks. Blank
+// pieces are dropped.
+func splitSentences(text string) []string {
+	var out []string
+	start := 0
+	for i, c := range text {
+		if c != '.' && c != '!' && c != '?' && c != '\n' {
+			continue
+		}
+		if next := i + 1; next < len(text) && strings.ContainsRune(".!?", rune(text[next])) && c != '\n' {
+			continue // still inside "..." or "?!"
+		}
+		if s := strings.TrimSpace(text[start : i+1]); strings.ContainsFunc(s, unicode.IsLetter) {
+			out = append(out, s)
+		}
+		start = i + 1
+	}
+	if s := strings.TrimSpace(text[start:]); strings.ContainsFunc(s, unicode.IsLetter) {
+		out = append(out, s)
+	}
+	return out
+}
+
+// inflection reports whether suffix turns a stem into another form of the
+// same word.
+func inflection(suffix string) bool {
+	switch suffix {
+	case "", "s", "es", "ed", "er", "ers", "ing", "in", "y", "ty", "hole", "holes":
+		return true
+	}
+	return false
+}
+
+// isEmoji reports whether c is a pictograph. Joiners, variation selectors
+// and skin tones are parts of one emoji and are not counted.
+func isEmoji(c rune) bool {
+	switch {
+	case c >= 0x1F300 && c <= 0x1F3FA, c >= 0x1F400 && c <= 0x1FAFF:
+		return true
+	case c >= 0x1F000 && c <= 0x1F2FF: // mahjong, cards, enclosed letters
+		return true
+	case c >= 0x2600 && c <= 0x27BF: // misc symbols, dingbats
+		return true
+	case c >= 0x2B00 && c <= 0x2BFF: // arrows, stars
+		return c == 0x2B50 || c == 0x2B55 || c == 0x2B1B || c == 0x2B1C
+	}
+	return false
+}
+
+// SnarkScore rates how much a reply sounds like a reddit commenter: length
+// up to 80 words, slang, question and exclamation marks, trailing dots,
+// lowercase typing; assistant-speak costs 20 a phrase. Under five
+// characters scores -100. The constants mirror wtforacle.py:_score_response
+// so /troll choices stay comparable across versions.
+func SnarkScore(text string) float64 {
+	if len(strings.TrimSpace(text)) < 5 {
+		return -100
+	}
+	score := 0.0
+	words := strings.Fields(text)
+	if w := len(words); w < 80 {
+		score += float64(w) * 0.5
+	} else {
+		score += 80 * 0.5
+	}
+	lower := strings.ToLower(text)
+	for _, s := range []string{"bro", "tbh", "ngl", "imo", "lmao", "lol", "bruh",
+		"nah", "fr", "literally", "actually", "honestly",
+		"ok so", "look", "the thing is", "imagine"} {
+		score += float64(strings.Count(lower, s)) * 3
+	}
+	score += float64(strings.Count(text, "?")) * 2
+	score += float64(strings.Count(text, "!")) * 1.5
+	score += float64(strings.Count(text, "...")) * 2
+
+	alpha := 0
+	lowerAlpha := 0
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			alpha++
+			if unicode.IsLower(r) {
+				lowerAlpha++
+			}
+		}
+	}
+	if alpha > 0 && float64(lowerAlpha)/float64(alpha) > 0.9 {
+		score += 5
+	}
+	for _, b := range assistantSpeak {
+		if strings.Contains(lower, b) {
+			score -= 20
+		}
+	}
+	return score
+}
+
+// StyleGate regenerates replies that fail a style check.
+type StyleGate struct {
+	Rules   *StyleRules // nil = OracleStyle
+	Retries int         // extra samples allowed per call
+}
+
+// check scores text under the gate's rules.
+func (g *StyleGate) check(text string) StyleReport {
+	if g.Rules == nil {
+		return OracleStyle().Score(text)
+	}
+	return g.Rules.Score(text)
+}
+
+// styleGate scores res and, while it fails, samples again up to
+// opts.Style.Retries times, keeping the reply that broke the fewest rules.
+// Greedy decoding would only repeat itself, so it is scored but not retried.
+func styleGate(m *LlamaModel, tok *Tokenizer, tokens []int, start int, opts GenOptions, res Result) Result {
+	g := opts.Style
+	rep := g.check(res.Text)
+	res.Style = &rep
+	for try := 1; try <= g.Retries && !res.Style.Pass && opts.Temp > 0; try++ {
+		if opts.Seed != 0 {
+			opts.Seed++ // a fixed seed would replay the same sample path
+		}
+		next := decodeOnce(m, tok, tokens, start, opts)
+		rep := g.check(next.Text)
+		next.Style = &rep
+		next.Retries = res.Retries + 1
+		if len(rep.Failures) < len(res.Style.Failures) {
+			res = next
+		} else {
+			res.Retries = next.Retries
+		}
+	}
+	return res
+}
@@ -0,0 +1,57 @@
+package wtf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStyleScore(t *testing.T) {
+	r := OracleStyle()
+
+	good := r.Score("bro tbh that is a skill issue. ngl rust is fine... just learn it lol")
+	if !good.Pass || good.Sentences != 3 || good.Emoji != 0 || len(good.Banned) != 0 {
+		t.Fatalf("snarky reply failed: %+v", good)
+	}
+	if !reflect.DeepEqual(good.SentenceWords, []int{7, 4, 4}) {
+		t.Fatalf("sentence lengths %v", good.SentenceWords)
+	}
+
+	bad := r.Score("Great question! As an AI, I'd be happy to help 😊🚀")
+	if bad.Pass || bad.Emoji != 2 || len(bad.Banned) != 3 {
+		t.Fatalf("assistant reply: %+v", bad)
+	}
+
+	// Stems count their inflections, not words that merely start with them.
+	sw := r.Score("hello hellish shell, damned assumption. hell.")
+	if sw.Profanity != 2 {
+		t.Fatalf("profanity %d in %q, want 2", sw.Profanity, "hello hellish shell, damned assumption. hell.")
+	}
+	if r.Score("fuck shit damn, bro.").Pass {
+		t.Fatal("profanity rate above the limit passed")
+	}
+}
+
+func TestStyleGate(t *testing.T) {
+	e := newTestEngine()
+	opts := greedyOpts(8)
+	opts.Style = &StyleGate{Retries: 3}
+	res, err := e.Generate("", "the sky", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Style == nil || res.Retries != 0 {
+		t.Fatalf("greedy reply: style %+v, %d retries; want scored, never resampled", res.Style, res.Retries)
+	}
+
+	// Nothing passes an impossible snark floor: every retry is spent and the
+	// reply still carries its report.
+	opts.Temp, opts.Seed = 0.9, 11
+	opts.Style = &StyleGate{Rules: &StyleRules{MinSnark: 1e9}, Retries: 2}
+	res, err = e.Generate("", "the sky", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Style == nil || res.Style.Pass || res.Retries != 2 {
+		t.Fatalf("style %+v after %d retries, want a failing report after 2", res.Style, res.Retries)
+	}
+}
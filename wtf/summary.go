@@ -0,0 +1,100 @@
+package wtf
+
+// summary.go — sessions that outgrow the context fold their oldest turns
+// into a summary instead of dropping them. With Session.Summarize set, a
+// turn whose prompt (plus room for the reply) would pass At of the context
+// first has the model itself summarize everything but the latest Keep
+// turns, under the same lock and on the same cache as the turn. The
+// summary rides after the system message and the folded turns leave
+// Messages; it only changes at the next compression, so the turns between
+// two compressions reuse the cached prefix as usual.
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// SummaryPolicy configures Session compression. The zero value never
+// summarizes.
+type SummaryPolicy struct {
+	At        float64 `json:"at"`                   // share of the context a turn may fill before older turns are folded, e.g. 0.75; 0 = off
+	Keep      int     `json:"keep,omitempty"`       // latest turns kept word for word; 0 = DefaultSummaryKeep
+	MaxTokens int     `json:"max_tokens,omitempty"` // summary length; 0 = DefaultSummaryTokens
+}
+
+const (
+	DefaultSummaryKeep   = 2
+	DefaultSummaryTokens = 128
+)
+
+// summaryAnchor and summaryAsk frame the summarizing pass; summaryLead
+// introduces the summary in the session's prompt.
+const (
+	summaryAnchor = "You keep notes on a conversation."
+	summaryAsk    = "Summarize the conversation below in a few plain sentences: who asked what, what was answered, any names, numbers and decisions.\n\n"
+	summaryLead   = "Earlier in this conversation: "
+)
+
+// due reports whether a turn of n prompt tokens needs compressing first.
+func (p *SummaryPolicy) due(n int, opts *GenOptions, seqLen int) bool {
+	return p.At > 0 && float64(n+opts.MaxTokens) > p.At*float64(seqLen)
+}
+
+// compress folds the oldest turns of msgs (history plus the new user
+// message) into s.Summary and returns what is left. With nothing to fold,
+// or no summary that fits the context, msgs comes back as it was. Caller
+// holds the engine lock.
+func (s *Session) compress(msgs []Message) ([]Message, error) {
+	p := s.Summarize
+	keep, maxTokens := p.Keep, p.MaxTokens
+	if keep <= 0 {
+		keep = DefaultSummaryKeep
+	}
+	if maxTokens <= 0 {
+		maxTokens = DefaultSummaryTokens
+	}
+	var system []Message
+	rest := msgs
+	if rest[0].Role == RoleSystem {
+		system, rest = rest[:1], rest[1:]
+	}
+	turns := splitTurns(rest[:len(rest)-1])
+	if len(turns) <= keep {
+		return msgs, nil
+	}
+
+	opts := DefaultGenOptions()
+	opts.MaxTokens, opts.Temp = maxTokens, 0
+	s.e.Tok.chatStops(s.Format, &opts)
+	// Fold as many of the old turns as the context takes, oldest first.
+	seqLen := s.e.Model.Config.SeqLen
+	for n := len(turns) - keep; n > 0; n-- {
+		var b strings.Builder
+		if s.Summary != "" {
+			b.WriteString(summaryLead + s.Summary + "\n")
+		}
+		for _, t := range turns[:n] {
+			for _, m := range t {
+				fmt.Fprintf(&b, "%s: %s\n", m.Role, m.Content)
+			}
+		}
+		tokens, err := s.e.Tok.BuildChat([]Message{{RoleSystem, summaryAnchor}, {RoleUser, summaryAsk + b.String()}}, s.Format)
+		if err != nil {
+			return nil, err
+		}
+		if len(tokens)+maxTokens >= seqLen {
+			continue
+		}
+		res := s.e.decodeCached(tokens, opts)
+		s.SummaryTokens += res.PromptTokens + len(res.Tokens)
+		summary := strings.TrimSpace(res.Text)
+		if summary == "" {
+			return msgs, nil // keep the turns rather than lose them to an empty note
+		}
+		s.Summary = summary
+		out := append(slices.Clone(system), slices.Concat(turns[n:]...)...)
+		return append(out, rest[len(rest)-1]), nil
+	}
+	return msgs, nil
+}
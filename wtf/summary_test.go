@@ -0,0 +1,52 @@
+package wtf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSessionSummarize(t *testing.T) {
+	e := newTestEngine()
+	// Room for the summarizing prompt: the test vocabulary spends a token
+	// per byte.
+	m := e.Model
+	m.Config.SeqLen = 512
+	m.State = allocState(&m.Config)
+	precomputeRoPE(&m.State, &m.Config)
+	opts := greedyOpts(6)
+	opts.Grace.Limit = 0
+	s := e.NewSession("you are the oracle", ChatQA, opts)
+	s.Summarize = SummaryPolicy{At: 0.6, Keep: 1, MaxTokens: 12}
+
+	folded := false
+	for turn := range 12 {
+		before := len(s.Messages)
+		if _, err := s.Send("why is the sky " + strings.Repeat("so ", turn%3) + "blue"); err != nil {
+			t.Fatalf("turn %d: %v", turn, err)
+		}
+		if len(s.Messages) < before+2 {
+			folded = true
+			if s.Summary == "" || s.SummaryTokens == 0 {
+				t.Fatalf("turn %d: turns folded without a summary", turn)
+			}
+			if s.Messages[0].Content != "you are the oracle" || len(s.Messages) != 1+2*2 {
+				t.Fatalf("turn %d: kept %+v", turn, s.Messages)
+			}
+		}
+		if n := len(e.Model.State.Tokens); n >= e.Model.Config.SeqLen {
+			t.Fatalf("turn %d: %d tokens in a %d context", turn, n, e.Model.Config.SeqLen)
+		}
+	}
+	if !folded {
+		t.Fatal("history never summarized")
+	}
+
+	blob, err := s.Export(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := e.ImportSession(blob)
+	if err != nil || back.Summary != s.Summary || back.Summarize != s.Summarize {
+		t.Fatalf("import: %q, %+v, %v", back.Summary, back.Summarize, err)
+	}
+}
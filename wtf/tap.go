@@ -0,0 +1,49 @@
+package wtf
+
+// tap.go — activation tap for interpretability work. A registered tap sees
+// the residual stream (the hidden state after a layer's attention and MLP
+// blocks) of the chosen layers on every forward pass — prefill, decode and
+// scoring alike — without touching the model code.
+
+import "fmt"
+
+// TapFunc receives layer l's output for the token at pos. hidden is the
+// model's own buffer, valid only during the call: copy it to keep it.
+type TapFunc func(layer, pos int, hidden []float32)
+
+type activationTap struct {
+	want []bool
+	fn   TapFunc
+}
+
+// SetActivationTap calls fn after each of layers (nil = all) on every
+// forward pass; fn == nil removes the tap. While a tap is set, run-ahead is
+// disabled so every tapped pass is one the decode actually kept.
+func (e *Engine) SetActivationTap(layers []int, fn TapFunc) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.Model.SetActivationTap(layers, fn)
+}
+
+// SetActivationTap is Engine.SetActivationTap for a bare model. Not safe
+// while a forward pass is running.
+func (m *LlamaModel) SetActivationTap(layers []int, fn TapFunc) error {
+	if fn == nil {
+		m.tap = nil
+		return nil
+	}
+	t := &activationTap{want: make([]bool, m.Config.NumLayers), fn: fn}
+	for _, l := range layers {
+		if l < 0 || l >= m.Config.NumLayers {
+			return fmt.Errorf("tap: layer %d out of range [0, %d)", l, m.Config.NumLayers)
+		}
+		t.want[l] = true
+	}
+	if layers == nil {
+		for l := range t.want {
+			t.want[l] = true
+		}
+	}
+	m.tap = t
+	return nil
+}
@@ -0,0 +1,69 @@
+package wtf
+
+// telemetry.go — per-token uncertainty. With GenOptions.Telemetry set, every
+// sampled token records the entropy of the distribution it was drawn from
+// and its own probability, so a host can tell a confident reply from one the
+// model was flailing through — and see drift before the text goes bad.
+
+import "math"
+
+// TokenStat is the sampling picture for one generated token. Both numbers
+// are taken over the full vocab after temperature and penalties, before any
+// top-k / top-p cut.
+type TokenStat struct {
+	ID      int
+	Prob    float32 // probability of the chosen token
+	Entropy float32 // entropy of the distribution, in nats
+}
+
+// tokenStat computes the stat for choosing id from logits at temperature
+// temp (temp <= 0, i.e. greedy, is measured at 1).
+func tokenStat(logits []float32, vocab int, temp float32, id int) TokenStat {
+	if temp <= 0 {
+		temp = 1
+	}
+	maxv := logits[0]
+	for i := 1; i < vocab; i++ {
+		maxv = max(maxv, logits[i])
+	}
+	// H = log Z - E[x] with x = (l - max) / T, Z = Σ e^x.
+	var z, ex float64
+	for i := 0; i < vocab; i++ {
+		x := float64((logits[i] - maxv) / temp)
+		e := math.Exp(x)
+		z += e
+		ex += e * x
+	}
+	x := float64((logits[id] - maxv) / temp)
+	return TokenStat{
+		ID:      id,
+		Prob:    float32(math.Exp(x) / z),
+		Entropy: float32(math.Log(z) - ex/z),
+	}
+}
+
+// MeanEntropy is the average per-token entropy of the reply (0 without
+// telemetry).
+func (r Result) MeanEntropy() float32 {
+	if len(r.Stats) == 0 {
+		return 0
+	}
+	var sum float32
+	for _, s := range r.Stats {
+		sum += s.Entropy
+	}
+	return sum / float32(len(r.Stats))
+}
+
+// MeanSurprise is the average -log p of the chosen tokens, in nats — how
+// far off the model's own expectations the sampler wandered.
+func (r Result) MeanSurprise() float32 {
+	if len(r.Stats) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, s := range r.Stats {
+		sum -= math.Log(float64(max(s.Prob, 1e-30)))
+	}
+	return float32(sum / float64(len(r.Stats)))
+}
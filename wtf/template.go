@@ -0,0 +1,111 @@
+package wtf
+
+// template.go — {{variables}} in persona anchors and system messages, so
+// the oracle knows what day it is without the host rebuilding its anchors:
+//
+//	"today is {{weekday}}, {{date}}. your knowledge stops at {{cutoff}}."
+//
+// Built in are date (2006-01-02), weekday, month and year, on the local
+// clock, and tools, the registered tools (see tools.go). Custom variables
+// come from Engine.SetVar (the config's "vars") and, per call, from
+// GenOptions.Vars; a custom variable wins over a built-in of the same name.
+// A placeholder with no value is left as written.
+//
+// Variables are resolved when the anchor is prefilled. A persona keeps its
+// cached KV prefix while the resolved anchor stays the same and re-prefills
+// once when it changes — at midnight for {{date}}, or on every call whose
+// Vars give it a new value, so keep per-call values out of anchors that
+// should stay cached. Response cache keys cover the resolved text.
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// templateVar matches a {{name}} placeholder; spaces inside the braces are
+// allowed.
+var templateVar = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_]+)\s*\}\}`)
+
+var varName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// SetVar sets the custom template variable name to value for every later
+// call; an empty value removes it.
+func (e *Engine) SetVar(name, value string) error {
+	if !varName.MatchString(name) {
+		return fmt.Errorf("template variable %q: names are letters, digits and _", name)
+	}
+	e.varMu.Lock()
+	defer e.varMu.Unlock()
+	if value == "" {
+		delete(e.vars, name)
+		return nil
+	}
+	if e.vars == nil {
+		e.vars = make(map[string]string)
+	}
+	e.vars[name] = value
+	return nil
+}
+
+// Vars returns the custom template variables set with SetVar.
+func (e *Engine) Vars() map[string]string {
+	e.varMu.Lock()
+	defer e.varMu.Unlock()
+	return maps.Clone(e.vars)
+}
+
+// expand resolves the placeholders in text: call first, then the engine's
+// variables, then the built-ins.
+func (e *Engine) expand(text string, call map[string]string) string {
+	if !strings.Contains(text, "{{") {
+		return text
+	}
+	now := time.Now
+	if e.now != nil {
+		now = e.now
+	}
+	t := now()
+	e.varMu.Lock()
+	defer e.varMu.Unlock()
+	return templateVar.ReplaceAllStringFunc(text, func(ph string) string {
+		name := templateVar.FindStringSubmatch(ph)[1]
+		if v, ok := call[name]; ok {
+			return v
+		}
+		if v, ok := e.vars[name]; ok {
+			return v
+		}
+		switch name {
+		case "date":
+			return t.Format(time.DateOnly)
+		case "weekday":
+			return t.Weekday().String()
+		case "month":
+			return t.Month().String()
+		case "year":
+			return t.Format("2006")
+		case "tools":
+			return e.toolList()
+		}
+		return ph
+	})
+}
+
+// resolve brings the persona's tokens up to date with its anchor's current
+// expansion, dropping the cached prefix if they change. Caller holds mu.
+func (e *Engine) resolve(p *Persona, call map[string]string) error {
+	text := e.expand(p.Anchor, call)
+	if text == p.text {
+		return nil
+	}
+	tokens, err := e.anchorTokens(p.Name, text)
+	if err != nil {
+		return err
+	}
+	p.prefix.release()
+	p.prefix, p.tokens, p.text = nil, tokens, text
+	return nil
+}
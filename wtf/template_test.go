@@ -0,0 +1,66 @@
+package wtf
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTemplateVars(t *testing.T) {
+	e := newTestEngine()
+	day := time.Date(2026, time.October, 15, 9, 0, 0, 0, time.Local)
+	e.now = func() time.Time { return day }
+	if err := e.SetVar("cutoff", "2024"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetVar("bad name", "x"); err == nil {
+		t.Fatal("SetVar accepted a name with a space")
+	}
+
+	got := e.expand("{{weekday}} {{ date }}, {{month}} {{year}}; cutoff {{cutoff}}, {{who}} {{nope}}", map[string]string{"who": "you"})
+	if want := "Thursday 2026-10-15, October 2026; cutoff 2024, you {{nope}}"; got != want {
+		t.Fatalf("expand = %q; want %q", got, want)
+	}
+	if got := e.expand("{{cutoff}}", map[string]string{"cutoff": "never"}); got != "never" {
+		t.Fatalf("call vars must win: %q", got)
+	}
+
+	if err := e.RegisterPersona("oracle", "today is {{date}}", SamplerOverrides{}); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := e.Persona("oracle")
+	if p.text != "today is 2026-10-15" {
+		t.Fatalf("anchor resolved to %q", p.text)
+	}
+	first, err := e.Generate("oracle", "the sky", greedyOpts(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := p.prefix
+	if _, err := e.Generate("oracle", "the sky", greedyOpts(6)); err != nil || p.prefix != prefix {
+		t.Fatalf("same day: prefix rebuilt (%v)", err)
+	}
+
+	// A new day resolves a new anchor and drops the cached prefix.
+	day = day.AddDate(0, 0, 1)
+	if _, err := e.Generate("oracle", "the sky", greedyOpts(6)); err != nil || p.prefix == prefix || p.text != "today is 2026-10-16" {
+		t.Fatalf("next day: %q, %v", p.text, err)
+	}
+	day = day.AddDate(0, 0, -1)
+	if again, err := e.Generate("oracle", "the sky", greedyOpts(6)); err != nil || again.Text != first.Text {
+		t.Fatalf("back to the first day: %q, %v; want %q", again.Text, err, first.Text)
+	}
+
+	// Sessions keep the system message as written.
+	s := e.NewSession("today is {{date}}", ChatQA, greedyOpts(4))
+	if _, err := s.Send("hi"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Messages[0].Content != "today is {{date}}" {
+		t.Fatalf("session system message rewritten: %q", s.Messages[0].Content)
+	}
+	want, _ := e.Tok.BuildChat([]Message{{RoleSystem, "today is 2026-10-15"}, {RoleUser, "hi"}}, ChatQA)
+	if got := e.Model.State.Tokens[:len(want)]; !slices.Equal(got, want) {
+		t.Fatal("session prompt did not resolve the system message")
+	}
+}
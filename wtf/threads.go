@@ -0,0 +1,55 @@
+package wtf
+
+// threads.go — how much of the host the engine may use. An embedder sharing
+// the process with latency-sensitive work caps the Go scheduler with
+// SetThreads and, on Linux, pins the process to a CPU subset with
+// SetThreadAffinity. Threads inside the BLAS library are governed by its own
+// environment (OPENBLAS_NUM_THREADS, VECLIB_MAXIMUM_THREADS), read at startup.
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// ErrAffinityUnsupported is returned by SetThreadAffinity where the OS has
+// no per-thread CPU masks (everything but Linux).
+var ErrAffinityUnsupported = errors.New("thread affinity not supported on this platform")
+
+// SetThreads caps the threads running Go code at once — decode, batch
+// encode workers, async — and returns the previous cap. n <= 0 only reports.
+func SetThreads(n int) int {
+	if n <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return runtime.GOMAXPROCS(n)
+}
+
+// ParseCPUList parses a Linux-style CPU list such as "0-3,8,10-11".
+func ParseCPUList(s string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		a, err := strconv.Atoi(lo)
+		b := a
+		if err == nil && isRange {
+			b, err = strconv.Atoi(hi)
+		}
+		if err != nil || a < 0 || b < a {
+			return nil, fmt.Errorf("bad cpu list entry %q", part)
+		}
+		for c := a; c <= b; c++ {
+			cpus = append(cpus, c)
+		}
+	}
+	if len(cpus) == 0 {
+		return nil, fmt.Errorf("empty cpu list %q", s)
+	}
+	return cpus, nil
+}
@@ -0,0 +1,97 @@
+package wtf
+
+// threads_linux.go — CPU pinning via sched_setaffinity.
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetThreadAffinity pins every thread of the process to cpus. Threads the Go
+// runtime starts later inherit the mask from the thread that spawns them,
+// so the pin holds for the life of the process. Call it before the first
+// generation; BLAS worker threads started earlier keep their old mask.
+func SetThreadAffinity(cpus []int) error {
+	var set unix.CPUSet
+	for _, c := range cpus {
+		if c < 0 || c >= len(set)*64 {
+			return fmt.Errorf("affinity: cpu %d out of range", c)
+		}
+		set.Set(c)
+	}
+	if set.Count() == 0 {
+		return fmt.Errorf("affinity: no cpus given")
+	}
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return fmt.Errorf("affinity: %w", err)
+	}
+	for _, t := range tasks {
+		tid, err := strconv.Atoi(t.Name())
+		if err != nil {
+			continue
+		}
+		// A thread may exit between ReadDir and here.
+		if err := unix.SchedSetaffinity(tid, &set); err != nil && err != unix.ESRCH {
+			return fmt.Errorf("affinity: thread %d: %w", tid, err)
+		}
+	}
+	return nil
+}
+
+// ThreadAffinity reports the CPUs the calling thread may run on.
+func ThreadAffinity() ([]int, error) {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return nil, fmt.Errorf("affinity: %w", err)
+	}
+	var cpus []int
+	for c := 0; c < len(set)*64; c++ {
+		if set.IsSet(c) {
+			cpus = append(cpus, c)
+		}
+	}
+	return cpus, nil
+}
+
+// lowPriority runs fn on an OS thread at nice 19. Niced threads are kept
+// locked to their goroutines, so one never goes back to the scheduler still
+// niced (an unprivileged process cannot raise it again), and idle ones wait
+// in nicedIdle for the next call instead of a thread being made per call.
+func lowPriority(fn func()) {
+	var inbox chan func()
+	select {
+	case inbox = <-nicedIdle:
+	default:
+		inbox = make(chan func())
+		go nicedWorker(inbox)
+	}
+	done := make(chan struct{})
+	inbox <- func() {
+		defer close(done)
+		fn()
+	}
+	<-done
+	select {
+	case nicedIdle <- inbox:
+	default:
+		close(inbox) // enough idle already: let the thread exit
+	}
+}
+
+// nicedIdle holds the inboxes of idle niced workers.
+var nicedIdle = make(chan chan func(), runtime.NumCPU())
+
+// nicedWorker nices its thread and runs what arrives on inbox until it is
+// closed; the thread then exits with the goroutine.
+func nicedWorker(inbox <-chan func()) {
+	runtime.LockOSThread()
+	_ = unix.Setpriority(unix.PRIO_PROCESS, unix.Gettid(), 19) // best effort
+	for fn := range inbox {
+		fn()
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package wtf
+
+// SetThreadAffinity is Linux-only; elsewhere it returns ErrAffinityUnsupported.
+func SetThreadAffinity(cpus []int) error { return ErrAffinityUnsupported }
+
+// ThreadAffinity is Linux-only; elsewhere it returns ErrAffinityUnsupported.
+func ThreadAffinity() ([]int, error) { return nil, ErrAffinityUnsupported }
+
+// lowPriority just runs fn: only Linux has per-thread priorities. The
+// pauses between tokens still apply.
+func lowPriority(fn func()) { fn() }
@@ -0,0 +1,36 @@
+package wtf
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	got, err := ParseCPUList("0-2, 5,7-8")
+	if err != nil || !slices.Equal(got, []int{0, 1, 2, 5, 7, 8}) {
+		t.Fatalf("got %v, %v", got, err)
+	}
+	for _, bad := range []string{"", "3-1", "x", "1-", "-2"} {
+		if _, err := ParseCPUList(bad); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+}
+
+func TestSetThreadAffinity(t *testing.T) {
+	orig, err := ThreadAffinity()
+	if errors.Is(err, ErrAffinityUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetThreadAffinity(orig)
+	if err := SetThreadAffinity(orig[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ThreadAffinity(); !slices.Equal(got, orig[:1]) {
+		t.Fatalf("affinity = %v, want %v", got, orig[:1])
+	}
+}
@@ -13,9 +13,13 @@ package wtf
 //   6 = byte fallback (<0x00>...<0xFF>)
 
 import (
+	"container/heap"
 	"fmt"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"unicode/utf8"
 )
 
@@ -25,6 +29,10 @@ import (
 // Other bytes (0-32, 127-160, 173) map to 256+n.
 var gpt2UnicodeToByteMap map[rune]byte
 
+// gpt2ByteToUnicode is the forward mapping, as the UTF-8 string the vocab
+// stores for each byte (' ' → "Ġ", '\n' → "Ċ").
+var gpt2ByteToUnicode [256]string
+
 func init() {
 	gpt2UnicodeToByteMap = make(map[rune]byte, 256)
 	// Printable byte ranges that map to themselves
@@ -54,6 +62,9 @@ func init() {
 			n++
 		}
 	}
+	for r, b := range gpt2UnicodeToByteMap {
+		gpt2ByteToUnicode[b] = string(r)
+	}
 }
 
 // Tokenizer handles SentencePiece BPE encoding/decoding
@@ -77,6 +88,20 @@ type Tokenizer struct {
 
 	// Special tokens that should be matched as whole units (not BPE'd)
 	specialTokens map[string]int
+
+	// Decoded text of every token, built on first use (see Piece)
+	pieces     []string
+	piecesOnce sync.Once
+
+	// Tokens masked or biased at every step: per GenOptions.Strip kind
+	// (see strip.go) and per GenOptions.Language script set (see lang.go)
+	stripped map[StripKind][]int
+	foreign  map[string][]int
+	maskMu   sync.Mutex
+
+	// Tokens that can open a tool call, built on first use (see tools.go)
+	calls    *callIndex
+	callOnce sync.Once
 }
 
 // NewTokenizer creates a tokenizer from GGUF metadata
@@ -162,6 +187,37 @@ func (t *Tokenizer) Encode(text string, addBos bool) []int {
 	return tokens
 }
 
+// EncodeBatch encodes every text (no BOS), spreading the work over the
+// available CPUs. Encode only reads the tokenizer, so this is safe to call
+// while a generation is running.
+func (t *Tokenizer) EncodeBatch(texts []string) [][]int {
+	out := make([][]int, len(texts))
+	workers := min(runtime.GOMAXPROCS(0), len(texts))
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1) - 1); i < len(texts); i = int(next.Add(1) - 1) {
+				out[i] = t.Encode(texts[i], false)
+			}
+		}()
+	}
+	wg.Wait()
+	return out
+}
+
+// CountTokens returns the encoded length of every text — the budget check
+// for a batch of candidate prompts.
+func (t *Tokenizer) CountTokens(texts []string) []int {
+	counts := make([]int, len(texts))
+	for i, ids := range t.EncodeBatch(texts) {
+		counts[i] = len(ids)
+	}
+	return counts
+}
+
 // splitOnSpecialTokens splits text into segments, preserving special tokens as separate items
 func (t *Tokenizer) splitOnSpecialTokens(text string) []string {
 	if len(t.specialTokens) == 0 {
@@ -232,18 +288,11 @@ func (t *Tokenizer) encodeSentencePiece(text string) []int {
 
 // encodeGPT2 does GPT-2 BPE encoding (byte-level, merge-based)
 func (t *Tokenizer) encodeGPT2(text string) []int {
-	// GPT-2 BPE: each byte is an initial symbol (using vocab tokens)
-	var symbols []string
+	// GPT-2 BPE: each byte is an initial symbol, spelled the way the vocab
+	// spells it (byte → unicode mapping: ' ' is "Ġ", 0xE2 is "â", ...).
+	symbols := make([]string, 0, len(text))
 	for _, b := range []byte(text) {
-		// Try the byte as a single-char string first
-		ch := string([]byte{b})
-		if _, ok := t.tokenToID[ch]; ok {
-			symbols = append(symbols, ch)
-		} else {
-			// Byte fallback
-			byteStr := fmt.Sprintf("<0x%02X>", b)
-			symbols = append(symbols, byteStr)
-		}
+		symbols = append(symbols, gpt2ByteToUnicode[b])
 	}
 
 	symbols = t.bpeMerge(symbols)
@@ -262,63 +311,96 @@ func (t *Tokenizer) bpeMerge(symbols []string) []string {
 
 // bpeMergeGPT2 uses merge priority table (GPT-2 / SmolLM2 style)
 func (t *Tokenizer) bpeMergeGPT2(symbols []string) []string {
-	for {
-		bestRank := len(t.mergePriority) + 1 // worse than any real rank
-		bestIdx := -1
-
-		for i := 0; i < len(symbols)-1; i++ {
-			pair := symbols[i] + " " + symbols[i+1]
-			if rank, ok := t.mergePriority[pair]; ok {
-				if rank < bestRank {
-					bestRank = rank
-					bestIdx = i
-				}
-			}
+	return mergeQueue(symbols, func(a, b string) (float64, bool) {
+		rank, ok := t.mergePriority[a+" "+b]
+		return float64(rank), ok
+	})
+}
+
+// bpeMergeScores uses token scores (SentencePiece / LLaMA style)
+func (t *Tokenizer) bpeMergeScores(symbols []string) []string {
+	return mergeQueue(symbols, func(a, b string) (float64, bool) {
+		if id, ok := t.tokenToID[a+b]; ok && id < len(t.Scores) && t.Scores[id] > -1e30 {
+			return -float64(t.Scores[id]), true
 		}
+		return 0, false
+	})
+}
 
-		if bestIdx < 0 {
-			break
+// mergeQueue runs greedy BPE: repeatedly merge the adjacent pair with the
+// lowest cost (leftmost on a tie) until no pair has one. Pairs wait in a
+// heap and symbols in a linked list, so a long prompt costs n log n, not
+// the n² of rescanning every pair after every merge.
+func mergeQueue(symbols []string, cost func(a, b string) (float64, bool)) []string {
+	if len(symbols) < 2 {
+		return symbols
+	}
+	next := make([]int, len(symbols)) // -1 = end; a merged-away symbol is ""
+	prev := make([]int, len(symbols))
+	for i := range symbols {
+		next[i], prev[i] = i+1, i-1
+	}
+	next[len(symbols)-1] = -1
+
+	var q mergeHeap
+	push := func(l, r int) {
+		if l >= 0 && r >= 0 {
+			if c, ok := cost(symbols[l], symbols[r]); ok {
+				heap.Push(&q, mergePair{cost: c, left: l, right: r, size: len(symbols[l]) + len(symbols[r])})
+			}
+		}
+	}
+	for i := 0; i+1 < len(symbols); i++ {
+		push(i, i+1)
+	}
+	for q.Len() > 0 {
+		p := heap.Pop(&q).(mergePair)
+		l, r := p.left, p.right
+		// Stale: one side was merged into something else since the push.
+		if next[l] != r || symbols[l] == "" || symbols[r] == "" || len(symbols[l])+len(symbols[r]) != p.size {
+			continue
+		}
+		symbols[l] += symbols[r]
+		symbols[r] = ""
+		next[l] = next[r]
+		if next[l] >= 0 {
+			prev[next[l]] = l
 		}
+		push(prev[l], l)
+		push(l, next[l])
+	}
 
-		merged := symbols[bestIdx] + symbols[bestIdx+1]
-		newSymbols := make([]string, 0, len(symbols)-1)
-		newSymbols = append(newSymbols, symbols[:bestIdx]...)
-		newSymbols = append(newSymbols, merged)
-		newSymbols = append(newSymbols, symbols[bestIdx+2:]...)
-		symbols = newSymbols
+	out := symbols[:0]
+	for i := 0; i >= 0; i = next[i] {
+		out = append(out, symbols[i])
 	}
-	return symbols
+	return out
 }
 
-// bpeMergeScores uses token scores (SentencePiece / LLaMA style)
-func (t *Tokenizer) bpeMergeScores(symbols []string) []string {
-	for {
-		bestScore := float32(-1e30)
-		bestIdx := -1
-
-		for i := 0; i < len(symbols)-1; i++ {
-			merged := symbols[i] + symbols[i+1]
-			if id, ok := t.tokenToID[merged]; ok && id < len(t.Scores) {
-				score := t.Scores[id]
-				if score > bestScore {
-					bestScore = score
-					bestIdx = i
-				}
-			}
-		}
+// mergePair is a candidate merge of symbols left and right, whose texts
+// were size bytes long together when it was queued.
+type mergePair struct {
+	cost        float64
+	left, right int
+	size        int
+}
 
-		if bestIdx < 0 {
-			break
-		}
+type mergeHeap []mergePair
 
-		merged := symbols[bestIdx] + symbols[bestIdx+1]
-		newSymbols := make([]string, 0, len(symbols)-1)
-		newSymbols = append(newSymbols, symbols[:bestIdx]...)
-		newSymbols = append(newSymbols, merged)
-		newSymbols = append(newSymbols, symbols[bestIdx+2:]...)
-		symbols = newSymbols
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].cost != h[j].cost {
+		return h[i].cost < h[j].cost
 	}
-	return symbols
+	return h[i].left < h[j].left
+}
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)   { *h = append(*h, x.(mergePair)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
 }
 
 // symbolsToIDs converts BPE symbols to token IDs with byte fallback
@@ -444,6 +526,76 @@ func (t *Tokenizer) DecodeToken(id int) string {
 	return piece
 }
 
+// StreamDecoder turns a token stream into text incrementally without ever
+// splitting a UTF-8 character. A multi-byte character built from byte
+// tokens (<0xE2><0x80><0x99>, or GPT-2 pieces that end mid-character) is held
+// back until its last byte arrives. Decode of the whole sequence doesn't need
+// this — it concatenates bytes — but per-token output does.
+type StreamDecoder struct {
+	tok     *Tokenizer
+	pending []byte
+}
+
+// NewStreamDecoder returns a decoder with no pending bytes.
+func (t *Tokenizer) NewStreamDecoder() *StreamDecoder {
+	return &StreamDecoder{tok: t}
+}
+
+// Push decodes token id and returns the text that is now complete.
+func (d *StreamDecoder) Push(id int) string {
+	return d.Write(d.tok.DecodeToken(id))
+}
+
+// Write appends already-decoded bytes and returns the text that is now
+// complete. Invalid sequences are passed through, not held.
+func (d *StreamDecoder) Write(piece string) string {
+	d.pending = append(d.pending, piece...)
+	n := completeUTF8(d.pending)
+	out := string(d.pending[:n])
+	d.pending = append(d.pending[:0], d.pending[n:]...)
+	return out
+}
+
+// Flush returns whatever is still held (an unfinished character, raw).
+func (d *StreamDecoder) Flush() string {
+	out := string(d.pending)
+	d.pending = d.pending[:0]
+	return out
+}
+
+// completeUTF8 is the length of the longest prefix of b that does not end
+// inside an unfinished multi-byte character.
+func completeUTF8(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return len(b)
+			}
+			return i
+		}
+	}
+	return len(b)
+}
+
+// Piece returns the decoded text of token id, from a table built once.
+func (t *Tokenizer) Piece(id int) string {
+	t.piecesOnce.Do(func() {
+		t.pieces = make([]string, t.VocabSize)
+		for i := range t.pieces {
+			t.pieces[i] = t.DecodeToken(i)
+		}
+	})
+	if id < 0 || id >= len(t.pieces) {
+		return ""
+	}
+	return t.pieces[id]
+}
+
+// IsControl reports whether id is a control token (<s>, <|im_start|>, ...).
+func (t *Tokenizer) IsControl(id int) bool {
+	return t.Types != nil && id >= 0 && id < len(t.Types) && t.Types[id] == 3
+}
+
 // FindSpecialToken searches for a special token by name
 func (t *Tokenizer) FindSpecialToken(name string) int {
 	variants := []string{
@@ -0,0 +1,103 @@
+package wtf
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestEncodeBatch(t *testing.T) {
+	tok := newTestTokenizer()
+	texts := []string{"", "the oracle", "<|im_start|>x", "lol", "the the the"}
+	got := tok.EncodeBatch(texts)
+	counts := tok.CountTokens(texts)
+	for i, s := range texts {
+		want := tok.Encode(s, false)
+		if !slices.Equal(got[i], want) {
+			t.Errorf("EncodeBatch[%d] = %v, want %v", i, got[i], want)
+		}
+		if counts[i] != len(want) {
+			t.Errorf("CountTokens[%d] = %d, want %d", i, counts[i], len(want))
+		}
+	}
+	if len(tok.EncodeBatch(nil)) != 0 {
+		t.Error("EncodeBatch(nil) should be empty")
+	}
+}
+
+func TestWriteVocabJSON(t *testing.T) {
+	tok := newTestTokenizer()
+	var buf bytes.Buffer
+	if err := tok.WriteVocabJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var entries []VocabEntry
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(tok.Vocab) {
+		t.Fatalf("%d entries, want %d", len(entries), len(tok.Vocab))
+	}
+	id := tok.FindSpecialToken("im_start")
+	if e := entries[id]; e.ID != id || e.Piece != "<|im_start|>" || e.Type != 3 {
+		t.Errorf("im_start entry = %+v", e)
+	}
+	if e := entries[tok.tokenToID["Ġthe"]]; e.Text != " the" {
+		t.Errorf("Ġthe decodes to %q, want %q", e.Text, " the")
+	}
+}
+
+func TestEncodeGPT2Bytes(t *testing.T) {
+	tok := newTestTokenizer()
+	// Spaces and newlines go through the byte→unicode mapping (Ġ, Ċ) and
+	// merge; they used to be looked up raw and silently dropped.
+	if got, want := tok.Encode(" the", false), []int{tok.tokenToID["Ġthe"]}; !slices.Equal(got, want) {
+		t.Fatalf("Encode(%q) = %v, want %v", " the", got, want)
+	}
+	for _, s := range []string{"hi there\nok", "  two  spaces "} {
+		if got := tok.Decode(tok.Encode(s, false)); got != s {
+			t.Errorf("round trip %q -> %q", s, got)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		n    Normalization
+		want string
+	}{
+		{"cafe\u0301", NormNFC, "caf\u00e9"},
+		{"cafe\u0301 ﬁne…", NormNFC, "caf\u00e9 ﬁne…"},
+		{"ｌｏｌ\u00a0ﬁne…", NormNFKC, "lol fine..."},
+		{"it’s “fine” \u2013 ok\u200b", NormFold, `it's "fine" - ok`},
+		{"don’t panic", 0, "don’t panic"},
+		{"nai\u0308ve’s", NormNFKC | NormFold, "na\u00efve's"},
+	} {
+		if got := Normalize(c.in, c.n); got != c.want {
+			t.Errorf("Normalize(%q, %d) = %q, want %q", c.in, c.n, got, c.want)
+		}
+	}
+}
+
+func TestStreamDecoder(t *testing.T) {
+	tok := newTestTokenizer()
+	// "’" is E2 80 99: GPT-2 spells those bytes as three separate runes.
+	d := tok.NewStreamDecoder()
+	var got []string
+	for _, b := range []byte("a’b") {
+		if s := d.Write(gpt2DecodePiece(gpt2ByteToUnicode[b])); s != "" {
+			got = append(got, s)
+		}
+	}
+	if want := []string{"a", "’", "b"}; !slices.Equal(got, want) {
+		t.Fatalf("pieces = %q, want %q", got, want)
+	}
+	if d.Write("\xe2\x80") != "" || d.Flush() != "\xe2\x80" {
+		t.Fatal("unfinished character should be held, then flushed raw")
+	}
+	if s := d.Write("\x99x"); s != "\x99x" {
+		t.Fatalf("stray continuation byte should pass through, got %q", s)
+	}
+}
@@ -0,0 +1,293 @@
+package wtf
+
+// tools.go — tool calls. The host registers tools (a name, what it does,
+// the names of its arguments) and puts {{tools}} in the anchor, which lists
+// them in the one convention the oracle is taught:
+//
+//	CALL(weather, "lisbon")
+//
+// With GenOptions.ToolCalls set, once a reply writes CALL( the rest of the
+// call is held to that grammar — a registered name, then exactly its
+// arguments as double-quoted strings (\" and \\ escape) — by masking every
+// token that would break it. The reply ends at the closing parenthesis
+// with FinishToolCall and the parsed call in Result.ToolCall; the host runs
+// the tool and hands its output to ContinueTool, which puts it on a
+// RESULT: line after the call and lets the oracle carry on. Chats and
+// sessions stop at calls the same way; the host sends the output back as
+// the next message.
+//
+// Tool-call replies are never served from or stored in the response cache.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Tool describes a function the oracle may call.
+type Tool struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Params      []string `json:"params,omitempty"` // argument names, in call order
+}
+
+// ToolCall is a call parsed out of a reply.
+type ToolCall struct {
+	Name string   `json:"name"`
+	Args []string `json:"args"`
+	Text string   `json:"text"` // as written, CALL( to )
+}
+
+// callOpen starts a tool call.
+const callOpen = "CALL("
+
+// ToolResultPrefix introduces a tool's output in the prompt ContinueTool
+// builds.
+const ToolResultPrefix = "RESULT: "
+
+// ErrNoToolCall is returned by ContinueTool for a reply that did not end
+// in a tool call.
+var ErrNoToolCall = errors.New("reply did not end in a tool call")
+
+// RegisterTool adds (or replaces) a tool.
+func (e *Engine) RegisterTool(t Tool) error {
+	if !varName.MatchString(t.Name) {
+		return fmt.Errorf("tool %q: names are letters, digits and _", t.Name)
+	}
+	e.varMu.Lock()
+	defer e.varMu.Unlock()
+	e.tools = slices.DeleteFunc(slices.Clone(e.tools), func(o Tool) bool { return o.Name == t.Name })
+	e.tools = append(e.tools, t)
+	return nil
+}
+
+// Tools returns the registered tools.
+func (e *Engine) Tools() []Tool {
+	e.varMu.Lock()
+	defer e.varMu.Unlock()
+	return slices.Clone(e.tools)
+}
+
+// armTools hands the registered tools to a call that asked for them.
+func (e *Engine) armTools(opts *GenOptions) {
+	if opts.ToolCalls {
+		opts.tools = e.Tools()
+	}
+}
+
+// toolList is the {{tools}} text: one line per tool, written the way it is
+// called. Caller holds varMu.
+func (e *Engine) toolList() string {
+	var b strings.Builder
+	for i, t := range e.tools {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(callOpen + t.Name)
+		for _, p := range t.Params {
+			fmt.Fprintf(&b, ", %q", p)
+		}
+		b.WriteByte(')')
+		if t.Description != "" {
+			b.WriteString(" — " + t.Description)
+		}
+	}
+	return b.String()
+}
+
+// ContinueTool resumes a reply that stopped at a tool call: prompt and the
+// reply so far are followed by a RESULT: line with the tool's output, and
+// the oracle carries on after it. The result holds the continuation only;
+// it may end in another call.
+func (e *Engine) ContinueTool(persona, prompt string, prev Result, output string, opts GenOptions) (Result, error) {
+	if prev.ToolCall == nil {
+		return Result{}, ErrNoToolCall
+	}
+	return e.Generate(persona, prompt+prev.Text+"\n"+ToolResultPrefix+output+"\n", opts)
+}
+
+// callContext returns the tail of out a tool call depends on: from CALL(
+// on while one is open (open is set), or a partial CALL( at the very end.
+// It is "" otherwise, when only a piece holding a CALL( of its own can
+// break the grammar.
+func callContext(out []byte) (ctx string, open bool) {
+	if i := bytes.Index(out, []byte(callOpen)); i >= 0 {
+		return string(out[i:]), true
+	}
+	for k := len(callOpen) - 1; k > 0; k-- {
+		if bytes.HasSuffix(out, []byte(callOpen[:k])) {
+			return string(out[len(out)-k:]), false
+		}
+	}
+	return "", false
+}
+
+// callBlocks reports whether piece after ctx breaks the call grammar.
+func callBlocks(tools []Tool, ctx, piece string) bool {
+	s := ctx + piece
+	i := strings.Index(s, callOpen)
+	if i < 0 {
+		return false
+	}
+	_, ok := parseCall(s[i+len(callOpen):], tools)
+	return !ok
+}
+
+// toolBlocks reports whether piece after out breaks the call grammar.
+func toolBlocks(tools []Tool, out []byte, piece string) bool {
+	if len(tools) == 0 {
+		return false
+	}
+	ctx, _ := callContext(out)
+	return callBlocks(tools, ctx, piece)
+}
+
+// toolMask sets the logit of every token toolBlocks would reject to
+// -1e30, EOS included while a call is open. Outside a call only the tokens
+// that continue a partial CALL( or hold one are looked at.
+func (t *Tokenizer) toolMask(logits []float32, tools []Tool, out []byte) {
+	ctx, open := callContext(out)
+	mask := func(id int) {
+		if id != t.EosID && id < len(logits) && callBlocks(tools, ctx, t.Piece(id)) {
+			logits[id] = -1e30
+		}
+	}
+	if open {
+		for id := 0; id < len(logits) && id < t.VocabSize; id++ {
+			mask(id)
+		}
+		if t.EosID >= 0 && t.EosID < len(logits) {
+			logits[t.EosID] = -1e30
+		}
+		return
+	}
+	ix := t.callIndex()
+	if ctx != "" {
+		for _, id := range ix.byFirst[callOpen[len(ctx)]] {
+			mask(id)
+		}
+	}
+	for _, id := range ix.withCall {
+		mask(id)
+	}
+}
+
+// callIndex is the tokens by the first byte of their piece, and those
+// whose piece holds a CALL(: between them, every token that can open a
+// call.
+type callIndex struct {
+	byFirst  [256][]int
+	withCall []int
+}
+
+// callIndex builds t's index on first use.
+func (t *Tokenizer) callIndex() *callIndex {
+	t.callOnce.Do(func() {
+		ix := new(callIndex)
+		for id := 0; id < t.VocabSize; id++ {
+			p := t.Piece(id)
+			if p == "" {
+				continue
+			}
+			ix.byFirst[p[0]] = append(ix.byFirst[p[0]], id)
+			if strings.Contains(p, callOpen) {
+				ix.withCall = append(ix.withCall, id)
+			}
+		}
+		t.calls = ix
+	})
+	return t.calls
+}
+
+// finishedCall returns the call out ends with, if it is complete.
+func finishedCall(tools []Tool, out []byte) *ToolCall {
+	i := bytes.Index(out, []byte(callOpen))
+	if len(tools) == 0 || i < 0 {
+		return nil
+	}
+	call, _ := parseCall(string(out[i+len(callOpen):]), tools)
+	if call != nil {
+		call.Text = string(out[i:])
+	}
+	return call
+}
+
+// parseCall parses s, the text after CALL(. ok reports whether s is a call
+// or can still become one; call is set once s is a whole call, ending at
+// its closing parenthesis.
+func parseCall(s string, tools []Tool) (call *ToolCall, ok bool) {
+	i := 0
+	for i < len(s) && nameByte(s[i]) {
+		i++
+	}
+	name := s[:i]
+	if i == len(s) {
+		return nil, slices.ContainsFunc(tools, func(t Tool) bool { return strings.HasPrefix(t.Name, name) })
+	}
+	ti := slices.IndexFunc(tools, func(t Tool) bool { return t.Name == name })
+	if ti < 0 {
+		return nil, false
+	}
+	var args []string
+	for len(args) < len(tools[ti].Params) {
+		if i == len(s) {
+			return nil, true
+		}
+		if s[i] != ',' {
+			return nil, false
+		}
+		for i++; i < len(s) && s[i] == ' '; i++ {
+		}
+		arg, n, done, valid := quoted(s[i:])
+		if !valid || !done {
+			return nil, valid
+		}
+		args = append(args, arg)
+		i += n
+	}
+	switch {
+	case i == len(s):
+		return nil, true
+	case s[i] == ')' && i+1 == len(s):
+		return &ToolCall{Name: name, Args: args}, true
+	}
+	return nil, false
+}
+
+func nameByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// quoted reads a double-quoted argument at the start of s: its value, the
+// bytes it spans, whether it is closed, and whether s can still be one.
+func quoted(s string) (arg string, n int, done, ok bool) {
+	if s == "" {
+		return "", 0, false, true
+	}
+	if s[0] != '"' {
+		return "", 0, false, false
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return b.String(), i + 1, true, true
+		case '\n':
+			return "", 0, false, false
+		case '\\':
+			if i+1 == len(s) {
+				return "", 0, false, true
+			}
+			if s[i+1] != '"' && s[i+1] != '\\' {
+				return "", 0, false, false
+			}
+			i++
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, false, true
+}
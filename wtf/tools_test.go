@@ -0,0 +1,105 @@
+package wtf
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseCall(t *testing.T) {
+	tools := []Tool{{Name: "weather", Params: []string{"city"}}, {Name: "time"}, {Name: "convert", Params: []string{"from", "to"}}}
+	for _, tc := range []struct {
+		s    string
+		ok   bool
+		args []string // non-nil: a whole call
+	}{
+		{"", true, nil},
+		{"wea", true, nil},
+		{"weather", true, nil},
+		{`weather, "lis`, true, nil},
+		{`weather,"lisbon"`, true, nil},
+		{`weather, "lisbon")`, true, []string{"lisbon"}},
+		{`weather, "say \"hi\"")`, true, []string{`say "hi"`}},
+		{"time)", true, []string{}},
+		{`convert, "usd", "eur")`, true, []string{"usd", "eur"}},
+		{"news", false, nil},
+		{"weather)", false, nil},
+		{`weather, lisbon`, false, nil},
+		{`weather, "lisbon") and`, false, nil},
+		{"weather, \"lis\nbon\")", false, nil},
+		{`time, "now")`, false, nil},
+	} {
+		call, ok := parseCall(tc.s, tools)
+		if ok != tc.ok || (call != nil) != (tc.args != nil) || call != nil && !slices.Equal(call.Args, tc.args) {
+			t.Errorf("parseCall(%q) = %+v, %v; want ok %v, args %q", tc.s, call, ok, tc.ok, tc.args)
+		}
+	}
+}
+
+func TestToolCalls(t *testing.T) {
+	e := newTestEngine()
+	if err := e.RegisterTool(Tool{Name: "wx", Description: "the weather"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RegisterTool(Tool{Name: "bad name"}); err == nil {
+		t.Fatal("RegisterTool accepted a name with a space")
+	}
+	if got := e.expand("{{tools}}", nil); got != "CALL(wx) — the weather" {
+		t.Fatalf("{{tools}} = %q", got)
+	}
+
+	// Once the call is open only the grammar's tokens are left: w, x, ).
+	opts := greedyOpts(16)
+	opts.ForcePrefix = callOpen
+	opts.ToolCalls = true
+	res, err := e.Generate("", "the sky", opts)
+	if err != nil || res.Finish != FinishToolCall || res.ToolCall == nil || res.ToolCall.Name != "wx" || res.Text != "CALL(wx)" {
+		t.Fatalf("call: %+v, %v", res, err)
+	}
+
+	// Without ToolCalls nothing is held to the grammar or parsed.
+	opts.ToolCalls = false
+	if plain, err := e.Generate("", "the sky", opts); err != nil || plain.ToolCall != nil || plain.Finish == FinishToolCall {
+		t.Fatalf("tools off: %+v, %v", plain, err)
+	}
+
+	opts.ToolCalls, opts.ForcePrefix = true, ""
+	more, err := e.ContinueTool("", "the sky", res, "sunny", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.ContinueTool("", "the sky", more, "sunny", opts); more.ToolCall == nil && !errors.Is(err, ErrNoToolCall) {
+		t.Fatalf("continue without a call: %v", err)
+	}
+}
+
+func TestToolMask(t *testing.T) {
+	meta := &GGUFMetadata{TokenModel: "gpt2", TokenList: []string{"<|endoftext|>"}, TokenTypes: []int32{3}}
+	for b := 0; b < 256; b++ {
+		meta.TokenList = append(meta.TokenList, gpt2ByteToUnicode[b])
+	}
+	meta.TokenList = append(meta.TokenList, "CALL(", "AL(", "LL(w", "oh CALL(", "oh CALL(zz", "CALL(wx)")
+	for len(meta.TokenTypes) < len(meta.TokenList) {
+		meta.TokenTypes = append(meta.TokenTypes, 1)
+	}
+	meta.VocabSize = len(meta.TokenList)
+	tok := NewTokenizer(meta)
+	tools := []Tool{{Name: "wx"}}
+
+	// The mask is toolBlocks over the whole vocab, however few tokens it
+	// looks at.
+	for _, out := range []string{"", "so", "C", "CA", "so CAL", "CALL(", "CALL(w", "CALL(wx"} {
+		logits := make([]float32, tok.VocabSize)
+		tok.toolMask(logits, tools, []byte(out))
+		for id := range logits {
+			want := id != tok.EosID && toolBlocks(tools, []byte(out), tok.Piece(id))
+			if id == tok.EosID {
+				want = strings.Contains(out, callOpen)
+			}
+			if got := logits[id] < -1e29; got != want {
+				t.Errorf("after %q, %q masked %v, want %v", out, tok.Piece(id), got, want)
+			}
+		}
+	}
+}
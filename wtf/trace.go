@@ -0,0 +1,95 @@
+package wtf
+
+// trace.go — per-token trace for "why did it say that". With
+// GenOptions.Trace set, every step reports the top candidates after
+// penalties and masks, what the penalties did, which sampler ran, what the
+// veto rejected and how long the forward pass and the sampling took.
+// TraceJSON turns the events into JSON lines on any writer.
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// TraceEvent is one decode step.
+type TraceEvent struct {
+	Step      int              `json:"step"`
+	Pos       int              `json:"pos"`                 // cache row the chosen token goes to
+	Top       []TraceCandidate `json:"top"`                 // best first, after penalties and masks
+	Penalties map[int]float32  `json:"penalties,omitempty"` // token → logit change from the penalties
+	EOSBias   float32          `json:"eos_bias,omitempty"`  // added to EOS this step (EOSBias + length target)
+	Sampler   string           `json:"sampler"`             // "greedy", "top-p" or "top-k"
+	Vetoed    []int            `json:"vetoed,omitempty"`
+	Chosen    int              `json:"chosen"`
+	Piece     string           `json:"piece"`
+	Forward   time.Duration    `json:"forward_ns"` // the pass that produced these logits
+	Sample    time.Duration    `json:"sample_ns"`  // penalties through the final pick
+}
+
+// TraceCandidate is a token and its probability at the call's temperature
+// (1 when greedy).
+type TraceCandidate struct {
+	ID    int     `json:"id"`
+	Piece string  `json:"piece"`
+	Prob  float32 `json:"prob"`
+}
+
+// traceTop is how many candidates an event lists.
+const traceTop = 5
+
+// TraceJSON returns a GenOptions.Trace func that writes each event to w as
+// one JSON line. Write errors are dropped: tracing never fails a call.
+func TraceJSON(w io.Writer) func(TraceEvent) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(ev TraceEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = enc.Encode(ev)
+	}
+}
+
+// topCandidates lists the n likeliest tokens in logits with their
+// probabilities at temp.
+func topCandidates(tok *Tokenizer, logits []float32, vocab int, temp float32, n int) []TraceCandidate {
+	if temp <= 0 {
+		temp = 1
+	}
+	ids := make([]int, 0, n+1)
+	for i := 0; i < vocab; i++ {
+		if len(ids) == n && logits[i] <= logits[ids[n-1]] {
+			continue
+		}
+		j := len(ids)
+		ids = append(ids, i)
+		for ; j > 0 && logits[ids[j-1]] < logits[i]; j-- {
+			ids[j] = ids[j-1]
+		}
+		ids[j] = i
+		ids = ids[:min(len(ids), n)]
+	}
+	maxv := logits[ids[0]]
+	var z float64
+	for i := 0; i < vocab; i++ {
+		z += math.Exp(float64((logits[i] - maxv) / temp))
+	}
+	out := make([]TraceCandidate, len(ids))
+	for k, id := range ids {
+		out[k] = TraceCandidate{ID: id, Piece: tok.DecodeToken(id),
+			Prob: float32(math.Exp(float64((logits[id]-maxv)/temp)) / z)}
+	}
+	return out
+}
+
+func samplerName(opts *GenOptions) string {
+	switch {
+	case opts.Temp <= 0:
+		return "greedy"
+	case opts.TopP < 1:
+		return "top-p"
+	}
+	return "top-k"
+}
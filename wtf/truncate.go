@@ -0,0 +1,128 @@
+package wtf
+
+// truncate.go — fit a conversation into the context before prefill. The
+// anchor (system message) and the message being answered are never touched;
+// room is made by dropping whole history turns (a user message plus the
+// replies that follow it) so a question is never left without its answer.
+//
+// Without this, decode just stops prefilling at SeqLen-1 — which cuts off the
+// end of the prompt, i.e. the user's actual question.
+
+import (
+	"fmt"
+	"slices"
+)
+
+// TruncStrategy picks which history turns go first.
+type TruncStrategy int
+
+const (
+	TruncDropOldest TruncStrategy = iota // oldest turns first
+	TruncDropMiddle                      // keep the first and latest turns, drop from the middle
+	TruncMarker                          // drop oldest, then note the gap in the system message
+)
+
+// truncMarkerFmt is the note TruncMarker adds for the dropped messages.
+const truncMarkerFmt = "[%d earlier messages omitted]"
+
+// FitChat returns msgs trimmed so that BuildChat(msgs, f) leaves at least
+// reply tokens of room in a seqLen context. msgs itself is not modified.
+// If the anchor plus the last user message alone do not fit, it returns an
+// error: there is nothing left to drop that would not change the question.
+func (t *Tokenizer) FitChat(msgs []Message, f ChatFormat, seqLen, reply int, s TruncStrategy) ([]Message, error) {
+	if err := validateChat(msgs); err != nil {
+		return nil, err
+	}
+	budget := seqLen - 1 - reply
+	var system []Message
+	rest := msgs
+	if msgs[0].Role == RoleSystem {
+		system, rest = msgs[:1], msgs[1:]
+	}
+	last := rest[len(rest)-1]
+	turns := splitTurns(rest[:len(rest)-1])
+
+	dropped := 0
+	for {
+		out := assembleChat(system, turns, last, s, dropped)
+		ids, err := t.BuildChat(out, f)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) <= budget {
+			return out, nil
+		}
+		if len(turns) == 0 {
+			return nil, fmt.Errorf("%w: %d tokens with no history left to drop, budget is %d",
+				ErrContextOverflow, len(ids), budget)
+		}
+		i := 0
+		if s == TruncDropMiddle {
+			i = len(turns) / 2
+		}
+		dropped += len(turns[i])
+		turns = append(turns[:i:i], turns[i+1:]...)
+	}
+}
+
+// splitTurns groups history into turns, each starting at a user message.
+// Leading assistant messages (no question before them) form their own turn.
+func splitTurns(hist []Message) [][]Message {
+	var turns [][]Message
+	for i, m := range hist {
+		if m.Role == RoleUser || i == 0 {
+			turns = append(turns, nil)
+		}
+		turns[len(turns)-1] = append(turns[len(turns)-1], m)
+	}
+	return turns
+}
+
+func assembleChat(system []Message, turns [][]Message, last Message, s TruncStrategy, dropped int) []Message {
+	out := append([]Message(nil), system...)
+	if s == TruncMarker && dropped > 0 {
+		note := fmt.Sprintf(truncMarkerFmt, dropped)
+		if len(out) > 0 {
+			out[0].Content += "\n" + note
+		} else {
+			out = append(out, Message{RoleSystem, note})
+		}
+	}
+	for _, turn := range turns {
+		out = append(out, turn...)
+	}
+	return append(out, last)
+}
+
+// FitChat trims msgs for this engine's context, reserving room for
+// opts.MaxTokens plus the grace period.
+func (e *Engine) FitChat(msgs []Message, f ChatFormat, opts GenOptions, s TruncStrategy) ([]Message, error) {
+	return e.Tok.FitChat(msgs, f, e.Model.Config.SeqLen, opts.MaxTokens+opts.Grace.Limit, s)
+}
+
+// Fit drops turns from s.Messages until Send(text) leaves room for the
+// reply. Unlike Engine.FitChat it counts the prompt Send builds: the
+// system message with its variables resolved, the facts and the summary.
+func (s *Session) Fit(text string, strategy TruncStrategy) error {
+	opts := s.Opts
+	text, err := s.e.admit(text, &opts)
+	if err != nil {
+		return err
+	}
+	msgs := append(slices.Clip(s.Messages), Message{RoleUser, text})
+	full, err := s.chatPrompt(msgs, &opts)
+	if err != nil {
+		return err
+	}
+	bare, err := s.e.Tok.BuildChat(msgs, s.Format)
+	if err != nil {
+		return err
+	}
+	reply := opts.MaxTokens + opts.Grace.Limit + len(full) - len(bare)
+	fit, err := s.e.Tok.FitChat(msgs, s.Format, s.e.Model.Config.SeqLen, reply, strategy)
+	if err != nil {
+		return err
+	}
+	s.Messages = fit[:len(fit)-1]
+	return nil
+}
@@ -0,0 +1,93 @@
+package wtf
+
+// version.go — what build of the engine is running, for bug reports. The
+// commit comes from the VCS stamp Go embeds at build time (go build inside a
+// git checkout); builds without one report "unknown".
+
+import (
+	"encoding/json"
+	"runtime"
+	"runtime/debug"
+
+	"golang.org/x/sys/cpu"
+)
+
+// Version is the engine's semantic version.
+const Version = "3.1.0"
+
+// BuildInfo describes the running build.
+type BuildInfo struct {
+	Version      string   `json:"version"`
+	Commit       string   `json:"commit"` // "+dirty" when built from a modified tree
+	BuildTime    string   `json:"build_time,omitempty"`
+	Go           string   `json:"go"`
+	OS           string   `json:"os"`
+	Arch         string   `json:"arch"`
+	BLAS         string   `json:"blas"`         // sgemv backend notorch links
+	CPUFeatures  []string `json:"cpu_features"` // SIMD the host offers the BLAS
+	Kernels      string   `json:"kernels"`      // matvec kernel variant in use, see kernels.go
+	GPU          bool     `json:"gpu"`          // no GPU backend yet
+	GGUFVersions []int    `json:"gguf_versions"`
+}
+
+// Build reports the running build.
+func Build() BuildInfo {
+	b := BuildInfo{
+		Version: Version, Commit: "unknown", Go: runtime.Version(),
+		OS: runtime.GOOS, Arch: runtime.GOARCH, BLAS: "openblas",
+		CPUFeatures:  cpuFeatures(),
+		Kernels:      Kernels(),
+		GGUFVersions: []int{2, ggufVersion},
+	}
+	if runtime.GOOS == "darwin" {
+		b.BLAS = "accelerate"
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		dirty := false
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				b.Commit = s.Value
+			case "vcs.time":
+				b.BuildTime = s.Value
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if dirty {
+			b.Commit += "+dirty"
+		}
+	}
+	return b
+}
+
+// VersionJSON is Build as a JSON object.
+func VersionJSON() string {
+	blob, _ := json.Marshal(Build())
+	return string(blob)
+}
+
+func cpuFeatures() []string {
+	f := []string{}
+	for _, c := range []struct {
+		name string
+		on   bool
+	}{
+		{"sse4.2", cpu.X86.HasSSE42},
+		{"avx", cpu.X86.HasAVX},
+		{"avx2", cpu.X86.HasAVX2},
+		{"fma", cpu.X86.HasFMA},
+		{"avx512f", cpu.X86.HasAVX512F},
+		{"avx512bw", cpu.X86.HasAVX512BW},
+		{"avx512vnni", cpu.X86.HasAVX512VNNI},
+		{"amx-int8", cpu.X86.HasAMXInt8}, // reported; no kernel uses it yet
+		{"neon", cpu.ARM64.HasASIMD},
+		{"dotprod", cpu.ARM64.HasASIMDDP},
+		{"sve", cpu.ARM64.HasSVE},
+	} {
+		if c.on {
+			f = append(f, c.name)
+		}
+	}
+	return f
+}
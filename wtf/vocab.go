@@ -0,0 +1,52 @@
+package wtf
+
+// vocab.go — vocabulary export. Tooling outside the process (logit-bias
+// tables, ban lists) needs id → piece without parsing GGUF; this writes the
+// tokenizer's view of it as JSON.
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+)
+
+// VocabEntry is one token in the export.
+type VocabEntry struct {
+	ID    int     `json:"id"`
+	Piece string  `json:"piece"` // raw vocab string (Ġ / ▁ / <0xNN> as stored)
+	Text  string  `json:"text"`  // decoded text the token contributes
+	Score float32 `json:"score"` // SentencePiece score; 0 for GPT-2 BPE
+	Type  int32   `json:"type"`  // 1 normal, 2 unknown, 3 control, 6 byte
+}
+
+// Entry returns the export record for token id.
+func (t *Tokenizer) Entry(id int) VocabEntry {
+	e := VocabEntry{ID: id, Piece: t.Vocab[id], Text: t.Piece(id), Type: 1}
+	if id < len(t.Scores) {
+		e.Score = t.Scores[id]
+	}
+	if id < len(t.Types) {
+		e.Type = t.Types[id]
+	}
+	return e
+}
+
+// WriteVocabJSON writes the whole vocabulary as a JSON array, one entry per
+// line, in id order.
+func (t *Tokenizer) WriteVocabJSON(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("[\n")
+	for id := range t.Vocab {
+		b, err := json.Marshal(t.Entry(id))
+		if err != nil {
+			return err
+		}
+		bw.Write(b)
+		if id < len(t.Vocab)-1 {
+			bw.WriteByte(',')
+		}
+		bw.WriteByte('\n')
+	}
+	bw.WriteString("]\n")
+	return bw.Flush()
+}
@@ -0,0 +1,66 @@
+package wtf
+
+// warmup.go — pay the cold-start costs before the first request does. A
+// fresh engine builds a lot on first use: the kernel choice, the sampling
+// buffers and run-ahead scratch, the tokenizer's piece table, each persona's
+// anchor KV prefix, and (with a response cache) the model fingerprint that
+// hashes every weight; the weights themselves are only faulted in by the
+// first pass that reads them. Warmup runs throwaway generations under the
+// options real requests will use, so all of that happens at startup.
+//
+// The passes bypass the response cache, the retriever and OnToken, and
+// leave nothing behind but the warm state: the next call prefills as usual.
+
+import (
+	"maps"
+	"slices"
+	"time"
+)
+
+// warmupPrompt is what the throwaway passes decode after.
+const warmupPrompt = "why does my code work?"
+
+// warmupTokens caps each pass: a handful of steps exercises sampling.
+const warmupTokens = 8
+
+// WarmupReport says what Warmup did.
+type WarmupReport struct {
+	Passes   int           // raw generations run
+	Personas int           // anchors prefilled
+	Took     time.Duration // wall time
+}
+
+// Warmup runs passes raw generations (1 if passes <= 0) and one under each
+// registered persona, each at most warmupTokens long, with opts' sampling
+// and filters. It holds the engine for the duration.
+func (e *Engine) Warmup(opts GenOptions, passes int) (rep WarmupReport, err error) {
+	defer e.contain(&err, CrashRequest{Op: "warmup", PromptBytes: len(warmupPrompt)})
+	start := time.Now()
+	opts.MaxTokens = min(max(opts.MaxTokens, 1), warmupTokens)
+	opts.OnToken, opts.Record = nil, false
+	if err = e.lock(); err != nil {
+		return rep, err
+	}
+	defer e.unlock()
+	e.claim(nil)
+	e.Tok.Piece(0)
+	if e.Cache != nil {
+		e.Model.Fingerprint()
+	}
+	for range max(passes, 1) {
+		Generate(e.Model, e.Tok, warmupPrompt, opts)
+		rep.Passes++
+	}
+	prompt := e.Tok.Encode(warmupPrompt, false)
+	for _, name := range slices.Sorted(maps.Keys(e.personas)) {
+		p := e.personas[name]
+		if err := e.resolve(p, opts.Vars); err != nil {
+			return rep, err
+		}
+		p.loadPrefix(e.Model)
+		decode(e.Model, e.Tok, append(slices.Clone(p.tokens), prompt...), len(p.tokens), p.Overrides.apply(opts))
+		rep.Personas++
+	}
+	rep.Took = time.Since(start)
+	return rep, nil
+}
@@ -0,0 +1,29 @@
+package wtf
+
+import "testing"
+
+func TestWarmup(t *testing.T) {
+	e := newTestEngine()
+	want, err := e.Generate("", "the sky", greedyOpts(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = newTestEngine()
+	e.RegisterPersona("oracle", "you are the oracle", SamplerOverrides{})
+	e.Cache, _ = OpenCache(CacheConfig{Policy: CacheAll})
+	rep, err := e.Warmup(DefaultGenOptions(), 2)
+	if err != nil || rep.Passes != 2 || rep.Personas != 1 {
+		t.Fatalf("Warmup = %+v, %v", rep, err)
+	}
+	if e.personas["oracle"].prefix == nil {
+		t.Fatal("persona anchor not prefilled")
+	}
+	if hits, misses := e.Cache.Stats(); hits+misses != 0 {
+		t.Fatalf("warmup went through the cache: %d hits, %d misses", hits, misses)
+	}
+	// A warmed engine decodes what a cold one does.
+	got, err := e.Generate("", "the sky", greedyOpts(8))
+	if err != nil || got.Text != want.Text {
+		t.Fatalf("after warmup: %q, %v; want %q", got.Text, err, want.Text)
+	}
+}
@@ -0,0 +1,37 @@
+package wtf
+
+// watchdog.go — regenerate degenerate replies inside the engine instead of in
+// every host. A reply is degenerate when it is shorter than MinTokens and
+// either ended in a loop or came out blank. Each retry tightens sampling
+// (MinP goes up by MinPStep) and draws from a fresh RNG seed.
+
+import "strings"
+
+// WatchdogPolicy configures automatic regeneration. The zero value is off.
+type WatchdogPolicy struct {
+	Retries   int     // regenerations allowed per call
+	MinTokens int     // replies this long are never retried
+	MinPStep  float32 // added to MinP on every retry (0 = 0.05)
+}
+
+// degenerate reports whether res should be regenerated. Greedy decoding
+// would only reproduce the same reply, so it is never retried.
+func (w *WatchdogPolicy) degenerate(res Result, opts GenOptions) bool {
+	if opts.Temp <= 0 || len(res.Tokens) >= w.MinTokens {
+		return false
+	}
+	return res.Finish == FinishCycle || strings.TrimSpace(res.Text) == ""
+}
+
+// adjust returns the options for the next attempt.
+func (w *WatchdogPolicy) adjust(opts GenOptions) GenOptions {
+	step := w.MinPStep
+	if step <= 0 {
+		step = 0.05
+	}
+	opts.MinP = min(opts.MinP+step, 0.9)
+	if opts.Seed != 0 {
+		opts.Seed++ // a fixed seed would replay the same sample path
+	}
+	return opts
+}
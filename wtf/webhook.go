@@ -0,0 +1,217 @@
+package wtf
+
+// webhook.go — POST every finished generation to one or more URLs, for
+// analytics and moderation services that would rather be told than poll.
+// Hook it up as Server.OnResult. Delivery runs on its own goroutine so a
+// slow receiver never holds up the engine; failed posts (network errors,
+// 429 and 5xx) are retried with doubling backoff, other 4xx are dropped.
+//
+// With a secret, each body is signed: X-WTF-Signature is "sha256=" and the
+// hex HMAC-SHA256 of the raw body. X-WTF-Delivery stays the same across the
+// retries of one post, so receivers can drop duplicates.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// WebhookConfig says where finished generations are posted.
+type WebhookConfig struct {
+	URLs    []string      `json:"urls"`
+	Secret  string        `json:"secret"`  // HMAC key for X-WTF-Signature; "" = unsigned
+	Retries int           `json:"retries"` // after the first attempt
+	Timeout time.Duration `json:"timeout"` // per attempt, "10s" in JSON
+}
+
+// UnmarshalJSON reads Timeout as a duration string.
+func (c *WebhookConfig) UnmarshalJSON(b []byte) error {
+	type plain WebhookConfig
+	v := struct {
+		*plain
+		Timeout jsonDuration `json:"timeout"`
+	}{(*plain)(c), jsonDuration(c.Timeout)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	c.Timeout = time.Duration(v.Timeout)
+	return nil
+}
+
+// jsonDuration is a time.Duration written as a string in config files,
+// e.g. "10s" or "1m30s". Bare numbers are still read as nanoseconds.
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var ns int64
+		if json.Unmarshal(b, &ns) != nil {
+			return fmt.Errorf("duration: want a string like \"10s\", got %s", b)
+		}
+		*d = jsonDuration(ns)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(v)
+	return nil
+}
+
+// webhookQueue bounds the events waiting for delivery; past it new events
+// are dropped (and logged) rather than buffered without limit.
+const webhookQueue = 256
+
+// WebhookEvent is the JSON body of one post.
+type WebhookEvent struct {
+	Event        string       `json:"event"` // "generation.completed"
+	Time         time.Time    `json:"time"`
+	ID           string       `json:"id,omitempty"` // the Call's id
+	Persona      string       `json:"persona,omitempty"`
+	Prompt       string       `json:"prompt,omitempty"`
+	Question     string       `json:"question,omitempty"`
+	Output       string       `json:"output"`
+	Tokens       int          `json:"tokens"`
+	PromptTokens int          `json:"prompt_tokens"`
+	Finish       FinishReason `json:"finish"`
+	TTFTMillis   int64        `json:"ttft_ms"`
+	Redacted     int          `json:"redacted,omitempty"`
+	Injected     bool         `json:"injected,omitempty"`
+	Version      string       `json:"version"`
+}
+
+// Webhook delivers events to the configured URLs.
+type Webhook struct {
+	cfg     WebhookConfig
+	client  *http.Client
+	backoff time.Duration // first retry delay
+
+	queue chan []byte
+	done  sync.WaitGroup
+	once  sync.Once
+}
+
+// NewWebhook starts the delivery goroutine. Close stops it.
+func NewWebhook(cfg WebhookConfig) *Webhook {
+	w := &Webhook{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		backoff: time.Second,
+		queue:   make(chan []byte, webhookQueue),
+	}
+	w.done.Add(1)
+	go w.run()
+	return w
+}
+
+// OnResult queues the event for a finished generation; it has the
+// Server.OnResult signature.
+func (w *Webhook) OnResult(c Call, r Result) {
+	body, err := json.Marshal(WebhookEvent{
+		Event:        "generation.completed",
+		Time:         time.Now().UTC(),
+		ID:           c.ID,
+		Persona:      c.Persona,
+		Prompt:       c.Prompt,
+		Question:     c.Question,
+		Output:       r.Text,
+		Tokens:       len(r.Tokens),
+		PromptTokens: r.PromptTokens,
+		Finish:       r.Finish,
+		TTFTMillis:   r.TTFT.Milliseconds(),
+		Redacted:     r.Redacted,
+		Injected:     r.Injected,
+		Version:      Version,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[wtf] webhook: %v\n", err)
+		return
+	}
+	select {
+	case w.queue <- body:
+	default:
+		fmt.Fprintf(os.Stderr, "[wtf] webhook: queue full, dropping event\n")
+	}
+}
+
+// Close delivers what is queued (retries included) and stops.
+func (w *Webhook) Close() {
+	w.once.Do(func() { close(w.queue) })
+	w.done.Wait()
+}
+
+func (w *Webhook) run() {
+	defer w.done.Done()
+	for body := range w.queue {
+		for _, url := range w.cfg.URLs {
+			if err := w.deliver(url, body); err != nil {
+				fmt.Fprintf(os.Stderr, "[wtf] webhook %s: %v\n", url, err)
+			}
+		}
+	}
+}
+
+// deliver posts body to url, retrying up to cfg.Retries times.
+func (w *Webhook) deliver(url string, body []byte) error {
+	var id [8]byte
+	rand.Read(id[:])
+	delivery := hex.EncodeToString(id[:])
+	var sig string
+	if w.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.cfg.Secret))
+		mac.Write(body)
+		sig = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	wait := w.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(url, body, delivery, sig)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= w.cfg.Retries {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// post makes one attempt; retry says whether a failure is worth repeating.
+func (w *Webhook) post(url string, body []byte, delivery, sig string) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "wtforacle/"+Version)
+	req.Header.Set("X-WTF-Event", "generation.completed")
+	req.Header.Set("X-WTF-Delivery", delivery)
+	if sig != "" {
+		req.Header.Set("X-WTF-Signature", sig)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) // lets the connection be reused
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("%s", resp.Status)
+	}
+	return false, fmt.Errorf("%s", resp.Status)
+}
@@ -0,0 +1,79 @@
+package wtf
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		attempts   int
+		deliveries []string
+		got        WebhookEvent
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		if r.Header.Get("X-WTF-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("bad signature %q", r.Header.Get("X-WTF-Signature"))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		deliveries = append(deliveries, r.Header.Get("X-WTF-Delivery"))
+		if attempts == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		json.Unmarshal(body, &got)
+	}))
+	defer hook.Close()
+
+	e := newTestEngine()
+	wh := NewWebhook(WebhookConfig{URLs: []string{hook.URL}, Secret: "s3cret", Retries: 2, Timeout: time.Second})
+	wh.backoff = time.Millisecond
+	srv := &Server{Engine: e, Defaults: greedyOpts(4), OnResult: wh.OnResult}
+	srv.Defaults.ScrubPII = PIIEmail
+	reply := srv.Handle(Call{ID: "q1", Op: "generate", Prompt: "mail bob@example.com"}, nil)
+	if reply.Error != "" {
+		t.Fatal(reply.Error)
+	}
+	wh.Close()
+
+	if attempts != 2 || deliveries[0] != deliveries[1] {
+		t.Fatalf("attempts %d, delivery ids %q: want one retry under the same id", attempts, deliveries)
+	}
+	if got.Event != "generation.completed" || got.ID != "q1" || got.Output != reply.Text || got.Tokens != len(reply.Tokens) {
+		t.Fatalf("event %+v does not match reply %+v", got, reply)
+	}
+	if got.Prompt != ScrubPII("mail bob@example.com", PIIEmail) {
+		t.Fatalf("event prompt %q: want it scrubbed like the engine's input", got.Prompt)
+	}
+
+	// A 4xx other than 429 is not retried.
+	attempts = 1
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		http.Error(w, "nope", http.StatusBadRequest)
+	}))
+	defer bad.Close()
+	wh = NewWebhook(WebhookConfig{URLs: []string{bad.URL}, Retries: 3, Timeout: time.Second})
+	wh.backoff = time.Millisecond
+	wh.OnResult(Call{Op: "generate"}, Result{Text: "x"})
+	wh.Close()
+	if attempts != 2 {
+		t.Fatalf("%d attempts on 400, want 1", attempts-1)
+	}
+}